@@ -1,19 +1,36 @@
 package main
 
 import (
+	"1chanserver/internal/api/api_channel"
 	"1chanserver/internal/api/api_comment"
 	"1chanserver/internal/api/api_dev"
+	"1chanserver/internal/api/api_event"
 	"1chanserver/internal/api/api_files"
+	"1chanserver/internal/api/api_message"
+	"1chanserver/internal/api/api_moderation"
 	"1chanserver/internal/api/api_notification"
+	"1chanserver/internal/api/api_oidc"
+	"1chanserver/internal/api/api_passkey"
+	"1chanserver/internal/api/api_poll"
+	"1chanserver/internal/api/api_search"
+	"1chanserver/internal/api/api_session"
 	"1chanserver/internal/api/api_thread"
 	"1chanserver/internal/api/api_token"
+	"1chanserver/internal/api/api_totp"
 	"1chanserver/internal/api/api_user"
 	"1chanserver/internal/database"
 	_ "1chanserver/internal/database"
+	"1chanserver/internal/events"
+	"1chanserver/internal/mailer"
 	"1chanserver/internal/middleware"
+	"1chanserver/internal/models"
 	"1chanserver/internal/models/api_error"
+	"1chanserver/internal/oidc"
 	"1chanserver/internal/routes"
 	"1chanserver/internal/utils/utils_auth"
+	"1chanserver/internal/utils/utils_db"
+	"1chanserver/internal/utils/utils_jwks"
+	"1chanserver/internal/webauthn"
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
@@ -35,6 +52,10 @@ func main() {
 	routes.BaseAPI = os.Getenv("BASE_API")
 	routes.BaseURL = os.Getenv("BASE_URL")
 	routes.APIRoot = routes.BaseURL + routes.BaseAPI
+	routes.ClientURL = os.Getenv("CLIENT_URL")
+	if routes.ClientURL == "" {
+		routes.ClientURL = routes.BaseURL
+	}
 
 	secureCookieEnabled := os.Getenv("SECURE_COOKIE")
 	if secureCookieEnabled == "true" {
@@ -47,6 +68,54 @@ func main() {
 
 	utils_auth.JWT_SECRET_KEY = []byte(os.Getenv("JWT_SECRET_KEY"))
 
+	// Tokens are signed with the asymmetric keys in JWT_KEYS_DIR when it is
+	// set. Tokens signed with JWT_SECRET_KEY before then are still accepted,
+	// if it is set as well, until JWT_LEGACY_SECRET_UNTIL. It has no default,
+	// as one relative to startup would be pushed back by every restart.
+	if keysDir := os.Getenv("JWT_KEYS_DIR"); keysDir != "" {
+		var legacyUntil time.Time
+		if len(utils_auth.JWT_SECRET_KEY) != 0 {
+			until := os.Getenv("JWT_LEGACY_SECRET_UNTIL")
+			if until == "" {
+				log.Fatal("JWT_LEGACY_SECRET_UNTIL must be set when both JWT_KEYS_DIR and JWT_SECRET_KEY are, " +
+					"or JWT_SECRET_KEY unset to stop accepting tokens signed with it")
+			}
+
+			legacyUntil, err = time.Parse(time.RFC3339, until)
+			if err != nil {
+				log.Fatalf("invalid JWT_LEGACY_SECRET_UNTIL: %s", err.Error())
+			}
+		}
+
+		utils_auth.SigningKeys, err = utils_jwks.LoadKeySet(
+			keysDir, os.Getenv("JWT_ACTIVE_KEY_ID"), utils_auth.JWT_SECRET_KEY, legacyUntil)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		utils_auth.SigningKeys = utils_jwks.NewHMACKeySet(utils_auth.JWT_SECRET_KEY)
+	}
+
+	mailer.Default, err = mailer.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = oidc.RegisterFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	api_oidc.RedirectURL = os.Getenv("OIDC_REDIRECT_URL")
+	if api_oidc.RedirectURL == "" {
+		api_oidc.RedirectURL = routes.ClientURL + "/oauth/callback"
+	}
+
+	api_passkey.RelyingParty, err = webauthn.FromEnv(routes.ClientURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Initialise database
 	database.InitDB()
 
@@ -87,13 +156,60 @@ func main() {
 				usersAuth.GET("/comments", api_user.Comments())
 				usersAuth.POST("/update_password", api_user.UpdatePassword())
 				usersAuth.POST("/profile/picture", api_files.UploadProfilePicture())
+				usersAuth.DELETE("/account", api_user.Delete)
+				usersAuth.GET("/export", api_user.Export)
+				usersAuth.POST("/email/verify/resend", api_user.ResendVerification)
+				usersAuth.GET("/2fa", api_totp.Status)
+				usersAuth.POST("/2fa/enrol", api_totp.Enrol)
+				usersAuth.POST("/2fa/confirm", api_totp.Confirm)
+				usersAuth.POST("/2fa/recovery_codes", api_totp.RegenerateRecoveryCodes)
+				usersAuth.DELETE("/2fa", api_totp.Disable)
+				usersAuth.GET("/sessions", api_session.List)
+				usersAuth.DELETE("/sessions", api_session.RevokeOthers)
+				usersAuth.DELETE("/sessions/:sessionID", api_session.Revoke)
+				usersAuth.GET("/security_events", api_session.SecurityEvents)
+				usersAuth.GET("/oidc/identities", api_oidc.Identities)
+				usersAuth.POST("/oidc/:provider/link", api_oidc.Link)
+				usersAuth.DELETE("/oidc/identities/:provider", api_oidc.Unlink)
+				usersAuth.GET("/passkeys", api_passkey.List)
+				usersAuth.POST("/passkeys/register/begin", api_passkey.BeginRegistration)
+				usersAuth.POST("/passkeys/register/finish", api_passkey.FinishRegistration)
+				usersAuth.DELETE("/passkeys/:passkeyID", api_passkey.Remove)
 			}
 
 			users.POST("/login", api_user.Login)
+			users.POST("/login/2fa", api_totp.VerifyLogin)
 			users.POST("/register", api_user.Register)
+			users.GET("/oidc/providers", api_oidc.Providers)
+			users.POST("/oidc/:provider/authorize", api_oidc.Authorize)
+			users.POST("/oidc/callback", api_oidc.Callback)
+			users.POST("/oidc/register", api_oidc.Register)
+			users.POST("/login/passkey/begin", api_passkey.BeginLogin)
+			users.POST("/login/passkey/finish", api_passkey.FinishLogin)
 			users.GET("/profile/:username", api_user.GetProfile(false))
 			users.GET("/refresh_new", api_token.RefreshToken("first"))
 			users.GET("/refresh", api_token.RefreshToken("continue"))
+			users.POST("/email/verify", api_user.VerifyEmail)
+			users.POST("/password/forgot", api_user.ForgotPassword)
+			users.POST("/password/reset", api_user.ResetPassword)
+		}
+
+		// Search routes
+		search := v1.Group("/search")
+		{
+			searchAuth := search.Group("/", middleware.Auth())
+			{
+				searchAuth.GET("/history", api_search.History)
+				searchAuth.DELETE("/history", api_search.ClearHistory)
+				searchAuth.PUT("/history/recording", api_search.SetHistoryRecording)
+				searchAuth.GET("/saved", api_search.SavedSearches)
+				searchAuth.POST("/saved", api_search.SaveSearch)
+				searchAuth.PUT("/saved/:savedSearchID/notify", api_search.SetSavedSearchNotify)
+				searchAuth.DELETE("/saved/:savedSearchID", api_search.DeleteSavedSearch)
+			}
+
+			search.GET("", middleware.OptionalAuth(), api_search.Search())
+			search.GET("/autocomplete", middleware.OptionalAuth(), api_search.Autocomplete())
 		}
 
 		// Thread routes
@@ -106,15 +222,51 @@ func main() {
 				threadsAuth.PUT("/dislike/:objID", api_comment.HandleLikeDislike(0, "user_thread_likes"))
 				threadsAuth.PATCH("/edit/:threadID", api_thread.Edit)
 				threadsAuth.DELETE("/:threadID", api_thread.Delete)
+				threadsAuth.POST("/restore/:threadID", api_thread.Restore)
 				threadsAuth.POST("/report/:objID", api_thread.Report("thread"))
 			}
 
-			threads.GET("/:threadID", api_thread.View(1))
-			threads.GET("/:threadID/:page", api_thread.View(1))
+			threads.GET("/:threadID", middleware.OptionalAuth(), api_thread.View(1))
+			threads.GET("/:threadID/:page", middleware.OptionalAuth(), api_thread.View(1))
 			threads.GET("/list", api_thread.List())
-			threads.GET("/search", api_thread.Search())
+			threads.GET("/search", middleware.OptionalAuth(), api_thread.Search())
 			threads.GET("/tags", api_thread.Tags)
+			threads.GET("/revisions/:objID", middleware.OptionalAuth(), api_thread.Revisions("thread"))
+			threads.GET("/revisions/:objID/diff", middleware.OptionalAuth(), api_thread.RevisionDiff("thread"))
+
+		}
+
+		// Channel routes
+		channels := v1.Group("/channels")
+		{
+			channelsAuth := channels.Group("/", middleware.Auth())
+			{
+				channelsAuth.POST("/new", api_channel.New)
+				channelsAuth.PATCH("/edit/:channelID", api_channel.Edit)
+				channelsAuth.DELETE("/:channelID", api_channel.Delete)
+				channelsAuth.PUT("/follow/:channelID", api_channel.Follow)
+				channelsAuth.DELETE("/follow/:channelID", api_channel.Unfollow)
+				channelsAuth.GET("/followed", api_channel.Followed)
+				channelsAuth.PUT("/:channelID/moderators/:username", api_channel.SetModerator(true))
+				channelsAuth.DELETE("/:channelID/moderators/:username", api_channel.SetModerator(false))
+			}
+
+			channels.GET("/list", api_channel.List())
+			channels.GET("/:channelID", api_channel.View())
+			channels.GET("/:channelID/threads", api_channel.Threads())
+			channels.GET("/:channelID/moderators", api_channel.Moderators())
+		}
+
+		// Poll routes
+		polls := v1.Group("/polls")
+		{
+			pollsAuth := polls.Group("/", middleware.Auth())
+			{
+				pollsAuth.PUT("/:pollID/vote", api_poll.Vote)
+				pollsAuth.DELETE("/:pollID/vote", api_poll.Retract)
+			}
 
+			polls.GET("/:pollID", middleware.OptionalAuth(), api_poll.View())
 		}
 
 		// Comment routes
@@ -125,13 +277,17 @@ func main() {
 				commentsAuth.POST("/new/:threadID", api_comment.New)
 				commentsAuth.PATCH("/edit/:commentID", api_comment.Edit)
 				commentsAuth.DELETE("/:commentID", api_comment.Delete)
+				commentsAuth.POST("/restore/:commentID", api_comment.Restore)
 				commentsAuth.PUT("/like/:objID", api_comment.HandleLikeDislike(1, "user_comment_likes"))
 				commentsAuth.PUT("/dislike/:objID", api_comment.HandleLikeDislike(0, "user_comment_likes"))
 				commentsAuth.POST("/report/:objID", api_thread.Report("comment"))
 			}
 
 			comments.GET("/:commentID", api_comment.View())
+			comments.GET("/:commentID/replies", api_comment.Replies())
 			comments.GET("/thread/:threadID", api_comment.List())
+			comments.GET("/revisions/:objID", middleware.OptionalAuth(), api_thread.Revisions("comment"))
+			comments.GET("/revisions/:objID/diff", middleware.OptionalAuth(), api_thread.RevisionDiff("comment"))
 		}
 
 		// Tags route
@@ -139,14 +295,55 @@ func main() {
 		{
 			tagsAuth := tags.Group("/", middleware.Auth())
 			{
-				tagsAuth.POST("/new", api_thread.CreateTag)
+				tagsAuth.POST("/new", middleware.RequireRole(models.AdminRole), api_thread.CreateTag)
 			}
 		}
 
-		// NOT FULLY IMPLEMENTED: Notifications route
-		notifications := v1.Group("/notifications")
+		// Direct message routes
+		messages := v1.Group("/messages", middleware.Auth())
+		{
+			messages.POST("/send/:username", api_message.Send)
+			messages.GET("/conversations", api_message.Conversations)
+			messages.GET("/conversations/:username", api_message.Conversation())
+			messages.PUT("/conversations/:username/read", api_message.MarkRead)
+			messages.GET("/blocked", api_message.Blocked)
+			messages.PUT("/block/:username", api_message.Block)
+			messages.DELETE("/block/:username", api_message.Unblock)
+		}
+
+		// Notifications route
+		notifications := v1.Group("/notifications", middleware.Auth())
+		{
+			notifications.GET("/list", api_notification.List())
+			notifications.GET("/unread_count", api_notification.UnreadCount)
+			notifications.PUT("/acknowledge/:notificationID", api_notification.Acknowledge)
+			notifications.PUT("/acknowledge_all", api_notification.AcknowledgeAll)
+			notifications.POST("/broadcast", middleware.RequireRole(models.AdminRole), api_notification.Broadcast)
+		}
+
+		// Moderation routes
+		moderation := v1.Group("/moderation", middleware.Auth(), middleware.RequireRole(models.ModeratorRole))
+		{
+			moderation.GET("/reports", api_moderation.Reports())
+			moderation.GET("/reports/:reportID", api_moderation.ViewReport())
+			moderation.PUT("/reports/:reportID/claim", api_moderation.Claim)
+			moderation.DELETE("/reports/:reportID/claim", api_moderation.Unclaim)
+			moderation.POST("/reports/:reportID/resolve", api_moderation.Resolve)
+			moderation.GET("/log", api_moderation.Log())
+		}
+
+		// Admin routes
+		admin := v1.Group("/admin", middleware.Auth(), middleware.RequireRole(models.AdminRole))
+		{
+			admin.PUT("/users/:username/role", api_user.UpdateRole)
+		}
+
+		// Server-sent event routes
+		eventStreams := v1.Group("/events")
 		{
-			notifications.GET("/notifications", api_notification.GetGlobalNotifications())
+			eventStreams.POST("/ticket", middleware.Auth(), api_event.Ticket)
+			eventStreams.GET("/notifications", middleware.StreamAuth(), api_event.Notifications)
+			eventStreams.GET("/threads/:threadID", api_event.ThreadComments)
 		}
 
 		// File upload route
@@ -157,6 +354,9 @@ func main() {
 
 		}
 
+		// Public keys which access tokens can be verified with
+		r.GET("/.well-known/jwks.json", api_token.JWKS)
+
 		// File server routes
 		r.Static("/files", "./public/uploads")
 	}
@@ -167,6 +367,29 @@ func main() {
 		cleanupExpiredRefreshToken(database.DB, stop)
 	}()
 
+	go func() {
+		log.Println("started background task: cleanup expired email tokens, login challenges, sign in requests, passkey challenges and stream tickets every hour")
+		cleanupExpiredShortLivedTokens(database.DB, stop)
+	}()
+
+	go func() {
+		log.Println("started background task: notify new saved search matches")
+		notifySavedSearchMatches(database.DB, stop)
+	}()
+
+	go func() {
+		log.Println("started background task: purge soft-deleted content past its grace period every hour")
+		purgeDeleted(database.DB, stop)
+	}()
+
+	// Share events between server instances through Postgres when enabled
+	if os.Getenv("EVENTS_BACKEND") == "postgres" {
+		go func() {
+			log.Println("started background task: relay events through postgres LISTEN/NOTIFY")
+			events.DefaultHub.ListenPostgres(database.DB, database.DSN, stop)
+		}()
+	}
+
 	defer func() {
 		close(stop)
 		err := database.DB.Close()
@@ -179,7 +402,12 @@ func main() {
 func cleanupExpiredRefreshToken(db *sqlx.DB, stop chan struct{}) {
 	ticker := time.NewTicker(6 * time.Hour)
 	defer ticker.Stop()
-	query := "DELETE FROM refresh_tokens WHERE expiration_date < NOW()"
+	queries := []string{
+		"DELETE FROM refresh_tokens WHERE expiration_date < NOW()",
+		"DELETE FROM rotated_refresh_tokens WHERE expiration_date < NOW()",
+		fmt.Sprintf("DELETE FROM access_token_denylist WHERE revoked_date < NOW() - make_interval(secs => %d)",
+			int(utils_auth.JWT_ACCESS_TOKEN_EXPIRATION.Seconds())),
+	}
 
 	for {
 		select {
@@ -187,13 +415,82 @@ func cleanupExpiredRefreshToken(db *sqlx.DB, stop chan struct{}) {
 			log.Println("[cleanupExpiredRefreshToken] stopping...")
 			return
 		case <-ticker.C:
-			_, err := db.Exec(query)
+			for _, query := range queries {
+				_, err := db.Exec(query)
+				if err != nil {
+					log.Printf("[cleanupExpiredRefreshToken] failed to cleanup expired refresh token: %s\n", err.Error())
+				} else {
+					log.Println("[cleanupExpiredRefreshToken] successfully cleaned up expired refresh token")
+				}
+			}
+		}
+	}
+}
+
+func cleanupExpiredShortLivedTokens(db *sqlx.DB, stop chan struct{}) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	queries := []string{
+		"DELETE FROM email_tokens WHERE expiration_date < NOW()",
+		"DELETE FROM login_challenges WHERE expiration_date < NOW()",
+		"DELETE FROM oidc_states WHERE expiration_date < NOW()",
+		"DELETE FROM oidc_registrations WHERE expiration_date < NOW()",
+		"DELETE FROM webauthn_challenges WHERE expiration_date < NOW()",
+		"DELETE FROM stream_tickets WHERE expiration_date < NOW()",
+		fmt.Sprintf("DELETE FROM totp_failed_attempts WHERE attempt_date < NOW() - make_interval(secs => %d)",
+			int(models.TOTP_FAILED_ATTEMPT_WINDOW.Seconds())),
+	}
+
+	for {
+		select {
+		case <-stop:
+			log.Println("[cleanupExpiredShortLivedTokens] stopping...")
+			return
+		case <-ticker.C:
+			for _, query := range queries {
+				_, err := db.Exec(query)
+				if err != nil {
+					log.Printf("[cleanupExpiredShortLivedTokens] failed to cleanup expired tokens: %s\n", err.Error())
+				}
+			}
+		}
+	}
+}
+
+func notifySavedSearchMatches(db *sqlx.DB, stop chan struct{}) {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			log.Println("[notifySavedSearchMatches] stopping...")
+			return
+		case <-ticker.C:
+			err := api_search.NotifySavedSearchMatches(db)
 			if err != nil {
-				log.Printf("[cleanupExpiredRefreshToken] failed to cleanup expired refresh token: %s\n", err.Error())
-			} else {
-				log.Println("[cleanupExpiredRefreshToken] successfully cleaned up expired refresh token")
+				log.Printf("[notifySavedSearchMatches] failed to notify saved search matches: %s\n", err.Error())
 			}
+		}
+	}
+}
 
+func purgeDeleted(db *sqlx.DB, stop chan struct{}) {
+	ticker := time.NewTicker(models.PURGE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			log.Println("[purgeDeleted] stopping...")
+			return
+		case <-ticker.C:
+			purged, err := utils_db.PurgeDeleted(db)
+			if err != nil {
+				log.Printf("[purgeDeleted] failed to purge soft-deleted content: %s\n", err.Error())
+			} else {
+				log.Printf("[purgeDeleted] successfully purged %d soft-deleted rows\n", purged)
+			}
 		}
 	}
 }
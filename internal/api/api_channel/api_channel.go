@@ -1 +1,473 @@
 package api_channel
+
+import (
+	"1chanserver/internal/api/api_files"
+	"1chanserver/internal/models"
+	"1chanserver/internal/models/api_error"
+	"1chanserver/internal/utils/utils_db"
+	"1chanserver/internal/utils/utils_handler"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const channelViewQuery = `
+	SELECT ch.*, u.username AS creator_username
+	FROM channels ch
+	JOIN users u ON u.id = ch.creator_id
+	`
+
+func New(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	name := strings.TrimSpace(c.PostForm("name"))
+	description := strings.TrimSpace(c.PostForm("description"))
+	if name == "" {
+		c.Error(api_error.NewFromStr("missing channel name", http.StatusBadRequest))
+		return
+	}
+
+	if description == "" {
+		description = "Welcome to this channel!"
+	}
+
+	// The channel picture is optional on creation
+	var picturePath *string
+	if _, err := c.FormFile("channel_picture"); err == nil {
+		fileName, err := api_files.SaveFormImage(c, "channel_picture", "channel_pictures")
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		picturePath = &fileName
+	}
+
+	var channelID int
+	err := db.QueryRowx(
+		"INSERT INTO channels(name, description, channel_picture_path, creator_id) VALUES ($1, $2, $3, $4) RETURNING id",
+		name, description, picturePath, userID).Scan(&channelID)
+	if err != nil {
+		if utils_db.CheckDuplicateError(err) {
+			c.Error(api_error.NewFromStr("channel already exists", http.StatusConflict))
+			return
+		}
+
+		c.Error(err)
+		return
+	}
+
+	// The creator of a channel follows it by default
+	_, err = db.Exec("INSERT INTO user_channel_follows(user_id, channel_id) VALUES ($1, $2)", userID, channelID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"id": channelID,
+	})
+}
+
+func Edit(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	channelID, err := strconv.Atoi(c.Param("channelID"))
+	if err != nil {
+		c.Error(api_error.NewFromStr("invalid channel id", http.StatusBadRequest))
+		return
+	}
+
+	channel, err := utils_db.FetchOne[models.Channel](db, "SELECT * FROM channels WHERE id = $1", channelID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	canManage, err := canManageChannel(c, db, channel, userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if !canManage {
+		c.Error(api_error.NewFromStr("you cannot modify this channel", http.StatusForbidden))
+		return
+	}
+
+	if name := strings.TrimSpace(c.PostForm("name")); name != "" {
+		channel.Name = name
+	}
+
+	if description := strings.TrimSpace(c.PostForm("description")); description != "" {
+		channel.Description = description
+	}
+
+	if _, err := c.FormFile("channel_picture"); err == nil {
+		fileName, err := api_files.SaveFormImage(c, "channel_picture", "channel_pictures")
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		channel.ChannelPicturePath = &fileName
+	}
+
+	query := `
+	UPDATE channels
+	SET name = $1, description = $2, channel_picture_path = $3, updated_date = $4
+	WHERE id = $5
+	`
+
+	_, err = db.Exec(query, channel.Name, channel.Description, channel.ChannelPicturePath, time.Now().UTC(), channelID)
+	if err != nil {
+		if utils_db.CheckDuplicateError(err) {
+			c.Error(api_error.NewFromStr("channel already exists", http.StatusConflict))
+			return
+		}
+
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func Delete(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	channelID, err := strconv.Atoi(c.Param("channelID"))
+	if err != nil {
+		c.Error(api_error.NewFromStr("invalid channel id", http.StatusBadRequest))
+		return
+	}
+
+	channel, err := utils_db.FetchOne[models.Channel](db, "SELECT * FROM channels WHERE id = $1", channelID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	// Channel moderators may manage a channel, but not delete it
+	if !channel.IsOwnedBy(&userID) && !utils_handler.GetReqRole(c).AtLeast(models.AdminRole) {
+		c.Error(api_error.NewFromStr("you cannot delete this channel", http.StatusForbidden))
+		return
+	}
+
+	// Threads in the deleted channel are kept, and are simply detached from it
+	_, err = db.Exec("DELETE FROM channels WHERE id = $1", channelID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func View() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := c.MustGet("db").(*sqlx.DB)
+
+		channelID, err := strconv.Atoi(c.Param("channelID"))
+		if err != nil {
+			c.Error(api_error.NewFromStr("invalid channel id", http.StatusBadRequest))
+			return
+		}
+
+		channel, err := utils_db.FetchOne[models.ChannelView](db, channelViewQuery+"WHERE ch.id = $1", channelID)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		c.JSON(http.StatusOK, channel)
+	}
+}
+
+func List() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := c.MustGet("db").(*sqlx.DB)
+
+		pageInt, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+		if err != nil || pageInt <= 0 {
+			c.Error(api_error.InvalidPageReq)
+			return
+		}
+
+		sortBy, err := sortCriteriaToDBColumn(c.DefaultQuery("sort_by", "followers"))
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		order := c.DefaultQuery("order", "desc")
+		if order != "desc" && order != "asc" {
+			c.Error(api_error.NewFromStr("invalid order parameter", http.StatusBadRequest))
+			return
+		}
+
+		query := fmt.Sprintf(channelViewQuery+`
+			ORDER BY %s %s, ch.id
+			LIMIT $1 OFFSET $2`, sortBy, order)
+
+		channels, err := utils_db.FetchAll[models.ChannelView](db, query,
+			models.DEFAULT_PAGE_SIZE, (pageInt-1)*models.DEFAULT_PAGE_SIZE)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		channelCount, err := utils_db.GetTotalRecordNo(db, "SELECT COUNT(*) FROM channels")
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		c.JSON(http.StatusOK, models.PaginatedResponse[models.ChannelView]{
+			Response: channels,
+			Pagination: models.Pagination{
+				CurrentPage: pageInt,
+				LastPage:    channelCount/models.DEFAULT_PAGE_SIZE + 1,
+				PageSize:    min(len(channels), models.DEFAULT_PAGE_SIZE),
+			},
+		})
+	}
+}
+
+func Threads() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := c.MustGet("db").(*sqlx.DB)
+
+		channelID, err := strconv.Atoi(c.Param("channelID"))
+		if err != nil {
+			c.Error(api_error.NewFromStr("invalid channel id", http.StatusBadRequest))
+			return
+		}
+
+		threadReqQuery, err := utils_handler.GetThreadReqQuery(c, "t", "date")
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		pageInt := threadReqQuery["page"].(int)
+		sortBy := threadReqQuery["sort_by"].(string)
+		order := threadReqQuery["order"].(string)
+
+		query := fmt.Sprintf(`
+			SELECT
+				t.*, u.username, up.profile_picture_path, ch.name AS channel
+			FROM threads t
+			JOIN users u ON t.user_id = u.id
+			JOIN user_profiles up ON t.user_id = up.id
+			JOIN channels ch ON ch.id = t.channel_id
+			WHERE t.channel_id = $1 AND t.deleted_at IS NULL
+			ORDER BY %s %s
+			LIMIT $2 OFFSET $3`, sortBy, order)
+
+		threadList, err := utils_db.FetchAll[models.ThreadView](db, query,
+			channelID, models.DEFAULT_PAGE_SIZE, (pageInt-1)*models.DEFAULT_PAGE_SIZE)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		// Truncate the post content
+		for i := 0; i < len(threadList); i++ {
+			if len(threadList[i].OriginalPost) > 200 {
+				threadList[i].OriginalPost = threadList[i].OriginalPost[:200] + "..."
+			}
+		}
+
+		threadCount, err := utils_db.GetTotalRecordNo(db, "SELECT COUNT(*) FROM threads WHERE channel_id = $1 AND deleted_at IS NULL", channelID)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		c.JSON(http.StatusOK, models.PaginatedResponse[models.ThreadView]{
+			Response: threadList,
+			Pagination: models.Pagination{
+				CurrentPage: pageInt,
+				LastPage:    threadCount/models.DEFAULT_PAGE_SIZE + 1,
+				PageSize:    min(len(threadList), models.DEFAULT_PAGE_SIZE),
+			},
+		})
+	}
+}
+
+func Follow(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	channelID, err := strconv.Atoi(c.Param("channelID"))
+	if err != nil {
+		c.Error(api_error.NewFromStr("invalid channel id", http.StatusBadRequest))
+		return
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO user_channel_follows(user_id, channel_id) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		userID, channelID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func Unfollow(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	channelID, err := strconv.Atoi(c.Param("channelID"))
+	if err != nil {
+		c.Error(api_error.NewFromStr("invalid channel id", http.StatusBadRequest))
+		return
+	}
+
+	_, err = db.Exec(
+		"DELETE FROM user_channel_follows WHERE user_id = $1 AND channel_id = $2",
+		userID, channelID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func Followed(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	query := channelViewQuery + `
+	JOIN user_channel_follows ucf ON ucf.channel_id = ch.id
+	WHERE ucf.user_id = $1
+	ORDER BY ch.name
+	`
+
+	channels, err := utils_db.FetchAll[models.ChannelView](db, query, userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"channels": channels,
+	})
+}
+
+// canManageChannel reports whether the user may edit the channel. This is
+// the case for its creator, its moderators and admins.
+func canManageChannel(c *gin.Context, db *sqlx.DB, channel models.Channel, userID uuid.UUID) (bool, error) {
+	if channel.IsOwnedBy(&userID) || utils_handler.GetReqRole(c).AtLeast(models.AdminRole) {
+		return true, nil
+	}
+
+	isChannelModerator, err := utils_db.FetchOne[int](db,
+		"SELECT COUNT(*) FROM channel_moderators WHERE channel_id = $1 AND user_id = $2", channel.ID, userID)
+	if err != nil {
+		return false, err
+	}
+
+	return isChannelModerator > 0, nil
+}
+
+func Moderators() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := c.MustGet("db").(*sqlx.DB)
+
+		channelID, err := strconv.Atoi(c.Param("channelID"))
+		if err != nil {
+			c.Error(api_error.NewFromStr("invalid channel id", http.StatusBadRequest))
+			return
+		}
+
+		query := `
+		SELECT u.username
+		FROM channel_moderators cm
+		JOIN users u ON u.id = cm.user_id
+		WHERE cm.channel_id = $1
+		ORDER BY cm.appointed_date
+		`
+
+		usernames, err := utils_db.FetchAll[string](db, query, channelID)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"moderators": usernames,
+		})
+	}
+}
+
+// SetModerator appoints (appoint = true) or removes (appoint = false) the
+// user identified by the username path parameter as a channel moderator.
+// Only the channel creator and admins may do so.
+func SetModerator(appoint bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db, userID := utils_handler.GetReqCx(c)
+
+		channelID, err := strconv.Atoi(c.Param("channelID"))
+		if err != nil {
+			c.Error(api_error.NewFromStr("invalid channel id", http.StatusBadRequest))
+			return
+		}
+
+		channel, err := utils_db.FetchOne[models.Channel](db, "SELECT * FROM channels WHERE id = $1", channelID)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		// Moderators may manage the channel but not its moderators, or one
+		// could appoint others or remove the rest of the team
+		if !channel.IsOwnedBy(&userID) && !utils_handler.GetReqRole(c).AtLeast(models.AdminRole) {
+			c.Error(api_error.NewFromStr("only the channel creator can appoint or remove moderators", http.StatusForbidden))
+			return
+		}
+
+		username := c.Param("username")
+		moderator, err := utils_db.GetUserByUsername(&username, db)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		if appoint {
+			_, err = db.Exec(
+				"INSERT INTO channel_moderators(channel_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+				channelID, moderator.ID)
+		} else {
+			_, err = db.Exec(
+				"DELETE FROM channel_moderators WHERE channel_id = $1 AND user_id = $2",
+				channelID, moderator.ID)
+		}
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		c.Status(http.StatusOK)
+	}
+}
+
+func sortCriteriaToDBColumn(s string) (string, error) {
+	switch s {
+	case "followers":
+		return "ch.follower_count", nil
+	case "threads":
+		return "ch.thread_count", nil
+	case "date":
+		return "ch.creation_date", nil
+	case "name":
+		return "ch.name", nil
+	default:
+		return "", api_error.NewFromErr(errors.New("invalid sort criteria"), http.StatusBadRequest)
+	}
+}
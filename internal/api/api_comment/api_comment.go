@@ -1,18 +1,41 @@
 package api_comment
 
 import (
+	"1chanserver/internal/api/api_notification"
+	"1chanserver/internal/events"
 	"1chanserver/internal/models"
 	"1chanserver/internal/models/api_error"
 	"1chanserver/internal/utils/utils_db"
 	"1chanserver/internal/utils/utils_handler"
+	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"log"
 	"net/http"
 	"strconv"
 	"time"
 )
 
+// CommentViewSelect selects the columns of models.CommentView,
+// leaving the WHERE clause and ordering to the caller. Soft-deleted
+// comments are selected as tombstones, so that their replies keep
+// their context.
+const CommentViewSelect = `
+	SELECT 
+		c.id, c.parent_id, c.depth, c.creation_date, c.updated_date,
+		c.like_count, c.dislike_count, c.reply_count, c.lang,
+		c.deleted_at IS NOT NULL AS deleted,
+		CASE WHEN c.deleted_at IS NULL THEN u.username ELSE '' END AS username,
+		CASE WHEN c.deleted_at IS NULL THEN up.profile_picture_path END AS profile_picture_path,
+		CASE WHEN c.deleted_at IS NULL THEN c.comment ELSE '' END AS comment
+	FROM comments c
+	JOIN users u ON c.user_id = u.id
+	JOIN user_profiles up ON c.user_id = up.id
+	`
+
 func New(c *gin.Context) {
 	db, userID := utils_handler.GetReqCx(c)
 	threadID := c.Param("threadID")
@@ -24,25 +47,81 @@ func New(c *gin.Context) {
 	threadIDInt, err := strconv.Atoi(threadID)
 	if err != nil {
 		c.Error(api_error.NewFromStr("invalid thread id", http.StatusBadRequest))
+		return
 	}
 
-	var commentRequest map[string]string
-	err = c.ShouldBindJSON(&commentRequest)
+	commentRequest, err := utils_handler.GetObj[models.CommentRequest](c)
 	if err != nil {
 		c.Error(api_error.NewFromStr("invalid obj", http.StatusBadRequest))
 		return
 	}
 
-	comment := commentRequest["comment"]
+	if commentRequest.Lang != nil && !commentRequest.Lang.IsValid() {
+		c.Error(api_error.NewFromStr("invalid language", http.StatusBadRequest))
+		return
+	}
+
+	threadExists, err := utils_db.FetchOne[bool](db,
+		"SELECT EXISTS(SELECT 1 FROM threads WHERE id = $1 AND deleted_at IS NULL)", threadIDInt)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if !threadExists {
+		c.Error(api_error.NewFromStr("thread not found", http.StatusNotFound))
+		return
+	}
+
+	depth := 0
+	if commentRequest.ParentID != nil {
+		parent, err := utils_db.FetchOne[models.Comment](db,
+			"SELECT thread_id, depth FROM comments WHERE id = $1 AND deleted_at IS NULL", *commentRequest.ParentID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				c.Error(api_error.NewFromStr("parent comment not found", http.StatusNotFound))
+				return
+			}
+
+			c.Error(err)
+			return
+		}
+
+		if parent.ThreadID != threadIDInt {
+			c.Error(api_error.NewFromStr("parent comment belongs to another thread", http.StatusBadRequest))
+			return
+		}
+
+		if parent.Depth >= models.MAX_COMMENT_DEPTH {
+			c.Error(api_error.NewFromStr("maximum reply depth reached", http.StatusBadRequest))
+			return
+		}
+
+		depth = parent.Depth + 1
+	}
+
 	var commentID int
 
-	query := "INSERT INTO comments (thread_id, user_id, comment) VALUES ($1, $2, $3) RETURNING id"
-	err = db.QueryRowx(query, threadIDInt, userID, comment).Scan(&commentID)
+	// Comments are written in their author's preferred language unless specified
+	query := `
+	INSERT INTO comments (thread_id, user_id, parent_id, depth, comment, lang) 
+	VALUES ($1, $2, $3, $4, $5, COALESCE($6, (SELECT preferred_lang FROM user_profiles WHERE id = $2))) 
+	RETURNING id
+	`
+	err = db.QueryRowx(query, threadIDInt, userID, commentRequest.ParentID, depth, commentRequest.Comment,
+		commentRequest.Lang).Scan(&commentID)
 	if err != nil {
 		c.Error(err)
 		return
 	}
 
+	if commentRequest.ParentID != nil {
+		api_notification.NotifyCommentReply(db, userID, int64(threadIDInt), *commentRequest.ParentID, int64(commentID))
+	} else {
+		api_notification.NotifyThreadComment(db, userID, int64(threadIDInt), int64(commentID))
+	}
+	publishCommentEvent(db, "comment_created", int64(threadIDInt), int64(commentID))
+
 	c.JSON(http.StatusCreated, gin.H{
 		"id": commentID,
 	})
@@ -65,18 +144,26 @@ func Edit(c *gin.Context) {
 	query := `
 	UPDATE comments
 	SET comment = $1, updated_date = $2
-	WHERE id = $3 AND user_id = $4 
+	WHERE id = $3 AND user_id = $4 AND deleted_at IS NULL
+	RETURNING id, thread_id
 	`
 
-	_, err = db.Exec(query, comment["comment"], time.Now().UTC(), commentID, userID)
+	var editedComment models.Comment
+	err = db.QueryRowx(query, comment["comment"], time.Now().UTC(), commentID, userID).
+		Scan(&editedComment.ID, &editedComment.ThreadID)
 	if err != nil {
 		c.Error(err)
 		return
 	}
 
+	publishCommentEvent(db, "comment_edited", int64(editedComment.ThreadID), editedComment.ID)
+
 	c.Status(http.StatusOK)
 }
 
+// List lists the comments of a thread. With view=flat (the default) every
+// comment is paginated regardless of its depth, whereas view=tree paginates
+// top-level comments and nests their replies under them.
 func List() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		db := c.MustGet("db").(*sqlx.DB)
@@ -94,42 +181,85 @@ func List() gin.HandlerFunc {
 			return
 		}
 
+		view := c.DefaultQuery("view", "flat")
+		if view != "flat" && view != "tree" {
+			c.Error(api_error.NewFromStr("invalid view", http.StatusBadRequest))
+			return
+		}
+
 		threadID := c.Param("threadID")
 		if threadID == "" {
 			c.Error(api_error.NewFromStr("missing thread id", http.StatusBadRequest))
 			return
 		}
 
-		page := c.DefaultQuery("page", "1")
-		pageInt, err := strconv.Atoi(page)
+		pageRequest, err := utils_handler.GetPageRequest(c, sortParamDB, order)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		threadExists, err := utils_db.FetchOne[bool](db,
+			"SELECT EXISTS(SELECT 1 FROM threads WHERE id = $1 AND deleted_at IS NULL)", threadID)
 		if err != nil {
-			c.Error(api_error.NewFromStr("invalid page", http.StatusBadRequest))
+			c.Error(err)
+			return
+		}
+
+		if !threadExists {
+			c.Error(api_error.NewFromStr("thread not found", http.StatusNotFound))
 			return
 		}
-		//sort := c.DefaultQuery("sort", "likes")
-
-		query := fmt.Sprintf(`
-			SELECT 
-				c.id, u.username, up.profile_picture_path, c.comment, c.creation_date, 
-				c.updated_date, c.like_count, c.dislike_count
-			FROM comments c
-			JOIN users u ON c.user_id = u.id
-			JOIN user_profiles up ON c.user_id = up.id
+
+		var depthClause string
+		if view == "tree" {
+			depthClause = "AND c.parent_id IS NULL"
+		}
+
+		// In cursor mode, only the comments after the cursor are selected
+		args := []interface{}{threadID, pageRequest.PageSize, pageRequest.Offset()}
+		var cursorClause string
+		if pageRequest.Cursor != nil {
+			cursorClause = "AND " + utils_db.KeysetCondition(sortParamDB, "c.id", order, 4)
+			args = append(args, pageRequest.Cursor.Value, pageRequest.Cursor.ID)
+		}
+
+		query := CommentViewSelect + fmt.Sprintf(`
 			WHERE
-				c.thread_id = $1
+				c.thread_id = $1 %s %s
 			ORDER BY
-				%s %s
+				%s %s, c.id %s
 			LIMIT $2 OFFSET $3
-			`, sortParamDB, order)
+			`, depthClause, cursorClause, sortParamDB, order, order)
 
-		comments, err := utils_db.FetchAll[models.CommentView](db, query,
-			threadID, models.DEFAULT_PAGE_SIZE, (pageInt-1)*models.DEFAULT_PAGE_SIZE)
+		comments, err := utils_db.FetchAll[models.CommentView](db, query, args...)
 		if err != nil {
 			c.Error(err)
 			return
 		}
 
-		commentsCount, err := utils_db.GetTotalRecordNo(db, "SELECT COUNT(*) FROM comments WHERE thread_id = $1", threadID)
+		if view == "tree" {
+			err = attachReplies(db, comments)
+			if err != nil {
+				c.Error(err)
+				return
+			}
+		}
+
+		// The count is skipped in cursor mode, which has no notion of a last page
+		if pageRequest.CursorMode {
+			c.JSON(http.StatusOK, models.PaginatedResponse[models.CommentView]{
+				Response: comments,
+				Pagination: models.Pagination{
+					PageSize:   len(comments),
+					NextCursor: models.NextCursor(comments, pageRequest, sortParamDB, order),
+				},
+			})
+			return
+		}
+
+		commentsCount, err := utils_db.GetTotalRecordNo(db,
+			fmt.Sprintf("SELECT COUNT(*) FROM comments c WHERE c.thread_id = $1 %s", depthClause), threadID)
 		if err != nil {
 			c.Error(err)
 			return
@@ -138,9 +268,9 @@ func List() gin.HandlerFunc {
 		c.JSON(http.StatusOK, models.PaginatedResponse[models.CommentView]{
 			Response: comments,
 			Pagination: models.Pagination{
-				CurrentPage: pageInt,
-				PageSize:    min(len(comments), models.DEFAULT_PAGE_SIZE),
-				LastPage:    commentsCount/models.DEFAULT_PAGE_SIZE + 1,
+				CurrentPage: pageRequest.Page,
+				PageSize:    min(len(comments), pageRequest.PageSize),
+				LastPage:    commentsCount/pageRequest.PageSize + 1,
 			},
 		})
 
@@ -148,22 +278,172 @@ func List() gin.HandlerFunc {
 
 }
 
+// attachReplies fetches every reply below the given comments and nests
+// them under their parents, oldest first.
+func attachReplies(db *sqlx.DB, comments []models.CommentView) error {
+	if len(comments) == 0 {
+		return nil
+	}
+
+	rootIDs := make([]int64, len(comments))
+	for i, comment := range comments {
+		rootIDs[i] = comment.ID
+	}
+
+	query := `
+	WITH RECURSIVE replies AS (
+		SELECT id FROM comments WHERE parent_id = ANY($1)
+		UNION ALL
+		SELECT r.id FROM comments r JOIN replies ON r.parent_id = replies.id
+	)` + CommentViewSelect + `
+	WHERE c.id IN (SELECT id FROM replies)
+	ORDER BY c.creation_date ASC, c.id ASC
+	`
+
+	replies, err := utils_db.FetchAll[models.CommentView](db, query, pq.Array(rootIDs))
+	if err != nil {
+		return err
+	}
+
+	children := make(map[int64][]models.CommentView)
+	for _, reply := range replies {
+		children[*reply.ParentID] = append(children[*reply.ParentID], reply)
+	}
+
+	var nest func(comment *models.CommentView)
+	nest = func(comment *models.CommentView) {
+		comment.Replies = children[comment.ID]
+		for i := range comment.Replies {
+			nest(&comment.Replies[i])
+		}
+	}
+
+	for i := range comments {
+		nest(&comments[i])
+	}
+
+	return nil
+}
+
+// Replies lists the direct replies to a comment, oldest first.
+func Replies() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := c.MustGet("db").(*sqlx.DB)
+
+		commentID, err := strconv.ParseInt(c.Param("commentID"), 10, 64)
+		if err != nil {
+			c.Error(api_error.NewFromStr("invalid comment id", http.StatusBadRequest))
+			return
+		}
+
+		pageInt, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+		if err != nil || pageInt <= 0 {
+			c.Error(api_error.InvalidPageReq)
+			return
+		}
+
+		replyCount, err := utils_db.FetchOne[int](db, `
+			SELECT c.reply_count FROM comments c
+			WHERE c.id = $1 AND EXISTS (SELECT 1 FROM threads t WHERE t.id = c.thread_id AND t.deleted_at IS NULL)
+			`, commentID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				c.Error(api_error.NewFromStr("comment not found", http.StatusNotFound))
+				return
+			}
+
+			c.Error(err)
+			return
+		}
+
+		query := CommentViewSelect + `
+		WHERE c.parent_id = $1
+		ORDER BY c.creation_date ASC, c.id ASC
+		LIMIT $2 OFFSET $3
+		`
+
+		replies, err := utils_db.FetchAll[models.CommentView](db, query,
+			commentID, models.DEFAULT_PAGE_SIZE, (pageInt-1)*models.DEFAULT_PAGE_SIZE)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		c.JSON(http.StatusOK, models.PaginatedResponse[models.CommentView]{
+			Response: replies,
+			Pagination: models.Pagination{
+				CurrentPage: pageInt,
+				PageSize:    min(len(replies), models.DEFAULT_PAGE_SIZE),
+				LastPage:    replyCount/models.DEFAULT_PAGE_SIZE + 1,
+			},
+		})
+	}
+}
+
+// Delete soft-deletes a comment, which is then shown as a tombstone. Its
+// owner can restore it within models.DELETION_GRACE_PERIOD.
 func Delete(c *gin.Context) {
 	db, userID := utils_handler.GetReqCx(c)
-	commentID := c.Param("commentID")
+	commentID, err := strconv.ParseInt(c.Param("commentID"), 10, 64)
+	if err != nil {
+		c.Error(api_error.NewFromStr("invalid comment id", http.StatusBadRequest))
+		return
+	}
 
-	if commentID == "" {
-		c.Error(api_error.NewFromStr("missing comment id", http.StatusBadRequest))
+	deleteRequest, err := utils_handler.GetDeleteRequest(c)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	deleted, err := utils_db.SoftDelete(db, "comments", commentID, &userID, userID, deleteRequest.Reason)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if !deleted {
+		c.Error(api_error.NewFromStr("comment not found", http.StatusNotFound))
+		return
+	}
+
+	threadID, err := utils_db.FetchOne[int64](db, "SELECT thread_id FROM comments WHERE id = $1", commentID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	events.Publish(events.Event{
+		Topic: events.ThreadTopic(threadID),
+		Name:  "comment_deleted",
+		ID:    commentID,
+	})
+
+	c.Status(http.StatusOK)
+}
+
+func Restore(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+	commentID, err := strconv.ParseInt(c.Param("commentID"), 10, 64)
+	if err != nil {
+		c.Error(api_error.NewFromStr("invalid comment id", http.StatusBadRequest))
 		return
 	}
 
-	query := "DELETE FROM comments WHERE id = $1 AND user_id = $2"
-	_, err := db.Exec(query, commentID, userID)
+	err = utils_db.Restore(db, "comments", commentID, userID)
 	if err != nil {
 		c.Error(err)
 		return
 	}
 
+	threadID, err := utils_db.FetchOne[int64](db, "SELECT thread_id FROM comments WHERE id = $1", commentID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	publishCommentEvent(db, "comment_restored", threadID, commentID)
+
 	c.Status(http.StatusOK)
 }
 
@@ -177,11 +457,29 @@ func HandleLikeDislike(v int, tableName string) gin.HandlerFunc {
 		}
 
 		var columnName string
+		var objectType string
+		var objectTable string
 		switch tableName {
 		case "user_thread_likes":
 			columnName = "thread_id"
+			objectType = "thread"
+			objectTable = "threads"
 		case "user_comment_likes":
 			columnName = "comment_id"
+			objectType = "comment"
+			objectTable = "comments"
+		}
+
+		objectExists, err := utils_db.FetchOne[bool](db, fmt.Sprintf(
+			"SELECT EXISTS(SELECT 1 FROM %s WHERE id = $1 AND deleted_at IS NULL)", objectTable), objID)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		if !objectExists {
+			c.Error(api_error.NewFromStr(objectType+" not found", http.StatusNotFound))
+			return
 		}
 
 		isLiked, err := utils_db.FetchOne[int](
@@ -198,6 +496,10 @@ func HandleLikeDislike(v int, tableName string) gin.HandlerFunc {
 				c.Error(err)
 				return
 			}
+
+			if v == 1 {
+				api_notification.NotifyLike(db, userID, objectType, int64(objID))
+			}
 		case 1:
 			likeVariant, err := utils_db.FetchOne[int](db,
 				fmt.Sprintf("SELECT variant FROM %s WHERE user_id = $1 AND %s = $2", tableName, columnName),
@@ -224,6 +526,10 @@ func HandleLikeDislike(v int, tableName string) gin.HandlerFunc {
 					return
 				}
 
+				if v == 1 {
+					api_notification.NotifyLike(db, userID, objectType, int64(objID))
+				}
+
 			case 1:
 				var query string
 				if v == 0 {
@@ -255,8 +561,8 @@ func View() gin.HandlerFunc {
 			return
 		}
 
-		query := `
-		SELECT * FROM comments WHERE id = $1
+		query := CommentViewSelect + `
+		WHERE c.id = $1 AND EXISTS (SELECT 1 FROM threads t WHERE t.id = c.thread_id AND t.deleted_at IS NULL)
 		`
 
 		comment, err := utils_db.FetchOne[models.CommentView](db, query, commentID)
@@ -268,3 +574,22 @@ func View() gin.HandlerFunc {
 		c.JSON(http.StatusOK, comment)
 	}
 }
+
+// publishCommentEvent publishes the current state of a comment to the
+// subscribers of its thread.
+func publishCommentEvent(db *sqlx.DB, name string, threadID int64, commentID int64) {
+	query := CommentViewSelect + "WHERE c.id = $1"
+
+	comment, err := utils_db.FetchOne[models.CommentView](db, query, commentID)
+	if err != nil {
+		log.Printf("[publishCommentEvent] failed to fetch comment %d: %s\n", commentID, err.Error())
+		return
+	}
+
+	events.Publish(events.Event{
+		Topic: events.ThreadTopic(threadID),
+		Name:  name,
+		ID:    commentID,
+		Data:  comment,
+	})
+}
@@ -0,0 +1,116 @@
+package api_event
+
+import (
+	"1chanserver/internal/events"
+	"1chanserver/internal/models"
+	"1chanserver/internal/models/api_error"
+	"1chanserver/internal/utils/utils_auth"
+	"1chanserver/internal/utils/utils_handler"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const HEARTBEAT_INTERVAL = 30 * time.Second
+
+// stream writes every event received on the given subscriptions to the
+// client as server-sent events until the client disconnects.
+func stream(c *gin.Context, topics ...string) {
+	merged := make(chan events.Event, events.SUBSCRIBER_BUFFER_SIZE)
+	done := make(chan struct{})
+	defer close(done)
+
+	for _, topic := range topics {
+		subscription, unsubscribe := events.Subscribe(topic)
+		defer unsubscribe()
+
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case event, ok := <-subscription:
+					if !ok {
+						return
+					}
+					select {
+					case merged <- event:
+					case <-done:
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	heartbeat := time.NewTicker(HEARTBEAT_INTERVAL)
+	defer heartbeat.Stop()
+
+	c.SSEvent("ready", gin.H{"topics": topics})
+	c.Writer.Flush()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case event := <-merged:
+			c.SSEvent(event.Name, event)
+			return true
+		case <-heartbeat.C:
+			c.SSEvent("ping", time.Now().UTC().Unix())
+			return true
+		}
+	})
+}
+
+// Ticket issues a stream ticket for the authenticated user's session, to
+// be passed as the ticket query parameter when opening an event stream.
+func Ticket(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+	sessionID := c.MustGet("SessionID").(uuid.UUID)
+
+	ticket, ticketHash, err := utils_auth.GenerateOpaqueToken()
+	if err != nil {
+		c.Error(api_error.NewFromErr(err, http.StatusInternalServerError))
+		return
+	}
+
+	expirationDate := time.Now().UTC().Add(models.STREAM_TICKET_EXPIRATION)
+	_, err = db.Exec(
+		"INSERT INTO stream_tickets(token_hash, user_id, session_id, expiration_date) VALUES ($1, $2, $3, $4)",
+		ticketHash, userID, sessionID, expirationDate)
+	if err != nil {
+		c.Error(api_error.NewFromErr(err, http.StatusInternalServerError))
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"ticket":          ticket,
+		"expiration_date": expirationDate,
+	})
+}
+
+// Notifications streams the new notifications of the authenticated user,
+// as well as admin broadcasts.
+func Notifications(c *gin.Context) {
+	_, userID := utils_handler.GetReqCx(c)
+	stream(c, events.UserTopic(userID), events.BroadcastTopic)
+}
+
+// ThreadComments streams the comments created, edited and deleted under a thread.
+func ThreadComments(c *gin.Context) {
+	threadID, err := strconv.ParseInt(c.Param("threadID"), 10, 64)
+	if err != nil {
+		c.Error(api_error.NewFromStr("invalid thread id", http.StatusBadRequest))
+		return
+	}
+
+	stream(c, events.ThreadTopic(threadID))
+}
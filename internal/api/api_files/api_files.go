@@ -8,9 +8,16 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"net/http"
+	"path/filepath"
+	"regexp"
 	"strings"
 )
 
+const UPLOADS_DIR = "./public/uploads"
+
+// Uploaded files are served under /files, by their generated name
+var uploadedFilePattern = regexp.MustCompile(`/files/([0-9a-f-]{36}\.\w+)`)
+
 func Upload(category string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		file, err := c.FormFile(category)
@@ -85,3 +92,42 @@ func UploadProfilePicture() gin.HandlerFunc {
 		})
 	}
 }
+
+// SaveFormImage saves the image uploaded under formKey in the multipart form
+// to ./public/uploads/<subDir>, and returns the name of the saved file.
+func SaveFormImage(c *gin.Context, formKey string, subDir string) (string, error) {
+	file, err := c.FormFile(formKey)
+	if err != nil {
+		return "", api_error.NewFromErr(err, http.StatusBadRequest)
+	}
+
+	filenameSplits := strings.Split(file.Filename, ".")
+	if len(filenameSplits) == 1 {
+		return "", api_error.NewFromStr("invalid image", http.StatusBadRequest)
+	}
+
+	fileName := fmt.Sprintf("%s.%s", uuid.New().String(), filenameSplits[len(filenameSplits)-1])
+	err = c.SaveUploadedFile(file, fmt.Sprintf("./public/uploads/%s/%s", subDir, fileName))
+	if err != nil {
+		return "", err
+	}
+
+	return fileName, nil
+}
+
+// UploadedFilePaths returns the paths, relative to UPLOADS_DIR, of the
+// uploaded files linked to in content.
+func UploadedFilePaths(content string) []string {
+	var paths []string
+	for _, match := range uploadedFilePattern.FindAllStringSubmatch(content, -1) {
+		paths = append(paths, match[1])
+	}
+
+	return paths
+}
+
+// UploadedFilePath returns the path, relative to UPLOADS_DIR, of the file
+// named fileName uploaded to subDir.
+func UploadedFilePath(subDir string, fileName string) string {
+	return filepath.Join(subDir, filepath.Base(fileName))
+}
@@ -0,0 +1,300 @@
+package api_message
+
+import (
+	"1chanserver/internal/api/api_notification"
+	"1chanserver/internal/models"
+	"1chanserver/internal/models/api_error"
+	"1chanserver/internal/utils/utils_db"
+	"1chanserver/internal/utils/utils_handler"
+	"database/sql"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// getCorrespondent returns the ID of the user identified by the username
+// path parameter, ensuring it is not the requesting user.
+func getCorrespondent(c *gin.Context, db *sqlx.DB, userID uuid.UUID) (uuid.UUID, error) {
+	username := c.Param("username")
+	if username == "" {
+		return uuid.Nil, api_error.NewFromStr("missing username", http.StatusBadRequest)
+	}
+
+	user, err := utils_db.GetUserByUsername(&username, db)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return uuid.Nil, api_error.NewFromStr("user not found", http.StatusNotFound)
+		}
+
+		return uuid.Nil, err
+	}
+
+	// Deleted accounts cannot be messaged
+	if user.IsDeleted() {
+		return uuid.Nil, api_error.NewFromStr("user not found", http.StatusNotFound)
+	}
+
+	if user.ID == userID {
+		return uuid.Nil, api_error.NewFromStr("you cannot message yourself", http.StatusBadRequest)
+	}
+
+	return user.ID, nil
+}
+
+// IsBlocked reports whether either of the two users has blocked the other.
+func IsBlocked(db *sqlx.DB, userID uuid.UUID, otherUserID uuid.UUID) (bool, error) {
+	blockCount, err := utils_db.FetchOne[int](db, `
+		SELECT COUNT(*) FROM user_blocks
+		WHERE (blocker_id = $1 AND blocked_id = $2) OR (blocker_id = $2 AND blocked_id = $1)
+		`, userID, otherUserID)
+	if err != nil {
+		return false, err
+	}
+
+	return blockCount > 0, nil
+}
+
+func Send(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	recipientID, err := getCorrespondent(c, db, userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	messageRequest, err := utils_handler.GetObj[models.DirectMessageRequest](c)
+	if err != nil {
+		c.Error(api_error.NewFromStr("invalid object", http.StatusBadRequest))
+		return
+	}
+
+	content := strings.TrimSpace(messageRequest.Content)
+	if content == "" || len(content) > models.DM_MAX_LENGTH {
+		c.Error(api_error.NewFromStr("invalid message length", http.StatusBadRequest))
+		return
+	}
+
+	isBlocked, err := IsBlocked(db, userID, recipientID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if isBlocked {
+		c.Error(api_error.NewFromStr("you cannot message this user", http.StatusForbidden))
+		return
+	}
+
+	query := `
+	INSERT INTO direct_messages(user_a_id, user_b_id, sender_id, content)
+	VALUES (LEAST($1::uuid, $2::uuid), GREATEST($1::uuid, $2::uuid), $1, $3)
+	RETURNING message_id
+	`
+
+	var messageID int64
+	err = db.QueryRowx(query, userID, recipientID, content).Scan(&messageID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	api_notification.NotifyDirectMessage(db, userID, recipientID, messageID)
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message_id": messageID,
+	})
+}
+
+func Conversations(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	query := `
+	WITH latest_messages AS (
+		SELECT DISTINCT ON (dm.user_a_id, dm.user_b_id)
+			dm.*,
+			CASE WHEN dm.user_a_id = $1 THEN dm.user_b_id ELSE dm.user_a_id END AS other_id
+		FROM direct_messages dm
+		WHERE dm.user_a_id = $1 OR dm.user_b_id = $1
+		ORDER BY dm.user_a_id, dm.user_b_id, dm.message_id DESC
+	)
+	SELECT
+		u.username, up.profile_picture_path,
+		lm.content AS last_message, su.username AS last_message_username,
+		lm.creation_date AS last_message_date,
+		(
+			SELECT COUNT(*) FROM direct_messages d
+			WHERE d.user_a_id = lm.user_a_id AND d.user_b_id = lm.user_b_id
+			AND d.sender_id <> $1 AND d.read_date IS NULL
+		) AS unread_count
+	FROM latest_messages lm
+	JOIN users u ON u.id = lm.other_id
+	JOIN user_profiles up ON up.id = u.id
+	JOIN users su ON su.id = lm.sender_id
+	ORDER BY lm.creation_date DESC
+	`
+
+	conversations, err := utils_db.FetchAll[models.ConversationView](db, query, userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	// Truncate the last message into a preview, on a character boundary
+	// so that multi-byte characters are not split
+	for i := 0; i < len(conversations); i++ {
+		lastMessage := []rune(conversations[i].LastMessage)
+		if len(lastMessage) > models.DM_PREVIEW_LENGTH {
+			conversations[i].LastMessage = string(lastMessage[:models.DM_PREVIEW_LENGTH]) + "..."
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"conversations": conversations,
+	})
+}
+
+func Conversation() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db, userID := utils_handler.GetReqCx(c)
+
+		otherUserID, err := getCorrespondent(c, db, userID)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		pageInt, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+		if err != nil || pageInt <= 0 {
+			c.Error(api_error.InvalidPageReq)
+			return
+		}
+
+		// Messages are returned newest first, so that page 1 is the latest exchange
+		query := `
+		SELECT dm.message_id, u.username AS sender_username, dm.content, dm.creation_date, dm.read_date
+		FROM direct_messages dm
+		JOIN users u ON u.id = dm.sender_id
+		WHERE dm.user_a_id = LEAST($1::uuid, $2::uuid) AND dm.user_b_id = GREATEST($1::uuid, $2::uuid)
+		ORDER BY dm.message_id DESC
+		LIMIT $3 OFFSET $4
+		`
+
+		messages, err := utils_db.FetchAll[models.DirectMessageView](db, query,
+			userID, otherUserID, models.DEFAULT_PAGE_SIZE, (pageInt-1)*models.DEFAULT_PAGE_SIZE)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		messageCount, err := utils_db.GetTotalRecordNo(db, `
+			SELECT COUNT(*) FROM direct_messages
+			WHERE user_a_id = LEAST($1::uuid, $2::uuid) AND user_b_id = GREATEST($1::uuid, $2::uuid)
+			`, userID, otherUserID)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		c.JSON(http.StatusOK, models.PaginatedResponse[models.DirectMessageView]{
+			Response: messages,
+			Pagination: models.Pagination{
+				CurrentPage: pageInt,
+				LastPage:    messageCount/models.DEFAULT_PAGE_SIZE + 1,
+				PageSize:    min(len(messages), models.DEFAULT_PAGE_SIZE),
+			},
+		})
+	}
+}
+
+// MarkRead marks every message the other user has sent in the
+// conversation as read.
+func MarkRead(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	otherUserID, err := getCorrespondent(c, db, userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	query := `
+	UPDATE direct_messages
+	SET read_date = $1
+	WHERE user_a_id = LEAST($2::uuid, $3::uuid) AND user_b_id = GREATEST($2::uuid, $3::uuid)
+	AND sender_id = $3 AND read_date IS NULL
+	`
+
+	_, err = db.Exec(query, time.Now().UTC(), userID, otherUserID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func Block(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	blockedID, err := getCorrespondent(c, db, userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO user_blocks(blocker_id, blocked_id) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		userID, blockedID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func Unblock(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	blockedID, err := getCorrespondent(c, db, userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	_, err = db.Exec("DELETE FROM user_blocks WHERE blocker_id = $1 AND blocked_id = $2", userID, blockedID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func Blocked(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	query := `
+	SELECT u.username
+	FROM user_blocks ub
+	JOIN users u ON u.id = ub.blocked_id
+	WHERE ub.blocker_id = $1
+	ORDER BY ub.creation_date DESC
+	`
+
+	usernames, err := utils_db.FetchAll[string](db, query, userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"blocked": usernames,
+	})
+}
@@ -0,0 +1,449 @@
+package api_moderation
+
+import (
+	"1chanserver/internal/api/api_notification"
+	"1chanserver/internal/models"
+	"1chanserver/internal/models/api_error"
+	"1chanserver/internal/utils/utils_db"
+	"1chanserver/internal/utils/utils_handler"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const reportViewQuery = `
+	SELECT
+		r.*,
+		ru.username AS reporter_username,
+		tu.username AS reported_username,
+		mu.username AS moderator_username,
+		(
+			SELECT COUNT(*) FROM reports pr
+			WHERE pr.status <> 'resolved'
+			AND (pr.thread_id = r.thread_id OR pr.comment_id = r.comment_id)
+		) AS pending_reports_on_item
+	FROM reports r
+	LEFT JOIN users ru ON ru.id = r.reporter_id
+	LEFT JOIN users tu ON tu.id = r.reported_user_id
+	LEFT JOIN users mu ON mu.id = r.moderator_id
+	`
+
+// inlineReportedContent attaches the reported thread or comment, if it
+// still exists, to the report.
+func inlineReportedContent(db *sqlx.DB, report *models.ReportView) error {
+	if report.ThreadID != nil {
+		thread, err := utils_db.FetchOne[models.ThreadView](db, `
+			SELECT t.*, u.username, up.profile_picture_path, ch.name AS channel
+			FROM threads t
+			JOIN users u ON u.id = t.user_id
+			JOIN user_profiles up ON up.id = u.id
+			LEFT JOIN channels ch ON ch.id = t.channel_id
+			WHERE t.id = $1
+			`, *report.ThreadID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if err == nil {
+			report.Thread = &thread
+		}
+	}
+
+	if report.CommentID != nil {
+		comment, err := utils_db.FetchOne[models.CommentView](db, `
+			SELECT c.*, c.deleted_at IS NOT NULL AS deleted, u.username, up.profile_picture_path
+			FROM comments c
+			JOIN users u ON u.id = c.user_id
+			JOIN user_profiles up ON up.id = u.id
+			WHERE c.id = $1
+			`, *report.CommentID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if err == nil {
+			report.Comment = &comment
+		}
+	}
+
+	return nil
+}
+
+func Reports() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := c.MustGet("db").(*sqlx.DB)
+
+		pageInt, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+		if err != nil || pageInt <= 0 {
+			c.Error(api_error.InvalidPageReq)
+			return
+		}
+
+		status := models.ReportStatus(c.DefaultQuery("status", string(models.ReportPending)))
+		switch status {
+		case models.ReportPending, models.ReportClaimed, models.ReportResolved:
+		default:
+			c.Error(api_error.NewFromStr("invalid report status", http.StatusBadRequest))
+			return
+		}
+
+		// Pending reports are served oldest first, so that none is left behind
+		order := "ASC"
+		if status == models.ReportResolved {
+			order = "DESC"
+		}
+
+		query := fmt.Sprintf(reportViewQuery+`
+			WHERE r.status = $1
+			ORDER BY r.creation_date %s, r.id %s
+			LIMIT $2 OFFSET $3`, order, order)
+
+		reports, err := utils_db.FetchAll[models.ReportView](db, query,
+			status, models.DEFAULT_PAGE_SIZE, (pageInt-1)*models.DEFAULT_PAGE_SIZE)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		for i := range reports {
+			if err := inlineReportedContent(db, &reports[i]); err != nil {
+				c.Error(err)
+				return
+			}
+		}
+
+		reportCount, err := utils_db.GetTotalRecordNo(db, "SELECT COUNT(*) FROM reports WHERE status = $1", status)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		c.JSON(http.StatusOK, models.PaginatedResponse[models.ReportView]{
+			Response: reports,
+			Pagination: models.Pagination{
+				CurrentPage: pageInt,
+				LastPage:    reportCount/models.DEFAULT_PAGE_SIZE + 1,
+				PageSize:    min(len(reports), models.DEFAULT_PAGE_SIZE),
+			},
+		})
+	}
+}
+
+func ViewReport() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := c.MustGet("db").(*sqlx.DB)
+
+		reportID, err := strconv.ParseInt(c.Param("reportID"), 10, 64)
+		if err != nil {
+			c.Error(api_error.NewFromStr("invalid report id", http.StatusBadRequest))
+			return
+		}
+
+		report, err := utils_db.FetchOne[models.ReportView](db, reportViewQuery+"WHERE r.id = $1", reportID)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		if err := inlineReportedContent(db, &report); err != nil {
+			c.Error(err)
+			return
+		}
+
+		c.JSON(http.StatusOK, report)
+	}
+}
+
+// Claim assigns a pending report to the requesting moderator, so that
+// other moderators do not work on it at the same time.
+func Claim(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	reportID, err := strconv.ParseInt(c.Param("reportID"), 10, 64)
+	if err != nil {
+		c.Error(api_error.NewFromStr("invalid report id", http.StatusBadRequest))
+		return
+	}
+
+	result, err := db.Exec(`
+		UPDATE reports
+		SET status = 'claimed', moderator_id = $1, claimed_date = $2
+		WHERE id = $3 AND status = 'pending'
+		`, userID, time.Now().UTC(), reportID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.Error(api_error.NewFromStr("report not found or no longer pending", http.StatusConflict))
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// Unclaim returns a report claimed by the requesting moderator to the queue.
+func Unclaim(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	reportID, err := strconv.ParseInt(c.Param("reportID"), 10, 64)
+	if err != nil {
+		c.Error(api_error.NewFromStr("invalid report id", http.StatusBadRequest))
+		return
+	}
+
+	result, err := db.Exec(`
+		UPDATE reports
+		SET status = 'pending', moderator_id = NULL, claimed_date = NULL
+		WHERE id = $1 AND status = 'claimed' AND moderator_id = $2
+		`, reportID, userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.Error(api_error.NewFromStr("report not claimed by you", http.StatusConflict))
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// Resolve applies a moderation action to the content and author of a
+// report, marks the report as resolved, and records the action in the
+// moderation log.
+func Resolve(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	reportID, err := strconv.ParseInt(c.Param("reportID"), 10, 64)
+	if err != nil {
+		c.Error(api_error.NewFromStr("invalid report id", http.StatusBadRequest))
+		return
+	}
+
+	resolution, err := utils_handler.GetObj[models.ReportResolution](c)
+	if err != nil {
+		c.Error(api_error.NewFromStr("invalid object", http.StatusBadRequest))
+		return
+	}
+	resolution.Note = strings.TrimSpace(resolution.Note)
+
+	switch resolution.Action {
+	case models.DismissAction, models.DeleteContentAction, models.WarnUserAction:
+	case models.SuspendUserAction:
+		if resolution.SuspendDays <= 0 || resolution.SuspendDays > models.MAX_SUSPENSION_DAYS {
+			c.Error(api_error.NewFromStr("invalid suspension length", http.StatusBadRequest))
+			return
+		}
+	default:
+		c.Error(api_error.NewFromStr("invalid moderation action", http.StatusBadRequest))
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	defer utils_db.HandleTxRollback(tx, &err, c)
+
+	// The report is locked so that moderators resolving it at once cannot
+	// both act on it
+	var report models.Report
+	err = tx.Get(&report, "SELECT * FROM reports WHERE id = $1 FOR UPDATE", reportID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if report.Status == models.ReportResolved {
+		err = api_error.NewFromStr("report already resolved", http.StatusConflict)
+		c.Error(err)
+		return
+	}
+
+	// A report whose moderator's account was removed counts as unclaimed
+	if report.Status == models.ReportClaimed && report.ModeratorID != nil && *report.ModeratorID != userID {
+		err = api_error.NewFromStr("report claimed by another moderator", http.StatusConflict)
+		c.Error(err)
+		return
+	}
+
+	if resolution.Action == models.WarnUserAction || resolution.Action == models.SuspendUserAction {
+		if report.ReportedUserID == nil {
+			err = api_error.NewFromStr("the reported user no longer exists", http.StatusConflict)
+			c.Error(err)
+			return
+		}
+
+		// Moderators cannot act against their peers or superiors
+		var reportedRole models.UserRole
+		err = tx.Get(&reportedRole, "SELECT role FROM users WHERE id = $1", *report.ReportedUserID)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		if reportedRole.AtLeast(utils_handler.GetReqRole(c)) {
+			err = api_error.NewFromStr("cannot act against a user of an equal or higher role", http.StatusForbidden)
+			c.Error(err)
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	actionsTaken := string(resolution.Action)
+	if resolution.Note != "" {
+		actionsTaken = fmt.Sprintf("%s: %s", resolution.Action, resolution.Note)
+	}
+
+	// Deleting the content settles every other open report on it as well
+	resolvedQuery := "UPDATE reports SET status = 'resolved', moderator_id = $1, actions_taken = $2, resolved_date = $3 WHERE id = $4"
+	if resolution.Action == models.DeleteContentAction {
+		resolvedQuery = `
+		UPDATE reports SET status = 'resolved', moderator_id = $1, actions_taken = $2, resolved_date = $3
+		WHERE id = $4 OR (status <> 'resolved' AND (thread_id = $5 OR comment_id = $6))
+		`
+		_, err = tx.Exec(resolvedQuery, userID, actionsTaken, now, reportID, report.ThreadID, report.CommentID)
+	} else {
+		_, err = tx.Exec(resolvedQuery, userID, actionsTaken, now, reportID)
+	}
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	switch resolution.Action {
+	case models.DeleteContentAction:
+		// The content is soft-deleted, so that it remains reviewable until
+		// purged, and cannot be restored by its owner
+		if report.CommentID != nil {
+			_, err = utils_db.SoftDelete(tx, "comments", *report.CommentID, nil, userID, &actionsTaken)
+		} else if report.ThreadID != nil {
+			_, err = utils_db.SoftDelete(tx, "threads", *report.ThreadID, nil, userID, &actionsTaken)
+		}
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+	case models.SuspendUserAction:
+		suspendedUntil := now.Add(time.Duration(resolution.SuspendDays) * 24 * time.Hour)
+		_, err = tx.Exec(
+			"UPDATE users SET suspended_until = GREATEST(COALESCE(suspended_until, $1), $1) WHERE id = $2",
+			suspendedUntil, *report.ReportedUserID)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		// Sign the suspended user out of every device
+		_, err = utils_db.RevokeSessions(tx, "user_id = $1", *report.ReportedUserID)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO moderation_log(moderator_id, report_id, action, target_user_id, thread_id, comment_id, note)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		`, userID, reportID, resolution.Action, report.ReportedUserID, report.ThreadID, report.CommentID, resolution.Note)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if resolution.Action != models.DismissAction && report.ReportedUserID != nil {
+		message := moderationNotice(resolution)
+		api_notification.NotifyAndLog(db, models.Notification{
+			UserID:   *report.ReportedUserID,
+			ThreadID: report.ThreadID,
+			Type:     models.AdminNotification,
+			Message:  &message,
+		})
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// moderationNotice is the message sent to the author of moderated content.
+func moderationNotice(resolution models.ReportResolution) string {
+	var notice string
+	switch resolution.Action {
+	case models.DeleteContentAction:
+		notice = "Your content has been removed by a moderator."
+	case models.WarnUserAction:
+		notice = "You have received a warning from a moderator."
+	case models.SuspendUserAction:
+		notice = fmt.Sprintf("Your account has been suspended for %d day(s) by a moderator.", resolution.SuspendDays)
+	}
+
+	if resolution.Note != "" {
+		notice = fmt.Sprintf("%s Reason: %s", notice, resolution.Note)
+	}
+
+	return notice
+}
+
+// Log lists the moderation audit trail, optionally restricted to the
+// actions of a single moderator.
+func Log() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := c.MustGet("db").(*sqlx.DB)
+
+		pageInt, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+		if err != nil || pageInt <= 0 {
+			c.Error(api_error.InvalidPageReq)
+			return
+		}
+
+		moderator := c.Query("moderator")
+
+		query := `
+		SELECT
+			ml.id, mu.username AS moderator_username, ml.report_id, ml.action,
+			tu.username AS target_username, ml.thread_id, ml.comment_id, ml.note, ml.creation_date
+		FROM moderation_log ml
+		LEFT JOIN users mu ON mu.id = ml.moderator_id
+		LEFT JOIN users tu ON tu.id = ml.target_user_id
+		WHERE ($1 = '' OR mu.username = $1)
+		ORDER BY ml.creation_date DESC, ml.id DESC
+		LIMIT $2 OFFSET $3
+		`
+
+		entries, err := utils_db.FetchAll[models.ModerationLogEntry](db, query,
+			moderator, models.DEFAULT_PAGE_SIZE, (pageInt-1)*models.DEFAULT_PAGE_SIZE)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		entryCount, err := utils_db.GetTotalRecordNo(db, `
+			SELECT COUNT(*)
+			FROM moderation_log ml
+			LEFT JOIN users mu ON mu.id = ml.moderator_id
+			WHERE ($1 = '' OR mu.username = $1)
+			`, moderator)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		c.JSON(http.StatusOK, models.PaginatedResponse[models.ModerationLogEntry]{
+			Response: entries,
+			Pagination: models.Pagination{
+				CurrentPage: pageInt,
+				LastPage:    entryCount/models.DEFAULT_PAGE_SIZE + 1,
+				PageSize:    min(len(entries), models.DEFAULT_PAGE_SIZE),
+			},
+		})
+	}
+}
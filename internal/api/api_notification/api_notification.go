@@ -1,12 +1,341 @@
 package api_notification
 
 import (
+	"1chanserver/internal/events"
+	"1chanserver/internal/models"
+	"1chanserver/internal/models/api_error"
+	"1chanserver/internal/utils/utils_db"
+	"1chanserver/internal/utils/utils_handler"
+	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func GetGlobalNotifications() gin.HandlerFunc {
+// Notify stores a notification for notification.UserID. Notifications
+// caused by the recipients themselves are silently dropped.
+func Notify(db *sqlx.DB, notification models.Notification) error {
+	if notification.ActorID != nil && *notification.ActorID == notification.UserID {
+		return nil
+	}
+
+	query := `
+	INSERT INTO notifications(user_id, actor_id, related_id, thread_id, type, message)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id, creation_date
+	`
+
+	err := db.QueryRowx(query,
+		notification.UserID,
+		notification.ActorID,
+		notification.RelatedID,
+		notification.ThreadID,
+		notification.Type,
+		notification.Message).Scan(&notification.ID, &notification.CreationDate)
+	if err != nil {
+		return err
+	}
+
+	events.Publish(events.Event{
+		Topic: events.UserTopic(notification.UserID),
+		Name:  "notification",
+		ID:    notification.ID,
+		Data:  notification,
+	})
+
+	return nil
+}
+
+// NotifyAndLog is Notify for callers whose own action has already
+// succeeded, and which should therefore not fail on a notification error.
+func NotifyAndLog(db *sqlx.DB, notification models.Notification) {
+	if err := Notify(db, notification); err != nil {
+		log.Printf("[NotifyAndLog] failed to create %s notification for user %s: %s\n",
+			notification.Type, notification.UserID, err.Error())
+	}
+}
+
+func List() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		c.Status(http.StatusOK)
+		db, userID := utils_handler.GetReqCx(c)
+
+		pageInt, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+		if err != nil || pageInt <= 0 {
+			c.Error(api_error.InvalidPageReq)
+			return
+		}
+
+		var statusClause string
+		switch c.DefaultQuery("status", "unread") {
+		case "unread":
+			statusClause = "AND n.acknowledged_date IS NULL"
+		case "all":
+			statusClause = ""
+		default:
+			c.Error(api_error.NewFromStr("invalid notification status", http.StatusBadRequest))
+			return
+		}
+
+		query := fmt.Sprintf(`
+			SELECT n.*, u.username AS actor_username
+			FROM notifications n
+			LEFT JOIN users u ON u.id = n.actor_id
+			WHERE n.user_id = $1 %s
+			ORDER BY n.creation_date DESC, n.id DESC
+			LIMIT $2 OFFSET $3`, statusClause)
+
+		notifications, err := utils_db.FetchAll[models.NotificationView](db, query,
+			userID, models.DEFAULT_PAGE_SIZE, (pageInt-1)*models.DEFAULT_PAGE_SIZE)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		notificationCount, err := utils_db.GetTotalRecordNo(db,
+			fmt.Sprintf("SELECT COUNT(*) FROM notifications n WHERE n.user_id = $1 %s", statusClause), userID)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		c.JSON(http.StatusOK, models.PaginatedResponse[models.NotificationView]{
+			Response: notifications,
+			Pagination: models.Pagination{
+				CurrentPage: pageInt,
+				LastPage:    notificationCount/models.DEFAULT_PAGE_SIZE + 1,
+				PageSize:    min(len(notifications), models.DEFAULT_PAGE_SIZE),
+			},
+		})
 	}
 }
+
+func UnreadCount(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	unreadCount, err := utils_db.GetTotalRecordNo(db,
+		"SELECT COUNT(*) FROM notifications WHERE user_id = $1 AND acknowledged_date IS NULL", userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"unread_count": unreadCount,
+	})
+}
+
+func Acknowledge(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	notificationID, err := strconv.ParseInt(c.Param("notificationID"), 10, 64)
+	if err != nil {
+		c.Error(api_error.NewFromStr("invalid notification id", http.StatusBadRequest))
+		return
+	}
+
+	result, err := db.Exec(
+		"UPDATE notifications SET acknowledged_date = COALESCE(acknowledged_date, $1) WHERE id = $2 AND user_id = $3",
+		time.Now().UTC(), notificationID, userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.Error(api_error.NewFromStr("notification not found", http.StatusNotFound))
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func AcknowledgeAll(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	_, err := db.Exec(
+		"UPDATE notifications SET acknowledged_date = $1 WHERE user_id = $2 AND acknowledged_date IS NULL",
+		time.Now().UTC(), userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// Broadcast sends an admin notification to every user.
+func Broadcast(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	broadcast, err := utils_handler.GetStringMap(c)
+	if err != nil {
+		c.Error(api_error.NewFromStr("invalid object", http.StatusBadRequest))
+		return
+	}
+
+	message := strings.TrimSpace(broadcast["message"])
+	if message == "" {
+		c.Error(api_error.NewFromStr("missing broadcast message", http.StatusBadRequest))
+		return
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO notifications(user_id, actor_id, type, message)
+		SELECT id, $1::uuid, $2, $3 FROM users WHERE deleted_at IS NULL
+		`, userID, models.AdminNotification, message)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	recipientCount, _ := result.RowsAffected()
+
+	events.Publish(events.Event{
+		Topic: events.BroadcastTopic,
+		Name:  "notification",
+		Data: gin.H{
+			"type":    models.AdminNotification,
+			"message": message,
+		},
+	})
+
+	c.JSON(http.StatusCreated, gin.H{
+		"recipient_count": recipientCount,
+	})
+}
+
+// notificationMessage formats the message shown for a notification
+// triggered by the user with the given username.
+func notificationMessage(format string, username string) *string {
+	message := fmt.Sprintf(format, username)
+	return &message
+}
+
+// NotifyThreadComment notifies the owner of a thread that it has been commented on.
+func NotifyThreadComment(db *sqlx.DB, actorID uuid.UUID, threadID int64, commentID int64) {
+	owner, err := utils_db.FetchOne[notificationTarget](db, `
+		SELECT t.user_id, u.username AS actor_username
+		FROM threads t, users u
+		WHERE t.id = $1 AND u.id = $2
+		`, threadID, actorID)
+	if err != nil {
+		log.Printf("[NotifyThreadComment] failed to fetch thread owner: %s\n", err.Error())
+		return
+	}
+
+	NotifyAndLog(db, models.Notification{
+		UserID:    owner.UserID,
+		ActorID:   &actorID,
+		RelatedID: &commentID,
+		ThreadID:  &threadID,
+		Type:      models.ThreadNotification,
+		Message:   notificationMessage("%s commented on your thread", owner.ActorUsername),
+	})
+}
+
+// NotifyCommentReply notifies the owner of a comment that it has been replied to.
+func NotifyCommentReply(db *sqlx.DB, actorID uuid.UUID, threadID int64, parentCommentID int64, replyID int64) {
+	owner, err := utils_db.FetchOne[notificationTarget](db, `
+		SELECT c.user_id, u.username AS actor_username
+		FROM comments c, users u
+		WHERE c.id = $1 AND u.id = $2
+		`, parentCommentID, actorID)
+	if err != nil {
+		log.Printf("[NotifyCommentReply] failed to fetch comment owner: %s\n", err.Error())
+		return
+	}
+
+	NotifyAndLog(db, models.Notification{
+		UserID:    owner.UserID,
+		ActorID:   &actorID,
+		RelatedID: &replyID,
+		ThreadID:  &threadID,
+		Type:      models.CommentNotification,
+		Message:   notificationMessage("%s replied to your comment", owner.ActorUsername),
+	})
+}
+
+// NotifyLike notifies the owner of a thread or comment that it has been liked.
+// objectType is either "thread" or "comment".
+func NotifyLike(db *sqlx.DB, actorID uuid.UUID, objectType string, objectID int64) {
+	var query string
+	switch objectType {
+	case "thread":
+		query = `
+		SELECT t.user_id, t.id AS thread_id, u.username AS actor_username
+		FROM threads t, users u
+		WHERE t.id = $1 AND u.id = $2
+		`
+	case "comment":
+		query = `
+		SELECT c.user_id, c.thread_id, u.username AS actor_username
+		FROM comments c, users u
+		WHERE c.id = $1 AND u.id = $2
+		`
+	default:
+		return
+	}
+
+	owner, err := utils_db.FetchOne[notificationTarget](db, query, objectID, actorID)
+	if err != nil {
+		log.Printf("[NotifyLike] failed to fetch %s owner: %s\n", objectType, err.Error())
+		return
+	}
+
+	message := notificationMessage("%s liked your "+objectType, owner.ActorUsername)
+
+	// Liking, unliking and liking again must not notify the owner every
+	// time, so skip the notification while an identical one is still unread
+	exists, err := utils_db.FetchOne[bool](db, `
+	SELECT EXISTS(
+		SELECT 1 FROM notifications
+		WHERE user_id = $1 AND actor_id = $2 AND type = $3
+		AND related_id = $4 AND thread_id IS NOT DISTINCT FROM $5
+		AND message IS NOT DISTINCT FROM $6 AND acknowledged_date IS NULL
+	)
+	`, owner.UserID, actorID, models.LikeNotification, objectID, owner.ThreadID, message)
+	if err != nil {
+		log.Printf("[NotifyLike] failed to check for an unread notification: %s\n", err.Error())
+		return
+	}
+	if exists {
+		return
+	}
+
+	NotifyAndLog(db, models.Notification{
+		UserID:    owner.UserID,
+		ActorID:   &actorID,
+		RelatedID: &objectID,
+		ThreadID:  owner.ThreadID,
+		Type:      models.LikeNotification,
+		Message:   message,
+	})
+}
+
+// NotifyDirectMessage notifies a user that they have received a direct message.
+func NotifyDirectMessage(db *sqlx.DB, actorID uuid.UUID, recipientID uuid.UUID, messageID int64) {
+	actorUsername, err := utils_db.FetchOne[string](db, "SELECT username FROM users WHERE id = $1", actorID)
+	if err != nil {
+		log.Printf("[NotifyDirectMessage] failed to fetch sender: %s\n", err.Error())
+		return
+	}
+
+	NotifyAndLog(db, models.Notification{
+		UserID:    recipientID,
+		ActorID:   &actorID,
+		RelatedID: &messageID,
+		Type:      models.DMNotification,
+		Message:   notificationMessage("%s sent you a message", actorUsername),
+	})
+}
+
+type notificationTarget struct {
+	UserID        uuid.UUID `db:"user_id"`
+	ThreadID      *int64    `db:"thread_id"`
+	ActorUsername string    `db:"actor_username"`
+}
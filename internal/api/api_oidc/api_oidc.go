@@ -0,0 +1,470 @@
+package api_oidc
+
+import (
+	"1chanserver/internal/api/api_user"
+	"1chanserver/internal/models"
+	"1chanserver/internal/models/api_error"
+	"1chanserver/internal/oidc"
+	"1chanserver/internal/utils/utils_auth"
+	"1chanserver/internal/utils/utils_db"
+	"1chanserver/internal/utils/utils_handler"
+	"database/sql"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// RedirectURL is the page of the client which providers redirect users back
+// to. It must be registered with every provider, and pass the code and state
+// it receives on to Callback.
+var RedirectURL string
+
+var errInvalidState = api_error.NewFromStr("invalid or expired sign in request", http.StatusUnauthorized)
+
+// Providers lists the names of the providers users can sign in with.
+func Providers(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"providers": oidc.Names(),
+	})
+}
+
+// Authorize starts signing in with the provider given by the provider path
+// parameter, and returns the URL to send the user to.
+func Authorize(c *gin.Context) {
+	authorize(c, nil)
+}
+
+// Link starts linking the provider given by the provider path parameter to
+// the user's account, and returns the URL to send the user to. The link is
+// made once they are redirected back and Callback is called.
+func Link(c *gin.Context) {
+	_, userID := utils_handler.GetReqCx(c)
+	authorize(c, &userID)
+}
+
+func authorize(c *gin.Context, userID *uuid.UUID) {
+	db := c.MustGet("db").(*sqlx.DB)
+
+	deviceID := c.GetHeader("Device-ID")
+	if deviceID == "" {
+		c.Error(api_error.NewFromStr("missing device ID", http.StatusBadRequest))
+		return
+	}
+
+	provider, ok := oidc.Get(c.Param("provider"))
+	if !ok {
+		c.Error(api_error.NewFromStr("unknown provider", http.StatusNotFound))
+		return
+	}
+
+	state, stateHash, err := utils_auth.GenerateOpaqueToken()
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	nonce, _, err := utils_auth.GenerateOpaqueToken()
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	codeVerifier, _, err := utils_auth.GenerateOpaqueToken()
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	authorizationURL, err := provider.AuthorizationURL(c.Request.Context(), RedirectURL, state, nonce, oidc.CodeChallenge(codeVerifier))
+	if err != nil {
+		c.Error(api_error.New(err, http.StatusBadGateway, "provider unavailable"))
+		return
+	}
+
+	expirationDate := time.Now().UTC().Add(models.OIDC_STATE_EXPIRATION)
+	_, err = db.Exec(`
+		INSERT INTO oidc_states(state_hash, provider, device_id, nonce, code_verifier, user_id, expiration_date)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		`, stateHash, provider.Name(), deviceID, nonce, codeVerifier, userID, expirationDate)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"authorization_url": authorizationURL,
+		"expiration_date":   expirationDate,
+	})
+}
+
+// Callback completes the authorization request identified by state with
+// the code the provider redirected the user back with. Depending on the
+// request and on whether the identity is already linked to an account, it
+// either links the provider to the user's account, signs the user in, or
+// responds with a registration token for them to pick a username with.
+func Callback(c *gin.Context) {
+	db := c.MustGet("db").(*sqlx.DB)
+	deviceID := c.GetHeader("Device-ID")
+
+	request, err := utils_handler.GetObj[models.OIDCCallbackRequest](c)
+	if err != nil {
+		c.Error(api_error.NewFromErr(err, http.StatusBadRequest))
+		return
+	}
+
+	// The state is consumed whatever the outcome, so that it cannot be
+	// used again
+	var state models.OIDCState
+	err = db.Get(&state, "DELETE FROM oidc_states WHERE state_hash = $1 RETURNING *", utils_auth.HashOpaqueToken(request.State))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = errInvalidState
+		}
+
+		c.Error(err)
+		return
+	}
+
+	if state.IsExpired() || state.DeviceID != deviceID {
+		c.Error(errInvalidState)
+		return
+	}
+
+	provider, ok := oidc.Get(state.Provider)
+	if !ok {
+		c.Error(api_error.NewFromStr("unknown provider", http.StatusNotFound))
+		return
+	}
+
+	identity, err := provider.Exchange(c.Request.Context(), RedirectURL, request.Code, state.CodeVerifier, state.Nonce)
+	if err != nil {
+		c.Error(api_error.New(err, http.StatusUnauthorized, "failed to sign in with provider"))
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	defer utils_db.HandleTxRollback(tx, &err, c)
+
+	if state.UserID != nil {
+		var linkedIdentity models.UserIdentity
+		linkedIdentity, err = linkIdentity(tx, *state.UserID, &identity)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"linked":   true,
+			"identity": linkedIdentity,
+		})
+		return
+	}
+
+	var user models.User
+	err = tx.Get(&user, `
+		SELECT users.* FROM users JOIN user_identities ON user_identities.user_id = users.id
+		WHERE user_identities.provider = $1 AND user_identities.subject = $2
+		`, identity.Provider, identity.Subject)
+	if err == nil {
+		err = api_user.CheckCanSignIn(&user)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		_, err = tx.Exec(
+			"UPDATE user_identities SET last_login_date = NOW() WHERE provider = $1 AND subject = $2",
+			identity.Provider, identity.Subject)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		err = api_user.SignInOrChallenge(c, tx, &user, deviceID)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		return
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		c.Error(err)
+		return
+	}
+
+	// The identity is not linked to any account yet. Accounts are never
+	// linked by matching emails, as the provider may not have verified it,
+	// so the user gets a new account once they pick a username.
+	registrationToken, tokenHash, err := utils_auth.GenerateOpaqueToken()
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	var email *string
+	if identity.Email != "" {
+		email = &identity.Email
+	}
+
+	expirationDate := time.Now().UTC().Add(models.OIDC_REGISTRATION_EXPIRATION)
+	_, err = tx.Exec(`
+		INSERT INTO oidc_registrations(token_hash, provider, subject, device_id, email, email_verified, expiration_date)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		`, tokenHash, identity.Provider, identity.Subject, deviceID, email, identity.EmailVerified, expirationDate)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"registration_required": true,
+		"registration_token":    registrationToken,
+		"suggested_username":    suggestUsername(&identity),
+		"email":                 email,
+		"expiration_date":       expirationDate,
+	})
+}
+
+// Register creates the account of a user who signed in with a provider for
+// the first time, under the username they picked, and signs them in. Their
+// email is saved along with it, and counts as verified when the provider
+// verified it and no other account has verified it already.
+func Register(c *gin.Context) {
+	db := c.MustGet("db").(*sqlx.DB)
+	deviceID := c.GetHeader("Device-ID")
+
+	request, err := utils_handler.GetObj[models.OIDCRegistrationRequest](c)
+	if err != nil {
+		c.Error(api_error.NewFromErr(err, http.StatusBadRequest))
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	defer utils_db.HandleTxRollback(tx, &err, c)
+
+	// The registration is only consumed once the account is created, so
+	// that the user can pick another username if theirs is taken
+	var registration models.OIDCRegistration
+	err = tx.Get(&registration,
+		"DELETE FROM oidc_registrations WHERE token_hash = $1 RETURNING *", utils_auth.HashOpaqueToken(request.RegistrationToken))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = api_error.NewFromStr("invalid or expired registration token", http.StatusUnauthorized)
+		}
+
+		c.Error(err)
+		return
+	}
+
+	if registration.IsExpired() || registration.DeviceID != deviceID {
+		err = api_error.NewFromStr("invalid or expired registration token", http.StatusUnauthorized)
+		c.Error(err)
+		return
+	}
+
+	user := models.User{
+		ID:       uuid.New(),
+		Username: strings.TrimSpace(request.Username),
+		Role:     models.RegularUserRole,
+	}
+
+	if user.Username == "" {
+		err = api_error.NewFromStr("username must not be blank", http.StatusBadRequest)
+		c.Error(err)
+		return
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO users(id, username, password_hash) VALUES ($1, $2, '')", user.ID, user.Username)
+	if err != nil {
+		if utils_db.CheckDuplicateError(err) {
+			err = api_error.NewFromStr("username already exists", http.StatusConflict)
+		}
+
+		c.Error(err)
+		return
+	}
+
+	emailVerified := false
+	if registration.Email != nil && registration.EmailVerified {
+		err = tx.Get(&emailVerified, `
+			SELECT NOT EXISTS (SELECT 1 FROM user_profiles WHERE lower(email) = lower($1) AND email_verified)
+			`, *registration.Email)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO user_profiles(id, creation_date, email, email_verified) VALUES ($1, $2, $3, $4)",
+		user.ID, time.Now().UTC(), registration.Email, emailVerified)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO user_identities(user_id, provider, subject, email, last_login_date)
+		VALUES ($1, $2, $3, $4, NOW())
+		`, user.ID, registration.Provider, registration.Subject, registration.Email)
+	if err != nil {
+		if utils_db.CheckDuplicateError(err) {
+			err = api_error.NewFromStr("this account is already registered", http.StatusConflict)
+		}
+
+		c.Error(err)
+		return
+	}
+
+	log.Printf("[Register] created user %s with %s identity\n", user.ID, registration.Provider)
+
+	err = api_user.SignIn(c, tx, &user, deviceID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+}
+
+// Identities lists the providers linked to the user's account.
+func Identities(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	identities, err := utils_db.FetchAll[models.UserIdentity](db,
+		"SELECT * FROM user_identities WHERE user_id = $1 ORDER BY creation_date", userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if identities == nil {
+		identities = make([]models.UserIdentity, 0)
+	}
+
+	c.JSON(http.StatusOK, identities)
+}
+
+// Unlink unlinks the provider given by the provider path parameter from the
+// user's account. The last provider of an account without a password or
+// passkey cannot be unlinked, as the user would have no way left to sign in.
+func Unlink(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	defer utils_db.HandleTxRollback(tx, &err, c)
+
+	// The user's row is locked so that concurrent requests cannot remove
+	// their last sign in methods together
+	_, err = tx.Exec("SELECT 1 FROM users WHERE id = $1 FOR UPDATE", userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	result, err := tx.Exec("DELETE FROM user_identities WHERE user_id = $1 AND provider = $2", userID, c.Param("provider"))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	unlinked, err := result.RowsAffected()
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if unlinked == 0 {
+		err = api_error.NewFromStr("provider not linked", http.StatusNotFound)
+		c.Error(err)
+		return
+	}
+
+	remaining, err := utils_db.CountSignInMethods(tx, userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if remaining == 0 {
+		err = api_error.NewFromStr("set a password or add a passkey before unlinking your last provider", http.StatusConflict)
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// linkIdentity links identity to the account of userID, unless it is
+// already linked to another account, or the account already has another
+// identity with the same provider.
+func linkIdentity(tx *sqlx.Tx, userID uuid.UUID, identity *oidc.Identity) (models.UserIdentity, error) {
+	var email *string
+	if identity.Email != "" {
+		email = &identity.Email
+	}
+
+	var linkedIdentity models.UserIdentity
+	err := tx.Get(&linkedIdentity, `
+		INSERT INTO user_identities(user_id, provider, subject, email)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (provider, subject) DO UPDATE SET email = EXCLUDED.email
+		WHERE user_identities.user_id = EXCLUDED.user_id
+		RETURNING *
+		`, userID, identity.Provider, identity.Subject, email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return linkedIdentity, api_error.NewFromStr("this account is linked to another user", http.StatusConflict)
+		}
+
+		if utils_db.CheckDuplicateError(err) {
+			return linkedIdentity, api_error.NewFromStr("another account of this provider is already linked", http.StatusConflict)
+		}
+
+		return linkedIdentity, err
+	}
+
+	return linkedIdentity, nil
+}
+
+// suggestUsername returns a username for the user to start from, based on
+// their preferred username or the local part of their email.
+func suggestUsername(identity *oidc.Identity) string {
+	suggestion := identity.PreferredUsername
+	if suggestion == "" {
+		suggestion, _, _ = strings.Cut(identity.Email, "@")
+	}
+
+	suggestion = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.' {
+			return r
+		}
+		return -1
+	}, suggestion)
+
+	runes := []rune(suggestion)
+	if len(runes) > models.OIDC_SUGGESTED_USERNAME_MAX_SIZE {
+		suggestion = string(runes[:models.OIDC_SUGGESTED_USERNAME_MAX_SIZE])
+	}
+
+	return suggestion
+}
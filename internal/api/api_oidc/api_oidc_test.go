@@ -0,0 +1,486 @@
+package api_oidc
+
+import (
+	"1chanserver/internal/middleware"
+	"1chanserver/internal/oidc"
+	"1chanserver/internal/utils/utils_auth"
+	"1chanserver/internal/utils/utils_jwks"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The tests run against the database of TEST_DATABASE_URL, in a schema of
+// their own which is dropped afterwards. They are skipped when it is unset.
+
+const (
+	testClientID      = "client"
+	testRedirectURL   = "https://1chan.test/oauth/callback"
+	testProvider      = "mock"
+	testOtherProvider = "other"
+	testDeviceID      = "device"
+)
+
+var (
+	testDB     *sqlx.DB
+	testMock   *mockProvider
+	testRouter *gin.Engine
+)
+
+func TestMain(m *testing.M) {
+	databaseURL := os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		fmt.Println("TEST_DATABASE_URL is not set, skipping database tests")
+		os.Exit(0)
+	}
+
+	os.Exit(run(m, databaseURL))
+}
+
+func run(m *testing.M, databaseURL string) int {
+	schema := "api_oidc_test_" + strings.ReplaceAll(uuid.NewString(), "-", "")
+
+	adminDB, err := sqlx.Connect("postgres", databaseURL)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer adminDB.Close()
+
+	_, err = adminDB.Exec("CREATE SCHEMA " + schema)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer adminDB.Exec("DROP SCHEMA " + schema + " CASCADE")
+
+	testDB, err = sqlx.Connect("postgres", withSearchPath(databaseURL, schema+",public"))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer testDB.Close()
+
+	err = loadSchema(testDB, "../../../setup.sql")
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	utils_auth.SigningKeys = utils_jwks.NewHMACKeySet([]byte("test secret"))
+	RedirectURL = testRedirectURL
+
+	testMock = newMockProvider()
+	defer testMock.server.Close()
+
+	oidc.Register(testMock.provider(testProvider))
+	oidc.Register(testMock.provider(testOtherProvider))
+
+	gin.SetMode(gin.TestMode)
+	testRouter = gin.New()
+	testRouter.Use(middleware.ErrorHandler(), middleware.DBProvider(testDB))
+	testRouter.POST("/oidc/:provider/authorize", Authorize)
+	testRouter.POST("/oidc/callback", Callback)
+	testRouter.POST("/oidc/register", Register)
+	testRouter.POST("/oidc/:provider/link", middleware.Auth(), Link)
+	testRouter.DELETE("/oidc/identities/:provider", middleware.Auth(), Unlink)
+
+	return m.Run()
+}
+
+// withSearchPath adds the search_path run-time parameter to databaseURL,
+// which is either a URL or a list of key=value settings.
+func withSearchPath(databaseURL string, searchPath string) string {
+	if !strings.Contains(databaseURL, "://") {
+		return databaseURL + " search_path=" + searchPath
+	}
+
+	separator := "?"
+	if strings.Contains(databaseURL, "?") {
+		separator = "&"
+	}
+	return databaseURL + separator + "search_path=" + url.QueryEscape(searchPath)
+}
+
+// loadSchema runs setup.sql, without the psql commands recreating and
+// connecting to the forum database at its top.
+func loadSchema(db *sqlx.DB, path string) error {
+	setup, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	_, schema, found := strings.Cut(string(setup), "\\c forum")
+	if !found {
+		return fmt.Errorf("%s does not connect to the forum database", path)
+	}
+
+	_, err = db.Exec(schema)
+	return err
+}
+
+// grant is an authorization granted by the user of subject, which a code
+// is exchanged for.
+type grant struct {
+	subject       string
+	nonce         string
+	codeChallenge string
+	redirectURI   string
+}
+
+// mockProvider is an OpenID Connect provider serving discovery, JWKS and
+// token endpoints, for public clients. Users are authorized through
+// authorize instead of an authorization endpoint.
+type mockProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu     sync.Mutex
+	grants map[string]grant // By code
+}
+
+func newMockProvider() *mockProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	m := &mockProvider{key: key, grants: make(map[string]grant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.server.URL,
+			"authorization_endpoint": m.server.URL + "/authorize",
+			"token_endpoint":         m.server.URL + "/token",
+			"jwks_uri":               m.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "key",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", m.token)
+
+	m.server = httptest.NewServer(mux)
+	return m
+}
+
+func (m *mockProvider) provider(name string) *oidc.OIDCProvider {
+	return &oidc.OIDCProvider{
+		ProviderName: name,
+		Issuer:       m.server.URL,
+		ClientID:     testClientID,
+		HTTPClient:   m.server.Client(),
+	}
+}
+
+// authorize has the user of subject grant the authorization request of
+// authorizationURL, and returns the code the client is redirected with.
+func (m *mockProvider) authorize(t *testing.T, authorizationURL string, subject string) string {
+	t.Helper()
+
+	parsed, err := url.Parse(authorizationURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := parsed.Query()
+	if query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("authorization request does not use PKCE: %s", authorizationURL)
+	}
+
+	code := uuid.NewString()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.grants[code] = grant{
+		subject:       subject,
+		nonce:         query.Get("nonce"),
+		codeChallenge: query.Get("code_challenge"),
+		redirectURI:   query.Get("redirect_uri"),
+	}
+	return code
+}
+
+func (m *mockProvider) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	m.mu.Lock()
+	grant, ok := m.grants[r.PostForm.Get("code")]
+	delete(m.grants, r.PostForm.Get("code"))
+	m.mu.Unlock()
+
+	if !ok || r.PostForm.Get("client_id") != testClientID || r.PostForm.Get("redirect_uri") != grant.redirectURI ||
+		oidc.CodeChallenge(r.PostForm.Get("code_verifier")) != grant.codeChallenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":                m.server.URL,
+		"sub":                grant.subject,
+		"aud":                testClientID,
+		"exp":                now.Add(time.Hour).Unix(),
+		"iat":                now.Unix(),
+		"nonce":              grant.nonce,
+		"email":              grant.subject + "@example.com",
+		"email_verified":     true,
+		"preferred_username": grant.subject,
+	})
+	token.Header["kid"] = "key"
+	idToken, err := token.SignedString(m.key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"id_token": idToken})
+}
+
+// request sends a JSON request to the test router on behalf of the user of
+// accessToken, if any, and decodes its response into a map.
+func request(t *testing.T, method string, path string, accessToken string, body interface{}) (int, map[string]interface{}) {
+	t.Helper()
+
+	var encoded []byte
+	if body != nil {
+		var err error
+		encoded, err = json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(encoded))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Device-ID", testDeviceID)
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	recorder := httptest.NewRecorder()
+	testRouter.ServeHTTP(recorder, req)
+
+	response := make(map[string]interface{})
+	if recorder.Body.Len() > 0 {
+		err := json.Unmarshal(recorder.Body.Bytes(), &response)
+		if err != nil {
+			t.Fatalf("%s %s: %v: %s", method, path, err, recorder.Body.String())
+		}
+	}
+
+	return recorder.Code, response
+}
+
+// signInWith goes through the authorization request of provider as the
+// user of subject, and returns the status and response of Callback.
+func signInWith(t *testing.T, provider string, accessToken string, subject string) (int, map[string]interface{}) {
+	t.Helper()
+
+	path := "/oidc/" + provider + "/authorize"
+	if accessToken != "" {
+		path = "/oidc/" + provider + "/link"
+	}
+
+	status, response := request(t, http.MethodPost, path, accessToken, nil)
+	if status != http.StatusOK {
+		t.Fatalf("POST %s = %d %v", path, status, response)
+	}
+
+	authorizationURL := response["authorization_url"].(string)
+	code := testMock.authorize(t, authorizationURL, subject)
+
+	parsed, _ := url.Parse(authorizationURL)
+	return request(t, http.MethodPost, "/oidc/callback", "", map[string]string{
+		"code":  code,
+		"state": parsed.Query().Get("state"),
+	})
+}
+
+// register signs up the user of subject with the mock provider, and returns
+// their ID and access token.
+func register(t *testing.T, subject string) (uuid.UUID, string) {
+	t.Helper()
+
+	status, response := signInWith(t, testProvider, "", subject)
+	if status != http.StatusAccepted || response["registration_required"] != true {
+		t.Fatalf("Callback() = %d %v, want registration", status, response)
+	}
+
+	status, response = request(t, http.MethodPost, "/oidc/register", "", map[string]string{
+		"registration_token": response["registration_token"].(string),
+		"username":           subject,
+	})
+	if status != http.StatusOK {
+		t.Fatalf("Register() = %d %v", status, response)
+	}
+
+	userID := uuid.MustParse(response["uuid"].(string))
+	accessToken := response["account"].(map[string]interface{})["access_token"].(string)
+	return userID, accessToken
+}
+
+func newSubject() string {
+	return "user_" + strings.ReplaceAll(uuid.NewString(), "-", "")[:16]
+}
+
+func TestCallbackRegistration(t *testing.T) {
+	subject := newSubject()
+
+	status, response := signInWith(t, testProvider, "", subject)
+	if status != http.StatusAccepted {
+		t.Fatalf("Callback() = %d %v", status, response)
+	}
+
+	if response["registration_required"] != true || response["registration_token"] == "" {
+		t.Errorf("Callback() = %v, want a registration token", response)
+	}
+	if response["suggested_username"] != subject {
+		t.Errorf("suggested_username = %v, want %q", response["suggested_username"], subject)
+	}
+	if response["email"] != subject+"@example.com" {
+		t.Errorf("email = %v, want %q", response["email"], subject+"@example.com")
+	}
+
+	var users int
+	err := testDB.Get(&users, "SELECT COUNT(*) FROM user_identities WHERE provider = $1 AND subject = $2", testProvider, subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users != 0 {
+		t.Errorf("identity linked before registering")
+	}
+}
+
+func TestCallbackSignIn(t *testing.T) {
+	subject := newSubject()
+	userID, _ := register(t, subject)
+
+	status, response := signInWith(t, testProvider, "", subject)
+	if status != http.StatusOK {
+		t.Fatalf("Callback() = %d %v", status, response)
+	}
+
+	if response["uuid"] != userID.String() {
+		t.Errorf("signed in as %v, want %s", response["uuid"], userID)
+	}
+
+	account, _ := response["account"].(map[string]interface{})
+	if account["access_token"] == nil || account["access_token"] == "" {
+		t.Errorf("Callback() = %v, want an access token", response)
+	}
+}
+
+func TestCallbackLink(t *testing.T) {
+	userID, accessToken := register(t, newSubject())
+
+	otherSubject := newSubject()
+	status, response := signInWith(t, testOtherProvider, accessToken, otherSubject)
+	if status != http.StatusOK || response["linked"] != true {
+		t.Fatalf("Callback() = %d %v, want linked", status, response)
+	}
+
+	var linkedUserID uuid.UUID
+	err := testDB.Get(&linkedUserID,
+		"SELECT user_id FROM user_identities WHERE provider = $1 AND subject = $2", testOtherProvider, otherSubject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linkedUserID != userID {
+		t.Errorf("identity linked to %s, want %s", linkedUserID, userID)
+	}
+
+	// An identity linked to an account cannot be linked to another
+	_, secondAccessToken := register(t, newSubject())
+	status, response = signInWith(t, testOtherProvider, secondAccessToken, otherSubject)
+	if status != http.StatusConflict {
+		t.Errorf("linking an identity of another user = %d %v, want %d", status, response, http.StatusConflict)
+	}
+}
+
+func TestCallbackReplayedState(t *testing.T) {
+	status, response := request(t, http.MethodPost, "/oidc/"+testProvider+"/authorize", "", nil)
+	if status != http.StatusOK {
+		t.Fatalf("Authorize() = %d %v", status, response)
+	}
+
+	authorizationURL := response["authorization_url"].(string)
+	parsed, _ := url.Parse(authorizationURL)
+	state := parsed.Query().Get("state")
+
+	status, response = request(t, http.MethodPost, "/oidc/callback", "", map[string]string{
+		"code":  testMock.authorize(t, authorizationURL, newSubject()),
+		"state": state,
+	})
+	if status != http.StatusAccepted {
+		t.Fatalf("Callback() = %d %v", status, response)
+	}
+
+	// Replayed with a fresh code, so that it is the state which is rejected
+	status, response = request(t, http.MethodPost, "/oidc/callback", "", map[string]string{
+		"code":  testMock.authorize(t, authorizationURL, newSubject()),
+		"state": state,
+	})
+	if status != http.StatusUnauthorized {
+		t.Errorf("replayed Callback() = %d %v, want %d", status, response, http.StatusUnauthorized)
+	}
+}
+
+func TestUnlinkLastMethod(t *testing.T) {
+	userID, accessToken := register(t, newSubject())
+
+	status, response := request(t, http.MethodDelete, "/oidc/identities/"+testProvider, accessToken, nil)
+	if status != http.StatusConflict {
+		t.Fatalf("unlinking the last method = %d %v, want %d", status, response, http.StatusConflict)
+	}
+
+	var identities int
+	err := testDB.Get(&identities, "SELECT COUNT(*) FROM user_identities WHERE user_id = $1", userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identities != 1 {
+		t.Fatalf("%d identities left after a refused unlink, want 1", identities)
+	}
+
+	status, response = signInWith(t, testOtherProvider, accessToken, newSubject())
+	if status != http.StatusOK {
+		t.Fatalf("Callback() = %d %v", status, response)
+	}
+
+	status, response = request(t, http.MethodDelete, "/oidc/identities/"+testProvider, accessToken, nil)
+	if status != http.StatusOK {
+		t.Errorf("unlinking with another method left = %d %v, want %d", status, response, http.StatusOK)
+	}
+
+	status, response = request(t, http.MethodDelete, "/oidc/identities/"+testProvider, accessToken, nil)
+	if status != http.StatusNotFound {
+		t.Errorf("unlinking an unlinked provider = %d %v, want %d", status, response, http.StatusNotFound)
+	}
+}
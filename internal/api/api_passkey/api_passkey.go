@@ -0,0 +1,456 @@
+package api_passkey
+
+import (
+	"1chanserver/internal/api/api_user"
+	"1chanserver/internal/models"
+	"1chanserver/internal/models/api_error"
+	"1chanserver/internal/utils/utils_db"
+	"1chanserver/internal/utils/utils_handler"
+	"1chanserver/internal/webauthn"
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RelyingParty is the site passkeys are registered with.
+var RelyingParty webauthn.RelyingParty
+
+var (
+	errInvalidChallenge = api_error.NewFromStr("invalid or expired challenge", http.StatusUnauthorized)
+	errInvalidPasskey   = api_error.NewFromStr("invalid passkey", http.StatusUnauthorized)
+)
+
+// BeginRegistration starts registering a passkey for the user, and returns
+// the options to pass to navigator.credentials.create().
+func BeginRegistration(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	deviceID := c.GetHeader("Device-ID")
+	if deviceID == "" {
+		c.Error(api_error.NewFromStr("missing device ID", http.StatusBadRequest))
+		return
+	}
+
+	username, err := utils_db.FetchOne[string](db, "SELECT username FROM users WHERE id = $1", userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	// The user's passkeys are excluded, so that an authenticator which
+	// holds one of them is not registered twice
+	credentialIDs, err := utils_db.FetchAll[string](db, "SELECT credential_id FROM passkeys WHERE user_id = $1", userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	excludeCredentials := make([]gin.H, 0, len(credentialIDs))
+	for _, credentialID := range credentialIDs {
+		excludeCredentials = append(excludeCredentials, gin.H{"type": "public-key", "id": credentialID})
+	}
+
+	challenge, err := createChallenge(db, models.PasskeyRegistration, &userID, deviceID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	pubKeyCredParams := make([]gin.H, 0, len(webauthn.SupportedAlgorithms))
+	for _, algorithm := range webauthn.SupportedAlgorithms {
+		pubKeyCredParams = append(pubKeyCredParams, gin.H{"type": "public-key", "alg": algorithm})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"rp": gin.H{
+			"id":   RelyingParty.ID,
+			"name": RelyingParty.Name,
+		},
+		"user": gin.H{
+			"id":          base64.RawURLEncoding.EncodeToString(userID[:]),
+			"name":        username,
+			"displayName": username,
+		},
+		"challenge":          challenge,
+		"pubKeyCredParams":   pubKeyCredParams,
+		"timeout":            models.PASSKEY_CHALLENGE_EXPIRATION.Milliseconds(),
+		"excludeCredentials": excludeCredentials,
+		"authenticatorSelection": gin.H{
+			"residentKey":      "required",
+			"userVerification": "required",
+		},
+		"attestation": "none",
+	})
+}
+
+// FinishRegistration verifies the passkey created with the options returned
+// by BeginRegistration, and saves it under the given name.
+func FinishRegistration(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+	deviceID := c.GetHeader("Device-ID")
+
+	request, err := utils_handler.GetObj[models.PasskeyRegistrationRequest](c)
+	if err != nil {
+		c.Error(api_error.NewFromErr(err, http.StatusBadRequest))
+		return
+	}
+
+	name := strings.TrimSpace(request.Name)
+	if name == "" {
+		name = "Passkey"
+	}
+
+	if len([]rune(name)) > models.PASSKEY_NAME_MAX_SIZE {
+		c.Error(api_error.NewFromStr("name is too long", http.StatusBadRequest))
+		return
+	}
+
+	if request.Credential.Type != "public-key" {
+		c.Error(api_error.NewFromStr("unsupported credential type", http.StatusBadRequest))
+		return
+	}
+
+	rawID, errID := webauthn.DecodeBase64URL(request.Credential.RawID)
+	clientDataJSON, errClientData := webauthn.DecodeBase64URL(request.Credential.Response.ClientDataJSON)
+	attestationObject, errAttestation := webauthn.DecodeBase64URL(request.Credential.Response.AttestationObject)
+	if errors.Join(errID, errClientData, errAttestation) != nil {
+		c.Error(api_error.NewFromStr("malformed credential", http.StatusBadRequest))
+		return
+	}
+
+	clientData, err := RelyingParty.ParseClientData(clientDataJSON, webauthn.CeremonyCreate)
+	if err != nil {
+		c.Error(api_error.NewFromErr(err, http.StatusBadRequest))
+		return
+	}
+
+	challenge, err := consumeChallenge(db, clientData.Challenge, models.PasskeyRegistration, deviceID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if challenge.UserID == nil || *challenge.UserID != userID {
+		c.Error(errInvalidChallenge)
+		return
+	}
+
+	authData, err := RelyingParty.VerifyRegistration(attestationObject, true)
+	if err != nil {
+		c.Error(api_error.NewFromErr(err, http.StatusBadRequest))
+		return
+	}
+
+	// The passkey is saved under the ID attested by the authenticator, which
+	// is the one it will be looked up by when signing in
+	if !bytes.Equal(rawID, authData.CredentialID) {
+		c.Error(api_error.NewFromStr("credential ID does not match the attested credential", http.StatusBadRequest))
+		return
+	}
+
+	transports := request.Credential.Response.Transports
+	if transports == nil {
+		transports = make([]string, 0)
+	}
+
+	passkey := models.Passkey{
+		UserID:       userID,
+		CredentialID: base64.RawURLEncoding.EncodeToString(authData.CredentialID),
+		PublicKey:    authData.PublicKey,
+		SignCount:    int64(authData.SignCount),
+		Transports:   transports,
+		Name:         name,
+		BackedUp:     authData.HasFlag(webauthn.FlagBackedUp),
+	}
+
+	err = db.Get(&passkey, `
+		INSERT INTO passkeys(user_id, credential_id, public_key, sign_count, transports, name, backed_up)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING *
+		`, passkey.UserID, passkey.CredentialID, passkey.PublicKey, passkey.SignCount, passkey.Transports,
+		passkey.Name, passkey.BackedUp)
+	if err != nil {
+		if utils_db.CheckDuplicateError(err) {
+			c.Error(api_error.NewFromStr("passkey already registered", http.StatusConflict))
+			return
+		}
+
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, passkey)
+}
+
+// BeginLogin starts signing in with a passkey, and returns the options to
+// pass to navigator.credentials.get(). No credentials are listed, so that
+// the user picks one of the passkeys their authenticator holds for the site
+// without giving their username first.
+func BeginLogin(c *gin.Context) {
+	db := c.MustGet("db").(*sqlx.DB)
+
+	deviceID := c.GetHeader("Device-ID")
+	if deviceID == "" {
+		c.Error(api_error.NewFromStr("missing device ID", http.StatusBadRequest))
+		return
+	}
+
+	challenge, err := createChallenge(db, models.PasskeyAuthentication, nil, deviceID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"challenge":        challenge,
+		"rpId":             RelyingParty.ID,
+		"timeout":          models.PASSKEY_CHALLENGE_EXPIRATION.Milliseconds(),
+		"allowCredentials": make([]gin.H, 0),
+		"userVerification": "required",
+	})
+}
+
+// FinishLogin verifies the assertion made with the options returned by
+// BeginLogin, and signs in the user the passkey belongs to with the same
+// tokens as api_user.Login. As the authenticator verified the user, the
+// passkey counts as two factors, and no TOTP code is asked for.
+func FinishLogin(c *gin.Context) {
+	db := c.MustGet("db").(*sqlx.DB)
+	deviceID := c.GetHeader("Device-ID")
+
+	request, err := utils_handler.GetObj[models.PasskeyLoginRequest](c)
+	if err != nil {
+		c.Error(api_error.NewFromErr(err, http.StatusBadRequest))
+		return
+	}
+
+	if request.Type != "public-key" {
+		c.Error(api_error.NewFromStr("unsupported credential type", http.StatusBadRequest))
+		return
+	}
+
+	rawID, errID := webauthn.DecodeBase64URL(request.RawID)
+	clientDataJSON, errClientData := webauthn.DecodeBase64URL(request.Response.ClientDataJSON)
+	authenticatorData, errAuthData := webauthn.DecodeBase64URL(request.Response.AuthenticatorData)
+	signature, errSignature := webauthn.DecodeBase64URL(request.Response.Signature)
+	userHandle, errUserHandle := webauthn.DecodeBase64URL(request.Response.UserHandle)
+	if errors.Join(errID, errClientData, errAuthData, errSignature, errUserHandle) != nil {
+		c.Error(api_error.NewFromStr("malformed credential", http.StatusBadRequest))
+		return
+	}
+
+	clientData, err := RelyingParty.ParseClientData(clientDataJSON, webauthn.CeremonyGet)
+	if err != nil {
+		c.Error(api_error.NewFromErr(err, http.StatusBadRequest))
+		return
+	}
+
+	_, err = consumeChallenge(db, clientData.Challenge, models.PasskeyAuthentication, deviceID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	defer utils_db.HandleTxRollback(tx, &err, c)
+
+	var passkey models.Passkey
+	err = tx.Get(&passkey, "SELECT * FROM passkeys WHERE credential_id = $1 FOR UPDATE",
+		base64.RawURLEncoding.EncodeToString(rawID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = errInvalidPasskey
+		}
+
+		c.Error(err)
+		return
+	}
+
+	if len(userHandle) != 0 && string(userHandle) != string(passkey.UserID[:]) {
+		err = errInvalidPasskey
+		c.Error(err)
+		return
+	}
+
+	authData, err := RelyingParty.VerifyAssertion(passkey.PublicKey, authenticatorData, clientDataJSON, signature, true)
+	if err != nil {
+		log.Printf("[FinishLogin] rejected assertion of passkey %d: %s\n", passkey.ID, err.Error())
+		err = errInvalidPasskey
+		c.Error(err)
+		return
+	}
+
+	// Authenticators which count signatures must always report a higher
+	// count than before. A lower one means that the passkey was cloned, which
+	// the user is warned about. The event is committed, so err is left unset.
+	signCount := int64(authData.SignCount)
+	if (signCount != 0 || passkey.SignCount != 0) && signCount <= passkey.SignCount {
+		err = utils_db.InsertSecurityEvent(passkey.UserID, models.PasskeyCloneSuspectedEvent, deviceID,
+			utils_handler.GetSessionClient(c), tx)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		log.Printf("[FinishLogin] rejected passkey %d of user %s: sign count went from %d to %d\n",
+			passkey.ID, passkey.UserID, passkey.SignCount, signCount)
+		c.Error(errInvalidPasskey)
+		return
+	}
+
+	_, err = tx.Exec("UPDATE passkeys SET sign_count = $1, backed_up = $2, last_used_date = NOW() WHERE id = $3",
+		signCount, authData.HasFlag(webauthn.FlagBackedUp), passkey.ID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	var user models.User
+	err = tx.Get(&user, "SELECT * FROM users WHERE id = $1", passkey.UserID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	err = api_user.CheckCanSignIn(&user)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	err = api_user.SignIn(c, tx, &user, deviceID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+}
+
+// List returns the user's passkeys, most recently created first.
+func List(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	passkeys, err := utils_db.FetchAll[models.Passkey](db,
+		"SELECT * FROM passkeys WHERE user_id = $1 ORDER BY creation_date DESC", userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if passkeys == nil {
+		passkeys = make([]models.Passkey, 0)
+	}
+
+	c.JSON(http.StatusOK, passkeys)
+}
+
+// Remove removes one of the user's passkeys, unless it is the only way they
+// have left to sign in.
+func Remove(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	passkeyID, err := strconv.ParseInt(c.Param("passkeyID"), 10, 64)
+	if err != nil {
+		c.Error(api_error.NewFromStr("invalid passkey ID", http.StatusBadRequest))
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	defer utils_db.HandleTxRollback(tx, &err, c)
+
+	// The user's row is locked so that concurrent requests cannot remove
+	// their last sign in methods together
+	_, err = tx.Exec("SELECT 1 FROM users WHERE id = $1 FOR UPDATE", userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	result, err := tx.Exec("DELETE FROM passkeys WHERE id = $1 AND user_id = $2", passkeyID, userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	removed, err := result.RowsAffected()
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if removed == 0 {
+		err = api_error.NewFromStr("passkey not found", http.StatusNotFound)
+		c.Error(err)
+		return
+	}
+
+	remaining, err := utils_db.CountSignInMethods(tx, userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if remaining == 0 {
+		err = api_error.NewFromStr("set a password or link a provider before removing your last passkey", http.StatusConflict)
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// createChallenge returns a new challenge for a ceremony on deviceID.
+func createChallenge(db *sqlx.DB, ceremony models.WebAuthnCeremony, userID *uuid.UUID, deviceID string) (string, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO webauthn_challenges(challenge, ceremony, user_id, device_id, expiration_date) VALUES ($1, $2, $3, $4, $5)",
+		challenge, ceremony, userID, deviceID, time.Now().UTC().Add(models.PASSKEY_CHALLENGE_EXPIRATION))
+	if err != nil {
+		return "", err
+	}
+
+	return challenge, nil
+}
+
+// consumeChallenge deletes the challenge so that it cannot be used again,
+// and returns it if it is unexpired and was issued for the ceremony on
+// deviceID.
+func consumeChallenge(db *sqlx.DB, challenge string, ceremony models.WebAuthnCeremony, deviceID string) (models.PasskeyChallenge, error) {
+	var storedChallenge models.PasskeyChallenge
+	err := db.Get(&storedChallenge, "DELETE FROM webauthn_challenges WHERE challenge = $1 RETURNING *", challenge)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return storedChallenge, errInvalidChallenge
+		}
+
+		return storedChallenge, err
+	}
+
+	if storedChallenge.IsExpired() || storedChallenge.Ceremony != ceremony || storedChallenge.DeviceID != deviceID {
+		return storedChallenge, errInvalidChallenge
+	}
+
+	return storedChallenge, nil
+}
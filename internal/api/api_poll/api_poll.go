@@ -0,0 +1,274 @@
+package api_poll
+
+import (
+	"1chanserver/internal/models"
+	"1chanserver/internal/models/api_error"
+	"1chanserver/internal/utils/utils_db"
+	"1chanserver/internal/utils/utils_handler"
+	"database/sql"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Insert validates pollRequest and creates the poll and its options for
+// the thread with the given threadID as part of tx.
+func Insert(tx *sqlx.Tx, threadID int, pollRequest *models.PollRequest) error {
+	question := strings.TrimSpace(pollRequest.Question)
+	if question == "" {
+		return api_error.NewFromStr("missing poll question", http.StatusBadRequest)
+	}
+
+	if len(pollRequest.Options) < models.POLL_MIN_OPTIONS || len(pollRequest.Options) > models.POLL_MAX_OPTIONS {
+		return api_error.NewFromStr("invalid number of poll options", http.StatusBadRequest)
+	}
+
+	maxChoice := pollRequest.MaxChoice
+	if maxChoice == 0 {
+		maxChoice = 1
+	}
+
+	if maxChoice < 1 || maxChoice > len(pollRequest.Options) {
+		return api_error.NewFromStr("invalid poll max choice", http.StatusBadRequest)
+	}
+
+	if pollRequest.CloseDate != nil && pollRequest.CloseDate.Before(time.Now().UTC()) {
+		return api_error.NewFromStr("poll close date is in the past", http.StatusBadRequest)
+	}
+
+	var pollID int64
+	err := tx.QueryRowx(
+		"INSERT INTO polls(thread_id, question, close_date, max_choice, hide_results_until_voted) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		threadID, question, pollRequest.CloseDate, maxChoice, pollRequest.HideResultsUntilVoted).Scan(&pollID)
+	if err != nil {
+		return err
+	}
+
+	for i, option := range pollRequest.Options {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			return api_error.NewFromStr("empty poll option", http.StatusBadRequest)
+		}
+
+		_, err = tx.Exec(
+			"INSERT INTO poll_options(poll_id, option_id, option_text) VALUES ($1, $2, $3)",
+			pollID, i+1, option)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FetchByThread returns the poll attached to a thread as seen by userID,
+// or nil if the thread has no poll. userID may be nil for anonymous users.
+func FetchByThread(db *sqlx.DB, threadID int, userID *uuid.UUID) (*models.PollView, error) {
+	poll, err := utils_db.FetchOne[models.Poll](db, "SELECT * FROM polls WHERE thread_id = $1", threadID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return fetchView(db, poll, userID)
+}
+
+func fetchView(db *sqlx.DB, poll models.Poll, userID *uuid.UUID) (*models.PollView, error) {
+	options, err := utils_db.FetchAll[models.PollOption](db,
+		"SELECT * FROM poll_options WHERE poll_id = $1 ORDER BY option_id", poll.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	userVotes := []int{}
+	if userID != nil {
+		userVotes, err = utils_db.FetchAll[int](db,
+			"SELECT poll_option_id FROM user_poll_votes WHERE poll_id = $1 AND user_id = $2 ORDER BY poll_option_id",
+			poll.ID, *userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pollView := models.PollView{
+		Poll:      poll,
+		IsClosed:  poll.Closed(),
+		Options:   options,
+		UserVotes: userVotes,
+	}
+
+	// Results are hidden until the caller has voted, unless the poll is closed
+	if poll.HideResultsUntilVoted && len(userVotes) == 0 && !pollView.IsClosed {
+		for i := range pollView.Options {
+			pollView.Options[i].VoteCount = nil
+		}
+
+		return &pollView, nil
+	}
+
+	totalVoters, err := utils_db.FetchOne[int](db,
+		"SELECT COUNT(DISTINCT user_id) FROM user_poll_votes WHERE poll_id = $1", poll.ID)
+	if err != nil {
+		return nil, err
+	}
+	pollView.TotalVoters = &totalVoters
+
+	return &pollView, nil
+}
+
+func View() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := c.MustGet("db").(*sqlx.DB)
+
+		pollID, err := strconv.ParseInt(c.Param("pollID"), 10, 64)
+		if err != nil {
+			c.Error(api_error.NewFromStr("invalid poll id", http.StatusBadRequest))
+			return
+		}
+
+		// Polls of deleted threads are hidden along with them
+		poll, err := utils_db.FetchOne[models.Poll](db, `
+			SELECT p.* FROM polls p JOIN threads t ON t.id = p.thread_id
+			WHERE p.id = $1 AND t.deleted_at IS NULL
+			`, pollID)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		pollView, err := fetchView(db, poll, utils_handler.GetOptionalUserID(c))
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		c.JSON(http.StatusOK, pollView)
+	}
+}
+
+// Vote casts the user's votes on a poll, replacing any votes they have
+// previously cast on it.
+func Vote(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	pollID, err := strconv.ParseInt(c.Param("pollID"), 10, 64)
+	if err != nil {
+		c.Error(api_error.NewFromStr("invalid poll id", http.StatusBadRequest))
+		return
+	}
+
+	voteRequest, err := utils_handler.GetObj[models.PollVoteRequest](c)
+	if err != nil {
+		c.Error(api_error.NewFromStr("invalid object", http.StatusBadRequest))
+		return
+	}
+
+	if len(voteRequest.Options) == 0 {
+		c.Error(api_error.NewFromStr("no poll option chosen", http.StatusBadRequest))
+		return
+	}
+
+	seen := make(map[int]bool)
+	for _, option := range voteRequest.Options {
+		if seen[option] {
+			c.Error(api_error.NewFromStr("duplicate poll option chosen", http.StatusBadRequest))
+			return
+		}
+		seen[option] = true
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	defer utils_db.HandleTxRollback(tx, &err, c)
+
+	// The poll is locked so that concurrent votes of the user cannot each
+	// replace their previous votes, and add up to more than MaxChoice
+	var poll models.Poll
+	err = tx.Get(&poll, `
+		SELECT p.* FROM polls p JOIN threads t ON t.id = p.thread_id
+		WHERE p.id = $1 AND t.deleted_at IS NULL
+		FOR UPDATE OF p
+		`, pollID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if poll.Closed() {
+		err = api_error.NewFromStr("poll is closed", http.StatusForbidden)
+		c.Error(err)
+		return
+	}
+
+	if len(voteRequest.Options) > poll.MaxChoice {
+		err = api_error.NewFromStr("too many poll options chosen", http.StatusBadRequest)
+		c.Error(err)
+		return
+	}
+
+	_, err = tx.Exec("DELETE FROM user_poll_votes WHERE poll_id = $1 AND user_id = $2", pollID, userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	for _, option := range voteRequest.Options {
+		_, err = tx.Exec(
+			"INSERT INTO user_poll_votes(user_id, poll_id, poll_option_id) VALUES ($1, $2, $3)",
+			userID, pollID, option)
+		if err != nil {
+			if utils_db.CheckForeignKeyError(err) {
+				err = api_error.NewFromStr("invalid poll option", http.StatusBadRequest)
+			}
+
+			c.Error(err)
+			return
+		}
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func Retract(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	pollID, err := strconv.ParseInt(c.Param("pollID"), 10, 64)
+	if err != nil {
+		c.Error(api_error.NewFromStr("invalid poll id", http.StatusBadRequest))
+		return
+	}
+
+	poll, err := utils_db.FetchOne[models.Poll](db, `
+		SELECT p.* FROM polls p JOIN threads t ON t.id = p.thread_id
+		WHERE p.id = $1 AND t.deleted_at IS NULL
+		`, pollID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if poll.Closed() {
+		c.Error(api_error.NewFromStr("poll is closed", http.StatusForbidden))
+		return
+	}
+
+	_, err = db.Exec("DELETE FROM user_poll_votes WHERE poll_id = $1 AND user_id = $2", pollID, userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,722 @@
+package api_search
+
+import (
+	"1chanserver/internal/api/api_notification"
+	"1chanserver/internal/models"
+	"1chanserver/internal/models/api_error"
+	"1chanserver/internal/utils/utils_db"
+	"1chanserver/internal/utils/utils_handler"
+	"1chanserver/internal/utils/utils_search"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Search searches threads, comments, users and custom tags at once. The type
+// parameter restricts the results to a single type, while the counts of every
+// type are always returned so that clients can display them as tabs.
+func Search() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := c.MustGet("db").(*sqlx.DB)
+
+		q := strings.TrimSpace(c.Query("q"))
+		if q == "" {
+			c.Error(api_error.NewFromStr("missing search query", http.StatusBadRequest))
+			return
+		}
+
+		searchType := models.SearchType(c.DefaultQuery("type", string(models.AllSearch)))
+		if !searchType.IsValid() {
+			c.Error(api_error.NewFromStr("invalid search type", http.StatusBadRequest))
+			return
+		}
+
+		pageInt, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+		if err != nil || pageInt <= 0 {
+			c.Error(api_error.InvalidPageReq)
+			return
+		}
+
+		query, err := utils_search.Parse(q)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		query.Languages, err = utils_search.ParseLanguage(c.Query("lang"))
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		if pageInt == 1 {
+			RecordSearch(db, utils_handler.GetOptionalUserID(c), q)
+		}
+
+		offset := (pageInt - 1) * models.DEFAULT_PAGE_SIZE
+
+		var response models.SearchResponse
+
+		// Threads and comments are matched against the whole query, while users
+		// and tags, which are not full-text indexed, only by its plain terms
+		threadColumns := utils_search.Columns{
+			SearchVector: "t.search_vector",
+			UserID:       "t.user_id",
+			ThreadID:     "t.id",
+			CreationDate: "t.creation_date",
+			Language:     "t.lang",
+		}
+		commentColumns := utils_search.Columns{
+			SearchVector: "cm.search_vector",
+			UserID:       "cm.user_id",
+			ThreadID:     "cm.thread_id",
+			CreationDate: "cm.creation_date",
+			Language:     "cm.lang",
+		}
+
+		// Filters such as author: or tag: only apply to threads and comments
+		terms := query.Terms()
+		matchesPeople := terms != "" && len(query.Authors) == 0 && len(query.Tags) == 0 &&
+			query.After == nil && query.Before == nil && len(query.Languages) == 0
+		pattern := utils_db.ContainsPattern(terms)
+
+		var countArgs []interface{}
+		threadCountConditions := strings.Join(
+			append(query.Conditions(threadColumns, &countArgs), visibleThreadCondition), " AND ")
+		commentCountConditions := strings.Join(
+			append(query.Conditions(commentColumns, &countArgs), visibleCommentCondition), " AND ")
+
+		userCountQuery, tagCountQuery := "0", "0"
+		if matchesPeople {
+			countArgs = append(countArgs, terms, pattern)
+			userCountQuery = fmt.Sprintf(`
+				SELECT COUNT(*) FROM users u JOIN user_profiles up ON up.id = u.id
+				WHERE (up.search_vector @@ plainto_tsquery('english', $%d) OR u.username ILIKE $%d) AND %s
+				`, len(countArgs)-1, len(countArgs), visibleUserCondition)
+			tagCountQuery = fmt.Sprintf("SELECT COUNT(*) FROM custom_tags ct WHERE ct.tag ILIKE $%d", len(countArgs))
+		}
+
+		response.Counts, err = utils_db.FetchOne[models.SearchCounts](db, fmt.Sprintf(`
+			SELECT
+				(SELECT COUNT(*) FROM threads t WHERE %s) AS threads,
+				(SELECT COUNT(*) FROM comments cm WHERE %s) AS comments,
+				(%s) AS users,
+				(%s) AS tags
+			`, threadCountConditions, commentCountConditions, userCountQuery, tagCountQuery), countArgs...)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		if searchType.Includes(models.ThreadSearch) {
+			args := []interface{}{models.DEFAULT_PAGE_SIZE, offset}
+			fullText := query.FullText(threadColumns, &args)
+			conditions := append(searchConditions(fullText, query.Filters(threadColumns, &args)), visibleThreadCondition)
+			headline := fullText.Headline("t.title || ' ' || t.original_post", models.SEARCH_HEADLINE_OPTIONS, &args)
+
+			response.Threads, err = utils_db.FetchAll[models.ThreadSearchResult](db, fmt.Sprintf(`
+				SELECT
+					t.id, t.title, u.username, ch.name AS channel, t.creation_date, t.like_count, t.comment_count,
+					t.lang, %s AS rank, %s AS headline
+				FROM threads t
+				JOIN users u ON u.id = t.user_id
+				LEFT JOIN channels ch ON ch.id = t.channel_id
+				WHERE %s
+				ORDER BY rank DESC, t.id DESC
+				LIMIT $1 OFFSET $2
+				`, fullText.Rank(), headline, strings.Join(conditions, " AND ")), args...)
+			if err != nil {
+				c.Error(err)
+				return
+			}
+
+			for i := range response.Threads {
+				response.Threads[i].Headline = models.FormatSearchHeadline(response.Threads[i].Headline)
+			}
+		}
+
+		if searchType.Includes(models.CommentSearch) {
+			args := []interface{}{models.DEFAULT_PAGE_SIZE, offset}
+			fullText := query.FullText(commentColumns, &args)
+			conditions := append(searchConditions(fullText, query.Filters(commentColumns, &args)), visibleCommentCondition)
+			headline := fullText.Headline("cm.comment", models.SEARCH_HEADLINE_OPTIONS, &args)
+
+			response.Comments, err = utils_db.FetchAll[models.CommentSearchResult](db, fmt.Sprintf(`
+				SELECT
+					cm.id, cm.thread_id, t.title AS thread_title, u.username, cm.creation_date, cm.like_count,
+					cm.lang, %s AS rank, %s AS headline
+				FROM comments cm
+				JOIN threads t ON t.id = cm.thread_id
+				JOIN users u ON u.id = cm.user_id
+				WHERE %s
+				ORDER BY rank DESC, cm.id DESC
+				LIMIT $1 OFFSET $2
+				`, fullText.Rank(), headline, strings.Join(conditions, " AND ")), args...)
+			if err != nil {
+				c.Error(err)
+				return
+			}
+
+			for i := range response.Comments {
+				response.Comments[i].Headline = models.FormatSearchHeadline(response.Comments[i].Headline)
+			}
+		}
+
+		if searchType.Includes(models.UserSearch) && matchesPeople {
+			// Exact username matches come first, then biodata matches by relevance
+			response.Users, err = utils_db.FetchAll[models.UserSearchResult](db, `
+				SELECT
+					u.username, up.profile_picture_path, up.post_count, up.comment_count,
+					ts_headline('english', up.biodata, q, $3) AS headline
+				FROM users u
+				JOIN user_profiles up ON up.id = u.id
+				CROSS JOIN plainto_tsquery('english', $1) q
+				WHERE (up.search_vector @@ q OR u.username ILIKE $2) AND u.deleted_at IS NULL
+				ORDER BY lower(u.username) = lower($1) DESC, ts_rank(up.search_vector, q) DESC, u.username
+				LIMIT $4 OFFSET $5
+				`, terms, pattern, models.SEARCH_HEADLINE_OPTIONS, models.DEFAULT_PAGE_SIZE, offset)
+			if err != nil {
+				c.Error(err)
+				return
+			}
+
+			for i := range response.Users {
+				response.Users[i].Headline = models.FormatSearchHeadline(response.Users[i].Headline)
+			}
+		}
+
+		if searchType.Includes(models.TagSearch) && matchesPeople {
+			response.Tags, err = utils_db.FetchAll[models.TagSearchResult](db, `
+				SELECT ct.tag, COUNT(tct.thread_id) AS thread_count
+				FROM custom_tags ct
+				LEFT JOIN thread_custom_tags tct ON tct.custom_tag_id = ct.id
+				WHERE ct.tag ILIKE $1
+				GROUP BY ct.id, ct.tag
+				ORDER BY thread_count DESC, ct.tag
+				LIMIT $2 OFFSET $3
+				`, pattern, models.DEFAULT_PAGE_SIZE, offset)
+			if err != nil {
+				c.Error(err)
+				return
+			}
+		}
+
+		// The last page is that of the type with the most results
+		resultCount := 0
+		for _, typeCount := range []struct {
+			searchType models.SearchType
+			count      int
+		}{
+			{models.ThreadSearch, response.Counts.Threads},
+			{models.CommentSearch, response.Counts.Comments},
+			{models.UserSearch, response.Counts.Users},
+			{models.TagSearch, response.Counts.Tags},
+		} {
+			if searchType.Includes(typeCount.searchType) {
+				resultCount = max(resultCount, typeCount.count)
+			}
+		}
+
+		response.Pagination = models.Pagination{
+			CurrentPage: pageInt,
+			LastPage:    resultCount/models.DEFAULT_PAGE_SIZE + 1,
+			PageSize: max(len(response.Threads), len(response.Comments),
+				len(response.Users), len(response.Tags)),
+		}
+
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// Soft-deleted content, including the comments of soft-deleted
+// threads, and soft-deleted users are never searched.
+const (
+	visibleThreadCondition  = "t.deleted_at IS NULL"
+	visibleCommentCondition = "cm.deleted_at IS NULL AND cm.thread_id IN (SELECT id FROM threads WHERE deleted_at IS NULL)"
+	visibleUserCondition    = "u.deleted_at IS NULL"
+)
+
+// searchConditions adds the full-text condition, if any, to filters.
+func searchConditions(fullText utils_search.FullText, filters []string) []string {
+	if fullText.Empty() {
+		return filters
+	}
+
+	return append(filters, fullText.Condition())
+}
+
+// RecordSearch adds query to the search history of a signed-in user, unless
+// they have turned history off. Anonymous searches are not recorded.
+func RecordSearch(db *sqlx.DB, userID *uuid.UUID, query string) {
+	if userID == nil || strings.TrimSpace(query) == "" {
+		return
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO user_search_history(user_id, query)
+		SELECT id, $2 FROM user_profiles WHERE id = $1 AND record_search_history
+		`, *userID, strings.TrimSpace(query))
+	if err != nil {
+		log.Printf("[RecordSearch] failed to record search for user %s: %s\n", *userID, err.Error())
+	}
+}
+
+// History lists the user's most recent distinct searches.
+func History(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	var response models.SearchHistoryResponse
+	var err error
+
+	response.Enabled, err = utils_db.FetchOne[bool](db,
+		"SELECT record_search_history FROM user_profiles WHERE id = $1", userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	response.History, err = utils_db.FetchAll[models.SearchHistoryEntry](db, `
+		SELECT query, MAX(creation_date) AS last_searched
+		FROM user_search_history
+		WHERE user_id = $1
+		GROUP BY query
+		ORDER BY last_searched DESC
+		LIMIT $2
+		`, userID, models.SEARCH_HISTORY_SIZE)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func ClearHistory(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	_, err := db.Exec("DELETE FROM user_search_history WHERE user_id = $1", userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// SetHistoryRecording turns the recording of the user's searches on or off.
+// Turning it off does not clear the existing history.
+func SetHistoryRecording(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	recording, err := utils_handler.GetObj[struct {
+		Enabled *bool `json:"enabled" binding:"required"`
+	}](c)
+	if err != nil {
+		c.Error(api_error.NewFromStr("invalid object", http.StatusBadRequest))
+		return
+	}
+
+	_, err = db.Exec("UPDATE user_profiles SET record_search_history = $1 WHERE id = $2", *recording.Enabled, userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func SavedSearches(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	savedSearches, err := utils_db.FetchAll[models.SavedSearch](db,
+		"SELECT * FROM saved_searches WHERE user_id = $1 ORDER BY creation_date DESC", userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"saved_searches": savedSearches,
+	})
+}
+
+func SaveSearch(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	savedSearch, err := utils_handler.GetObj[models.SavedSearchRequest](c)
+	if err != nil {
+		c.Error(api_error.NewFromStr("invalid object", http.StatusBadRequest))
+		return
+	}
+
+	savedSearch.Name = strings.TrimSpace(savedSearch.Name)
+	if savedSearch.Name == "" || len(savedSearch.Name) > models.SAVED_SEARCH_NAME_LIMIT {
+		c.Error(api_error.NewFromStr("invalid saved search name", http.StatusBadRequest))
+		return
+	}
+
+	savedSearch.Query = strings.TrimSpace(savedSearch.Query)
+	if savedSearch.Query == "" && len(savedSearch.Tags) == 0 && len(savedSearch.CustomTags) == 0 {
+		c.Error(api_error.NewFromStr("a saved search needs a query or tags", http.StatusBadRequest))
+		return
+	}
+
+	// Saved searches are validated as the searches they will be turned into
+	if savedSearch.Query != "" {
+		if _, err = utils_search.Parse(savedSearch.Query); err != nil {
+			c.Error(err)
+			return
+		}
+	}
+
+	if savedSearch.SortBy == "" {
+		savedSearch.SortBy = "relevance"
+	}
+	if _, err = utils_db.SortCriteriaToDBColumn(savedSearch.SortBy); err != nil {
+		c.Error(err)
+		return
+	}
+
+	if savedSearch.Order == "" {
+		savedSearch.Order = "desc"
+	}
+	if savedSearch.Order != "desc" && savedSearch.Order != "asc" {
+		c.Error(api_error.NewFromStr("invalid order", http.StatusBadRequest))
+		return
+	}
+
+	if savedSearch.Lang != nil && !savedSearch.Lang.IsValid() {
+		c.Error(api_error.NewFromStr("invalid language", http.StatusBadRequest))
+		return
+	}
+
+	tags := make([]string, len(savedSearch.Tags))
+	for i, tag := range savedSearch.Tags {
+		tags[i] = strconv.Itoa(tag)
+	}
+
+	customTags := make([]string, len(savedSearch.CustomTags))
+	for i, customTag := range savedSearch.CustomTags {
+		customTags[i] = strings.ToLower(customTag)
+		if customTags[i] == "" || !utils_handler.CheckAllowedSymbols(customTags[i]) || strings.Contains(customTags[i], ",") {
+			c.Error(api_error.NewFromStr("invalid custom tag", http.StatusBadRequest))
+			return
+		}
+	}
+
+	savedSearchCount, err := utils_db.GetTotalRecordNo(db, "SELECT COUNT(*) FROM saved_searches WHERE user_id = $1", userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if savedSearchCount >= models.MAX_SAVED_SEARCHES {
+		c.Error(api_error.NewFromStr(
+			fmt.Sprintf("you cannot save more than %d searches", models.MAX_SAVED_SEARCHES), http.StatusConflict))
+		return
+	}
+
+	// Only threads created from now on, give or take the match overlap, are
+	// notified of
+	query := `
+	INSERT INTO saved_searches(user_id, name, query, tags, custom_tags, sort_by, sort_order, lang, notify)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	RETURNING id
+	`
+
+	var savedSearchID int64
+	err = db.QueryRowx(query, userID, savedSearch.Name, savedSearch.Query, strings.Join(tags, ","),
+		strings.Join(customTags, ","), savedSearch.SortBy, savedSearch.Order, savedSearch.Lang, savedSearch.Notify).
+		Scan(&savedSearchID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"id": savedSearchID,
+	})
+}
+
+// SetSavedSearchNotify turns the notifications of new matches of a saved search on or off.
+func SetSavedSearchNotify(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	savedSearchID, err := strconv.ParseInt(c.Param("savedSearchID"), 10, 64)
+	if err != nil {
+		c.Error(api_error.NewFromStr("invalid saved search id", http.StatusBadRequest))
+		return
+	}
+
+	notify, err := utils_handler.GetObj[struct {
+		Notify *bool `json:"notify" binding:"required"`
+	}](c)
+	if err != nil {
+		c.Error(api_error.NewFromStr("invalid object", http.StatusBadRequest))
+		return
+	}
+
+	// Threads created while notifications were off are not notified of
+	result, err := db.Exec(`
+		UPDATE saved_searches
+		SET notify = $1, last_checked_date = NOW()
+		WHERE id = $2 AND user_id = $3
+		`, *notify.Notify, savedSearchID, userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.Error(api_error.NewFromStr("saved search not found", http.StatusNotFound))
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func DeleteSavedSearch(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	savedSearchID, err := strconv.ParseInt(c.Param("savedSearchID"), 10, 64)
+	if err != nil {
+		c.Error(api_error.NewFromStr("invalid saved search id", http.StatusBadRequest))
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM saved_searches WHERE id = $1 AND user_id = $2", savedSearchID, userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.Error(api_error.NewFromStr("saved search not found", http.StatusNotFound))
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// NotifySavedSearchMatches notifies the owners of saved searches with
+// notifications on of the threads created since their last check which match
+// them. Threads are not notified of to their own authors.
+func NotifySavedSearchMatches(db *sqlx.DB) error {
+	checkedDate, err := utils_db.FetchOne[time.Time](db, "SELECT NOW()")
+	if err != nil {
+		return err
+	}
+
+	savedSearches, err := utils_db.FetchAll[models.SavedSearch](db, "SELECT * FROM saved_searches WHERE notify")
+	if err != nil {
+		return err
+	}
+
+	for _, savedSearch := range savedSearches {
+		matches, err := newSavedSearchMatches(db, savedSearch, checkedDate)
+		if err != nil {
+			log.Printf("[NotifySavedSearchMatches] failed to match saved search %d: %s\n", savedSearch.ID, err.Error())
+			continue
+		}
+
+		if matches.Count > 0 {
+			message := fmt.Sprintf("%d new threads match your saved search \"%s\"", matches.Count, savedSearch.Name)
+			if matches.Count == 1 {
+				message = fmt.Sprintf("A new thread matches your saved search \"%s\"", savedSearch.Name)
+			}
+
+			api_notification.NotifyAndLog(db, models.Notification{
+				UserID:    savedSearch.UserID,
+				RelatedID: &savedSearch.ID,
+				ThreadID:  matches.TopThreadID,
+				Type:      models.SavedSearchNotification,
+				Message:   &message,
+			})
+		}
+
+		// Matches which the next check's overlap no longer reaches are not needed
+		_, err = db.Exec(
+			"DELETE FROM saved_search_matches WHERE saved_search_id = $1 AND thread_creation_date <= $2",
+			savedSearch.ID, checkedDate.Add(-models.SAVED_SEARCH_MATCH_OVERLAP))
+		if err != nil {
+			log.Printf("[NotifySavedSearchMatches] failed to prune matches of saved search %d: %s\n", savedSearch.ID, err.Error())
+		}
+
+		_, err = db.Exec("UPDATE saved_searches SET last_checked_date = $1 WHERE id = $2",
+			checkedDate, savedSearch.ID)
+		if err != nil {
+			log.Printf("[NotifySavedSearchMatches] failed to update saved search %d: %s\n", savedSearch.ID, err.Error())
+		}
+	}
+
+	return nil
+}
+
+type savedSearchMatches struct {
+	Count       int    `db:"count"`
+	TopThreadID *int64 `db:"top_thread_id"`
+}
+
+// newSavedSearchMatches records the threads created since the saved search
+// was last checked, up to checkedDate, which match it and have not been
+// notified of yet. It returns how many there are, along with the first of
+// them in the saved search's sort order.
+func newSavedSearchMatches(db *sqlx.DB, savedSearch models.SavedSearch, checkedDate time.Time) (savedSearchMatches, error) {
+	var query utils_search.Query
+	var err error
+
+	if savedSearch.Query != "" {
+		query, err = utils_search.Parse(savedSearch.Query)
+		if err != nil {
+			return savedSearchMatches{}, err
+		}
+	}
+
+	if savedSearch.Lang != nil {
+		query.Languages = []models.AppLanguage{*savedSearch.Lang}
+	}
+
+	args := []interface{}{
+		savedSearch.ID,
+		savedSearch.LastCheckedDate.Add(-models.SAVED_SEARCH_MATCH_OVERLAP),
+		checkedDate,
+		savedSearch.UserID,
+	}
+	columns := utils_search.Columns{
+		SearchVector: "t.search_vector",
+		UserID:       "t.user_id",
+		ThreadID:     "t.id",
+		CreationDate: "t.creation_date",
+		Language:     "t.lang",
+	}
+	fullText := query.FullText(columns, &args)
+	conditions := searchConditions(fullText, query.Filters(columns, &args))
+
+	if savedSearch.Tags != "" {
+		args = append(args, pq.Array(strings.Split(savedSearch.Tags, ",")))
+		conditions = append(conditions, fmt.Sprintf(
+			"t.id IN (SELECT thread_id FROM thread_tags WHERE tag_id = ANY($%d::int[]))", len(args)))
+	}
+
+	if savedSearch.CustomTags != "" {
+		args = append(args, pq.Array(strings.Split(savedSearch.CustomTags, ",")))
+		conditions = append(conditions, fmt.Sprintf(`t.id IN (
+			SELECT tct.thread_id FROM thread_custom_tags tct JOIN custom_tags ct ON ct.id = tct.custom_tag_id
+			WHERE ct.tag = ANY($%d))`, len(args)))
+	}
+
+	conditions = append(conditions,
+		"t.creation_date > $2", "t.creation_date <= $3", "t.user_id <> $4", visibleThreadCondition)
+
+	// Both were validated when the search was saved
+	orderBy := fullText.Rank()
+	if savedSearch.SortBy != "relevance" {
+		orderBy, err = utils_db.SortCriteriaToDBColumnWithAlias(savedSearch.SortBy, "t")
+		if err != nil {
+			return savedSearchMatches{}, err
+		}
+	}
+	order := "DESC"
+	if savedSearch.SortOrder == "asc" {
+		order = "ASC"
+	}
+
+	return utils_db.FetchOne[savedSearchMatches](db, fmt.Sprintf(`
+		WITH matches AS (
+			INSERT INTO saved_search_matches(saved_search_id, thread_id, thread_creation_date)
+			SELECT $1, t.id, t.creation_date
+			FROM threads t
+			WHERE %s
+			ON CONFLICT DO NOTHING
+			RETURNING thread_id
+		)
+		SELECT
+			(SELECT COUNT(*) FROM matches) AS count,
+			(SELECT t.id FROM threads t JOIN matches m ON m.thread_id = t.id ORDER BY %s %s, t.id DESC LIMIT 1) AS top_thread_id
+		`, strings.Join(conditions, " AND "), orderBy, order), args...)
+}
+
+// Autocomplete suggests thread titles, custom tags, usernames and the user's
+// own recent searches matching what has been typed so far. Suggestions are
+// matched by trigram word similarity, so that typos still match, and those
+// of similar relevance are ranked by popularity.
+func Autocomplete() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := c.MustGet("db").(*sqlx.DB)
+
+		q := strings.TrimSpace(c.Query("q"))
+		if len([]rune(q)) < models.AUTOCOMPLETE_MIN_LENGTH || len(q) > models.AUTOCOMPLETE_MAX_LENGTH {
+			c.Error(api_error.NewFromStr(fmt.Sprintf("query must be between %d and %d characters long",
+				models.AUTOCOMPLETE_MIN_LENGTH, models.AUTOCOMPLETE_MAX_LENGTH), http.StatusBadRequest))
+			return
+		}
+
+		pattern := utils_db.ContainsPattern(q)
+
+		var suggestions models.SearchSuggestions
+		var err error
+
+		suggestions.Threads, err = utils_db.FetchAll[models.ThreadSuggestion](db, `
+			SELECT t.id, t.title
+			FROM threads t
+			WHERE ($1 <% t.title OR t.title ILIKE $2) AND t.deleted_at IS NULL
+			ORDER BY round(word_similarity($1, t.title)::numeric, 1) DESC, t.view_count + t.like_count DESC
+			LIMIT $3
+			`, q, pattern, models.AUTOCOMPLETE_LIMIT)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		suggestions.Tags, err = utils_db.FetchAll[models.TagSearchResult](db, `
+			SELECT ct.tag, COUNT(tct.thread_id) AS thread_count
+			FROM custom_tags ct
+			LEFT JOIN thread_custom_tags tct ON tct.custom_tag_id = ct.id
+			WHERE $1 <% ct.tag OR ct.tag ILIKE $2
+			GROUP BY ct.id, ct.tag
+			ORDER BY round(word_similarity($1, ct.tag)::numeric, 1) DESC, thread_count DESC
+			LIMIT $3
+			`, strings.ToLower(q), pattern, models.AUTOCOMPLETE_LIMIT)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		suggestions.Users, err = utils_db.FetchAll[models.UserSuggestion](db, `
+			SELECT u.username, up.profile_picture_path
+			FROM users u
+			JOIN user_profiles up ON up.id = u.id
+			WHERE ($1 <% u.username OR u.username ILIKE $2) AND u.deleted_at IS NULL
+			ORDER BY round(word_similarity($1, u.username)::numeric, 1) DESC, up.post_count + up.comment_count DESC
+			LIMIT $3
+			`, q, pattern, models.AUTOCOMPLETE_LIMIT)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		if userID := utils_handler.GetOptionalUserID(c); userID != nil {
+			suggestions.RecentSearches, err = utils_db.FetchAll[string](db, `
+				SELECT query
+				FROM user_search_history
+				WHERE user_id = $1 AND ($2 <% query OR query ILIKE $3)
+				GROUP BY query
+				ORDER BY round(word_similarity($2, query)::numeric, 1) DESC, MAX(creation_date) DESC
+				LIMIT $4
+				`, *userID, q, pattern, models.AUTOCOMPLETE_LIMIT)
+			if err != nil {
+				c.Error(err)
+				return
+			}
+		}
+
+		c.JSON(http.StatusOK, suggestions)
+	}
+}
@@ -0,0 +1,109 @@
+package api_session
+
+import (
+	"1chanserver/internal/api/api_token"
+	"1chanserver/internal/models"
+	"1chanserver/internal/models/api_error"
+	"1chanserver/internal/utils/utils_db"
+	"1chanserver/internal/utils/utils_handler"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+)
+
+// List returns the user's unexpired sessions, most recently used first.
+// The session of the device making the request is marked as current.
+func List(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+	deviceID := c.GetHeader("Device-ID")
+
+	sessions, err := utils_db.FetchAll[models.Session](db, `
+		SELECT
+			id, device_id, user_agent, ip_address, creation_date, last_used_date, expiration_date,
+			device_id = $2 AS current
+		FROM refresh_tokens
+		WHERE user_id = $1 AND expiration_date > NOW()
+		ORDER BY last_used_date DESC
+		`, userID, deviceID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if sessions == nil {
+		sessions = make([]models.Session, 0)
+	}
+
+	c.JSON(http.StatusOK, sessions)
+}
+
+// Revoke ends one of the user's sessions, signing its device out straight away.
+func Revoke(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	sessionID, err := strconv.ParseInt(c.Param("sessionID"), 10, 64)
+	if err != nil {
+		c.Error(api_error.NewFromStr("invalid session ID", http.StatusBadRequest))
+		return
+	}
+
+	deviceID, err := utils_db.FetchOne[string](db,
+		"SELECT device_id FROM refresh_tokens WHERE id = $1 AND user_id = $2", sessionID, userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	_, err = utils_db.RevokeSessions(db, "id = $1 AND user_id = $2", sessionID, userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if deviceID == c.GetHeader("Device-ID") {
+		c.SetCookie("Refresh-Token", "", 0, "/", "*", api_token.SecureCookieEnabled, true)
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// RevokeOthers ends all of the user's sessions except that of the device
+// making the request, and returns how many were ended.
+func RevokeOthers(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	deviceID := c.GetHeader("Device-ID")
+	if deviceID == "" {
+		c.Error(api_error.NewFromStr("missing device ID", http.StatusBadRequest))
+		return
+	}
+
+	revoked, err := utils_db.RevokeSessions(db, "user_id = $1 AND device_id <> $2", userID, deviceID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"revoked": revoked,
+	})
+}
+
+// SecurityEvents returns the security events flagged on the user's account,
+// such as the revocation of a session whose refresh token was reused.
+func SecurityEvents(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	events, err := utils_db.FetchAll[models.SecurityEvent](db,
+		"SELECT * FROM security_events WHERE user_id = $1 ORDER BY creation_date DESC LIMIT 50", userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if events == nil {
+		events = make([]models.SecurityEvent, 0)
+	}
+
+	c.JSON(http.StatusOK, events)
+}
@@ -1,10 +1,15 @@
 package api_thread
 
 import (
+	"1chanserver/internal/api/api_comment"
+	"1chanserver/internal/api/api_poll"
+	"1chanserver/internal/api/api_search"
 	"1chanserver/internal/models"
 	"1chanserver/internal/models/api_error"
 	"1chanserver/internal/utils/utils_db"
+	"1chanserver/internal/utils/utils_diff"
 	"1chanserver/internal/utils/utils_handler"
+	"1chanserver/internal/utils/utils_search"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
@@ -59,20 +64,63 @@ func New(c *gin.Context) {
 		}
 	}
 
+	// Ensure the channel the thread is filed into exists
+	if newThread.ChannelID != nil {
+		var channelCount int
+		channelCount, err = utils_db.FetchOne[int](db, "SELECT COUNT(*) FROM channels WHERE id = $1", *newThread.ChannelID)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		if channelCount == 0 {
+			err = api_error.NewFromStr("channel does not exist", http.StatusNotFound)
+			c.Error(err)
+			return
+		}
+	}
+
+	if newThread.Lang != nil && !newThread.Lang.IsValid() {
+		err = api_error.NewFromStr("invalid language", http.StatusBadRequest)
+		c.Error(err)
+		return
+	}
+
+	// Threads are written in their author's preferred language unless specified
 	var threadID int
 	err = tx.QueryRowx(
-		"INSERT INTO threads(user_id, title, original_post, like_count, view_count) VALUES ($1, $2, $3, $4, $5) RETURNING id;",
+		`INSERT INTO threads(user_id, channel_id, title, original_post, like_count, view_count, lang) 
+		VALUES ($1, $2, $3, $4, $5, $6, COALESCE($7, (SELECT preferred_lang FROM user_profiles WHERE id = $1))) 
+		RETURNING id;`,
 		userID,
+		newThread.ChannelID,
 		newThread.Title,
 		newThread.OriginalPost,
 		0,
 		0,
+		newThread.Lang,
 	).Scan(&threadID)
 	if err != nil {
 		c.Error(err)
 		return
 	}
 
+	if newThread.ChannelID != nil {
+		_, err = tx.Exec("INSERT INTO thread_channels(thread_id, channel_id) VALUES($1, $2)", threadID, *newThread.ChannelID)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+	}
+
+	if newThread.Poll != nil {
+		err = api_poll.Insert(tx, threadID, newThread.Poll)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+	}
+
 	for i := 0; i < len(lowerCustomTags); i++ {
 		var customTagID int
 		err = tx.Get(&customTagID, "SELECT id FROM custom_tags WHERE tag = $1", lowerCustomTags[i])
@@ -120,7 +168,7 @@ func View(page int) gin.HandlerFunc {
 
 		db := c.MustGet("db").(*sqlx.DB)
 		comments, err := utils_db.FetchAll[models.CommentView](
-			db, "SELECT c.*, u.username, up.profile_picture_path FROM comments c, users u JOIN user_profiles up ON u.id = up.id WHERE thread_id = $1 AND c.user_id = u.id ORDER BY like_count LIMIT $2 OFFSET $3", threadID, models.DEFAULT_PAGE_SIZE, (page-1)*models.DEFAULT_PAGE_SIZE)
+			db, api_comment.CommentViewSelect+"WHERE c.thread_id = $1 ORDER BY c.like_count, c.id LIMIT $2 OFFSET $3", threadID, models.DEFAULT_PAGE_SIZE, (page-1)*models.DEFAULT_PAGE_SIZE)
 
 		if err != nil {
 			c.Error(err)
@@ -129,18 +177,19 @@ func View(page int) gin.HandlerFunc {
 
 		threadQuery := `
 			SELECT 
-				t.*, u.username, up.profile_picture_path,
+				t.*, u.username, up.profile_picture_path, ch.name AS channel,
 				array_to_string(array_agg(DISTINCT ct.tag) FILTER (WHERE ct.tag IS NOT NULL), ',') AS custom_tags,
 				array_to_string(array_agg(DISTINCT dt.id) FILTER (WHERE dt.id IS NOT NULL), ',') AS tags
 			FROM threads t
 			JOIN users u ON u.id = t.user_id
 			JOIN user_profiles up ON up.id = u.id
+			LEFT JOIN channels ch ON ch.id = t.channel_id
 			LEFT JOIN thread_custom_tags tct ON tct.thread_id = t.id
 			LEFT JOIN custom_tags ct ON ct.id = tct.custom_tag_id
 			LEFT JOIN thread_tags tt ON tt.thread_id = t.id
 			LEFT JOIN tags dt ON dt.id = tt.tag_id
-			WHERE t.id = $1 AND t.user_id = u.id
-			GROUP BY t.id, u.username, up.profile_picture_path
+			WHERE t.id = $1 AND t.user_id = u.id AND t.deleted_at IS NULL
+			GROUP BY t.id, u.username, up.profile_picture_path, ch.name
 			`
 		thread, err := utils_db.FetchOne[models.ThreadView](
 			db, threadQuery, threadID)
@@ -149,6 +198,12 @@ func View(page int) gin.HandlerFunc {
 			return
 		}
 
+		poll, err := api_poll.FetchByThread(db, threadID, utils_handler.GetOptionalUserID(c))
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
 		totalComments, err := utils_db.FetchOne[int](
 			db, "SELECT COUNT(*) FROM comments WHERE thread_id = $1", threadID)
 		if err != nil {
@@ -164,6 +219,7 @@ func View(page int) gin.HandlerFunc {
 
 		c.JSON(http.StatusOK, models.ThreadViewResponse{
 			Thread: thread,
+			Poll:   poll,
 			Comments: models.PaginatedResponse[models.CommentView]{
 				Response: comments,
 				Pagination: models.Pagination{
@@ -187,22 +243,21 @@ func Search() gin.HandlerFunc {
 			return
 		}
 
-		searchQuery := threadReqQuery["q"]
-		whereClauseSearchQuery := func() string {
-			if searchQuery != "" {
-				return "t.search_vector @@ to_tsquery('english', $3)"
-			} else {
-				return ""
+		searchQuery := threadReqQuery["q"].(string)
+		var parsedQuery utils_search.Query
+		if searchQuery != "" {
+			parsedQuery, err = utils_search.Parse(searchQuery)
+			if err != nil {
+				c.Error(err)
+				return
 			}
-		}()
+		}
 
-		whereClauseSearchCountQuery := func() string {
-			if searchQuery != "" {
-				return "t.search_vector @@ to_tsquery('english', $1)"
-			} else {
-				return ""
-			}
-		}()
+		parsedQuery.Languages, err = utils_search.ParseLanguage(c.Query("lang"))
+		if err != nil {
+			c.Error(err)
+			return
+		}
 
 		tags := threadReqQuery["tags"].([]string)
 		customTags := threadReqQuery["custom_tags"].([]string)
@@ -212,20 +267,57 @@ func Search() gin.HandlerFunc {
 			return
 		}
 
-		pageInt := threadReqQuery["page"].(int)
 		sortBy := threadReqQuery["sort_by"].(string)
 		order := threadReqQuery["order"].(string)
 
-		// Building the WHERE clauses dynamically
-		whereClausesMainQuery := []string{}
-		whereClausesCountQuery := []string{}
-		if whereClauseSearchQuery != "" {
-			whereClausesMainQuery = append(whereClausesMainQuery, whereClauseSearchQuery)
+		pageRequest, err := utils_handler.GetPageRequest(c, sortBy, order)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		// Only the first page of a search is recorded in the user's history
+		if searchQuery != "" && pageRequest.Offset() == 0 && pageRequest.Cursor == nil {
+			api_search.RecordSearch(db, utils_handler.GetOptionalUserID(c), searchQuery)
+		}
+
+		searchColumns := utils_search.Columns{
+			SearchVector: "t.search_vector",
+			UserID:       "t.user_id",
+			ThreadID:     "t.id",
+			CreationDate: "t.creation_date",
+			Language:     "t.lang",
 		}
-		if whereClauseSearchCountQuery != "" {
-			whereClausesCountQuery = append(whereClausesCountQuery, whereClauseSearchCountQuery)
+
+		// The main and count queries are built with their own arguments,
+		// as only the former is paginated
+		args := []interface{}{pageRequest.PageSize, pageRequest.Offset()}
+		var countArgs []interface{}
+
+		fullText := parsedQuery.FullText(searchColumns, &args)
+		whereClausesMainQuery := parsedQuery.Filters(searchColumns, &args)
+		if !fullText.Empty() {
+			whereClausesMainQuery = append(whereClausesMainQuery, fullText.Condition())
 		}
+		whereClausesCountQuery := parsedQuery.Conditions(searchColumns, &countArgs)
+
+		// Soft-deleted threads are never listed
+		whereClausesMainQuery = append(whereClausesMainQuery, "t.deleted_at IS NULL")
+		whereClausesCountQuery = append(whereClausesCountQuery, "t.deleted_at IS NULL")
+
+		// In cursor mode, only the threads after the cursor are selected
+		cursorClause := ""
+		if pageRequest.Cursor != nil {
+			sortColumn := "t." + sortBy
+			if sortBy == "rank" {
+				sortColumn = "rt.rank"
+			}
 
+			cursorClause = "WHERE " + utils_db.KeysetCondition(sortColumn, "t.id", order, len(args)+1)
+			args = append(args, pageRequest.Cursor.Value, pageRequest.Cursor.ID)
+		}
+
+		// Building the WHERE clauses dynamically
 		if len(tags) > 0 {
 			whereClausesMainQuery = append(whereClausesMainQuery, fmt.Sprintf("tt.tag_id IN %s", utils_db.ToInQueryForm[string](tags)))
 			whereClausesCountQuery = append(whereClausesCountQuery, fmt.Sprintf("tt.tag_id IN %s", utils_db.ToInQueryForm[string](tags)))
@@ -237,7 +329,7 @@ func Search() gin.HandlerFunc {
 		}
 
 		whereClauseMainQuery := func() string {
-			if searchQuery == "" && len(customTagIDs) == 0 && len(tags) == 0 {
+			if len(whereClausesMainQuery) == 0 {
 				return ""
 			} else {
 				return fmt.Sprintf("WHERE %s", strings.Join(whereClausesMainQuery, " AND "))
@@ -245,7 +337,7 @@ func Search() gin.HandlerFunc {
 		}()
 
 		whereClauseCountQuery := func() string {
-			if searchQuery == "" && len(customTagIDs) == 0 && len(tags) == 0 {
+			if len(whereClausesCountQuery) == 0 {
 				return ""
 			} else {
 				return fmt.Sprintf("WHERE %s", strings.Join(whereClausesCountQuery, " AND "))
@@ -272,19 +364,30 @@ func Search() gin.HandlerFunc {
 			}
 		}()
 
+		// Queries made of filters only are not ranked
 		rankSelectClause := func() string {
-			if searchQuery != "" {
-				return "t.id, ts_rank(t.search_vector, to_tsquery('english', $3)) AS rank"
+			if !fullText.Empty() {
+				return fmt.Sprintf("t.id, %s AS rank", fullText.Rank())
+			} else if searchQuery != "" {
+				return "t.id, 0::real AS rank"
 			} else {
 				return "t.id"
 			}
 		}()
 
+		rankColumnClause := func() string {
+			if searchQuery != "" {
+				return ", rt.rank"
+			} else {
+				return ""
+			}
+		}()
+
 		rankGroupByClause := func() string {
 			if searchQuery != "" {
-				return "GROUP BY t.id, u.username, up.profile_picture_path, rt.rank"
+				return "GROUP BY t.id, u.username, up.profile_picture_path, ch.name, rt.rank"
 			} else {
-				return "GROUP BY t.id, u.username, up.profile_picture_path"
+				return "GROUP BY t.id, u.username, up.profile_picture_path, ch.name"
 			}
 		}()
 
@@ -303,22 +406,27 @@ func Search() gin.HandlerFunc {
 				t.*, 
 				u.username, 
 				up.profile_picture_path,
+				ch.name AS channel,
 				-- Aggregate the tags into arrays, ignoring NULLs
 				array_to_string(array_agg(DISTINCT ct.tag) FILTER (WHERE ct.tag IS NOT NULL), ',') AS custom_tags,
-				array_to_string(array_agg(DISTINCT dt.id) FILTER (WHERE dt.id IS NOT NULL), ',') AS tags		
+				array_to_string(array_agg(DISTINCT dt.id) FILTER (WHERE dt.id IS NOT NULL), ',') AS tags
+				%s
 			FROM threads t
 			JOIN users u ON t.user_id = u.id
 			JOIN user_profiles up ON t.user_id = up.id
+			LEFT JOIN channels ch ON ch.id = t.channel_id
 			LEFT JOIN thread_tags tt ON tt.thread_id = t.id
 			LEFT JOIN tags dt ON dt.id = tt.tag_id
 			LEFT JOIN thread_custom_tags tct ON tct.thread_id = t.id
 			LEFT JOIN custom_tags ct ON ct.id = tct.custom_tag_id
 			JOIN ranked_threads rt ON rt.id = t.id
 			%s
-			ORDER BY %s %s
+			%s
+			ORDER BY %s %s, t.id %s
 			LIMIT $1 OFFSET $2
 			`,
-			rankSelectClause, customTagsJoinClause, tagsJoinClause, whereClauseMainQuery, rankGroupByClause, sortBy, order)
+			rankSelectClause, customTagsJoinClause, tagsJoinClause, whereClauseMainQuery, rankColumnClause,
+			cursorClause, rankGroupByClause, sortBy, order, order)
 		// Construct the count query
 		countQuery := fmt.Sprintf(`
 			SELECT COUNT(*)
@@ -336,16 +444,10 @@ func Search() gin.HandlerFunc {
 		//log.Println(query)
 		//log.Println(countQuery)
 
-		threadList, err := func() ([]models.ThreadView, error) {
-			if searchQuery != "" {
-				return utils_db.FetchAll[models.ThreadView](db, query, models.DEFAULT_PAGE_SIZE, (pageInt-1)*models.DEFAULT_PAGE_SIZE, searchQuery)
-			} else {
-				return utils_db.FetchAll[models.ThreadView](db, query, models.DEFAULT_PAGE_SIZE, (pageInt-1)*models.DEFAULT_PAGE_SIZE)
-			}
-		}()
+		threadList, err := utils_db.FetchAll[models.ThreadView](db, query, args...)
 
 		if err != nil {
-			c.Error(api_error.New(err, http.StatusInternalServerError, query))
+			c.Error(api_error.NewFromErr(err, http.StatusInternalServerError))
 			return
 		}
 
@@ -356,17 +458,22 @@ func Search() gin.HandlerFunc {
 			}
 		}
 
-		// Get total number of rows for the current query for pagination
-		threadCount, err := func() (int, error) {
-			if searchQuery != "" {
-				return utils_db.FetchOne[int](db, countQuery, searchQuery)
-			} else {
-				return utils_db.FetchOne[int](db, countQuery)
-			}
-		}()
+		// The count is skipped in cursor mode, which has no notion of a last page
+		if pageRequest.CursorMode {
+			c.JSON(http.StatusOK, models.PaginatedResponse[models.ThreadView]{
+				Response: threadList,
+				Pagination: models.Pagination{
+					PageSize:   len(threadList),
+					NextCursor: models.NextCursor(threadList, pageRequest, sortBy, order),
+				},
+			})
+			return
+		}
 
+		// Get total number of rows for the current query for pagination
+		threadCount, err := utils_db.FetchOne[int](db, countQuery, countArgs...)
 		if err != nil {
-			c.Error(api_error.New(err, http.StatusInternalServerError, countQuery))
+			c.Error(api_error.NewFromErr(err, http.StatusInternalServerError))
 			return
 		}
 
@@ -374,9 +481,9 @@ func Search() gin.HandlerFunc {
 		c.JSON(http.StatusOK, models.PaginatedResponse[models.ThreadView]{
 			Response: threadList,
 			Pagination: models.Pagination{
-				CurrentPage: pageInt,
-				LastPage:    threadCount/models.DEFAULT_PAGE_SIZE + 1,
-				PageSize:    min(len(threadList), models.DEFAULT_PAGE_SIZE),
+				CurrentPage: pageRequest.Page,
+				LastPage:    threadCount/pageRequest.PageSize + 1,
+				PageSize:    min(len(threadList), pageRequest.PageSize),
 			},
 		})
 	}
@@ -401,10 +508,28 @@ func List() gin.HandlerFunc {
 			return
 		}
 
-		pageInt := threadReqQuery["page"].(int)
 		sortBy := threadReqQuery["sort_by"].(string)
 		order := threadReqQuery["order"].(string)
 
+		pageRequest, err := utils_handler.GetPageRequest(c, sortBy, order)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		// In cursor mode, only the threads after the cursor are selected
+		args := []interface{}{pageRequest.PageSize, pageRequest.Offset()}
+		var cursorCondition string
+		if pageRequest.Cursor != nil {
+			cursorCondition = utils_db.KeysetCondition(sortBy, "t.id", order, 3)
+			args = append(args, pageRequest.Cursor.Value, pageRequest.Cursor.ID)
+		}
+
+		andCursorCondition := ""
+		if cursorCondition != "" {
+			andCursorCondition = "AND " + cursorCondition
+		}
+
 		var query string
 		var countQuery string
 
@@ -412,15 +537,17 @@ func List() gin.HandlerFunc {
 		if len(tags) > 0 && len(customTagIDs) > 0 {
 			query = fmt.Sprintf(`
 				SELECT DISTINCT
-					t.*, u.username, up.profile_picture_path
+					t.*, u.username, up.profile_picture_path, ch.name AS channel
 				FROM threads t
 				JOIN users u ON t.user_id = u.id
 				JOIN user_profiles up ON t.user_id = up.id 
+				LEFT JOIN channels ch ON ch.id = t.channel_id
 				JOIN thread_tags tt ON t.id = tt.thread_id
 				JOIN thread_custom_tags tct ON t.id = tct.thread_id
-				WHERE tt.tag_id IN %s AND tct.custom_tag_id IN %s
-				ORDER BY %s %s
-				LIMIT $1 OFFSET $2`, utils_db.ToInQueryForm[string](tags), utils_db.ToInQueryForm[int](customTagIDs), sortBy, order)
+				WHERE tt.tag_id IN %s AND tct.custom_tag_id IN %s AND t.deleted_at IS NULL %s
+				ORDER BY %s %s, t.id %s
+				LIMIT $1 OFFSET $2`, utils_db.ToInQueryForm[string](tags), utils_db.ToInQueryForm[int](customTagIDs),
+				andCursorCondition, sortBy, order, order)
 			countQuery = fmt.Sprintf(`
 				SELECT COUNT(*)
 				FROM threads t
@@ -428,61 +555,66 @@ func List() gin.HandlerFunc {
 				JOIN user_profiles up ON t.user_id = up.id 
 				JOIN thread_tags tt ON t.id = tt.thread_id
 				JOIN thread_custom_tags tct ON t.id = tct.thread_id
-				WHERE tt.tag_id IN %s AND tct.custom_tag_id IN %s`, utils_db.ToInQueryForm[string](tags), utils_db.ToInQueryForm[int](customTagIDs))
+				WHERE tt.tag_id IN %s AND tct.custom_tag_id IN %s AND t.deleted_at IS NULL`, utils_db.ToInQueryForm[string](tags), utils_db.ToInQueryForm[int](customTagIDs))
 		} else if len(tags) > 0 && len(customTagIDs) == 0 {
 			query = fmt.Sprintf(`
 				SELECT DISTINCT
-					t.*, u.username, up.profile_picture_path
+					t.*, u.username, up.profile_picture_path, ch.name AS channel
 				FROM threads t
 				JOIN users u ON t.user_id = u.id
 				JOIN user_profiles up ON t.user_id = up.id 
+				LEFT JOIN channels ch ON ch.id = t.channel_id
 				JOIN thread_tags tt ON t.id = tt.thread_id
-				WHERE tt.tag_id IN %s
-				ORDER BY %s %s
-				LIMIT $1 OFFSET $2`, utils_db.ToInQueryForm[string](tags), sortBy, order)
+				WHERE tt.tag_id IN %s AND t.deleted_at IS NULL %s
+				ORDER BY %s %s, t.id %s
+				LIMIT $1 OFFSET $2`, utils_db.ToInQueryForm[string](tags), andCursorCondition, sortBy, order, order)
 			countQuery = fmt.Sprintf(`
 				SELECT COUNT(*)
 				FROM threads t
 				JOIN users u ON t.user_id = u.id
 				JOIN user_profiles up ON t.user_id = up.id 
 				JOIN thread_tags tt ON t.id = tt.thread_id
-				WHERE tt.tag_id IN %s`, utils_db.ToInQueryForm[string](tags))
+				WHERE tt.tag_id IN %s AND t.deleted_at IS NULL`, utils_db.ToInQueryForm[string](tags))
 		} else if len(tags) == 0 && len(customTagIDs) > 0 {
 			query = fmt.Sprintf(`
 				SELECT DISTINCT
-					t.*, u.username, up.profile_picture_path
+					t.*, u.username, up.profile_picture_path, ch.name AS channel
 				FROM threads t
 				JOIN users u ON t.user_id = u.id
 				JOIN user_profiles up ON t.user_id = up.id 
+				LEFT JOIN channels ch ON ch.id = t.channel_id
 				JOIN thread_custom_tags tct ON t.id = tct.thread_id
-				WHERE tct.custom_tag_id IN %s
-				ORDER BY %s %s
-				LIMIT $1 OFFSET $2`, utils_db.ToInQueryForm[int](customTagIDs), sortBy, order)
+				WHERE tct.custom_tag_id IN %s AND t.deleted_at IS NULL %s
+				ORDER BY %s %s, t.id %s
+				LIMIT $1 OFFSET $2`, utils_db.ToInQueryForm[int](customTagIDs), andCursorCondition, sortBy, order, order)
 			countQuery = fmt.Sprintf(`
 				SELECT COUNT(*)
 				FROM threads t
 				JOIN users u ON t.user_id = u.id
 				JOIN user_profiles up ON t.user_id = up.id 
 				JOIN thread_custom_tags tct ON t.id = tct.thread_id
-				WHERE tt.tag_id IN %s AND tct.custom_tag_id IN %s`, utils_db.ToInQueryForm[int](customTagIDs))
+				WHERE tct.custom_tag_id IN %s AND t.deleted_at IS NULL`, utils_db.ToInQueryForm[int](customTagIDs))
 		} else {
 			query = fmt.Sprintf(`
 				SELECT DISTINCT
-					t.*, u.username,  up.profile_picture_path
+					t.*, u.username,  up.profile_picture_path, ch.name AS channel
 				FROM threads t
 				JOIN users u ON t.user_id = u.id
 				JOIN user_profiles up ON t.user_id = up.id
-				ORDER BY %s %s
-				LIMIT $1 OFFSET $2`, sortBy, order)
-			countQuery = fmt.Sprintf(`
+				LEFT JOIN channels ch ON ch.id = t.channel_id
+				WHERE t.deleted_at IS NULL %s
+				ORDER BY %s %s, t.id %s
+				LIMIT $1 OFFSET $2`, andCursorCondition, sortBy, order, order)
+			countQuery = `
 				SELECT COUNT(*)
 				FROM threads t
 				JOIN users u ON t.user_id = u.id
-				JOIN user_profiles up ON t.user_id = up.id`)
+				JOIN user_profiles up ON t.user_id = up.id
+				WHERE t.deleted_at IS NULL`
 		}
 
 		// Fetch threads based on the query
-		threadList, err := utils_db.FetchAll[models.ThreadView](db, query, models.DEFAULT_PAGE_SIZE, (pageInt-1)*models.DEFAULT_PAGE_SIZE)
+		threadList, err := utils_db.FetchAll[models.ThreadView](db, query, args...)
 		if err != nil {
 			c.Error(api_error.NewFromErr(err, http.StatusInternalServerError))
 			return
@@ -495,6 +627,18 @@ func List() gin.HandlerFunc {
 			}
 		}
 
+		// The count is skipped in cursor mode, which has no notion of a last page
+		if pageRequest.CursorMode {
+			c.JSON(http.StatusOK, models.PaginatedResponse[models.ThreadView]{
+				Response: threadList,
+				Pagination: models.Pagination{
+					PageSize:   len(threadList),
+					NextCursor: models.NextCursor(threadList, pageRequest, sortBy, order),
+				},
+			})
+			return
+		}
+
 		/// Get total number of rows for the current query for pagination
 		threadCount, err := utils_db.FetchOne[int](db, countQuery)
 		if err != nil {
@@ -505,9 +649,9 @@ func List() gin.HandlerFunc {
 		c.JSON(http.StatusOK, models.PaginatedResponse[models.ThreadView]{
 			Response: threadList,
 			Pagination: models.Pagination{
-				CurrentPage: pageInt,
-				LastPage:    threadCount/models.DEFAULT_PAGE_SIZE + 1,
-				PageSize:    min(len(threadList), models.DEFAULT_PAGE_SIZE),
+				CurrentPage: pageRequest.Page,
+				LastPage:    threadCount/pageRequest.PageSize + 1,
+				PageSize:    min(len(threadList), pageRequest.PageSize),
 			},
 		})
 	}
@@ -531,7 +675,7 @@ func Edit(c *gin.Context) {
 	query := `
 		UPDATE threads 
 		SET title = $1, original_post = $2, updated_date = $3 
-		WHERE id = $4 AND user_id = $5
+		WHERE id = $4 AND user_id = $5 AND deleted_at IS NULL
 	`
 	_, err = db.Exec(query, editedThread["title"], editedThread["original_post"], time.Now().UTC(), threadID, userID)
 	if err != nil {
@@ -542,6 +686,8 @@ func Edit(c *gin.Context) {
 	c.Status(http.StatusOK)
 }
 
+// Delete soft-deletes a thread, which its owner can restore within
+// models.DELETION_GRACE_PERIOD before it is purged along with its comments.
 func Delete(c *gin.Context) {
 	db, userID := utils_handler.GetReqCx(c)
 	threadID := c.Param("threadID")
@@ -550,9 +696,35 @@ func Delete(c *gin.Context) {
 		return
 	}
 
-	_, err := db.Exec(
-		"DELETE FROM threads WHERE id = $1 AND user_id = $2",
-		threadID, userID)
+	deleteRequest, err := utils_handler.GetDeleteRequest(c)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	deleted, err := utils_db.SoftDelete(db, "threads", threadID, &userID, userID, deleteRequest.Reason)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if !deleted {
+		c.Error(api_error.NewFromStr("thread not found", http.StatusNotFound))
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func Restore(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+	threadID, err := strconv.Atoi(c.Param("threadID"))
+	if err != nil {
+		c.Error(api_error.NewFromStr("invalid thread id", http.StatusBadRequest))
+		return
+	}
+
+	err = utils_db.Restore(db, "threads", threadID, userID)
 	if err != nil {
 		c.Error(err)
 		return
@@ -577,15 +749,27 @@ func Report(objectType string) gin.HandlerFunc {
 			return
 		}
 
+		if strings.TrimSpace(report["report_reason"]) == "" {
+			c.Error(api_error.NewFromStr("missing report reason", http.StatusBadRequest))
+			return
+		}
+
+		// The reported content is snapshotted along with the report
 		var query string
 		switch objectType {
 		case "thread":
 			query = `
-			INSERT INTO reports(thread_id, reporter_id, report_reason) VALUES($1, $2, $3) RETURNING id
+			INSERT INTO reports(thread_id, reporter_id, report_reason, reported_user_id, content_snapshot)
+			SELECT t.id, $2, $3, t.user_id, t.title || E'\n\n' || t.original_post
+			FROM threads t WHERE t.id = $1 AND t.deleted_at IS NULL
+			RETURNING id
 			`
 		case "comment":
 			query = `
-			INSERT INTO reports(comment_id, reporter_id, report_reason) VALUES($1, $2, $3) RETURNING id
+			INSERT INTO reports(comment_id, reporter_id, report_reason, reported_user_id, content_snapshot)
+			SELECT cm.id, $2, $3, cm.user_id, cm.comment
+			FROM comments cm WHERE cm.id = $1 AND cm.deleted_at IS NULL
+			RETURNING id
 			`
 		}
 
@@ -602,6 +786,126 @@ func Report(objectType string) gin.HandlerFunc {
 	}
 }
 
+// fetchRevisions returns the revisions of a thread or comment, oldest first.
+// Revisions outlive the content they belong to, but those of deleted content
+// are only shown to moderators.
+func fetchRevisions(c *gin.Context, objectType string) ([]models.Revision, bool, error) {
+	db := c.MustGet("db").(*sqlx.DB)
+
+	var revisionsQuery, existsQuery string
+	switch objectType {
+	case "thread":
+		revisionsQuery = `
+		SELECT r.revision, u.username, r.title, r.original_post AS content, r.creation_date
+		FROM thread_revisions r LEFT JOIN users u ON u.id = r.user_id
+		WHERE r.thread_id = $1
+		ORDER BY r.revision
+		`
+		existsQuery = "SELECT EXISTS(SELECT 1 FROM threads WHERE id = $1 AND deleted_at IS NULL)"
+	case "comment":
+		revisionsQuery = `
+		SELECT r.revision, u.username, r.comment AS content, r.creation_date
+		FROM comment_revisions r LEFT JOIN users u ON u.id = r.user_id
+		WHERE r.comment_id = $1
+		ORDER BY r.revision
+		`
+		existsQuery = "SELECT EXISTS(SELECT 1 FROM comments WHERE id = $1 AND deleted_at IS NULL)"
+	}
+
+	objID, err := strconv.ParseInt(c.Param("objID"), 10, 64)
+	if err != nil {
+		return nil, false, api_error.NewFromStr("invalid object id", http.StatusBadRequest)
+	}
+
+	exists, err := utils_db.FetchOne[bool](db, existsQuery, objID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !exists && !utils_handler.GetReqRole(c).AtLeast(models.ModeratorRole) {
+		return nil, false, api_error.NewFromStr(objectType+" not found", http.StatusNotFound)
+	}
+
+	revisions, err := utils_db.FetchAll[models.Revision](db, revisionsQuery, objID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(revisions) == 0 {
+		return nil, false, api_error.NewFromStr(objectType+" not found", http.StatusNotFound)
+	}
+
+	return revisions, !exists, nil
+}
+
+func Revisions(objectType string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		revisions, deleted, err := fetchRevisions(c, objectType)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		c.JSON(http.StatusOK, models.RevisionListResponse{
+			Deleted:   deleted,
+			Revisions: revisions,
+		})
+	}
+}
+
+// RevisionDiff returns the word-level diff between the revisions given by
+// the from and to query parameters, which default to the last edit.
+func RevisionDiff(objectType string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		revisions, _, err := fetchRevisions(c, objectType)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		latest := revisions[len(revisions)-1].Revision
+
+		from, err := strconv.Atoi(c.DefaultQuery("from", strconv.Itoa(max(latest-1, 1))))
+		if err != nil {
+			c.Error(api_error.NewFromStr("invalid from revision", http.StatusBadRequest))
+			return
+		}
+
+		to, err := strconv.Atoi(c.DefaultQuery("to", strconv.Itoa(latest)))
+		if err != nil {
+			c.Error(api_error.NewFromStr("invalid to revision", http.StatusBadRequest))
+			return
+		}
+
+		var fromRevision, toRevision *models.Revision
+		for i := range revisions {
+			if revisions[i].Revision == from {
+				fromRevision = &revisions[i]
+			}
+			if revisions[i].Revision == to {
+				toRevision = &revisions[i]
+			}
+		}
+
+		if fromRevision == nil || toRevision == nil {
+			c.Error(api_error.NewFromStr("revision not found", http.StatusNotFound))
+			return
+		}
+
+		diff := models.RevisionDiff{
+			From:    from,
+			To:      to,
+			Content: utils_diff.Words(fromRevision.Content, toRevision.Content),
+		}
+
+		if objectType == "thread" {
+			diff.Title = utils_diff.Words(*fromRevision.Title, *toRevision.Title)
+		}
+
+		c.JSON(http.StatusOK, diff)
+	}
+}
+
 func Tags(c *gin.Context) {
 	db := c.MustGet("db").(*sqlx.DB)
 
@@ -5,15 +5,42 @@ import (
 	"1chanserver/internal/models/api_error"
 	"1chanserver/internal/utils/utils_auth"
 	"1chanserver/internal/utils/utils_db"
+	"1chanserver/internal/utils/utils_handler"
+	"database/sql"
 	"errors"
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/jmoiron/sqlx"
+	"log"
 	"net/http"
+	"time"
 )
 
 var SecureCookieEnabled bool
 
+// JWKS publishes the public keys access tokens are signed with, so that
+// other services can verify them.
+func JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, utils_auth.SigningKeys.JWKS())
+}
+
+// gracefulSuccessor returns the successor of the rotated out token
+// previousToken, provided that it was rotated out of session last, within
+// utils_auth.REFRESH_TOKEN_REUSE_GRACE.
+func gracefulSuccessor(sessionFound bool, session *models.RefreshToken, rotated *models.RotatedRefreshToken, previousToken string) (string, bool) {
+	if !sessionFound || session.FamilyID != rotated.FamilyID || session.TokenID != rotated.SuccessorTokenID ||
+		time.Since(rotated.RotatedDate) > utils_auth.REFRESH_TOKEN_REUSE_GRACE {
+		return "", false
+	}
+
+	successor, err := utils_auth.OpenSuccessor(previousToken, rotated.SealedSuccessor)
+	if err != nil {
+		return "", false
+	}
+
+	return successor, true
+}
+
 func RefreshToken(tokenType string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		db := c.MustGet("db").(*sqlx.DB)
@@ -32,84 +59,139 @@ func RefreshToken(tokenType string) gin.HandlerFunc {
 			return
 		}
 
-		// Check validity of refresh token
-		parsedToken, err := jwt.ParseWithClaims(refreshToken, &utils_auth.Claims{}, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				err := api_error.NewFromStr("refresh token invalid", http.StatusUnauthorized)
-				c.Header("X-Refresh-Token", "failed")
-				c.Error(err)
-				return nil, err
-			}
-
-			return []byte(utils_auth.JWT_SECRET_KEY), nil
-		})
-
-		claims, ok := parsedToken.Claims.(*utils_auth.Claims)
-		switch {
-		case err == nil && ok && parsedToken.Valid:
-			//log.Printf("refresh token is valid")
-			//log.Printf("userID: %s", claims.UserID)
-			newAccessToken, err := utils_auth.GenerateAccessToken(claims.UserID)
-			if err != nil {
-				c.Header("X-Refresh-Token", "failed")
-				c.Error(err)
-				return
-			}
+		// Check validity of refresh token. Access tokens are rejected, as
+		// they carry a different token type and audience.
+		claims, err := utils_auth.ParseRefreshToken(refreshToken)
+		if err != nil {
+			c.Header("X-Refresh-Token", "failed")
+			c.Error(api_error.New(err, http.StatusUnauthorized, "refresh token invalid"))
+			return
+		}
 
-			// Check whether refresh token has been invalidated before its expiry
-			storedHash, err := utils_db.FetchOne[string](
-				db, "SELECT token_hash FROM refresh_tokens WHERE user_id = $1 AND device_id = $2", claims.UserID, deviceID)
+		// The role is read afresh so that role changes apply on the next refresh
+		var storedUser models.User
+		err = db.Get(&storedUser, "SELECT * FROM users WHERE id = $1", claims.UserID)
+		if err != nil {
+			c.Header("X-Refresh-Token", "failed")
+			c.Error(api_error.New(err, http.StatusUnauthorized, "refresh token invalid"))
+			return
+		}
 
-			if err != nil {
-				c.Header("X-RefreshToken", "failed")
-				c.Error(api_error.New(err, http.StatusUnauthorized, "an internal error has occurred"))
-				return
-			}
+		if storedUser.IsSuspended() {
+			c.Header("X-Refresh-Token", "failed")
+			c.Error(api_error.NewFromStr("account suspended", http.StatusForbidden))
+			return
+		}
 
-			ok := utils_auth.VerifyArgon2Hash(refreshToken, storedHash)
-			if !ok {
-				c.Header("X-Refresh-Token", "failed")
-				c.Error(api_error.NewFromStr("refresh token invalid", http.StatusUnauthorized))
-				return
-			}
+		tx, err := db.Beginx()
+		if err != nil {
+			c.Error(err)
+			return
+		}
 
-			c.Header("X-Refresh-Token", "success")
+		defer utils_db.HandleTxRollback(tx, &err, c)
 
-			switch tokenType {
-			case "continue":
-				c.JSON(http.StatusCreated, gin.H{
-					"access_token": newAccessToken,
-				})
-			case "first":
-				var storedUser models.User
-				err = db.Get(&storedUser, "SELECT * FROM users WHERE id = $1", claims.UserID)
+		client := utils_handler.GetSessionClient(c)
 
+		// The session is locked first, so that a concurrent refresh which
+		// rotated its token is seen to have done so below
+		var session models.RefreshToken
+		err = tx.Get(&session,
+			"SELECT * FROM refresh_tokens WHERE user_id = $1 AND device_id = $2 FOR UPDATE", claims.UserID, deviceID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			c.Error(err)
+			return
+		}
+		sessionFound := err == nil
+
+		var rotated models.RotatedRefreshToken
+		err = tx.Get(&rotated, "SELECT * FROM rotated_refresh_tokens WHERE token_id::TEXT = $1", claims.ID)
+		if err == nil {
+			// Tabs refreshing at once all present the same token, and all but
+			// the first find it rotated out. Shortly after its rotation, the
+			// token rotated out last is thus given its successor again.
+			successor, ok := gracefulSuccessor(sessionFound, &session, &rotated, refreshToken)
+			if !ok {
+				// Otherwise the token must have been stolen, as the client it
+				// was issued to has been given its successor. Since it is not
+				// known which of the two parties presents it, the whole family
+				// is revoked, logging both out. The revocation is committed, so
+				// err is left unset.
+				_, err = utils_db.RevokeSessions(tx, "family_id = $1", rotated.FamilyID)
 				if err != nil {
 					c.Error(err)
 					return
 				}
 
-				userProfile, err := utils_db.FetchOne[models.UserProfile](db, "SELECT * FROM user_profiles WHERE id = $1", storedUser.ID.String())
+				err = utils_db.InsertSecurityEvent(claims.UserID, models.RefreshTokenReuseEvent, deviceID, client, tx)
 				if err != nil {
 					c.Error(err)
 					return
 				}
 
-				c.JSON(http.StatusOK, gin.H{
-					"uuid":     storedUser.ID,
-					"username": storedUser.Username,
-					"account": gin.H{
-						"id":           storedUser.ID,
-						"username":     storedUser.Username,
-						"access_token": newAccessToken,
-					},
-					"profile":       userProfile,
-					"refresh_token": refreshToken,
-				})
+				log.Printf("[RefreshToken] revoked token family %s of user %s: rotated refresh token %s was reused\n",
+					rotated.FamilyID, claims.UserID, claims.ID)
+				c.Header("X-Refresh-Token", "failed")
+				c.Error(api_error.NewFromStr("refresh token reused", http.StatusUnauthorized))
+				return
+			}
+
+			refreshToken = successor
+		} else if errors.Is(err, sql.ErrNoRows) {
+			// Check whether refresh token has been invalidated before its expiry
+			if !sessionFound || session.TokenID.String() != claims.ID || session.FamilyID != claims.SessionID ||
+				!utils_auth.VerifyArgon2Hash(refreshToken, session.TokenHash) {
+				err = api_error.NewFromStr("refresh token invalid", http.StatusUnauthorized)
+				c.Header("X-Refresh-Token", "failed")
+				c.Error(err)
+				return
 			}
-		default:
-			c.Error(api_error.NewFromStr("refresh session type invalid", http.StatusInternalServerError))
+
+			refreshToken, err = utils_auth.RotateRefreshToken(&session, refreshToken, claims.ExpiresAt.Time, client, tx)
+			if err != nil {
+				c.Header("X-Refresh-Token", "failed")
+				c.Error(err)
+				return
+			}
+		} else {
+			c.Error(err)
+			return
+		}
+
+		newAccessToken, err := utils_auth.GenerateAccessToken(claims.UserID, storedUser.Role, session.FamilyID)
+		if err != nil {
+			c.Header("X-Refresh-Token", "failed")
+			c.Error(err)
 			return
 		}
+
+		c.Header("X-Refresh-Token", "success")
+		c.SetCookie("Refresh-Token", refreshToken, utils_auth.JWT_REFRESH_TOKEN_EXPIRATION_MAX_AGE, "/", "", SecureCookieEnabled, true)
+
+		switch tokenType {
+		case "continue":
+			c.JSON(http.StatusCreated, gin.H{
+				"access_token": newAccessToken,
+			})
+		case "first":
+			var userProfile models.UserProfile
+			err = tx.Get(&userProfile, "SELECT * FROM user_profiles WHERE id = $1", storedUser.ID)
+			if err != nil {
+				c.Error(err)
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{
+				"uuid":     storedUser.ID,
+				"username": storedUser.Username,
+				"account": gin.H{
+					"id":           storedUser.ID,
+					"username":     storedUser.Username,
+					"access_token": newAccessToken,
+				},
+				"profile":       userProfile,
+				"refresh_token": refreshToken,
+			})
+		}
 	}
 }
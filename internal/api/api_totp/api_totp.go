@@ -0,0 +1,485 @@
+package api_totp
+
+import (
+	"1chanserver/internal/api/api_user"
+	"1chanserver/internal/models"
+	"1chanserver/internal/models/api_error"
+	"1chanserver/internal/utils/utils_auth"
+	"1chanserver/internal/utils/utils_db"
+	"1chanserver/internal/utils/utils_handler"
+	"1chanserver/internal/utils/utils_totp"
+	"database/sql"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"net/http"
+	"time"
+)
+
+var errInvalidChallenge = api_error.NewFromStr("invalid or expired login challenge", http.StatusUnauthorized)
+
+// Status returns whether the user has two-factor authentication enabled,
+// and how many of their recovery codes are left.
+func Status(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	status, err := utils_db.FetchOne[models.TOTPStatus](db, `
+		SELECT
+			t.enabled_date IS NOT NULL AS enabled, t.enabled_date,
+			(SELECT COUNT(*) FROM totp_recovery_codes WHERE user_id = $1 AND used_date IS NULL) AS recovery_codes_remaining
+		FROM (SELECT $1::UUID AS user_id) u
+		LEFT JOIN user_totp t ON t.user_id = u.user_id
+		`, userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+// Enrol starts enrolling the user in two-factor authentication once they
+// confirm their password, and returns the secret to add to their
+// authenticator app. Enrolment is completed by Confirm.
+func Enrol(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	request, err := utils_handler.GetStringMap(c)
+	if err != nil {
+		c.Error(api_error.NewFromErr(err, http.StatusBadRequest))
+		return
+	}
+
+	err = api_user.Reauthenticate(c, db, userID, request["password"])
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	enabled, err := utils_db.FetchOne[bool](db,
+		"SELECT EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1 AND enabled_date IS NOT NULL)", userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if enabled {
+		c.Error(api_error.NewFromStr("two-factor authentication is already enabled", http.StatusConflict))
+		return
+	}
+
+	username, err := utils_db.FetchOne[string](db, "SELECT username FROM users WHERE id = $1", userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	secret, err := utils_totp.GenerateSecret()
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	// Enrolling again replaces the pending secret
+	_, err = db.Exec(`
+		INSERT INTO user_totp(user_id, secret) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, last_used_step = 0
+		`, userID, secret)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":           secret,
+		"provisioning_uri": utils_totp.ProvisioningURI(secret, models.TOTP_ISSUER, username),
+	})
+}
+
+// Confirm enables two-factor authentication once the user enters a first
+// valid code from their authenticator app, and returns their recovery codes.
+// These are only ever shown once.
+func Confirm(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	request, err := utils_handler.GetStringMap(c)
+	if err != nil || request["code"] == "" {
+		c.Error(api_error.NewFromStr("missing code", http.StatusBadRequest))
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	defer utils_db.HandleTxRollback(tx, &err, c)
+
+	var totp models.UserTOTP
+	err = tx.Get(&totp, "SELECT * FROM user_totp WHERE user_id = $1 FOR UPDATE", userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.Error(api_error.NewFromStr("two-factor authentication enrolment has not been started", http.StatusConflict))
+			return
+		}
+
+		c.Error(err)
+		return
+	}
+
+	if totp.IsEnabled() {
+		err = api_error.NewFromStr("two-factor authentication is already enabled", http.StatusConflict)
+		c.Error(err)
+		return
+	}
+
+	ok, err := useCode(tx, &totp, request["code"])
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if !ok {
+		err = api_error.NewFromStr("invalid code", http.StatusBadRequest)
+		c.Error(err)
+		return
+	}
+
+	_, err = tx.Exec("UPDATE user_totp SET enabled_date = $1 WHERE user_id = $2", time.Now().UTC(), userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	recoveryCodes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"recovery_codes": recoveryCodes,
+	})
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes once they
+// confirm their password, and returns the new ones.
+func RegenerateRecoveryCodes(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	request, err := utils_handler.GetStringMap(c)
+	if err != nil {
+		c.Error(api_error.NewFromErr(err, http.StatusBadRequest))
+		return
+	}
+
+	err = api_user.Reauthenticate(c, db, userID, request["password"])
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	defer utils_db.HandleTxRollback(tx, &err, c)
+
+	var enabled bool
+	err = tx.Get(&enabled,
+		"SELECT EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1 AND enabled_date IS NOT NULL)", userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if !enabled {
+		err = api_error.NewFromStr("two-factor authentication is not enabled", http.StatusConflict)
+		c.Error(err)
+		return
+	}
+
+	recoveryCodes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"recovery_codes": recoveryCodes,
+	})
+}
+
+// Disable turns off two-factor authentication once the user confirms
+// their password, removing their secret and recovery codes.
+func Disable(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	request, err := utils_handler.GetStringMap(c)
+	if err != nil {
+		c.Error(api_error.NewFromErr(err, http.StatusBadRequest))
+		return
+	}
+
+	err = api_user.Reauthenticate(c, db, userID, request["password"])
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	defer utils_db.HandleTxRollback(tx, &err, c)
+
+	result, err := tx.Exec("DELETE FROM user_totp WHERE user_id = $1", userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if deleted == 0 {
+		err = api_error.NewFromStr("two-factor authentication is not enabled", http.StatusConflict)
+		c.Error(err)
+		return
+	}
+
+	_, err = tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id = $1", userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	_, err = tx.Exec("DELETE FROM login_challenges WHERE user_id = $1", userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// VerifyLogin completes a login challenge issued by api_user.Login with a
+// code from the user's authenticator app or an unused recovery code, and
+// signs the user in. A challenge is void after too many wrong codes.
+func VerifyLogin(c *gin.Context) {
+	db := c.MustGet("db").(*sqlx.DB)
+
+	deviceID := c.GetHeader("Device-ID")
+	if deviceID == "" {
+		c.Error(api_error.NewFromStr("missing device ID", http.StatusBadRequest))
+		return
+	}
+
+	request, err := utils_handler.GetObj[models.TOTPLoginRequest](c)
+	if err != nil {
+		c.Error(api_error.NewFromErr(err, http.StatusBadRequest))
+		return
+	}
+
+	if request.Code == "" && request.RecoveryCode == "" {
+		c.Error(api_error.NewFromStr("either code or recovery_code is required", http.StatusBadRequest))
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	defer utils_db.HandleTxRollback(tx, &err, c)
+
+	challengeHash := utils_auth.HashOpaqueToken(request.Challenge)
+
+	var challenge models.LoginChallenge
+	err = tx.Get(&challenge, "SELECT * FROM login_challenges WHERE token_hash = $1 FOR UPDATE", challengeHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = errInvalidChallenge
+		}
+
+		c.Error(err)
+		return
+	}
+
+	if challenge.IsExpired() || challenge.DeviceID != deviceID || challenge.Attempts >= models.LOGIN_CHALLENGE_MAX_ATTEMPTS {
+		err = errInvalidChallenge
+		c.Error(err)
+		return
+	}
+
+	var totp models.UserTOTP
+	err = tx.Get(&totp, "SELECT * FROM user_totp WHERE user_id = $1 AND enabled_date IS NOT NULL FOR UPDATE", challenge.UserID)
+	if err != nil {
+		// Two-factor authentication was disabled since the challenge was issued
+		if errors.Is(err, sql.ErrNoRows) {
+			err = errInvalidChallenge
+		}
+
+		c.Error(err)
+		return
+	}
+
+	// The user's TOTP row is locked, so concurrent attempts are counted in turn
+	failedAttempts, err := countFailedAttempts(tx, challenge.UserID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if failedAttempts >= models.TOTP_MAX_FAILED_ATTEMPTS {
+		err = api_error.NewFromStr("too many failed attempts, please try again later", http.StatusTooManyRequests)
+		c.Error(err)
+		return
+	}
+
+	var ok bool
+	if request.Code != "" {
+		ok, err = useCode(tx, &totp, request.Code)
+	} else {
+		ok, err = useRecoveryCode(tx, challenge.UserID, request.RecoveryCode)
+	}
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if !ok {
+		// The failed attempt is committed, so err is left unset
+		_, err = tx.Exec("UPDATE login_challenges SET attempts = attempts + 1 WHERE token_hash = $1", challengeHash)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		_, err = tx.Exec("INSERT INTO totp_failed_attempts(user_id) VALUES ($1)", challenge.UserID)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		c.Error(api_error.NewFromStr("invalid code", http.StatusUnauthorized))
+		return
+	}
+
+	_, err = tx.Exec("DELETE FROM login_challenges WHERE token_hash = $1", challengeHash)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	// The account may have been suspended since the challenge was issued
+	var storedUser models.User
+	err = tx.Get(&storedUser, "SELECT * FROM users WHERE id = $1", challenge.UserID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	err = api_user.CheckCanSignIn(&storedUser)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	err = api_user.SignIn(c, tx, &storedUser, deviceID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+}
+
+// countFailedAttempts returns how many two-factor attempts of the user
+// have failed within models.TOTP_FAILED_ATTEMPT_WINDOW.
+func countFailedAttempts(tx *sqlx.Tx, userID uuid.UUID) (int, error) {
+	var count int
+	err := tx.Get(&count,
+		"SELECT COUNT(*) FROM totp_failed_attempts WHERE user_id = $1 AND attempt_date > $2",
+		userID, time.Now().UTC().Add(-models.TOTP_FAILED_ATTEMPT_WINDOW))
+	return count, err
+}
+
+// useCode reports whether code is currently valid for totp, and if so
+// records it as used so that it cannot be replayed.
+func useCode(tx *sqlx.Tx, totp *models.UserTOTP, code string) (bool, error) {
+	step, ok := utils_totp.Validate(totp.Secret, code, time.Now(), totp.LastUsedStep)
+	if !ok {
+		return false, nil
+	}
+
+	_, err := tx.Exec("UPDATE user_totp SET last_used_step = $1 WHERE user_id = $2", step, totp.UserID)
+	if err != nil {
+		return false, err
+	}
+
+	totp.LastUsedStep = step
+	return true, nil
+}
+
+// useRecoveryCode reports whether code is one of the user's unused
+// recovery codes, and if so marks it as used.
+func useRecoveryCode(tx *sqlx.Tx, userID uuid.UUID, code string) (bool, error) {
+	var recoveryCodes []struct {
+		ID       int64  `db:"id"`
+		CodeHash string `db:"code_hash"`
+	}
+	err := tx.Select(&recoveryCodes,
+		"SELECT id, code_hash FROM totp_recovery_codes WHERE user_id = $1 AND used_date IS NULL FOR UPDATE", userID)
+	if err != nil {
+		return false, err
+	}
+
+	code = utils_totp.NormaliseRecoveryCode(code)
+	for _, recoveryCode := range recoveryCodes {
+		if !utils_auth.VerifyArgon2Hash(code, recoveryCode.CodeHash) {
+			continue
+		}
+
+		_, err = tx.Exec("UPDATE totp_recovery_codes SET used_date = $1 WHERE id = $2", time.Now().UTC(), recoveryCode.ID)
+		if err != nil {
+			return false, err
+		}
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// replaceRecoveryCodes replaces the user's recovery codes with new ones,
+// of which only the hashes are stored, and returns them.
+func replaceRecoveryCodes(tx *sqlx.Tx, userID uuid.UUID) ([]string, error) {
+	_, err := tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id = $1", userID)
+	if err != nil {
+		return nil, err
+	}
+
+	recoveryCodes, err := utils_totp.GenerateRecoveryCodes(models.RECOVERY_CODE_COUNT)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, recoveryCode := range recoveryCodes {
+		_, err = tx.Exec("INSERT INTO totp_recovery_codes(user_id, code_hash) VALUES ($1, $2)",
+			userID, utils_auth.GenerateArgon2Hash(utils_totp.NormaliseRecoveryCode(recoveryCode)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return recoveryCodes, nil
+}
@@ -1,16 +1,28 @@
 package api_user
 
 import (
+	"1chanserver/internal/api/api_files"
 	"1chanserver/internal/api/api_token"
+	"1chanserver/internal/mailer"
 	"1chanserver/internal/models"
 	"1chanserver/internal/models/api_error"
+	"1chanserver/internal/routes"
 	"1chanserver/internal/utils/utils_auth"
 	"1chanserver/internal/utils/utils_db"
 	"1chanserver/internal/utils/utils_handler"
+	"archive/zip"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/jmoiron/sqlx"
-	//"log"
+	"io"
+	"log"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
 	"time"
 
 	"github.com/google/uuid"
@@ -66,27 +78,13 @@ func Register(c *gin.Context) {
 	}
 
 	// Generate access and refresh tokens
-	accessToken, err := utils_auth.GenerateAccessToken(newUser.ID)
+	refreshToken, sessionID, err := utils_auth.IssueRefreshToken(newUser.ID, deviceID, utils_handler.GetSessionClient(c), db)
 	if err != nil {
 		c.Error(err)
 		return
 	}
 
-	refreshToken, err := utils_auth.GenerateRefreshToken(newUser.ID)
-	if err != nil {
-		c.Error(err)
-		return
-	}
-
-	hashedRefreshToken := utils_auth.HashRefreshToken(refreshToken)
-
-	//log.Printf(
-	//	"Inserting refresh token %s for user %s at time %s",
-	//	hashedRefreshToken,
-	//	newUser.ID,
-	//	time.Now().UTC().Format("2006-01-02 15:04:05"))
-
-	err = utils_db.InsertRefreshToken(&newUser, hashedRefreshToken, time.Now().UTC().Add(utils_auth.JWT_REFRESH_TOKEN_EXPIRATION), deviceID, db)
+	accessToken, err := utils_auth.GenerateAccessToken(newUser.ID, models.RegularUserRole, sessionID)
 	if err != nil {
 		c.Error(err)
 		return
@@ -150,85 +148,178 @@ func Login(c *gin.Context) {
 		return
 	}
 
-	accessToken, err := utils_auth.GenerateAccessToken(storedUser.ID)
+	err = CheckCanSignIn(&storedUser)
 	if err != nil {
 		c.Error(err)
 		return
 	}
 
-	var refreshToken string
-	var hasRefreshToken int
-	err = db.Get(&hasRefreshToken,
-		"SELECT COUNT(*) FROM refresh_tokens WHERE user_id = $1 AND device_id = $2",
-		storedUser.ID, deviceID)
+	err = SignInOrChallenge(c, tx, &storedUser, deviceID)
 	if err != nil {
 		c.Error(err)
 		return
 	}
+}
+
+// Reauthenticate returns an error unless the user confirms a sensitive
+// action. Users with a password confirm it with their password, whereas
+// those who sign in with a provider or a passkey only must have signed in
+// within models.REAUTHENTICATION_WINDOW, so that a stolen access token is
+// not enough to take over their account. It must be used after Auth.
+func Reauthenticate(c *gin.Context, db *sqlx.DB, userID uuid.UUID, password string) error {
+	storedPasswordHash, err := utils_db.FetchOne[string](db, "SELECT password_hash FROM users WHERE id = $1", userID)
+	if err != nil {
+		return err
+	}
 
-	if hasRefreshToken != 0 {
-		_, err = tx.Exec(
-			"DELETE FROM refresh_tokens WHERE user_id = $1 AND device_id = $2",
-			storedUser.ID, deviceID)
+	if storedPasswordHash != "" {
+		if !utils_auth.VerifyArgon2Hash(password, storedPasswordHash) {
+			return api_error.NewFromStr("incorrect password", http.StatusForbidden)
+		}
 
+		return nil
+	}
+
+	// Sessions start on sign in, and keep their creation date when refreshed
+	signInDate, err := utils_db.FetchOne[time.Time](db,
+		"SELECT creation_date FROM refresh_tokens WHERE family_id = $1 AND user_id = $2",
+		c.MustGet("SessionID").(uuid.UUID), userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	if err != nil || time.Since(signInDate) > models.REAUTHENTICATION_WINDOW {
+		return api_error.NewFromStr("please sign in again to confirm this action", http.StatusForbidden)
+	}
+
+	return nil
+}
+
+// CheckCanSignIn returns an error if user may not sign in, because their
+// account is suspended or deleted past its grace period.
+func CheckCanSignIn(user *models.User) error {
+	if user.IsDeleted() && !user.IsRestorable() {
+		return api_error.NewFromStr("this account has been deleted", http.StatusForbidden)
+	}
+
+	if user.IsSuspended() {
+		return api_error.New(
+			errors.New("account suspended"), http.StatusForbidden,
+			fmt.Sprintf("your account is suspended until %s", user.SuspendedUntil.Format(time.RFC3339)))
+	}
+
+	return nil
+}
+
+// SignIn replaces the session of the device with a new one for user, and
+// responds with their tokens and profile. An account deleted within its
+// grace period is restored. The user must have been authenticated and
+// checked with CheckCanSignIn beforehand.
+func SignIn(c *gin.Context, tx *sqlx.Tx, user *models.User, deviceID string) error {
+	restored := false
+	if user.IsDeleted() {
+		// Logging in within the grace period cancels the account's deletion
+		_, err := tx.Exec(
+			"UPDATE users SET deleted_at = NULL, deleted_by = NULL, delete_reason = NULL, deletion_mode = NULL WHERE id = $1",
+			user.ID)
 		if err != nil {
-			c.Error(err)
-			return
+			return err
 		}
+		restored = true
 	}
 
-	refreshToken, err = utils_auth.GenerateRefreshToken(storedUser.ID)
+	_, err := utils_db.RevokeSessions(tx, "user_id = $1 AND device_id = $2", user.ID, deviceID)
 	if err != nil {
-		c.Error(err)
-		return
+		return err
 	}
 
-	hashedRefreshToken := utils_auth.HashRefreshToken(refreshToken)
+	refreshToken, sessionID, err := utils_auth.IssueRefreshToken(user.ID, deviceID, utils_handler.GetSessionClient(c), tx)
+	if err != nil {
+		return err
+	}
 
-	_, err = tx.Exec(
-		"INSERT INTO refresh_tokens(user_id, token_hash, expiration_date, device_id) VALUES ($1, $2, $3, $4)",
-		storedUser.ID,
-		hashedRefreshToken,
-		time.Now().UTC().Add(utils_auth.JWT_REFRESH_TOKEN_EXPIRATION), deviceID)
+	accessToken, err := utils_auth.GenerateAccessToken(user.ID, user.Role, sessionID)
 	if err != nil {
-		c.Error(err)
-		return
+		return err
 	}
 
-	query := `
-	SELECT * FROM user_profiles WHERE id = $1
-	`
-	userProfile, err := utils_db.FetchOne[models.UserProfile](db, query, storedUser.ID)
+	var userProfile models.UserProfile
+	err = tx.Get(&userProfile, "SELECT * FROM user_profiles WHERE id = $1", user.ID)
 	if err != nil {
-		c.Error(err)
-		return
+		return err
 	}
 
 	_, err = tx.Exec("UPDATE user_profiles SET last_login = $1 WHERE id = $2",
-		time.Now().UTC(), storedUser.ID)
+		time.Now().UTC(), user.ID)
 	if err != nil {
-		c.Error(err)
-		return
+		return err
 	}
 
 	c.SetCookie("Refresh-Token", refreshToken, 3600*24*14, "/", "", api_token.SecureCookieEnabled, true)
 
 	c.JSON(http.StatusOK, gin.H{
-		"uuid":     storedUser.ID,
-		"username": storedUser.Username,
+		"uuid":     user.ID,
+		"username": user.Username,
 		"account": gin.H{
-			"id":           storedUser.ID,
-			"username":     storedUser.Username,
+			"id":           user.ID,
+			"username":     user.Username,
 			"access_token": accessToken,
 		},
 		"refresh_token": refreshToken,
 		"profile":       userProfile,
+		"restored":      restored,
 	})
+	return nil
+}
+
+// SignInOrChallenge signs user in with SignIn, unless they have two-factor
+// authentication enabled, in which case they only get their tokens once
+// they complete the login challenge it responds with instead.
+func SignInOrChallenge(c *gin.Context, tx *sqlx.Tx, user *models.User, deviceID string) error {
+	var twoFactorEnabled bool
+	err := tx.Get(&twoFactorEnabled,
+		"SELECT EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1 AND enabled_date IS NOT NULL)", user.ID)
+	if err != nil {
+		return err
+	}
+
+	if !twoFactorEnabled {
+		return SignIn(c, tx, user, deviceID)
+	}
+
+	challenge, err := createLoginChallenge(tx, user.ID, deviceID)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"two_factor_required": true,
+		"challenge":           challenge,
+		"expiration_date":     time.Now().UTC().Add(models.LOGIN_CHALLENGE_EXPIRATION),
+	})
+	return nil
+}
+
+// createLoginChallenge returns a new login challenge for the user on deviceID.
+func createLoginChallenge(tx *sqlx.Tx, userID uuid.UUID, deviceID string) (string, error) {
+	challenge, challengeHash, err := utils_auth.GenerateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO login_challenges(token_hash, user_id, device_id, expiration_date) VALUES ($1, $2, $3, $4)",
+		challengeHash, userID, deviceID, time.Now().UTC().Add(models.LOGIN_CHALLENGE_EXPIRATION))
+	if err != nil {
+		return "", err
+	}
+
+	return challenge, nil
 }
 
 func Logout(c *gin.Context) {
 	db := c.MustGet("db").(*sqlx.DB)
-	refreshToken, err := c.Cookie("Refresh-Token")
+	_, err := c.Cookie("Refresh-Token")
 	userID := c.MustGet("UserID").(uuid.UUID)
 	deviceID := c.GetHeader("Device-ID")
 
@@ -238,8 +329,10 @@ func Logout(c *gin.Context) {
 		return
 	}
 
-	_, err = db.Exec("DELETE FROM refresh_tokens WHERE token_hash = $1 AND user_id = $2 AND device_id = $3",
-		refreshToken, userID, deviceID)
+	// Refresh tokens are stored as salted hashes, so the device's session
+	// is ended rather than looked up by its token. Its access token is
+	// denylisted along with it.
+	_, err = utils_db.RevokeSessions(db, "user_id = $1 AND device_id = $2", userID, deviceID)
 	if err != nil {
 		c.Error(err)
 		c.Abort()
@@ -250,6 +343,9 @@ func Logout(c *gin.Context) {
 	c.Status(http.StatusOK)
 }
 
+// UpdateProfile updates the user's biodata and email, when given. A
+// new email is only saved once the user follows the confirmation link sent
+// to it, whereas an empty email removes the current one straight away.
 func UpdateProfile(c *gin.Context) {
 	db, userID := utils_handler.GetReqCx(c)
 
@@ -259,20 +355,60 @@ func UpdateProfile(c *gin.Context) {
 		return
 	}
 
-	query := `
-	UPDATE user_profiles 
-	SET biodata = $1, email = $2
-	WHERE id = $3
-	`
+	email, hasEmail := newProfile["email"]
+	if hasEmail && email != "" {
+		email, err = parseEmail(email)
+		if err != nil {
+			c.Error(api_error.New(err, http.StatusBadRequest, "invalid email"))
+			return
+		}
+	}
 
-	_, err = db.Exec(query, newProfile["biodata"], newProfile["email"], userID)
+	if biodata, hasBiodata := newProfile["biodata"]; hasBiodata {
+		_, err = db.Exec("UPDATE user_profiles SET biodata = $1 WHERE id = $2", biodata, userID)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+	}
+
+	if !hasEmail {
+		c.Status(http.StatusOK)
+		return
+	}
+
+	if email == "" {
+		_, err = db.Exec("UPDATE user_profiles SET email = NULL, email_verified = FALSE WHERE id = $1", userID)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		c.Status(http.StatusOK)
+		return
+	}
+
+	currentEmail, err := utils_db.FetchOne[*string](db, "SELECT email FROM user_profiles WHERE id = $1", userID)
 	if err != nil {
 		c.Error(err)
 		return
 	}
 
-	c.Status(http.StatusOK)
-	return
+	if currentEmail != nil && *currentEmail == email {
+		c.Status(http.StatusOK)
+		return
+	}
+
+	token, err := createEmailToken(db, userID, models.ChangeEmailPurpose, email, models.EMAIL_TOKEN_EXPIRATION)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	mailer.SendAndLog(emailConfirmationMessage(email, token))
+	c.JSON(http.StatusAccepted, gin.H{
+		"pending_email": email,
+	})
 }
 
 func GetProfile(isOwner bool) gin.HandlerFunc {
@@ -296,7 +432,7 @@ func GetProfile(isOwner bool) gin.HandlerFunc {
 			profile, err = utils_db.FetchOne[models.UserProfile](
 				db, query, userID)
 		} else {
-			query = "SELECT id, profile_picture_path, biodata, email, post_count, comment_count, creation_date FROM user_profiles up, users u WHERE u.id = up.id AND u.username = $1"
+			query = "SELECT id, profile_picture_path, biodata, email, post_count, comment_count, creation_date FROM user_profiles up, users u WHERE u.id = up.id AND u.username = $1 AND u.deleted_at IS NULL"
 			profile, err = utils_db.FetchOne[models.UserProfile](
 				db, query, username)
 		}
@@ -310,17 +446,175 @@ func GetProfile(isOwner bool) gin.HandlerFunc {
 	}
 }
 
+// Delete deletes the user's account once they confirm their password. The
+// account is restored if they log in again within models.DELETION_GRACE_PERIOD,
+// and purged otherwise, along with or leaving behind their anonymised content.
 func Delete(c *gin.Context) {
 	db, userID := utils_handler.GetReqCx(c)
-	err := utils_db.DeleteUser(&userID, db)
+	deletionRequest, err := utils_handler.GetObj[models.AccountDeletionRequest](c)
+	if err != nil {
+		c.Error(api_error.NewFromErr(err, http.StatusBadRequest))
+		return
+	}
+
+	if !deletionRequest.Content.IsValid() {
+		c.Error(api_error.NewFromStr("content must be either anonymise or remove", http.StatusBadRequest))
+		return
+	}
+
+	err = Reauthenticate(c, db, userID, deletionRequest.Password)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	err = utils_db.DeleteUser(&userID, deletionRequest.Content, deletionRequest.Reason, db)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.SetCookie("Refresh-Token", "", 0, "/", "*", api_token.SecureCookieEnabled, true)
+	c.JSON(http.StatusOK, gin.H{
+		"purge_date": time.Now().UTC().Add(models.DELETION_GRACE_PERIOD),
+	})
+}
+
+// Export sends the user a zip archive of their personal data, as data.json,
+// along with the files they uploaded under files/.
+func Export(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	var export models.DataExport
+	err := db.Get(&export.Account, "SELECT username, role, suspended_until FROM users WHERE id = $1", userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	err = db.Get(&export.Profile, "SELECT * FROM user_profiles WHERE id = $1", userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	sections := []struct {
+		dest  interface{}
+		query string
+	}{
+		{&export.Threads, "SELECT * FROM threads WHERE user_id = $1 ORDER BY id"},
+		{&export.Comments, "SELECT * FROM comments WHERE user_id = $1 ORDER BY id"},
+		{&export.ThreadLikes, "SELECT thread_id AS id, variant FROM user_thread_likes WHERE user_id = $1"},
+		{&export.CommentLikes, "SELECT comment_id AS id, variant FROM user_comment_likes WHERE user_id = $1"},
+		{&export.PollVotes, `
+			SELECT p.thread_id, p.question, po.option_text
+			FROM user_poll_votes v
+			JOIN polls p ON p.id = v.poll_id
+			JOIN poll_options po ON po.poll_id = v.poll_id AND po.option_id = v.poll_option_id
+			WHERE v.user_id = $1
+			ORDER BY v.poll_id, v.poll_option_id
+			`},
+		{&export.Messages, `
+			SELECT
+				ou.username AS conversation_with, su.username AS sender_username,
+				dm.content, dm.creation_date, dm.read_date
+			FROM direct_messages dm
+			JOIN users ou ON ou.id = CASE WHEN dm.user_a_id = $1 THEN dm.user_b_id ELSE dm.user_a_id END
+			JOIN users su ON su.id = dm.sender_id
+			WHERE dm.user_a_id = $1 OR dm.user_b_id = $1
+			ORDER BY dm.creation_date
+			`},
+		{&export.SearchHistory, "SELECT query, creation_date FROM user_search_history WHERE user_id = $1 ORDER BY creation_date"},
+		{&export.SavedSearches, "SELECT * FROM saved_searches WHERE user_id = $1 ORDER BY id"},
+	}
 
+	for _, section := range sections {
+		err = db.Select(section.dest, section.query, userID)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+	}
+
+	channelPictures, err := utils_db.FetchAll[string](db,
+		"SELECT channel_picture_path FROM channels WHERE creator_id = $1 AND channel_picture_path IS NOT NULL", userID)
 	if err != nil {
 		c.Error(err)
 		return
 	}
 
+	// Files are collected from the profile, the channels the user created,
+	// and the images embedded in their threads and comments
+	var files []string
+	if export.Profile.ProfilePicturePath != nil {
+		files = append(files, api_files.UploadedFilePath("profile_pictures", *export.Profile.ProfilePicturePath))
+	}
+	for _, channelPicture := range channelPictures {
+		files = append(files, api_files.UploadedFilePath("channel_pictures", channelPicture))
+	}
+	for _, thread := range export.Threads {
+		files = append(files, api_files.UploadedFilePaths(thread.OriginalPost)...)
+	}
+	for _, comment := range export.Comments {
+		files = append(files, api_files.UploadedFilePaths(comment.Comment.Comment)...)
+	}
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", `attachment; filename="1chan-data-export.zip"`)
 	c.Status(http.StatusOK)
-	return
+
+	// Errors can no longer be reported to the user once the archive is being sent
+	archive := zip.NewWriter(c.Writer)
+	defer func() {
+		if err := archive.Close(); err != nil {
+			log.Printf("[Export] failed to finish archive: %s\n", err.Error())
+		}
+	}()
+
+	data, err := archive.Create("data.json")
+	if err != nil {
+		log.Printf("[Export] failed to add data: %s\n", err.Error())
+		return
+	}
+
+	encoder := json.NewEncoder(data)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(export)
+	if err != nil {
+		log.Printf("[Export] failed to encode data: %s\n", err.Error())
+		return
+	}
+
+	added := make(map[string]bool)
+	for _, file := range files {
+		if added[file] {
+			continue
+		}
+		added[file] = true
+
+		err = addFileToArchive(archive, file)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("[Export] failed to add %s: %s\n", file, err.Error())
+		}
+	}
+}
+
+// addFileToArchive copies the uploaded file at path, relative to
+// api_files.UPLOADS_DIR, into archive under files/.
+func addFileToArchive(archive *zip.Writer, path string) error {
+	file, err := os.Open(filepath.Join(api_files.UPLOADS_DIR, path))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	entry, err := archive.Create(filepath.ToSlash(filepath.Join("files", path)))
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(entry, file)
+	return err
 }
 
 func Likes(c *gin.Context) {
@@ -379,7 +673,7 @@ func Threads() gin.HandlerFunc {
 		db, userID := utils_handler.GetReqCx(c)
 
 		query := `
-		SELECT id FROM threads WHERE user_id = $1
+		SELECT id FROM threads WHERE user_id = $1 AND deleted_at IS NULL
 		`
 
 		rows, err := db.Queryx(query, userID)
@@ -408,7 +702,7 @@ func Comments() gin.HandlerFunc {
 		db, userID := utils_handler.GetReqCx(c)
 
 		query := `
-		SELECT id FROM comments WHERE user_id = $1
+		SELECT id FROM comments WHERE user_id = $1 AND deleted_at IS NULL
 		`
 		rows, err := db.Queryx(query, userID)
 		if err != nil {
@@ -448,24 +742,359 @@ func UpdatePassword() gin.HandlerFunc {
 			return
 		}
 
-		storedPasswordHash, err := utils_db.FetchOne[string](db, "SELECT password_hash FROM users WHERE id = $1", userID)
+		// Users who signed up with a provider or a passkey have no password
+		// to confirm when setting their first one, and must have signed in
+		// recently instead
+		err := Reauthenticate(c, db, userID, oldPassword)
 		if err != nil {
 			c.Error(err)
 			return
 		}
 
-		if utils_auth.VerifyArgon2Hash(oldPassword, storedPasswordHash) {
-			newPasswordHash := utils_auth.GenerateArgon2Hash(newPassword)
-			_, err = db.Exec("UPDATE users SET password_hash = $1 WHERE id = $2", newPasswordHash, userID)
-			if err != nil {
-				c.Error(err)
-				return
-			}
-		} else {
-			c.Status(http.StatusForbidden)
+		newPasswordHash := utils_auth.GenerateArgon2Hash(newPassword)
+		_, err = db.Exec("UPDATE users SET password_hash = $1 WHERE id = $2", newPasswordHash, userID)
+		if err != nil {
+			c.Error(err)
 			return
 		}
 
 		c.Status(http.StatusOK)
 	}
 }
+
+// UpdateRole changes the role of the user identified by the username path
+// parameter. The new role takes effect the next time their access token
+// is refreshed.
+func UpdateRole(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+	username := c.Param("username")
+
+	request, err := utils_handler.GetStringMap(c)
+	if err != nil {
+		c.Error(api_error.NewFromStr("invalid object", http.StatusBadRequest))
+		return
+	}
+
+	role := models.UserRole(request["role"])
+	if !role.IsValid() {
+		c.Error(api_error.NewFromStr("invalid role", http.StatusBadRequest))
+		return
+	}
+
+	user, err := utils_db.GetUserByUsername(&username, db)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	// Prevent admins from accidentally locking themselves out
+	if user.ID == userID {
+		c.Error(api_error.NewFromStr("you cannot change your own role", http.StatusForbidden))
+		return
+	}
+
+	_, err = db.Exec("UPDATE users SET role = $1 WHERE id = $2", role, user.ID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// VerifyEmail verifies the user's email, or changes it to the new email
+// they confirmed, with the token emailed to them.
+func VerifyEmail(c *gin.Context) {
+	db := c.MustGet("db").(*sqlx.DB)
+
+	request, err := utils_handler.GetStringMap(c)
+	if err != nil || request["token"] == "" {
+		c.Error(api_error.NewFromStr("missing token", http.StatusBadRequest))
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	defer utils_db.HandleTxRollback(tx, &err, c)
+
+	emailToken, err := consumeEmailToken(tx, request["token"], models.VerifyEmailPurpose, models.ChangeEmailPurpose)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	var profile models.UserProfile
+	err = tx.Get(&profile, "SELECT * FROM user_profiles WHERE id = $1 FOR UPDATE", emailToken.UserID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	switch emailToken.Purpose {
+	case models.VerifyEmailPurpose:
+		// The link is void once the user has changed their email since
+		if profile.Email == nil || *profile.Email != emailToken.Email {
+			err = errInvalidEmailToken
+			c.Error(err)
+			return
+		}
+
+		_, err = tx.Exec("UPDATE user_profiles SET email_verified = TRUE WHERE id = $1", emailToken.UserID)
+	case models.ChangeEmailPurpose:
+		_, err = tx.Exec("UPDATE user_profiles SET email = $1, email_verified = TRUE WHERE id = $2",
+			emailToken.Email, emailToken.UserID)
+	}
+	if err != nil {
+		if utils_db.CheckDuplicateError(err) {
+			c.Error(api_error.NewFromStr("email is already in use", http.StatusConflict))
+			return
+		}
+
+		c.Error(err)
+		return
+	}
+
+	// Let the previous address know, in case the account was taken over
+	if emailToken.Purpose == models.ChangeEmailPurpose && profile.EmailVerified && *profile.Email != emailToken.Email {
+		mailer.SendAndLog(emailChangedMessage(*profile.Email, emailToken.Email))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"email": emailToken.Email,
+	})
+}
+
+// ResendVerification emails the user a new link to verify their email.
+func ResendVerification(c *gin.Context) {
+	db, userID := utils_handler.GetReqCx(c)
+
+	profile, err := utils_db.FetchOne[models.UserProfile](db, "SELECT * FROM user_profiles WHERE id = $1", userID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if profile.Email == nil {
+		c.Error(api_error.NewFromStr("you have not set an email", http.StatusBadRequest))
+		return
+	}
+
+	if profile.EmailVerified {
+		c.Error(api_error.NewFromStr("your email is already verified", http.StatusConflict))
+		return
+	}
+
+	token, err := createEmailToken(db, userID, models.VerifyEmailPurpose, *profile.Email, models.EMAIL_TOKEN_EXPIRATION)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	mailer.SendAndLog(emailVerificationMessage(*profile.Email, token))
+	c.Status(http.StatusAccepted)
+}
+
+// ForgotPassword emails a password reset link to the account with the given
+// verified email. The response is the same whether or not such an account
+// exists, so that it cannot be used to find out who has an account.
+func ForgotPassword(c *gin.Context) {
+	db := c.MustGet("db").(*sqlx.DB)
+
+	request, err := utils_handler.GetStringMap(c)
+	if err != nil || request["email"] == "" {
+		c.Error(api_error.NewFromStr("missing email", http.StatusBadRequest))
+		return
+	}
+
+	var account struct {
+		ID    uuid.UUID `db:"id"`
+		Email string    `db:"email"`
+	}
+	err = db.Get(&account, `
+		SELECT up.id, up.email
+		FROM user_profiles up
+		JOIN users u ON u.id = up.id
+		WHERE LOWER(up.email) = LOWER($1) AND up.email_verified AND u.deleted_at IS NULL
+		`, request["email"])
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		c.Error(err)
+		return
+	default:
+		token, err := createEmailToken(db, account.ID, models.ResetPasswordPurpose, account.Email, models.PASSWORD_RESET_TOKEN_EXPIRATION)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		mailer.SendAndLog(passwordResetMessage(account.Email, token))
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "if an account with this verified email exists, a password reset link has been sent to it",
+	})
+}
+
+// ResetPassword sets a new password with the token emailed by ForgotPassword,
+// and signs the user out of every device.
+func ResetPassword(c *gin.Context) {
+	db := c.MustGet("db").(*sqlx.DB)
+
+	request, err := utils_handler.GetObj[models.PasswordResetRequest](c)
+	if err != nil {
+		c.Error(api_error.NewFromErr(err, http.StatusBadRequest))
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	defer utils_db.HandleTxRollback(tx, &err, c)
+
+	emailToken, err := consumeEmailToken(tx, request.Token, models.ResetPasswordPurpose)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	_, err = tx.Exec("UPDATE users SET password_hash = $1 WHERE id = $2",
+		utils_auth.GenerateArgon2Hash(request.NewPassword), emailToken.UserID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	_, err = utils_db.RevokeSessions(tx, "user_id = $1", emailToken.UserID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	mailer.SendAndLog(passwordChangedMessage(emailToken.Email))
+	c.SetCookie("Refresh-Token", "", 0, "/", "*", api_token.SecureCookieEnabled, true)
+	c.Status(http.StatusOK)
+}
+
+var errInvalidEmailToken = api_error.NewFromStr("invalid or expired token", http.StatusBadRequest)
+
+// parseEmail returns email if it is a bare email address, without a display name.
+func parseEmail(email string) (string, error) {
+	address, err := mail.ParseAddress(email)
+	if err != nil {
+		return "", err
+	}
+
+	if address.Address != email {
+		return "", errors.New("email must not include a name")
+	}
+
+	return address.Address, nil
+}
+
+// createEmailToken replaces the user's pending token for purpose with a new
+// one sent to email, and returns the token.
+func createEmailToken(db sqlx.Execer, userID uuid.UUID, purpose models.EmailTokenPurpose, email string, expiration time.Duration) (string, error) {
+	token, tokenHash, err := utils_auth.GenerateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO email_tokens(token_hash, user_id, purpose, email, expiration_date)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, purpose) DO UPDATE SET
+			token_hash = EXCLUDED.token_hash,
+			email = EXCLUDED.email,
+			creation_date = CURRENT_TIMESTAMP,
+			expiration_date = EXCLUDED.expiration_date
+		`, tokenHash, userID, purpose, email, time.Now().UTC().Add(expiration))
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// consumeEmailToken deletes the emailed token so that it cannot be used
+// again, and returns it if it is unexpired and meant for one of purposes.
+// Tokens meant for other purposes are kept when tx is rolled back.
+func consumeEmailToken(tx *sqlx.Tx, token string, purposes ...models.EmailTokenPurpose) (models.EmailToken, error) {
+	var emailToken models.EmailToken
+	err := tx.Get(&emailToken, `
+		DELETE FROM email_tokens WHERE token_hash = $1
+		RETURNING user_id, purpose, email, expiration_date
+		`, utils_auth.HashOpaqueToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return emailToken, errInvalidEmailToken
+	}
+	if err != nil {
+		return emailToken, err
+	}
+
+	if emailToken.IsExpired() || !slices.Contains(purposes, emailToken.Purpose) {
+		return emailToken, errInvalidEmailToken
+	}
+
+	return emailToken, nil
+}
+
+// clientLink returns the link to the frontend page at path, carrying token.
+func clientLink(path string, token string) string {
+	return fmt.Sprintf("%s%s?token=%s", routes.ClientURL, path, url.QueryEscape(token))
+}
+
+func emailVerificationMessage(email string, token string) mailer.Message {
+	return mailer.Message{
+		To:      email,
+		Subject: "Verify your 1chan email",
+		Body: fmt.Sprintf("Please verify your email by opening the link below within 24 hours:\n\n%s\n\n"+
+			"If you did not add this email to a 1chan account, you can ignore this email.\n",
+			clientLink("/verify-email", token)),
+	}
+}
+
+func emailConfirmationMessage(email string, token string) mailer.Message {
+	return mailer.Message{
+		To:      email,
+		Subject: "Confirm your new 1chan email",
+		Body: fmt.Sprintf("Please confirm that you want to use this email for your 1chan account by opening the link below within 24 hours:\n\n%s\n\n"+
+			"If you did not request this change, you can ignore this email.\n",
+			clientLink("/verify-email", token)),
+	}
+}
+
+func emailChangedMessage(previousEmail string, newEmail string) mailer.Message {
+	return mailer.Message{
+		To:      previousEmail,
+		Subject: "Your 1chan email has been changed",
+		Body: fmt.Sprintf("The email of your 1chan account has been changed to %s.\n\n"+
+			"If you did not make this change, please reset your password and contact us.\n", newEmail),
+	}
+}
+
+func passwordResetMessage(email string, token string) mailer.Message {
+	return mailer.Message{
+		To:      email,
+		Subject: "Reset your 1chan password",
+		Body: fmt.Sprintf("You can reset your password by opening the link below within an hour:\n\n%s\n\n"+
+			"If you did not ask to reset your password, you can ignore this email.\n",
+			clientLink("/reset-password", token)),
+	}
+}
+
+func passwordChangedMessage(email string) mailer.Message {
+	return mailer.Message{
+		To:      email,
+		Subject: "Your 1chan password has been reset",
+		Body: "The password of your 1chan account has been reset, and you have been logged out of every device.\n\n" +
+			"If you did not reset your password, please contact us immediately.\n",
+	}
+}
@@ -10,6 +10,10 @@ import (
 
 var DB (*sqlx.DB)
 
+// DSN is the connection string DB was opened with, kept for
+// connections that cannot be pooled, such as LISTEN/NOTIFY listeners.
+var DSN string
+
 func InitDB() {
 	var err error
 	log.Println("Connecting to database...")
@@ -18,9 +22,11 @@ func InitDB() {
 	if deploymentEnv == "cloud" {
 		RDSPassword := os.Getenv("RDS_PASSWORD")
 		RDSHost := os.Getenv("RDS_HOST")
-		DB, err = sqlx.Connect("postgres", fmt.Sprintf("user=postgres dbname=forum password=%s host=%s", RDSPassword, RDSHost))
+		DSN = fmt.Sprintf("user=postgres dbname=forum password=%s host=%s", RDSPassword, RDSHost)
+		DB, err = sqlx.Connect("postgres", DSN)
 	} else if deploymentEnv == "local" {
-		DB, err = sqlx.Connect("postgres", "user=postgres sslmode=disable dbname=forum password=postgres host=db")
+		DSN = "user=postgres sslmode=disable dbname=forum password=postgres host=db"
+		DB, err = sqlx.Connect("postgres", DSN)
 	} else {
 		panic("invalid DEPLOYMENT_ENV environment variable")
 	}
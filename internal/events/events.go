@@ -0,0 +1,189 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"log"
+	"sync"
+	"time"
+)
+
+// Event is a message published to every subscriber of Topic.
+// Name is used as the SSE event name.
+type Event struct {
+	Topic string      `json:"topic"`
+	Name  string      `json:"name"`
+	ID    int64       `json:"id"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+const (
+	// NOTIFY_CHANNEL is the Postgres channel events are relayed through
+	// when the hub is backed by LISTEN/NOTIFY.
+	NOTIFY_CHANNEL = "onechan_events"
+
+	// Postgres rejects NOTIFY payloads of 8000 bytes or more.
+	NOTIFY_MAX_PAYLOAD = 7900
+
+	SUBSCRIBER_BUFFER_SIZE = 16
+
+	BroadcastTopic = "broadcast"
+)
+
+// UserTopic is the topic on which a user's notifications are published.
+func UserTopic(userID uuid.UUID) string {
+	return fmt.Sprintf("user:%s", userID)
+}
+
+// ThreadTopic is the topic on which changes to a thread's comments are published.
+func ThreadTopic(threadID int64) string {
+	return fmt.Sprintf("thread:%d", threadID)
+}
+
+// Hub is an in-process publish/subscribe hub. When db is set, published
+// events are relayed through Postgres NOTIFY so that every server instance
+// listening on NOTIFY_CHANNEL delivers them to its own subscribers.
+type Hub struct {
+	mu          sync.RWMutex
+	subscribers map[string]map[chan Event]struct{}
+	db          *sqlx.DB
+}
+
+var DefaultHub = NewHub()
+
+func NewHub() *Hub {
+	return &Hub{
+		subscribers: make(map[string]map[chan Event]struct{}),
+	}
+}
+
+// Subscribe registers a new subscriber to topic, and returns the channel
+// events are delivered on along with a function that unsubscribes it.
+func (h *Hub) Subscribe(topic string) (<-chan Event, func()) {
+	ch := make(chan Event, SUBSCRIBER_BUFFER_SIZE)
+
+	h.mu.Lock()
+	if h.subscribers[topic] == nil {
+		h.subscribers[topic] = make(map[chan Event]struct{})
+	}
+	h.subscribers[topic][ch] = struct{}{}
+	h.mu.Unlock()
+
+	unsubscribe := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subscribers[topic][ch]; ok {
+			delete(h.subscribers[topic], ch)
+			close(ch)
+		}
+		if len(h.subscribers[topic]) == 0 {
+			delete(h.subscribers, topic)
+		}
+	}
+
+	return ch, unsubscribe
+}
+
+// Publish delivers event to the subscribers of event.Topic, either directly
+// or through Postgres if the hub has been started with ListenPostgres.
+func (h *Hub) Publish(event Event) {
+	h.mu.RLock()
+	db := h.db
+	h.mu.RUnlock()
+
+	if db == nil {
+		h.dispatch(event)
+		return
+	}
+
+	payload, err := json.Marshal(event)
+	if err == nil && len(payload) > NOTIFY_MAX_PAYLOAD {
+		// Subscribers receive the event without its data and are
+		// expected to fetch the object by its ID instead.
+		event.Data = nil
+		payload, err = json.Marshal(event)
+	}
+	if err != nil {
+		log.Printf("[Hub.Publish] failed to encode event: %s\n", err.Error())
+		return
+	}
+
+	_, err = db.Exec("SELECT pg_notify($1, $2)", NOTIFY_CHANNEL, string(payload))
+	if err != nil {
+		log.Printf("[Hub.Publish] failed to notify, delivering locally only: %s\n", err.Error())
+		h.dispatch(event)
+	}
+}
+
+// dispatch delivers event to the local subscribers of its topic. Events are
+// dropped for subscribers that are not keeping up, rather than blocking.
+func (h *Hub) dispatch(event Event) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for ch := range h.subscribers[event.Topic] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// ListenPostgres switches the hub to relay events through Postgres
+// LISTEN/NOTIFY, and blocks dispatching received events until stop is closed.
+func (h *Hub) ListenPostgres(db *sqlx.DB, dsn string, stop chan struct{}) {
+	listener := pq.NewListener(dsn, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("[Hub.ListenPostgres] listener event %d: %s\n", ev, err.Error())
+		}
+	})
+	defer listener.Close()
+
+	if err := listener.Listen(NOTIFY_CHANNEL); err != nil {
+		log.Printf("[Hub.ListenPostgres] failed to listen, events stay in-process: %s\n", err.Error())
+		return
+	}
+
+	h.mu.Lock()
+	h.db = db
+	h.mu.Unlock()
+
+	defer func() {
+		h.mu.Lock()
+		h.db = nil
+		h.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-stop:
+			log.Println("[Hub.ListenPostgres] stopping...")
+			return
+		case notification := <-listener.Notify:
+			// A nil notification is sent after the connection is re-established
+			if notification == nil {
+				continue
+			}
+
+			var event Event
+			if err := json.Unmarshal([]byte(notification.Extra), &event); err != nil {
+				log.Printf("[Hub.ListenPostgres] failed to decode event: %s\n", err.Error())
+				continue
+			}
+			h.dispatch(event)
+		case <-time.After(90 * time.Second):
+			go listener.Ping()
+		}
+	}
+}
+
+func Subscribe(topic string) (<-chan Event, func()) {
+	return DefaultHub.Subscribe(topic)
+}
+
+func Publish(event Event) {
+	DefaultHub.Publish(event)
+}
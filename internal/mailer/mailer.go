@@ -0,0 +1,124 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails. SMTPMailer is meant for production, whereas
+// FileMailer lets local development and tests read sent emails.
+type Mailer interface {
+	Send(message Message) error
+}
+
+var Default Mailer = FileMailer{}
+
+// FromEnv returns the mailer configured by the MAILER environment variable,
+// either "smtp" or "file" (the default).
+func FromEnv() (Mailer, error) {
+	switch os.Getenv("MAILER") {
+	case "smtp":
+		mailer := SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     os.Getenv("SMTP_PORT"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("MAIL_FROM"),
+		}
+		if mailer.Host == "" || mailer.Port == "" || mailer.From == "" {
+			return nil, fmt.Errorf("SMTP_HOST, SMTP_PORT and MAIL_FROM must be set to use the smtp mailer")
+		}
+		return mailer, nil
+	case "", "file":
+		return FileMailer{Dir: os.Getenv("MAIL_DIR"), From: os.Getenv("MAIL_FROM")}, nil
+	default:
+		return nil, fmt.Errorf("invalid MAILER environment variable: %s", os.Getenv("MAILER"))
+	}
+}
+
+// SendAndLog sends message with the default mailer in the background,
+// logging failures instead of reporting them.
+func SendAndLog(message Message) {
+	go func() {
+		err := Default.Send(message)
+		if err != nil {
+			log.Printf("[SendAndLog] failed to send email to %s: %s\n", message.To, err.Error())
+		}
+	}()
+}
+
+// encode returns message as an RFC 5322 email sent from from.
+func (m Message) encode(from string) []byte {
+	var email bytes.Buffer
+	fmt.Fprintf(&email, "From: %s\r\n", from)
+	fmt.Fprintf(&email, "To: %s\r\n", m.To)
+	fmt.Fprintf(&email, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&email, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z))
+	email.WriteString("MIME-Version: 1.0\r\n")
+	email.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	email.WriteString("\r\n")
+	email.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+	return email.Bytes()
+}
+
+// SMTPMailer sends emails through an SMTP server, authenticating with
+// PLAIN auth when Username is set.
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m SMTPMailer) Send(message Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	return smtp.SendMail(net.JoinHostPort(m.Host, m.Port), auth, m.From, []string{message.To}, message.encode(m.From))
+}
+
+// FileMailer writes emails as .eml files to Dir, or to the log when Dir
+// is empty, instead of sending them.
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (m FileMailer) Send(message Message) error {
+	from := m.From
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+
+	email := message.encode(from)
+	if m.Dir == "" {
+		log.Printf("[FileMailer] email to %s:\n%s\n", message.To, email)
+		return nil
+	}
+
+	err := os.MkdirAll(m.Dir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	fileName := fmt.Sprintf("%d.eml", time.Now().UTC().UnixNano())
+	return os.WriteFile(filepath.Join(m.Dir, fileName), email, 0o644)
+}
@@ -4,12 +4,15 @@ import (
 	"1chanserver/internal/models"
 	"1chanserver/internal/models/api_error"
 	"1chanserver/internal/utils/utils_auth"
+	"1chanserver/internal/utils/utils_db"
 	"1chanserver/internal/utils/utils_handler"
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
 	"net/http"
+	"strings"
 )
 
 func Auth() gin.HandlerFunc {
@@ -23,23 +26,15 @@ func Auth() gin.HandlerFunc {
 			return
 		}
 
-		accessToken := authHeader[len("Bearer "):]
-		parsedToken, err := jwt.ParseWithClaims(accessToken, &utils_auth.Claims{}, func(token *jwt.Token) (interface{}, error) {
-			// Validate the signing method
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			// Return the HMAC secret key used to sign the parsedToken
-			return []byte(utils_auth.JWT_SECRET_KEY), nil
-		})
-
-		claims, _ := parsedToken.Claims.(*utils_auth.Claims)
+		claims, err := parseAccessToken(c, authHeader)
 
 		//log.Printf("parsedToken: %s; err: %s; claims: %v;", parsedToken, err, claims)
 		switch {
-		case err == nil && parsedToken.Valid:
+		case err == nil:
 			//log.Printf("Access token is valid.")
 			c.Set("UserID", claims.UserID)
+			c.Set("Role", claims.Role)
+			c.Set("SessionID", claims.SessionID)
 			c.Next()
 		default:
 			c.Header("X-RefreshToken", "true")
@@ -50,6 +45,110 @@ func Auth() gin.HandlerFunc {
 	}
 }
 
+// RequireRole only lets through users whose role is at least as
+// privileged as minRole. It must be used after Auth.
+func RequireRole(minRole models.UserRole) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !utils_handler.GetReqRole(c).AtLeast(minRole) {
+			c.Error(api_error.NewFromStr(fmt.Sprintf("%s access required", minRole), http.StatusForbidden))
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// StreamAuth is Auth for server-sent event streams. Browsers cannot set
+// headers on an EventSource, so a stream ticket may instead be passed in
+// the ticket query parameter. Tickets are short-lived and single-use, so
+// that URLs showing up in logs do not give access to the account.
+func StreamAuth() gin.HandlerFunc {
+	auth := Auth()
+	return func(c *gin.Context) {
+		ticket := c.Query("ticket")
+		if c.GetHeader("Authorization") != "" || ticket == "" {
+			auth(c)
+			return
+		}
+
+		db := c.MustGet("db").(*sqlx.DB)
+		var owner struct {
+			UserID    uuid.UUID       `db:"user_id"`
+			SessionID uuid.UUID       `db:"session_id"`
+			Role      models.UserRole `db:"role"`
+		}
+		err := db.Get(&owner, `
+		DELETE FROM stream_tickets st
+		USING users u
+		WHERE st.token_hash = $1 AND st.expiration_date > NOW() AND u.id = st.user_id
+		RETURNING st.user_id, st.session_id, u.role
+		`, utils_auth.HashOpaqueToken(ticket))
+		if err == nil {
+			var revoked bool
+			revoked, err = utils_db.IsSessionRevoked(db, owner.SessionID)
+			if err == nil && revoked {
+				err = errors.New("session revoked")
+			}
+		}
+		if err != nil {
+			c.Error(api_error.NewFromStr("invalid or expired stream ticket", http.StatusUnauthorized))
+			c.Abort()
+			return
+		}
+
+		c.Set("UserID", owner.UserID)
+		c.Set("Role", owner.Role)
+		c.Set("SessionID", owner.SessionID)
+		c.Next()
+	}
+}
+
+// OptionalAuth sets UserID when a valid access token is supplied, and
+// otherwise lets the request through anonymously. It is meant for public
+// routes whose response differs slightly for signed-in users.
+func OptionalAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authHeader := c.GetHeader("Authorization")
+		if authHeader == "" || authHeader == "Bearer" {
+			c.Next()
+			return
+		}
+
+		claims, err := parseAccessToken(c, authHeader)
+		if err == nil {
+			c.Set("UserID", claims.UserID)
+			c.Set("Role", claims.Role)
+		}
+
+		c.Next()
+	}
+}
+
+// parseAccessToken validates the bearer token in authHeader and
+// returns its claims, unless its session has been revoked since.
+func parseAccessToken(c *gin.Context, authHeader string) (*utils_auth.Claims, error) {
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return nil, errors.New("invalid authorization header")
+	}
+
+	claims, err := utils_auth.ParseAccessToken(authHeader[len("Bearer "):])
+	if err != nil {
+		return nil, err
+	}
+
+	revoked, err := utils_db.IsSessionRevoked(c.MustGet("db").(*sqlx.DB), claims.SessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	if revoked {
+		return nil, errors.New("session revoked")
+	}
+
+	return claims, nil
+}
+
 func AuthResourceOwnership() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		_, userID := utils_handler.GetReqCx(c)
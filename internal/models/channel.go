@@ -1,8 +1,34 @@
 package models
 
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
 type Channel struct {
-	ID                 int    `db:"id" json:"id"`
-	Name               string `db:"name" json:"name"`
-	Description        string `db:"description" json:"description"`
-	ChannelPicturePath string `db:"channel_picture_path" json:"channel_picture_path"`
+	ID                 int        `db:"id" json:"id"`
+	Name               string     `db:"name" json:"name"`
+	Description        string     `db:"description" json:"description"`
+	ChannelPicturePath *string    `db:"channel_picture_path" json:"channel_picture_path"`
+	CreatorID          uuid.UUID  `db:"creator_id" json:"creator_id"`
+	CreationDate       time.Time  `db:"creation_date" json:"creation_date"`
+	UpdatedDate        *time.Time `db:"updated_date" json:"updated_date"`
+	FollowerCount      int        `db:"follower_count" json:"follower_count"`
+	ThreadCount        int        `db:"thread_count" json:"thread_count"`
+}
+
+type ChannelView struct {
+	ID                 int        `db:"id" json:"id"`
+	Name               string     `db:"name" json:"name"`
+	Description        string     `db:"description" json:"description"`
+	ChannelPicturePath *string    `db:"channel_picture_path" json:"channel_picture_path"`
+	CreatorUsername    string     `db:"creator_username" json:"creator_username"`
+	CreationDate       time.Time  `db:"creation_date" json:"creation_date"`
+	UpdatedDate        *time.Time `db:"updated_date" json:"updated_date"`
+	FollowerCount      int        `db:"follower_count" json:"follower_count"`
+	ThreadCount        int        `db:"thread_count" json:"thread_count"`
+}
+
+func (ch *Channel) IsOwnedBy(userID *uuid.UUID) bool {
+	return ch.CreatorID == *userID
 }
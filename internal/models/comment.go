@@ -2,31 +2,67 @@ package models
 
 import (
 	"github.com/google/uuid"
+	"strconv"
 	"time"
 )
 
 type Comment struct {
-	ID           int64      `json:"id" db:"id"`
-	ThreadID     int        `json:"thread_id" db:"thread_id"`
-	UserID       uuid.UUID  `json:"user_id" db:"user_id"`
-	Comment      string     `json:"comment" db:"comment"`
-	CreationDate time.Time  `json:"creation_date" db:"creation_date"`
-	UpdatedDate  *time.Time `json:"updated_date" db:"updated_date"`
-	LikeCount    int        `json:"like_count" db:"like_count"`
-	DislikeCount int        `json:"dislike_count" db:"dislike_count"`
+	ID           int64       `json:"id" db:"id"`
+	ThreadID     int         `json:"thread_id" db:"thread_id"`
+	UserID       uuid.UUID   `json:"user_id" db:"user_id"`
+	ParentID     *int64      `json:"parent_id" db:"parent_id"`
+	Depth        int         `json:"depth" db:"depth"`
+	Comment      string      `json:"comment" db:"comment"`
+	CreationDate time.Time   `json:"creation_date" db:"creation_date"`
+	UpdatedDate  *time.Time  `json:"updated_date" db:"updated_date"`
+	LikeCount    int         `json:"like_count" db:"like_count"`
+	DislikeCount int         `json:"dislike_count" db:"dislike_count"`
+	ReplyCount   int         `json:"reply_count" db:"reply_count"`
+	Lang         AppLanguage `json:"lang" db:"lang"`
 }
 
 type CommentView struct {
-	ID              int64      `json:"id" db:"id"`
-	Username        string     `json:"username" db:"username"`
-	UserProfilePath *string    `json:"user_profile_path" db:"profile_picture_path"`
-	Comment         string     `json:"comment" db:"comment"`
-	CreationDate    time.Time  `json:"creation_date" db:"creation_date"`
-	UpdatedDate     *time.Time `json:"updated_date" db:"updated_date"`
-	LikeCount       int        `json:"like_count" db:"like_count"`
-	DislikeCount    int        `json:"dislike_count" db:"dislike_count"`
+	ID              int64         `json:"id" db:"id"`
+	Username        string        `json:"username" db:"username"`
+	UserProfilePath *string       `json:"user_profile_path" db:"profile_picture_path"`
+	ParentID        *int64        `json:"parent_id" db:"parent_id"`
+	Depth           int           `json:"depth" db:"depth"`
+	Comment         string        `json:"comment" db:"comment"`
+	CreationDate    time.Time     `json:"creation_date" db:"creation_date"`
+	UpdatedDate     *time.Time    `json:"updated_date" db:"updated_date"`
+	LikeCount       int           `json:"like_count" db:"like_count"`
+	DislikeCount    int           `json:"dislike_count" db:"dislike_count"`
+	ReplyCount      int           `json:"reply_count" db:"reply_count"`
+	Lang            AppLanguage   `json:"lang" db:"lang"`
+	Deleted         bool          `json:"deleted" db:"deleted"`     // Tombstones have no author nor content
+	Replies         []CommentView `json:"replies,omitempty" db:"-"` // Only populated in tree listings
 }
 
+func (c CommentView) KeyFor(sortColumn string) (string, int64) {
+	switch sortColumnName(sortColumn) {
+	case "like_count":
+		return strconv.Itoa(c.LikeCount), c.ID
+	case "dislike_count":
+		return strconv.Itoa(c.DislikeCount), c.ID
+	case "creation_date":
+		return c.CreationDate.Format(time.RFC3339Nano), c.ID
+	}
+
+	return strconv.FormatInt(c.ID, 10), c.ID
+}
+
+type CommentRequest struct {
+	Comment  string       `json:"comment" binding:"required"`
+	ParentID *int64       `json:"parent_id"`
+	Lang     *AppLanguage `json:"lang"` // Defaults to the author's preferred language
+}
+
+const (
+	// MAX_COMMENT_DEPTH is the depth of the deepest reply allowed,
+	// where top-level comments have a depth of 0.
+	MAX_COMMENT_DEPTH = 5
+)
+
 func (c *Comment) IsOwnedBy(userID *uuid.UUID) bool {
 	return &c.UserID == userID
 }
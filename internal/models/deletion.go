@@ -0,0 +1,60 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+const (
+	// DELETION_GRACE_PERIOD is how long soft-deleted users, threads and
+	// comments are kept, and can be restored by their owners, before
+	// being purged.
+	DELETION_GRACE_PERIOD = 30 * 24 * time.Hour
+
+	PURGE_INTERVAL = time.Hour
+)
+
+// ANONYMOUS_USER_ID is the ID of the placeholder account which anonymised
+// content is reassigned to.
+var ANONYMOUS_USER_ID = uuid.Nil
+
+type DeleteRequest struct {
+	Reason *string `json:"reason"`
+}
+
+// AccountDeletionMode is what happens to a user's threads and comments once
+// their deleted account is purged. Removed comments which have replies are
+// kept as tombstones, and channels are handed over to the placeholder
+// account either way.
+type AccountDeletionMode string
+
+const (
+	AnonymiseContent AccountDeletionMode = "anonymise"
+	RemoveContent    AccountDeletionMode = "remove"
+)
+
+func (m AccountDeletionMode) IsValid() bool {
+	return m == AnonymiseContent || m == RemoveContent
+}
+
+type AccountDeletionRequest struct {
+	Password string              `json:"password"` // Not needed by users without a password, see api_user.Reauthenticate
+	Content  AccountDeletionMode `json:"content" binding:"required"`
+	Reason   *string             `json:"reason"`
+}
+
+// Deletion describes the soft deletion of a thread or comment.
+type Deletion struct {
+	UserID       uuid.UUID  `db:"user_id"`
+	DeletedAt    time.Time  `db:"deleted_at"`
+	DeletedBy    *uuid.UUID `db:"deleted_by"` // nil once the deleting account is purged
+	DeleteReason *string    `db:"delete_reason"`
+}
+
+// IsRestorableBy reports whether userID may restore the deleted content,
+// i.e. whether they deleted their own content within the grace period.
+// Content deleted by moderators cannot be restored by its owner.
+func (d *Deletion) IsRestorableBy(userID uuid.UUID) bool {
+	return d.UserID == userID && d.DeletedBy != nil && *d.DeletedBy == userID &&
+		time.Since(d.DeletedAt) < DELETION_GRACE_PERIOD
+}
@@ -0,0 +1,36 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+// EmailTokenPurpose is what an emailed token lets its recipient do.
+type EmailTokenPurpose string
+
+const (
+	VerifyEmailPurpose   EmailTokenPurpose = "verify_email"
+	ChangeEmailPurpose   EmailTokenPurpose = "change_email"
+	ResetPasswordPurpose EmailTokenPurpose = "reset_password"
+)
+
+const (
+	EMAIL_TOKEN_EXPIRATION          = 24 * time.Hour
+	PASSWORD_RESET_TOKEN_EXPIRATION = time.Hour
+)
+
+type EmailToken struct {
+	UserID         uuid.UUID         `db:"user_id"`
+	Purpose        EmailTokenPurpose `db:"purpose"`
+	Email          string            `db:"email"`
+	ExpirationDate time.Time         `db:"expiration_date"`
+}
+
+func (t *EmailToken) IsExpired() bool {
+	return t.ExpirationDate.Before(time.Now().UTC())
+}
+
+type PasswordResetRequest struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required"`
+}
@@ -0,0 +1,59 @@
+package models
+
+import "time"
+
+// DataExport is the personal data of a user, as exported to them.
+type DataExport struct {
+	Account       ExportedAccount   `json:"account"`
+	Profile       UserProfile       `json:"profile"`
+	Threads       []ExportedThread  `json:"threads"`
+	Comments      []ExportedComment `json:"comments"`
+	ThreadLikes   []ExportedLike    `json:"thread_likes"`
+	CommentLikes  []ExportedLike    `json:"comment_likes"`
+	PollVotes     []ExportedVote    `json:"poll_votes"`
+	Messages      []ExportedMessage `json:"messages"`
+	SearchHistory []ExportedSearch  `json:"search_history"`
+	SavedSearches []SavedSearch     `json:"saved_searches"`
+}
+
+type ExportedAccount struct {
+	Username       string     `db:"username" json:"username"`
+	Role           UserRole   `db:"role" json:"role"`
+	SuspendedUntil *time.Time `db:"suspended_until" json:"suspended_until"`
+}
+
+// ExportedThread includes soft-deleted threads, which are not purged yet.
+type ExportedThread struct {
+	Thread
+	DeletedAt *time.Time `db:"deleted_at" json:"deleted_at"`
+}
+
+// ExportedComment includes soft-deleted comments, which are not purged yet.
+type ExportedComment struct {
+	Comment
+	DeletedAt *time.Time `db:"deleted_at" json:"deleted_at"`
+}
+
+type ExportedLike struct {
+	ID      int64 `db:"id" json:"id"` // ID of the liked thread or comment
+	Variant int   `db:"variant" json:"variant"`
+}
+
+type ExportedVote struct {
+	ThreadID int    `db:"thread_id" json:"thread_id"`
+	Question string `db:"question" json:"question"`
+	Option   string `db:"option_text" json:"option"`
+}
+
+type ExportedMessage struct {
+	ConversationWith string     `db:"conversation_with" json:"conversation_with"`
+	SenderUsername   string     `db:"sender_username" json:"sender_username"`
+	Content          string     `db:"content" json:"content"`
+	CreationDate     time.Time  `db:"creation_date" json:"creation_date"`
+	ReadDate         *time.Time `db:"read_date" json:"read_date"`
+}
+
+type ExportedSearch struct {
+	Query        string    `db:"query" json:"query"`
+	CreationDate time.Time `db:"creation_date" json:"creation_date"`
+}
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+const (
+	OIDC_STATE_EXPIRATION            = 10 * time.Minute
+	OIDC_REGISTRATION_EXPIRATION     = 30 * time.Minute
+	OIDC_SUGGESTED_USERNAME_MAX_SIZE = 32
+)
+
+// UserIdentity links a user to their account with an OpenID Connect
+// provider, identified by the subject of its ID tokens.
+type UserIdentity struct {
+	ID            int64      `db:"id" json:"id"`
+	UserID        uuid.UUID  `db:"user_id" json:"-"`
+	Provider      string     `db:"provider" json:"provider"`
+	Subject       string     `db:"subject" json:"-"`
+	Email         *string    `db:"email" json:"email"`
+	CreationDate  time.Time  `db:"creation_date" json:"creation_date"`
+	LastLoginDate *time.Time `db:"last_login_date" json:"last_login_date"`
+}
+
+// OIDCState is an authorization request sent to a provider, which is
+// completed when the user is redirected back with its state. UserID is
+// set when the request links the provider to an existing account rather
+// than signing in with it.
+type OIDCState struct {
+	Provider       string     `db:"provider"`
+	DeviceID       string     `db:"device_id"`
+	Nonce          string     `db:"nonce"`
+	CodeVerifier   string     `db:"code_verifier"`
+	UserID         *uuid.UUID `db:"user_id"`
+	ExpirationDate time.Time  `db:"expiration_date"`
+}
+
+func (s *OIDCState) IsExpired() bool {
+	return s.ExpirationDate.Before(time.Now().UTC())
+}
+
+// OIDCRegistration is the identity of a user who signed in with a provider
+// for the first time, kept until they pick a username for their new account.
+type OIDCRegistration struct {
+	Provider       string    `db:"provider"`
+	Subject        string    `db:"subject"`
+	DeviceID       string    `db:"device_id"`
+	Email          *string   `db:"email"`
+	EmailVerified  bool      `db:"email_verified"`
+	ExpirationDate time.Time `db:"expiration_date"`
+}
+
+func (r *OIDCRegistration) IsExpired() bool {
+	return r.ExpirationDate.Before(time.Now().UTC())
+}
+
+// OIDCCallbackRequest carries the code and state the provider redirected
+// the user back to the client with.
+type OIDCCallbackRequest struct {
+	Code  string `json:"code" binding:"required"`
+	State string `json:"state" binding:"required"`
+}
+
+// OIDCRegistrationRequest creates the account of a user signing in with a
+// provider for the first time, under the username they picked.
+type OIDCRegistrationRequest struct {
+	RegistrationToken string `json:"registration_token" binding:"required"`
+	Username          string `json:"username" binding:"required"`
+}
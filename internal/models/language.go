@@ -7,3 +7,14 @@ const (
 	Japanese   AppLanguage = "ja"
 	Indonesian AppLanguage = "id"
 )
+
+var AppLanguages = []AppLanguage{English, Japanese, Indonesian}
+
+func (l AppLanguage) IsValid() bool {
+	switch l {
+	case English, Japanese, Indonesian:
+		return true
+	default:
+		return false
+	}
+}
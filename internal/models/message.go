@@ -0,0 +1,42 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+type DirectMessage struct {
+	MessageID    int64      `db:"message_id" json:"message_id"`
+	UserAID      uuid.UUID  `db:"user_a_id" json:"-"`
+	UserBID      uuid.UUID  `db:"user_b_id" json:"-"`
+	SenderID     uuid.UUID  `db:"sender_id" json:"sender_id"`
+	Content      string     `db:"content" json:"content"`
+	CreationDate time.Time  `db:"creation_date" json:"creation_date"`
+	ReadDate     *time.Time `db:"read_date" json:"read_date"`
+}
+
+type DirectMessageView struct {
+	MessageID      int64      `db:"message_id" json:"message_id"`
+	SenderUsername string     `db:"sender_username" json:"sender_username"`
+	Content        string     `db:"content" json:"content"`
+	CreationDate   time.Time  `db:"creation_date" json:"creation_date"`
+	ReadDate       *time.Time `db:"read_date" json:"read_date"`
+}
+
+type ConversationView struct {
+	Username            string    `db:"username" json:"username"`
+	UserProfilePath     *string   `db:"profile_picture_path" json:"user_profile_path"`
+	LastMessage         string    `db:"last_message" json:"last_message"`
+	LastMessageUsername string    `db:"last_message_username" json:"last_message_username"`
+	LastMessageDate     time.Time `db:"last_message_date" json:"last_message_date"`
+	UnreadCount         int       `db:"unread_count" json:"unread_count"`
+}
+
+type DirectMessageRequest struct {
+	Content string `json:"content" binding:"required"`
+}
+
+const (
+	DM_MAX_LENGTH     = 4000
+	DM_PREVIEW_LENGTH = 100
+)
@@ -1,9 +1,17 @@
 package models
 
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
 type Pagination struct {
-	CurrentPage int `json:"current_page"`
-	LastPage    int `json:"last_page"`
-	PageSize    int `json:"page_size"`
+	CurrentPage int    `json:"current_page,omitempty"`
+	LastPage    int    `json:"last_page,omitempty"`
+	PageSize    int    `json:"page_size"`
+	NextCursor  string `json:"next_cursor,omitempty"` // Only set in cursor mode, when more rows may follow
 }
 
 type PaginatedResponse[T any] struct {
@@ -13,4 +21,76 @@ type PaginatedResponse[T any] struct {
 
 const (
 	DEFAULT_PAGE_SIZE = 5
+	MAX_PAGE_SIZE     = 50
 )
+
+// PageRequest describes which slice of a listing the client asked for,
+// either by page number or, in cursor mode, by the position after Cursor.
+type PageRequest struct {
+	Page       int
+	PageSize   int
+	CursorMode bool
+	Cursor     *Cursor // nil for the first page in cursor mode
+}
+
+// Offset is the number of rows to skip. Cursor mode never skips rows,
+// as the cursor condition already excludes the previous pages.
+func (p PageRequest) Offset() int {
+	if p.CursorMode {
+		return 0
+	}
+
+	return (p.Page - 1) * p.PageSize
+}
+
+// Cursor marks the last row of a page in a keyset-paginated listing, by
+// the value of the column the listing is sorted on and the row's ID.
+type Cursor struct {
+	SortBy string `json:"s"`
+	Order  string `json:"o"`
+	Value  string `json:"v"`
+	ID     int64  `json:"i"`
+}
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+func (cursor Cursor) Encode() string {
+	payload, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(payload)
+}
+
+func DecodeCursor(s string) (*Cursor, error) {
+	payload, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var cursor Cursor
+	if err = json.Unmarshal(payload, &cursor); err != nil || cursor.Value == "" {
+		return nil, ErrInvalidCursor
+	}
+
+	return &cursor, nil
+}
+
+// Keyed is implemented by listing rows which can be paginated by cursor.
+// KeyFor returns the row's value for the given sort column, and its ID.
+type Keyed interface {
+	KeyFor(sortColumn string) (string, int64)
+}
+
+// NextCursor returns the cursor to the page following rows, or an empty
+// string when rows is a partial page and therefore the last one.
+func NextCursor[T Keyed](rows []T, pageRequest PageRequest, sortBy string, order string) string {
+	if !pageRequest.CursorMode || len(rows) < pageRequest.PageSize {
+		return ""
+	}
+
+	value, id := rows[len(rows)-1].KeyFor(sortBy)
+	return Cursor{SortBy: sortBy, Order: order, Value: value, ID: id}.Encode()
+}
+
+// sortColumnName strips the table alias from a sort column, if any.
+func sortColumnName(sortColumn string) string {
+	return sortColumn[strings.LastIndex(sortColumn, ".")+1:]
+}
@@ -0,0 +1,38 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+// STREAM_TICKET_EXPIRATION is how long a stream ticket may be used for,
+// which only needs to cover the time taken to open the stream.
+const STREAM_TICKET_EXPIRATION = 30 * time.Second
+
+type NotificationType string
+
+const (
+	AdminNotification       NotificationType = "admin"
+	ThreadNotification      NotificationType = "thread"  // A comment on the user's thread
+	CommentNotification     NotificationType = "comment" // A reply to the user's comment
+	LikeNotification        NotificationType = "like"
+	DMNotification          NotificationType = "dm"
+	SavedSearchNotification NotificationType = "saved_search" // New threads matching a saved search
+)
+
+type Notification struct {
+	ID               int64            `db:"id" json:"id"`
+	UserID           uuid.UUID        `db:"user_id" json:"-"`
+	ActorID          *uuid.UUID       `db:"actor_id" json:"-"`
+	RelatedID        *int64           `db:"related_id" json:"related_id"`
+	ThreadID         *int64           `db:"thread_id" json:"thread_id"`
+	Type             NotificationType `db:"type" json:"type"`
+	Message          *string          `db:"message" json:"message"`
+	CreationDate     time.Time        `db:"creation_date" json:"creation_date"`
+	AcknowledgedDate *time.Time       `db:"acknowledged_date" json:"acknowledged_date"`
+}
+
+type NotificationView struct {
+	Notification
+	ActorUsername *string `db:"actor_username" json:"actor_username"`
+}
@@ -0,0 +1,77 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"time"
+)
+
+const (
+	PASSKEY_CHALLENGE_EXPIRATION = 5 * time.Minute
+	PASSKEY_NAME_MAX_SIZE        = 64
+)
+
+type WebAuthnCeremony string
+
+const (
+	PasskeyRegistration   WebAuthnCeremony = "registration"
+	PasskeyAuthentication WebAuthnCeremony = "authentication"
+)
+
+// Passkey is a WebAuthn credential a user registered to sign in with,
+// without a password.
+type Passkey struct {
+	ID           int64          `db:"id" json:"id"`
+	UserID       uuid.UUID      `db:"user_id" json:"-"`
+	CredentialID string         `db:"credential_id" json:"credential_id"` // Unpadded base64url
+	PublicKey    []byte         `db:"public_key" json:"-"`                // COSE_Key
+	SignCount    int64          `db:"sign_count" json:"-"`
+	Transports   pq.StringArray `db:"transports" json:"transports"`
+	Name         string         `db:"name" json:"name"`
+	BackedUp     bool           `db:"backed_up" json:"backed_up"` // Whether it is synced, and survives losing the device
+	CreationDate time.Time      `db:"creation_date" json:"creation_date"`
+	LastUsedDate *time.Time     `db:"last_used_date" json:"last_used_date"`
+}
+
+// PasskeyChallenge is the challenge of a registration or authentication
+// ceremony, which the authenticator signs over. UserID is set for
+// registrations.
+type PasskeyChallenge struct {
+	Challenge      string           `db:"challenge"`
+	Ceremony       WebAuthnCeremony `db:"ceremony"`
+	UserID         *uuid.UUID       `db:"user_id"`
+	DeviceID       string           `db:"device_id"`
+	ExpirationDate time.Time        `db:"expiration_date"`
+}
+
+func (c *PasskeyChallenge) IsExpired() bool {
+	return c.ExpirationDate.Before(time.Now().UTC())
+}
+
+// PasskeyRegistrationRequest carries the PublicKeyCredential returned by
+// navigator.credentials.create(), with binary fields base64url encoded.
+type PasskeyRegistrationRequest struct {
+	Name       string `json:"name"`
+	Credential struct {
+		RawID    string `json:"rawId" binding:"required"`
+		Type     string `json:"type" binding:"required"`
+		Response struct {
+			ClientDataJSON    string   `json:"clientDataJSON" binding:"required"`
+			AttestationObject string   `json:"attestationObject" binding:"required"`
+			Transports        []string `json:"transports"`
+		} `json:"response" binding:"required"`
+	} `json:"credential" binding:"required"`
+}
+
+// PasskeyLoginRequest carries the PublicKeyCredential returned by
+// navigator.credentials.get(), with binary fields base64url encoded.
+type PasskeyLoginRequest struct {
+	RawID    string `json:"rawId" binding:"required"`
+	Type     string `json:"type" binding:"required"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON" binding:"required"`
+		AuthenticatorData string `json:"authenticatorData" binding:"required"`
+		Signature         string `json:"signature" binding:"required"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response" binding:"required"`
+}
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"time"
+)
+
+type Poll struct {
+	ID                    int64      `db:"id" json:"id"`
+	ThreadID              int        `db:"thread_id" json:"thread_id"`
+	Question              string     `db:"question" json:"question"`
+	CreationDate          time.Time  `db:"creation_date" json:"creation_date"`
+	CloseDate             *time.Time `db:"close_date" json:"close_date"`
+	MaxChoice             int        `db:"max_choice" json:"max_choice"`
+	HideResultsUntilVoted bool       `db:"hide_results_until_voted" json:"hide_results_until_voted"`
+}
+
+type PollOption struct {
+	PollID     int64  `db:"poll_id" json:"poll_id"`
+	OptionID   int    `db:"option_id" json:"option_id"`
+	OptionText string `db:"option_text" json:"option_text"`
+	VoteCount  *int   `db:"vote_count" json:"vote_count"` // nil when results are hidden from the caller
+}
+
+type PollView struct {
+	Poll
+	IsClosed    bool         `json:"is_closed"`
+	TotalVoters *int         `json:"total_voters"` // nil when results are hidden from the caller
+	Options     []PollOption `json:"options"`
+	UserVotes   []int        `json:"user_votes"`
+}
+
+type PollRequest struct {
+	Question              string     `json:"question"`
+	Options               []string   `json:"options"`
+	MaxChoice             int        `json:"max_choice"`
+	CloseDate             *time.Time `json:"close_date"`
+	HideResultsUntilVoted bool       `json:"hide_results_until_voted"`
+}
+
+type PollVoteRequest struct {
+	Options []int `json:"options"`
+}
+
+const (
+	POLL_MIN_OPTIONS = 2
+	POLL_MAX_OPTIONS = 10
+)
+
+func (p *Poll) Closed() bool {
+	return p.CloseDate != nil && p.CloseDate.Before(time.Now().UTC())
+}
@@ -0,0 +1,71 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+type ReportStatus string
+
+const (
+	ReportPending  ReportStatus = "pending"
+	ReportClaimed  ReportStatus = "claimed"
+	ReportResolved ReportStatus = "resolved"
+)
+
+type ModerationAction string
+
+const (
+	DismissAction       ModerationAction = "dismiss"
+	DeleteContentAction ModerationAction = "delete_content"
+	WarnUserAction      ModerationAction = "warn_user"
+	SuspendUserAction   ModerationAction = "suspend_user"
+)
+
+type Report struct {
+	ID              int64        `db:"id" json:"id"`
+	ThreadID        *int64       `db:"thread_id" json:"thread_id"`
+	CommentID       *int64       `db:"comment_id" json:"comment_id"`
+	ReporterID      *uuid.UUID   `db:"reporter_id" json:"-"`      // nil once the reporter is purged
+	ReportedUserID  *uuid.UUID   `db:"reported_user_id" json:"-"` // nil once the reported user is purged
+	ModeratorID     *uuid.UUID   `db:"moderator_id" json:"-"`
+	Status          ReportStatus `db:"status" json:"status"`
+	ReportReason    string       `db:"report_reason" json:"report_reason"`
+	ContentSnapshot string       `db:"content_snapshot" json:"content_snapshot"`
+	ActionsTaken    *string      `db:"actions_taken" json:"actions_taken"`
+	CreationDate    time.Time    `db:"creation_date" json:"creation_date"`
+	ClaimedDate     *time.Time   `db:"claimed_date" json:"claimed_date"`
+	ResolvedDate    *time.Time   `db:"resolved_date" json:"resolved_date"`
+}
+
+type ReportView struct {
+	Report
+	ReporterUsername     *string      `db:"reporter_username" json:"reporter_username"`
+	ReportedUsername     *string      `db:"reported_username" json:"reported_username"`
+	ModeratorUsername    *string      `db:"moderator_username" json:"moderator_username"`
+	PendingReportsOnItem int          `db:"pending_reports_on_item" json:"pending_reports_on_item"`
+	Thread               *ThreadView  `db:"-" json:"thread"`
+	Comment              *CommentView `db:"-" json:"comment"`
+}
+
+type ReportResolution struct {
+	Action      ModerationAction `json:"action" binding:"required"`
+	Note        string           `json:"note"`
+	SuspendDays int              `json:"suspend_days"`
+}
+
+type ModerationLogEntry struct {
+	ID                int64            `db:"id" json:"id"`
+	ModeratorUsername *string          `db:"moderator_username" json:"moderator_username"` // nil once the moderator's account is purged
+	ReportID          *int64           `db:"report_id" json:"report_id"`
+	Action            ModerationAction `db:"action" json:"action"`
+	TargetUsername    *string          `db:"target_username" json:"target_username"`
+	ThreadID          *int64           `db:"thread_id" json:"thread_id"`
+	CommentID         *int64           `db:"comment_id" json:"comment_id"`
+	Note              *string          `db:"note" json:"note"`
+	CreationDate      time.Time        `db:"creation_date" json:"creation_date"`
+}
+
+const (
+	MAX_SUSPENSION_DAYS = 365
+)
@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+// Revision is a version of a thread or comment. Title is only set for threads.
+type Revision struct {
+	Revision     int       `json:"revision" db:"revision"`
+	Username     *string   `json:"username" db:"username"` // nil once the editor's account is deleted
+	Title        *string   `json:"title,omitempty" db:"title"`
+	Content      string    `json:"content" db:"content"`
+	CreationDate time.Time `json:"creation_date" db:"creation_date"`
+}
+
+type RevisionListResponse struct {
+	Deleted   bool       `json:"deleted"` // Only moderators can list revisions of deleted content
+	Revisions []Revision `json:"revisions"`
+}
+
+type DiffOp string
+
+const (
+	DiffEqual  DiffOp = "equal"
+	DiffInsert DiffOp = "insert"
+	DiffDelete DiffOp = "delete"
+)
+
+type DiffSegment struct {
+	Op   DiffOp `json:"op"`
+	Text string `json:"text"`
+}
+
+type RevisionDiff struct {
+	From    int           `json:"from"`
+	To      int           `json:"to"`
+	Title   []DiffSegment `json:"title,omitempty"`
+	Content []DiffSegment `json:"content"`
+}
@@ -0,0 +1,32 @@
+package models
+
+type UserRole string
+
+const (
+	RegularUserRole UserRole = "user"
+	ModeratorRole   UserRole = "moderator"
+	AdminRole       UserRole = "admin"
+)
+
+// rank orders the roles by privilege. Unknown roles have no privilege.
+func (r UserRole) rank() int {
+	switch r {
+	case RegularUserRole:
+		return 1
+	case ModeratorRole:
+		return 2
+	case AdminRole:
+		return 3
+	default:
+		return 0
+	}
+}
+
+func (r UserRole) IsValid() bool {
+	return r.rank() > 0
+}
+
+// AtLeast reports whether r is at least as privileged as minRole.
+func (r UserRole) AtLeast(minRole UserRole) bool {
+	return r.IsValid() && r.rank() >= minRole.rank()
+}
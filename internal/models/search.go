@@ -0,0 +1,183 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"html"
+	"strings"
+	"time"
+)
+
+type SearchType string
+
+const (
+	AllSearch     SearchType = "all"
+	ThreadSearch  SearchType = "threads"
+	CommentSearch SearchType = "comments"
+	UserSearch    SearchType = "users"
+	TagSearch     SearchType = "tags"
+)
+
+func (t SearchType) IsValid() bool {
+	switch t {
+	case AllSearch, ThreadSearch, CommentSearch, UserSearch, TagSearch:
+		return true
+	default:
+		return false
+	}
+}
+
+// Includes reports whether results of type other are returned when searching for t.
+func (t SearchType) Includes(other SearchType) bool {
+	return t == AllSearch || t == other
+}
+
+// Matches in snippets are delimited by control characters, which are not
+// markup, so that the snippet can be escaped before the <mark> tags around
+// matches are put in by FormatSearchHeadline.
+const (
+	SEARCH_HEADLINE_START_SEL = "\x02"
+	SEARCH_HEADLINE_STOP_SEL  = "\x03"
+)
+
+// SEARCH_HEADLINE_OPTIONS are the ts_headline options used for snippets.
+const SEARCH_HEADLINE_OPTIONS = "StartSel=" + SEARCH_HEADLINE_START_SEL + ", StopSel=" + SEARCH_HEADLINE_STOP_SEL +
+	", MaxWords=35, MinWords=15, MaxFragments=2"
+
+var searchHeadlineReplacer = strings.NewReplacer(
+	SEARCH_HEADLINE_START_SEL, "<mark>",
+	SEARCH_HEADLINE_STOP_SEL, "</mark>",
+)
+
+// FormatSearchHeadline HTML-escapes a snippet produced with
+// SEARCH_HEADLINE_OPTIONS and wraps its matches in <mark> tags, so that
+// clients may render it as is.
+func FormatSearchHeadline(headline string) string {
+	return searchHeadlineReplacer.Replace(html.EscapeString(headline))
+}
+
+type ThreadSearchResult struct {
+	ID           int64       `json:"id" db:"id"`
+	Title        string      `json:"title" db:"title"`
+	Username     string      `json:"username" db:"username"`
+	Channel      *string     `json:"channel" db:"channel"`
+	CreationDate time.Time   `json:"creation_date" db:"creation_date"`
+	LikeCount    int         `json:"like_count" db:"like_count"`
+	CommentCount int         `json:"comment_count" db:"comment_count"`
+	Lang         AppLanguage `json:"lang" db:"lang"`
+	Rank         float32     `json:"rank" db:"rank"`
+	Headline     string      `json:"headline" db:"headline"`
+}
+
+type CommentSearchResult struct {
+	ID           int64       `json:"id" db:"id"`
+	ThreadID     int64       `json:"thread_id" db:"thread_id"`
+	ThreadTitle  string      `json:"thread_title" db:"thread_title"`
+	Username     string      `json:"username" db:"username"`
+	CreationDate time.Time   `json:"creation_date" db:"creation_date"`
+	LikeCount    int         `json:"like_count" db:"like_count"`
+	Lang         AppLanguage `json:"lang" db:"lang"`
+	Rank         float32     `json:"rank" db:"rank"`
+	Headline     string      `json:"headline" db:"headline"`
+}
+
+type UserSearchResult struct {
+	Username           string  `json:"username" db:"username"`
+	ProfilePicturePath *string `json:"profile_picture_path" db:"profile_picture_path"`
+	PostCount          int     `json:"post_count" db:"post_count"`
+	CommentCount       int     `json:"comment_count" db:"comment_count"`
+	Headline           string  `json:"headline" db:"headline"` // Snippet of the user's biodata
+}
+
+type TagSearchResult struct {
+	Tag         string `json:"tag" db:"tag"`
+	ThreadCount int    `json:"thread_count" db:"thread_count"`
+}
+
+// SearchCounts holds the total number of results of each type,
+// regardless of the type searched for.
+type SearchCounts struct {
+	Threads  int `json:"threads" db:"threads"`
+	Comments int `json:"comments" db:"comments"`
+	Users    int `json:"users" db:"users"`
+	Tags     int `json:"tags" db:"tags"`
+}
+
+type SearchResponse struct {
+	Counts     SearchCounts          `json:"counts"`
+	Threads    []ThreadSearchResult  `json:"threads,omitempty"`
+	Comments   []CommentSearchResult `json:"comments,omitempty"`
+	Users      []UserSearchResult    `json:"users,omitempty"`
+	Tags       []TagSearchResult     `json:"tags,omitempty"`
+	Pagination Pagination            `json:"pagination"`
+}
+
+type SearchHistoryEntry struct {
+	Query        string    `json:"query" db:"query"`
+	LastSearched time.Time `json:"last_searched" db:"last_searched"`
+}
+
+type SearchHistoryResponse struct {
+	Enabled bool                 `json:"enabled"`
+	History []SearchHistoryEntry `json:"history"`
+}
+
+type SavedSearch struct {
+	ID              int64        `json:"id" db:"id"`
+	UserID          uuid.UUID    `json:"-" db:"user_id"`
+	Name            string       `json:"name" db:"name"`
+	Query           string       `json:"query" db:"query"`
+	Tags            string       `json:"tags" db:"tags"`               // For default tag IDs
+	CustomTags      string       `json:"custom_tags" db:"custom_tags"` // For custom tag names
+	SortBy          string       `json:"sort_by" db:"sort_by"`
+	SortOrder       string       `json:"order" db:"sort_order"`
+	Lang            *AppLanguage `json:"lang" db:"lang"`
+	Notify          bool         `json:"notify" db:"notify"`
+	LastCheckedDate time.Time    `json:"-" db:"last_checked_date"`
+	CreationDate    time.Time    `json:"creation_date" db:"creation_date"`
+}
+
+type SavedSearchRequest struct {
+	Name       string       `json:"name"`
+	Query      string       `json:"query"`
+	Tags       []int        `json:"tags"`
+	CustomTags []string     `json:"custom_tags"`
+	SortBy     string       `json:"sort_by"`
+	Order      string       `json:"order"`
+	Lang       *AppLanguage `json:"lang"`
+	Notify     bool         `json:"notify"`
+}
+
+const (
+	SEARCH_HISTORY_SIZE     = 20
+	MAX_SAVED_SEARCHES      = 20
+	SAVED_SEARCH_NAME_LIMIT = 100
+)
+
+// SAVED_SEARCH_MATCH_OVERLAP is how far before their last check saved
+// searches are matched again. Threads are dated when their transaction
+// starts, so one which takes long to commit may be dated before the check
+// which should have matched it.
+const SAVED_SEARCH_MATCH_OVERLAP = 10 * time.Minute
+
+type ThreadSuggestion struct {
+	ID    int64  `json:"id" db:"id"`
+	Title string `json:"title" db:"title"`
+}
+
+type UserSuggestion struct {
+	Username           string  `json:"username" db:"username"`
+	ProfilePicturePath *string `json:"profile_picture_path" db:"profile_picture_path"`
+}
+
+type SearchSuggestions struct {
+	Threads        []ThreadSuggestion `json:"threads"`
+	Tags           []TagSearchResult  `json:"tags"`
+	Users          []UserSuggestion   `json:"users"`
+	RecentSearches []string           `json:"recent_searches"` // Only for signed-in users
+}
+
+const (
+	AUTOCOMPLETE_MIN_LENGTH = 2
+	AUTOCOMPLETE_MAX_LENGTH = 100
+	AUTOCOMPLETE_LIMIT      = 5
+)
@@ -0,0 +1,28 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+type SecurityEventType string
+
+const (
+	// RefreshTokenReuseEvent is recorded when a refresh token which was
+	// already rotated out is presented again, and its family is revoked.
+	RefreshTokenReuseEvent SecurityEventType = "refresh_token_reuse"
+	// PasskeyCloneSuspectedEvent is recorded when a passkey reports a sign
+	// count which is not higher than its last one, and signing in with it
+	// is refused.
+	PasskeyCloneSuspectedEvent SecurityEventType = "passkey_clone_suspected"
+)
+
+type SecurityEvent struct {
+	ID           int64             `db:"id" json:"id"`
+	UserID       uuid.UUID         `db:"user_id" json:"-"`
+	Type         SecurityEventType `db:"type" json:"type"`
+	DeviceID     *string           `db:"device_id" json:"device_id"`
+	UserAgent    *string           `db:"user_agent" json:"user_agent"`
+	IPAddress    *string           `db:"ip_address" json:"ip_address"`
+	CreationDate time.Time         `db:"creation_date" json:"creation_date"`
+}
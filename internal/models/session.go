@@ -0,0 +1,56 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+// REAUTHENTICATION_WINDOW is how long after signing in users without a
+// password may take actions which others must confirm with their password.
+const REAUTHENTICATION_WINDOW = 10 * time.Minute
+
+// RefreshToken is a session of a user on one of their devices. Its token is
+// rotated on every refresh, and the tokens rotated out are remembered by
+// their ID so that replaying one can be detected.
+type RefreshToken struct {
+	ID             int64     `db:"id"`
+	UserID         uuid.UUID `db:"user_id"`
+	DeviceID       string    `db:"device_id"`
+	TokenHash      string    `db:"token_hash"`
+	TokenID        uuid.UUID `db:"token_id"`
+	FamilyID       uuid.UUID `db:"family_id"`
+	ExpirationDate time.Time `db:"expiration_date"`
+	UserAgent      *string   `db:"user_agent"`
+	IPAddress      *string   `db:"ip_address"`
+	CreationDate   time.Time `db:"creation_date"`
+	LastUsedDate   time.Time `db:"last_used_date"`
+}
+
+// RotatedRefreshToken is a token rotated out of a session.
+type RotatedRefreshToken struct {
+	TokenID          uuid.UUID `db:"token_id"`
+	FamilyID         uuid.UUID `db:"family_id"`
+	UserID           uuid.UUID `db:"user_id"`
+	SuccessorTokenID uuid.UUID `db:"successor_token_id"`
+	SealedSuccessor  string    `db:"sealed_successor"` // See utils_auth.OpenSuccessor
+	RotatedDate      time.Time `db:"rotated_date"`
+	ExpirationDate   time.Time `db:"expiration_date"`
+}
+
+// Session is a refresh token of a user, as listed to them.
+type Session struct {
+	ID             int64     `db:"id" json:"id"`
+	DeviceID       string    `db:"device_id" json:"device_id"`
+	UserAgent      *string   `db:"user_agent" json:"user_agent"`
+	IPAddress      *string   `db:"ip_address" json:"ip_address"`
+	CreationDate   time.Time `db:"creation_date" json:"creation_date"`
+	LastUsedDate   time.Time `db:"last_used_date" json:"last_used_date"`
+	ExpirationDate time.Time `db:"expiration_date" json:"expiration_date"`
+	Current        bool      `db:"current" json:"current"` // Whether this is the session of the device listing it
+}
+
+// SessionClient describes the client a session was last used from.
+type SessionClient struct {
+	UserAgent string
+	IPAddress string
+}
@@ -2,45 +2,72 @@ package models
 
 import (
 	"github.com/google/uuid"
+	"strconv"
 	"time"
 )
 
 type Thread struct {
-	ID              int        `json:"id" db:"id"`
-	UserID          uuid.UUID  `json:"user_id" db:"user_id"`
-	ChannelID       *int64     `json:"channel_id" db:"channel_id"`
-	Title           string     `json:"title" db:"title"`
-	OriginalPost    string     `json:"original_post" db:"original_post"`
-	CreationDate    time.Time  `json:"creation_date" db:"creation_date"`
-	UpdatedDate     *time.Time `json:"updated_date" db:"updated_date"`
-	LastCommentDate *time.Time `json:"last_comment_date" db:"last_comment_date""`
-	LikeCount       int        `json:"like_count" db:"like_count"`
-	ViewCount       int        `json:"view_count" db:"view_count"`
+	ID              int         `json:"id" db:"id"`
+	UserID          uuid.UUID   `json:"user_id" db:"user_id"`
+	ChannelID       *int64      `json:"channel_id" db:"channel_id"`
+	Title           string      `json:"title" db:"title"`
+	OriginalPost    string      `json:"original_post" db:"original_post"`
+	CreationDate    time.Time   `json:"creation_date" db:"creation_date"`
+	UpdatedDate     *time.Time  `json:"updated_date" db:"updated_date"`
+	LastCommentDate *time.Time  `json:"last_comment_date" db:"last_comment_date"`
+	LikeCount       int         `json:"like_count" db:"like_count"`
+	ViewCount       int         `json:"view_count" db:"view_count"`
+	Lang            AppLanguage `json:"lang" db:"lang"`
 }
 
 type ThreadView struct {
-	ID              int        `json:"id" db:"id"`
-	Username        string     `json:"username" db:"username"`
-	UserProfilePath *string    `json:"user_profile_path" db:"profile_picture_path"`
-	Channel         *string    `json:"channel" db:"channel"`
-	Title           string     `json:"title" db:"title"`
-	OriginalPost    string     `json:"original_post" db:"original_post"`
-	CreationDate    time.Time  `json:"creation_date" db:"creation_date"`
-	UpdatedDate     *time.Time `json:"updated_date" db:"updated_date"`
-	LastCommentDate *time.Time `json:"last_comment_date" db:"last_comment_date"`
-	LikeCount       int        `json:"like_count" db:"like_count"`
-	DislikeCount    int        `json:"dislike_count" db:"dislike_count"`
-	CommentCount    int        `json:"comment_count" db:"comment_count"`
-	ViewCount       int        `json:"view_count" db:"view_count"`
-	TagIDs          *string    `json:"tags" db:"tags"`               // For default tag IDs
-	CustomTagNames  *string    `json:"custom_tags" db:"custom_tags"` // For custom tag names
+	ID              int         `json:"id" db:"id"`
+	Username        string      `json:"username" db:"username"`
+	UserProfilePath *string     `json:"user_profile_path" db:"profile_picture_path"`
+	ChannelID       *int64      `json:"channel_id" db:"channel_id"`
+	Channel         *string     `json:"channel" db:"channel"`
+	Title           string      `json:"title" db:"title"`
+	OriginalPost    string      `json:"original_post" db:"original_post"`
+	CreationDate    time.Time   `json:"creation_date" db:"creation_date"`
+	UpdatedDate     *time.Time  `json:"updated_date" db:"updated_date"`
+	LastCommentDate *time.Time  `json:"last_comment_date" db:"last_comment_date"`
+	LikeCount       int         `json:"like_count" db:"like_count"`
+	DislikeCount    int         `json:"dislike_count" db:"dislike_count"`
+	CommentCount    int         `json:"comment_count" db:"comment_count"`
+	ViewCount       int         `json:"view_count" db:"view_count"`
+	Lang            AppLanguage `json:"lang" db:"lang"`
+	TagIDs          *string     `json:"tags" db:"tags"`               // For default tag IDs
+	CustomTagNames  *string     `json:"custom_tags" db:"custom_tags"` // For custom tag names
+	Rank            *float32    `json:"rank,omitempty" db:"rank"`     // Only set in search results
+}
+
+func (t ThreadView) KeyFor(sortColumn string) (string, int64) {
+	switch sortColumnName(sortColumn) {
+	case "view_count":
+		return strconv.Itoa(t.ViewCount), int64(t.ID)
+	case "like_count":
+		return strconv.Itoa(t.LikeCount), int64(t.ID)
+	case "dislike_count":
+		return strconv.Itoa(t.DislikeCount), int64(t.ID)
+	case "creation_date":
+		return t.CreationDate.Format(time.RFC3339Nano), int64(t.ID)
+	case "rank":
+		if t.Rank != nil {
+			return strconv.FormatFloat(float64(*t.Rank), 'g', -1, 32), int64(t.ID)
+		}
+	}
+
+	return strconv.Itoa(t.ID), int64(t.ID)
 }
 
 type ThreadRequest struct {
-	Title        string   `json:"title"`
-	OriginalPost string   `json:"original_post"`
-	Tags         []Tag    `json:"tags"`
-	CustomTags   []string `json:"custom_tags"`
+	Title        string       `json:"title"`
+	OriginalPost string       `json:"original_post"`
+	ChannelID    *int64       `json:"channel_id"`
+	Lang         *AppLanguage `json:"lang"` // Defaults to the author's preferred language
+	Tags         []Tag        `json:"tags"`
+	CustomTags   []string     `json:"custom_tags"`
+	Poll         *PollRequest `json:"poll"`
 }
 
 func (t *Thread) IsOwnedBy(userID *uuid.UUID) bool {
@@ -60,5 +87,6 @@ type ThreadListResponse struct {
 
 type ThreadViewResponse struct {
 	Thread   ThreadView                     `json:"thread"`
+	Poll     *PollView                      `json:"poll"`
 	Comments PaginatedResponse[CommentView] `json:"comments"`
 }
@@ -0,0 +1,63 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+const (
+	RECOVERY_CODE_COUNT = 10
+
+	TOTP_ISSUER = "1chan"
+
+	LOGIN_CHALLENGE_EXPIRATION   = 5 * time.Minute
+	LOGIN_CHALLENGE_MAX_ATTEMPTS = 5
+
+	// A user's two-factor codes are no longer checked once this many
+	// attempts have failed within the window, whichever challenge they
+	// were made with
+	TOTP_MAX_FAILED_ATTEMPTS   = 10
+	TOTP_FAILED_ATTEMPT_WINDOW = 15 * time.Minute
+)
+
+// UserTOTP is a user's TOTP secret. It is pending until the user confirms
+// their enrolment with a first code, and two-factor authentication is only
+// required once EnabledDate is set.
+type UserTOTP struct {
+	UserID       uuid.UUID  `db:"user_id"`
+	Secret       string     `db:"secret"`
+	EnabledDate  *time.Time `db:"enabled_date"`
+	LastUsedStep int64      `db:"last_used_step"`
+}
+
+func (t *UserTOTP) IsEnabled() bool {
+	return t.EnabledDate != nil
+}
+
+// LoginChallenge is issued when a user with two-factor authentication
+// enabled logs in with their password, and is exchanged for their tokens
+// along with a valid code from the same device.
+type LoginChallenge struct {
+	UserID         uuid.UUID `db:"user_id"`
+	DeviceID       string    `db:"device_id"`
+	Attempts       int       `db:"attempts"`
+	ExpirationDate time.Time `db:"expiration_date"`
+}
+
+func (c *LoginChallenge) IsExpired() bool {
+	return c.ExpirationDate.Before(time.Now().UTC())
+}
+
+// TOTPLoginRequest completes a login challenge with either a code from the
+// user's authenticator app or one of their recovery codes.
+type TOTPLoginRequest struct {
+	Challenge    string `json:"challenge" binding:"required"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type TOTPStatus struct {
+	Enabled                bool       `json:"enabled" db:"enabled"`
+	EnabledDate            *time.Time `json:"enabled_date" db:"enabled_date"`
+	RecoveryCodesRemaining int        `json:"recovery_codes_remaining" db:"recovery_codes_remaining"`
+}
@@ -6,9 +6,28 @@ import (
 )
 
 type User struct {
-	ID       uuid.UUID `db:"id" json:"id"`
-	Username string    `db:"username" json:"username" binding:"required"`
-	Password string    `db:"password_hash" json:"password" binding:"required"`
+	ID             uuid.UUID  `db:"id" json:"id"`
+	Username       string     `db:"username" json:"username" binding:"required"`
+	Password       string     `db:"password_hash" json:"password" binding:"required"`
+	Role           UserRole   `db:"role" json:"-"`
+	SuspendedUntil *time.Time `db:"suspended_until" json:"-"`
+	DeletedAt      *time.Time `db:"deleted_at" json:"-"`
+	DeletedBy      *uuid.UUID `db:"deleted_by" json:"-"`
+}
+
+func (u *User) IsSuspended() bool {
+	return u.SuspendedUntil != nil && u.SuspendedUntil.After(time.Now().UTC())
+}
+
+func (u *User) IsDeleted() bool {
+	return u.DeletedAt != nil
+}
+
+// IsRestorable reports whether the user deleted their own account
+// within the grace period.
+func (u *User) IsRestorable() bool {
+	return u.IsDeleted() && u.DeletedBy != nil && *u.DeletedBy == u.ID &&
+		time.Since(*u.DeletedAt) < DELETION_GRACE_PERIOD
 }
 
 type UserForAuth struct {
@@ -26,6 +45,7 @@ type UserProfile struct {
 	ProfilePicturePath *string     `db:"profile_picture_path" json:"profile_picture_path"`
 	Biodata            string      `db:"biodata" json:"biodata"`
 	Email              *string     `db:"email" json:"email"`
+	EmailVerified      bool        `db:"email_verified" json:"email_verified"`
 	PostCount          int         `db:"post_count" json:"post_count"`
 	CommentCount       int         `db:"comment_count" json:"comment_count"`
 	PreferredLang      AppLanguage `db:"preferred_lang" json:"preferred_lang"`
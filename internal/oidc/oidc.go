@@ -0,0 +1,432 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DISCOVERY_TTL is how long the discovery document and keys of a provider
+// are cached for, after which they are fetched again when next needed.
+const DISCOVERY_TTL = 24 * time.Hour
+
+// KEY_REFRESH_INTERVAL is the least time between fetching the keys of a
+// provider again because an ID token was signed with an unknown key.
+const KEY_REFRESH_INTERVAL = time.Minute
+
+// Identity is the user a provider authenticated, as described by the
+// claims of their ID token.
+type Identity struct {
+	Provider          string
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+}
+
+// Provider authenticates users with the authorization code flow. OIDCProvider
+// works with any OpenID Connect provider, but providers which only support
+// plain OAuth2 can be plugged in by implementing Provider themselves.
+type Provider interface {
+	Name() string
+
+	// AuthorizationURL returns the URL to send the user to for them to sign
+	// in. The provider redirects them back to redirectURI with a code, and
+	// with state unchanged.
+	AuthorizationURL(ctx context.Context, redirectURI string, state string, nonce string, codeChallenge string) (string, error)
+
+	// Exchange redeems the code the provider redirected back with for the
+	// identity of the user, checking that it was issued for nonce.
+	Exchange(ctx context.Context, redirectURI string, code string, codeVerifier string, nonce string) (Identity, error)
+}
+
+var providers = make(map[string]Provider)
+
+// Register makes provider available under its name, replacing any provider
+// previously registered under that name.
+func Register(provider Provider) {
+	providers[provider.Name()] = provider
+}
+
+// Get returns the provider registered under name.
+func Get(name string) (Provider, bool) {
+	provider, ok := providers[name]
+	return provider, ok
+}
+
+// Names returns the names of the registered providers, sorted.
+func Names() []string {
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// RegisterFromEnv registers the providers listed in the comma separated
+// OIDC_PROVIDERS environment variable. Each provider <NAME> is configured
+// by OIDC_<NAME>_ISSUER, OIDC_<NAME>_CLIENT_ID, OIDC_<NAME>_CLIENT_SECRET
+// and, optionally, OIDC_<NAME>_SCOPES.
+func RegisterFromEnv() error {
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		provider := &OIDCProvider{
+			ProviderName: name,
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+		}
+		if scopes := os.Getenv(prefix + "SCOPES"); scopes != "" {
+			provider.Scopes = strings.Fields(scopes)
+		}
+
+		if provider.Issuer == "" || provider.ClientID == "" {
+			return fmt.Errorf("%sISSUER and %sCLIENT_ID must be set to use the %s provider", prefix, prefix, name)
+		}
+
+		Register(provider)
+	}
+
+	return nil
+}
+
+// CodeChallenge returns the S256 PKCE challenge of verifier.
+func CodeChallenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// OIDCProvider is an OpenID Connect provider whose endpoints are found
+// through its discovery document at <Issuer>/.well-known/openid-configuration.
+type OIDCProvider struct {
+	ProviderName string
+	Issuer       string
+	ClientID     string
+	ClientSecret string // Empty for public clients, which rely on PKCE alone
+	Scopes       []string
+	HTTPClient   *http.Client
+
+	mu            sync.Mutex
+	discovery     *discoveryDocument
+	discoveredAt  time.Time
+	keys          map[string]interface{}
+	keysFetchedAt time.Time
+}
+
+type discoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type idTokenClaims struct {
+	Nonce             string      `json:"nonce"`
+	Email             string      `json:"email"`
+	EmailVerified     interface{} `json:"email_verified"` // Some providers send a string
+	PreferredUsername string      `json:"preferred_username"`
+	jwt.RegisteredClaims
+}
+
+func (p *OIDCProvider) Name() string {
+	return p.ProviderName
+}
+
+func (p *OIDCProvider) AuthorizationURL(ctx context.Context, redirectURI string, state string, nonce string, codeChallenge string) (string, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	scopes := p.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {codeChallenge},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+func (p *OIDCProvider) Exchange(ctx context.Context, redirectURI string, code string, codeVerifier string, nonce string) (Identity, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {p.ClientID},
+		"code_verifier": {codeVerifier},
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Identity{}, err
+	}
+
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		request.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	var tokenResponse struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = p.doJSON(request, &tokenResponse)
+	if err != nil {
+		if tokenResponse.Error != "" {
+			return Identity{}, fmt.Errorf("token request rejected: %s %s", tokenResponse.Error, tokenResponse.ErrorDescription)
+		}
+		return Identity{}, err
+	}
+
+	if tokenResponse.IDToken == "" {
+		return Identity{}, errors.New("token response has no ID token")
+	}
+
+	claims := &idTokenClaims{}
+	_, err = jwt.ParseWithClaims(tokenResponse.IDToken, claims, p.keyfunc(ctx),
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithIssuer(discovery.Issuer),
+		jwt.WithAudience(p.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil {
+		return Identity{}, fmt.Errorf("invalid ID token: %w", err)
+	}
+
+	if claims.Nonce != nonce {
+		return Identity{}, errors.New("invalid ID token: nonce mismatch")
+	}
+
+	if claims.Subject == "" {
+		return Identity{}, errors.New("invalid ID token: missing subject")
+	}
+
+	return Identity{
+		Provider:          p.ProviderName,
+		Subject:           claims.Subject,
+		Email:             claims.Email,
+		EmailVerified:     claims.EmailVerified == true || claims.EmailVerified == "true",
+		PreferredUsername: claims.PreferredUsername,
+	}, nil
+}
+
+// discover returns the discovery document of the provider, fetching it
+// when it is not cached.
+func (p *OIDCProvider) discover(ctx context.Context) (*discoveryDocument, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil && time.Since(p.discoveredAt) < DISCOVERY_TTL {
+		return p.discovery, nil
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	discovery := &discoveryDocument{}
+	err = p.doJSON(request, discovery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover %s: %w", p.ProviderName, err)
+	}
+
+	if discovery.Issuer != p.Issuer {
+		return nil, fmt.Errorf("discovery document of %s is for issuer %q", p.ProviderName, discovery.Issuer)
+	}
+
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document of %s is missing endpoints", p.ProviderName)
+	}
+
+	p.discovery = discovery
+	p.discoveredAt = time.Now()
+	p.keys = nil
+	return discovery, nil
+}
+
+// keyfunc returns the function ID tokens are verified with. The keys of
+// the provider are fetched again when a token is signed with a key which
+// is not cached, so that the provider can rotate its keys.
+func (p *OIDCProvider) keyfunc(ctx context.Context) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		keyID, _ := token.Header["kid"].(string)
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		key, ok := p.keys[keyID]
+		if ok {
+			return key, nil
+		}
+
+		if p.keys != nil && time.Since(p.keysFetchedAt) < KEY_REFRESH_INTERVAL {
+			return nil, fmt.Errorf("unknown signing key %q", keyID)
+		}
+
+		keys, err := p.fetchKeys(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		p.keys = keys
+		p.keysFetchedAt = time.Now()
+
+		key, ok = p.keys[keyID]
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", keyID)
+		}
+
+		return key, nil
+	}
+}
+
+// fetchKeys returns the signing keys published by the provider, by kid.
+// Keys of unsupported types are skipped.
+func (p *OIDCProvider) fetchKeys(ctx context.Context) (map[string]interface{}, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, p.discovery.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var jwks struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyID   string `json:"kid"`
+			Use     string `json:"use"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+			Curve   string `json:"crv"`
+			X       string `json:"x"`
+			Y       string `json:"y"`
+		} `json:"keys"`
+	}
+	err = p.doJSON(request, &jwks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch keys of %s: %w", p.ProviderName, err)
+	}
+
+	keys := make(map[string]interface{})
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		var key interface{}
+		switch jwk.KeyType {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+			if errN != nil || errE != nil || len(e) > 4 {
+				continue
+			}
+			key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch jwk.Curve {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+
+			x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			key = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		case "OKP":
+			x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+			if jwk.Curve != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+				continue
+			}
+			key = ed25519.PublicKey(x)
+		default:
+			continue
+		}
+
+		keys[jwk.KeyID] = key
+	}
+
+	return keys, nil
+}
+
+// doJSON sends request and decodes the JSON response into v, which is also
+// decoded on error responses so that their details can be read.
+func (p *OIDCProvider) doJSON(request *http.Request, v interface{}) error {
+	client := p.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	decodeErr := json.Unmarshal(body, v)
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s returned %s", request.Method, request.URL.Redacted(), response.Status)
+	}
+
+	return decodeErr
+}
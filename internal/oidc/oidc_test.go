@@ -0,0 +1,370 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v5"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID     = "client"
+	testClientSecret = "secret"
+	testRedirectURI  = "https://1chan.test/oauth/callback"
+	testCode         = "code"
+	testVerifier     = "verifier"
+	testNonce        = "nonce"
+)
+
+// mockProvider is an OpenID Connect provider serving discovery, JWKS and
+// token endpoints. Its token endpoint returns idToken for testCode, provided
+// that the PKCE verifier matches the one of the authorization request.
+type mockProvider struct {
+	server *httptest.Server
+
+	mu           sync.Mutex
+	keys         map[string]*rsa.PrivateKey // Published keys, by kid
+	idToken      string
+	jwksRequests int
+	tokenForm    url.Values
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+
+	m := &mockProvider{keys: make(map[string]*rsa.PrivateKey)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(discoveryDocument{
+			Issuer:                m.server.URL,
+			AuthorizationEndpoint: m.server.URL + "/authorize",
+			TokenEndpoint:         m.server.URL + "/token",
+			JWKSURI:               m.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		m.jwksRequests++
+		keys := []map[string]string{}
+		for keyID, key := range m.keys {
+			keys = append(keys, map[string]string{
+				"kty": "RSA",
+				"kid": keyID,
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		r.ParseForm()
+		m.tokenForm = r.PostForm
+
+		clientID, clientSecret, ok := r.BasicAuth()
+		if !ok || clientID != testClientID || clientSecret != testClientSecret {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+
+		if r.PostForm.Get("code") != testCode || r.PostForm.Get("code_verifier") != testVerifier ||
+			r.PostForm.Get("redirect_uri") != testRedirectURI {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"id_token": m.idToken})
+	})
+
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+// addKey generates and publishes a new signing key.
+func (m *mockProvider) addKey(t *testing.T, keyID string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys[keyID] = key
+}
+
+// issue makes the token endpoint return an ID token with claims, signed
+// with the key keyID.
+func (m *mockProvider) issue(t *testing.T, keyID string, claims jwt.MapClaims) {
+	t.Helper()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = keyID
+	idToken, err := token.SignedString(m.keys[keyID])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.idToken = idToken
+}
+
+// validClaims returns the claims of an ID token which Exchange accepts.
+func (m *mockProvider) validClaims() jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":                m.server.URL,
+		"sub":                "subject",
+		"aud":                testClientID,
+		"exp":                now.Add(time.Hour).Unix(),
+		"iat":                now.Unix(),
+		"nonce":              testNonce,
+		"email":              "user@example.com",
+		"email_verified":     true,
+		"preferred_username": "user",
+	}
+}
+
+func (m *mockProvider) provider() *OIDCProvider {
+	return &OIDCProvider{
+		ProviderName: "mock",
+		Issuer:       m.server.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		HTTPClient:   m.server.Client(),
+	}
+}
+
+func TestCodeChallenge(t *testing.T) {
+	// Example of RFC 7636, appendix B
+	challenge := CodeChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	if challenge != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("CodeChallenge() = %q", challenge)
+	}
+}
+
+func TestAuthorizationURL(t *testing.T) {
+	m := newMockProvider(t)
+
+	authorizationURL, err := m.provider().AuthorizationURL(context.Background(), testRedirectURI, "state", testNonce, "challenge")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := url.Parse(authorizationURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(authorizationURL, m.server.URL+"/authorize?") {
+		t.Errorf("authorization URL %q is not on the authorization endpoint", authorizationURL)
+	}
+
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientID,
+		"redirect_uri":          testRedirectURI,
+		"scope":                 "openid email profile",
+		"state":                 "state",
+		"nonce":                 testNonce,
+		"code_challenge":        "challenge",
+		"code_challenge_method": "S256",
+	}
+	for name, value := range want {
+		if got := parsed.Query().Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	m := newMockProvider(t)
+	provider := m.provider()
+	provider.Issuer = m.server.URL + "/"
+
+	_, err := provider.AuthorizationURL(context.Background(), testRedirectURI, "state", testNonce, "challenge")
+	if err == nil {
+		t.Fatal("discovery document of another issuer accepted")
+	}
+}
+
+func TestExchange(t *testing.T) {
+	tests := []struct {
+		name    string
+		claims  func(claims jwt.MapClaims)
+		nonce   string
+		wantErr string
+	}{
+		{name: "valid"},
+		{name: "nonce mismatch", nonce: "other", wantErr: "nonce mismatch"},
+		{name: "missing nonce", claims: func(claims jwt.MapClaims) { delete(claims, "nonce") }, wantErr: "nonce mismatch"},
+		{name: "wrong issuer", claims: func(claims jwt.MapClaims) { claims["iss"] = "https://evil.test" }, wantErr: "issuer"},
+		{name: "wrong audience", claims: func(claims jwt.MapClaims) { claims["aud"] = "other" }, wantErr: "audience"},
+		{
+			name:    "expired",
+			claims:  func(claims jwt.MapClaims) { claims["exp"] = time.Now().Add(-time.Minute).Unix() },
+			wantErr: "expired",
+		},
+		{name: "missing expiry", claims: func(claims jwt.MapClaims) { delete(claims, "exp") }, wantErr: "exp"},
+		{
+			name:    "issued in the future",
+			claims:  func(claims jwt.MapClaims) { claims["iat"] = time.Now().Add(time.Hour).Unix() },
+			wantErr: "used before issued",
+		},
+		{name: "missing subject", claims: func(claims jwt.MapClaims) { delete(claims, "sub") }, wantErr: "subject"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newMockProvider(t)
+			m.addKey(t, "key")
+
+			claims := m.validClaims()
+			if test.claims != nil {
+				test.claims(claims)
+			}
+			m.issue(t, "key", claims)
+
+			nonce := testNonce
+			if test.nonce != "" {
+				nonce = test.nonce
+			}
+
+			identity, err := m.provider().Exchange(context.Background(), testRedirectURI, testCode, testVerifier, nonce)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("Exchange() error = %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := Identity{
+				Provider:          "mock",
+				Subject:           "subject",
+				Email:             "user@example.com",
+				EmailVerified:     true,
+				PreferredUsername: "user",
+			}
+			if identity != want {
+				t.Errorf("Exchange() = %+v, want %+v", identity, want)
+			}
+		})
+	}
+}
+
+func TestExchangeForwardsPKCEVerifier(t *testing.T) {
+	m := newMockProvider(t)
+	m.addKey(t, "key")
+	m.issue(t, "key", m.validClaims())
+
+	_, err := m.provider().Exchange(context.Background(), testRedirectURI, testCode, testVerifier, testNonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := m.tokenForm.Get("code_verifier"); got != testVerifier {
+		t.Errorf("code_verifier = %q, want %q", got, testVerifier)
+	}
+	if got := m.tokenForm.Get("grant_type"); got != "authorization_code" {
+		t.Errorf("grant_type = %q, want authorization_code", got)
+	}
+
+	// The provider rejects the code when the verifier does not match the
+	// challenge it was issued with
+	_, err = m.provider().Exchange(context.Background(), testRedirectURI, testCode, "other", testNonce)
+	if err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("Exchange() with the wrong verifier error = %v, want invalid_grant", err)
+	}
+}
+
+func TestExchangeRefreshesKeys(t *testing.T) {
+	m := newMockProvider(t)
+	m.addKey(t, "old")
+	provider := m.provider()
+
+	m.issue(t, "old", m.validClaims())
+	if _, err := provider.Exchange(context.Background(), testRedirectURI, testCode, testVerifier, testNonce); err != nil {
+		t.Fatal(err)
+	}
+
+	// The provider rotates its keys. Tokens signed with the new key are
+	// rejected until the keys may be fetched again.
+	m.addKey(t, "new")
+	m.issue(t, "new", m.validClaims())
+	_, err := provider.Exchange(context.Background(), testRedirectURI, testCode, testVerifier, testNonce)
+	if err == nil || !strings.Contains(err.Error(), "unknown signing key") {
+		t.Fatalf("Exchange() error = %v, want unknown signing key", err)
+	}
+	if m.jwksRequests != 1 {
+		t.Fatalf("keys fetched %d times within KEY_REFRESH_INTERVAL, want 1", m.jwksRequests)
+	}
+
+	provider.mu.Lock()
+	provider.keysFetchedAt = time.Now().Add(-KEY_REFRESH_INTERVAL)
+	provider.mu.Unlock()
+
+	if _, err = provider.Exchange(context.Background(), testRedirectURI, testCode, testVerifier, testNonce); err != nil {
+		t.Fatal(err)
+	}
+	if m.jwksRequests != 2 {
+		t.Errorf("keys fetched %d times, want 2", m.jwksRequests)
+	}
+
+	// Tokens signed with a key which is not published are still rejected
+	m.addKey(t, "unpublished")
+	m.issue(t, "unpublished", m.validClaims())
+	m.mu.Lock()
+	delete(m.keys, "unpublished")
+	m.mu.Unlock()
+
+	provider.mu.Lock()
+	provider.keysFetchedAt = time.Now().Add(-KEY_REFRESH_INTERVAL)
+	provider.mu.Unlock()
+
+	_, err = provider.Exchange(context.Background(), testRedirectURI, testCode, testVerifier, testNonce)
+	if err == nil || !strings.Contains(err.Error(), "unknown signing key") {
+		t.Errorf("Exchange() error = %v, want unknown signing key", err)
+	}
+}
+
+func TestExchangeRejectsUnsignedTokens(t *testing.T) {
+	m := newMockProvider(t)
+	m.addKey(t, "key")
+
+	token := jwt.NewWithClaims(jwt.SigningMethodNone, m.validClaims())
+	idToken, err := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.idToken = idToken
+
+	_, err = m.provider().Exchange(context.Background(), testRedirectURI, testCode, testVerifier, testNonce)
+	if err == nil {
+		t.Fatal("unsigned ID token accepted")
+	}
+}
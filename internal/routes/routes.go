@@ -4,4 +4,7 @@ var (
 	BaseURL string
 	BaseAPI string
 	APIRoot string
+
+	// ClientURL is the root of the frontend, which links sent by email point to.
+	ClientURL string
 )
@@ -1,9 +1,15 @@
 package utils_auth
 
 import (
+	"1chanserver/internal/models"
 	"1chanserver/internal/utils/utils_db"
+	"1chanserver/internal/utils/utils_jwks"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
@@ -19,13 +25,32 @@ import (
 	"time"
 )
 
+// TokenType tells access tokens and refresh tokens apart, so that neither
+// is accepted in place of the other.
+type TokenType string
+
+const (
+	AccessTokenType  TokenType = "access"
+	RefreshTokenType TokenType = "refresh"
+)
+
+// Claims are the claims of access and refresh tokens. SessionID is the
+// family of the refresh token session the token was issued for.
 type Claims struct {
-	UserID uuid.UUID
+	UserID    uuid.UUID
+	Role      models.UserRole `json:"role,omitempty"`
+	TokenType TokenType       `json:"token_type"`
+	SessionID uuid.UUID       `json:"sid"`
 	jwt.RegisteredClaims
 }
 
 var JWT_SECRET_KEY = []byte(os.Getenv("JWT_SECRET_KEY"))
 
+// SigningKeys signs and verifies access and refresh tokens. It defaults to
+// HS256 with JWT_SECRET_KEY, and is replaced at startup when asymmetric
+// signing keys are configured.
+var SigningKeys = utils_jwks.NewHMACKeySet(JWT_SECRET_KEY)
+
 const (
 	ARGON2_TIME       = uint32(1)
 	ARGON2_MEMORY     = uint32(64 * 1024)
@@ -36,6 +61,16 @@ const (
 	JWT_ACCESS_TOKEN_EXPIRATION          = 5 * time.Minute
 	JWT_REFRESH_TOKEN_EXPIRATION         = 14 * 24 * time.Hour
 	JWT_REFRESH_TOKEN_EXPIRATION_MAX_AGE = 3600 * 24 * 14
+
+	// REFRESH_TOKEN_REUSE_GRACE is how long after being rotated out a
+	// refresh token may still be exchanged for its successor
+	REFRESH_TOKEN_REUSE_GRACE = 30 * time.Second
+
+	// Access tokens are meant for the API, and other services we run, whereas
+	// refresh tokens are only ever accepted by the refresh endpoints
+	JWT_ISSUER           = "1chan"
+	JWT_ACCESS_AUDIENCE  = "1chan-api"
+	JWT_REFRESH_AUDIENCE = "1chan-refresh"
 )
 
 // formatHash takes in a salt and Argon2hash of a password in bytes,
@@ -125,32 +160,81 @@ func VerifyArgon2Hash(payload string, storedHash string) bool {
 	return computedHash == expectedHash
 }
 
-func GenerateAccessToken(userID uuid.UUID) (string, error) {
+func GenerateAccessToken(userID uuid.UUID, role models.UserRole, sessionID uuid.UUID) (string, error) {
 	claims := Claims{
-		UserID: userID,
+		UserID:    userID,
+		Role:      role,
+		TokenType: AccessTokenType,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Issuer:    JWT_ISSUER,
+			Subject:   userID.String(),
+			Audience:  jwt.ClaimStrings{JWT_ACCESS_AUDIENCE},
 			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(JWT_ACCESS_TOKEN_EXPIRATION)),
 			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
 			NotBefore: jwt.NewNumericDate(time.Now().UTC()),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(JWT_SECRET_KEY)
+	return SigningKeys.Sign(claims)
 }
 
-func GenerateRefreshToken(userID uuid.UUID) (string, error) {
+// GenerateRefreshToken returns a refresh token of the session sessionID,
+// identified by tokenID, which is carried as its jti.
+func GenerateRefreshToken(userID uuid.UUID, sessionID uuid.UUID, tokenID uuid.UUID) (string, error) {
 	claims := Claims{
-		UserID: userID,
+		UserID:    userID,
+		TokenType: RefreshTokenType,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        tokenID.String(),
+			Issuer:    JWT_ISSUER,
+			Subject:   userID.String(),
+			Audience:  jwt.ClaimStrings{JWT_REFRESH_AUDIENCE},
 			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(JWT_REFRESH_TOKEN_EXPIRATION)),
 			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
 			NotBefore: jwt.NewNumericDate(time.Now().UTC()),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(JWT_SECRET_KEY)
+	return SigningKeys.Sign(claims)
+}
+
+// ParseAccessToken verifies an access token and returns its claims.
+func ParseAccessToken(accessToken string) (*Claims, error) {
+	return parseToken(accessToken, AccessTokenType, JWT_ACCESS_AUDIENCE)
+}
+
+// ParseRefreshToken verifies a refresh token and returns its claims. Whether
+// the token is still the current one of its session is left to the caller.
+func ParseRefreshToken(refreshToken string) (*Claims, error) {
+	return parseToken(refreshToken, RefreshTokenType, JWT_REFRESH_AUDIENCE)
+}
+
+func parseToken(token string, tokenType TokenType, audience string) (*Claims, error) {
+	parsedToken, err := jwt.ParseWithClaims(token, &Claims{}, SigningKeys.Keyfunc,
+		jwt.WithIssuer(JWT_ISSUER),
+		jwt.WithAudience(audience),
+		jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := parsedToken.Claims.(*Claims)
+	if !ok || !parsedToken.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	if claims.TokenType != tokenType {
+		return nil, fmt.Errorf("expected %s token, got %q", tokenType, claims.TokenType)
+	}
+
+	if claims.ID == "" || claims.SessionID == uuid.Nil {
+		return nil, errors.New("token is missing its jti or session ID")
+	}
+
+	return claims, nil
 }
 
 func HashRefreshToken(refreshToken string) string {
@@ -159,6 +243,121 @@ func HashRefreshToken(refreshToken string) string {
 	return formatHash(salt, hash)
 }
 
+// IssueRefreshToken starts a new session, with a new token family, for the
+// user on deviceID, and returns its refresh token and session ID.
+func IssueRefreshToken(userID uuid.UUID, deviceID string, client models.SessionClient, db sqlx.Ext) (string, uuid.UUID, error) {
+	session := models.RefreshToken{
+		UserID:         userID,
+		DeviceID:       deviceID,
+		TokenID:        uuid.New(),
+		FamilyID:       uuid.New(),
+		ExpirationDate: time.Now().UTC().Add(JWT_REFRESH_TOKEN_EXPIRATION),
+		UserAgent:      &client.UserAgent,
+		IPAddress:      &client.IPAddress,
+	}
+
+	refreshToken, err := GenerateRefreshToken(userID, session.FamilyID, session.TokenID)
+	if err != nil {
+		return "", uuid.Nil, err
+	}
+
+	session.TokenHash = HashRefreshToken(refreshToken)
+	err = utils_db.InsertRefreshToken(&session, db)
+	if err != nil {
+		return "", uuid.Nil, err
+	}
+
+	return refreshToken, session.FamilyID, nil
+}
+
+// RotateRefreshToken replaces the token of session, previousToken, with a
+// new one of the same family, remembering the previous token as rotated out,
+// and returns the new refresh token.
+func RotateRefreshToken(session *models.RefreshToken, previousToken string, previousExpiration time.Time, client models.SessionClient, tx *sqlx.Tx) (string, error) {
+	tokenID := uuid.New()
+	refreshToken, err := GenerateRefreshToken(session.UserID, session.FamilyID, tokenID)
+	if err != nil {
+		return "", err
+	}
+
+	sealedSuccessor, err := sealSuccessor(previousToken, refreshToken)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO rotated_refresh_tokens(token_id, family_id, user_id, successor_token_id, sealed_successor, expiration_date)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		`, session.TokenID, session.FamilyID, session.UserID, tokenID, sealedSuccessor, previousExpiration)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE refresh_tokens
+		SET token_hash = $1, token_id = $2, expiration_date = $3, last_used_date = $4, user_agent = $5, ip_address = $6
+		WHERE id = $7
+		`, HashRefreshToken(refreshToken), tokenID, time.Now().UTC().Add(JWT_REFRESH_TOKEN_EXPIRATION),
+		time.Now().UTC(), client.UserAgent, client.IPAddress, session.ID)
+	if err != nil {
+		return "", err
+	}
+
+	return refreshToken, nil
+}
+
+// successorCipher returns the cipher a token's successor is sealed with. Its
+// key is derived from the token, so that the successor can only be recovered
+// by whoever presents the token, and not from the database alone.
+func successorCipher(previousToken string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte("refresh-token-successor:" + previousToken))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func sealSuccessor(previousToken string, successor string) (string, error) {
+	aead, err := successorCipher(previousToken)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(successor), nil)), nil
+}
+
+// OpenSuccessor returns the successor of a rotated out refresh token, given
+// the token itself and the sealed successor stored along with it.
+func OpenSuccessor(previousToken string, sealedSuccessor string) (string, error) {
+	aead, err := successorCipher(previousToken)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(sealedSuccessor)
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("sealed successor too short")
+	}
+
+	successor, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(successor), nil
+}
+
 func ValidateRefreshToken(db *sqlx.DB, userID uuid.UUID, givenRefreshToken string, deviceID string) error {
 	storedHash, err := utils_db.FetchOne[string](
 		db, "SELECT token_hash FROM refresh_tokens WHERE user_id = $1 AND device_id = $2", userID, deviceID)
@@ -184,3 +383,23 @@ func SetRefreshTokenCookie(c *gin.Context, refreshToken string) {
 
 	c.SetCookie("Refresh-Token", refreshToken, JWT_REFRESH_TOKEN_EXPIRATION_MAX_AGE, "/", "", secureCookieEnabled == "true", true)
 }
+
+// GenerateOpaqueToken returns a random token, such as those sent by email,
+// along with the hash to store in its place.
+func GenerateOpaqueToken() (string, string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", "", err
+	}
+
+	encodedToken := base64.RawURLEncoding.EncodeToString(token)
+	return encodedToken, HashOpaqueToken(encodedToken), nil
+}
+
+// HashOpaqueToken returns the SHA-256 hash of an opaque token. Unlike
+// passwords, the tokens are random enough not to need a salted hash,
+// which lets them be looked up by their hash.
+func HashOpaqueToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
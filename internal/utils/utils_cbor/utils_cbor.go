@@ -0,0 +1,156 @@
+package utils_cbor
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// MAX_DEPTH is how deeply arrays and maps may be nested in decoded items.
+const MAX_DEPTH = 16
+
+var errTruncated = errors.New("cbor: unexpected end of data")
+
+// Decode decodes the CBOR (RFC 8949) data item at the start of data, and
+// returns it along with the data following it. Only the subset of CBOR
+// used by WebAuthn is supported, that is definite length items without
+// tags or floating point numbers.
+//
+// Integers are decoded as int64, byte strings as []byte, text strings as
+// string, arrays as []interface{}, maps as map[interface{}]interface{},
+// and simple values as bool or nil.
+func Decode(data []byte) (interface{}, []byte, error) {
+	return decode(data, 0)
+}
+
+func decode(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > MAX_DEPTH {
+		return nil, nil, errors.New("cbor: nested too deeply")
+	}
+
+	if len(data) == 0 {
+		return nil, nil, errTruncated
+	}
+
+	majorType := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	if majorType == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		default:
+			return nil, nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+		}
+	}
+
+	argument, data, err := decodeArgument(info, data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch majorType {
+	case 0:
+		if argument > 1<<63-1 {
+			return nil, nil, errors.New("cbor: integer overflows int64")
+		}
+		return int64(argument), data, nil
+	case 1:
+		if argument > 1<<63-1 {
+			return nil, nil, errors.New("cbor: integer overflows int64")
+		}
+		return -1 - int64(argument), data, nil
+	case 2, 3:
+		if argument > uint64(len(data)) {
+			return nil, nil, errTruncated
+		}
+
+		if majorType == 2 {
+			return append([]byte(nil), data[:argument]...), data[argument:], nil
+		}
+		return string(data[:argument]), data[argument:], nil
+	case 4:
+		// Every item takes at least one byte, which bounds the length
+		// before anything is allocated for it
+		if argument > uint64(len(data)) {
+			return nil, nil, errTruncated
+		}
+
+		array := make([]interface{}, argument)
+		for i := range array {
+			array[i], data, err = decode(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return array, data, nil
+	case 5:
+		if argument > uint64(len(data))/2 {
+			return nil, nil, errTruncated
+		}
+
+		m := make(map[interface{}]interface{}, argument)
+		for i := uint64(0); i < argument; i++ {
+			var key, value interface{}
+			key, data, err = decode(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("cbor: unsupported map key type %T", key)
+			}
+
+			if _, ok := m[key]; ok {
+				return nil, nil, fmt.Errorf("cbor: duplicate map key %v", key)
+			}
+
+			value, data, err = decode(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[key] = value
+		}
+		return m, data, nil
+	default:
+		return nil, nil, fmt.Errorf("cbor: unsupported major type %d", majorType)
+	}
+}
+
+// decodeArgument decodes the argument of an item, whose additional
+// information is info, from data following its initial byte.
+func decodeArgument(info byte, data []byte) (uint64, []byte, error) {
+	switch {
+	case info < 24:
+		return uint64(info), data, nil
+	case info == 24:
+		if len(data) < 1 {
+			return 0, nil, errTruncated
+		}
+		return uint64(data[0]), data[1:], nil
+	case info == 25:
+		if len(data) < 2 {
+			return 0, nil, errTruncated
+		}
+		return uint64(binary.BigEndian.Uint16(data)), data[2:], nil
+	case info == 26:
+		if len(data) < 4 {
+			return 0, nil, errTruncated
+		}
+		return uint64(binary.BigEndian.Uint32(data)), data[4:], nil
+	case info == 27:
+		if len(data) < 8 {
+			return 0, nil, errTruncated
+		}
+		return binary.BigEndian.Uint64(data), data[8:], nil
+	default:
+		return 0, nil, errors.New("cbor: indefinite length items are not supported")
+	}
+}
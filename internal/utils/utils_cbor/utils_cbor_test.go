@@ -0,0 +1,169 @@
+package utils_cbor
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	// Examples of RFC 8949, appendix A, where supported
+	tests := []struct {
+		name string
+		data string
+		want interface{}
+	}{
+		{"zero", "00", int64(0)},
+		{"largest direct integer", "17", int64(23)},
+		{"one byte integer", "1818", int64(24)},
+		{"two byte integer", "1903e8", int64(1000)},
+		{"four byte integer", "1a000f4240", int64(1000000)},
+		{"eight byte integer", "1b000000e8d4a51000", int64(1000000000000)},
+		{"largest integer", "1b7fffffffffffffff", int64(1<<63 - 1)},
+		{"negative integer", "20", int64(-1)},
+		{"one byte negative integer", "3863", int64(-100)},
+		{"smallest integer", "3b7fffffffffffffff", int64(-1 << 63)},
+		{"false", "f4", false},
+		{"true", "f5", true},
+		{"null", "f6", nil},
+		{"undefined", "f7", nil},
+		{"empty byte string", "40", []byte(nil)},
+		{"byte string", "4401020304", []byte{1, 2, 3, 4}},
+		{"empty text string", "60", ""},
+		{"text string", "6449455446", "IETF"},
+		{"UTF-8 text string", "62c3bc", "ü"},
+		{"empty array", "80", []interface{}{}},
+		{"array", "83010203", []interface{}{int64(1), int64(2), int64(3)}},
+		{"nested array", "8301820203820405", []interface{}{
+			int64(1), []interface{}{int64(2), int64(3)}, []interface{}{int64(4), int64(5)},
+		}},
+		{"empty map", "a0", map[interface{}]interface{}{}},
+		{"map with integer keys", "a201020304", map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)}},
+		{"map with text keys", "a26161016162820203", map[interface{}]interface{}{
+			"a": int64(1), "b": []interface{}{int64(2), int64(3)},
+		}},
+		{"COSE key", "a4010220012158200102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20225820" +
+			"2122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f40",
+			map[interface{}]interface{}{
+				int64(1):  int64(2),
+				int64(-1): int64(1),
+				int64(-2): mustHex("0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20"),
+				int64(-3): mustHex("2122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f40"),
+			}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, rest, err := Decode(mustHex(test.data))
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Decode() = %#v, want %#v", got, test.want)
+			}
+
+			if len(rest) != 0 {
+				t.Errorf("Decode() left %x", rest)
+			}
+		})
+	}
+}
+
+func TestDecodeReturnsFollowingData(t *testing.T) {
+	got, rest, err := Decode(mustHex("4201020304"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got.([]byte), []byte{1, 2}) {
+		t.Errorf("Decode() = %x, want 0102", got)
+	}
+
+	if !bytes.Equal(rest, []byte{3, 4}) {
+		t.Errorf("Decode() left %x, want 0304", rest)
+	}
+}
+
+func TestDecodeCopiesByteStrings(t *testing.T) {
+	data := mustHex("420102")
+	got, _, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data[1] = 0xff
+	if got.([]byte)[0] != 1 {
+		t.Errorf("decoded byte string shares the memory of the data")
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		truncated bool // Whether errTruncated is expected
+	}{
+		{"empty", "", true},
+		{"truncated one byte argument", "18", true},
+		{"truncated two byte argument", "1901", true},
+		{"truncated four byte argument", "1a000102", true},
+		{"truncated eight byte argument", "1b00010203040506", true},
+		{"truncated byte string", "430102", true},
+		{"truncated text string", "636162", true},
+		{"truncated array", "830102", true},
+		{"truncated map key", "a2010203", true},
+		{"truncated map value", "a101", true},
+		{"over-long byte string", "5b7fffffffffffffff00", true},
+		{"over-long text string", "7a0000100000", true},
+		{"over-long array", "9bffffffffffffffff00", true},
+		{"over-long map", "bb7fffffffffffffff0000", true},
+		{"positive integer overflow", "1b8000000000000000", false},
+		{"negative integer overflow", "3b8000000000000000", false},
+		{"indefinite length byte string", "5f42010243030405ff", false},
+		{"indefinite length text string", "7f657374726561646d696e67ff", false},
+		{"indefinite length array", "9f0102ff", false},
+		{"indefinite length map", "bf61610161629f0203ffff", false},
+		{"reserved additional information", "1c", false},
+		{"duplicate integer key", "a201020103", false},
+		{"duplicate text key", "a2616101616102", false},
+		{"byte string key", "a1420102f5", false},
+		{"array key", "a18001", false},
+		{"tag", "c074323031332d30332d32315432303a30343a30305a", false},
+		{"half precision float", "f93c00", false},
+		{"double precision float", "fb3ff199999999999a", false},
+		{"simple value", "f0", false},
+		{"nested too deeply", strings.Repeat("81", MAX_DEPTH+1) + "00", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, _, err := Decode(mustHex(test.data))
+			if err == nil {
+				t.Fatalf("Decode() = %#v, want an error", got)
+			}
+
+			if errors.Is(err, errTruncated) != test.truncated {
+				t.Errorf("Decode() error = %v, truncated %t", err, test.truncated)
+			}
+		})
+	}
+}
+
+func TestDecodeMaxDepth(t *testing.T) {
+	_, _, err := Decode(mustHex(strings.Repeat("81", MAX_DEPTH) + "00"))
+	if err != nil {
+		t.Errorf("Decode() of items nested %d deep error = %v", MAX_DEPTH, err)
+	}
+}
+
+func mustHex(s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
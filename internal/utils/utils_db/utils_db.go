@@ -52,25 +52,84 @@ func EditUserProfile(userProfile *models.UserProfile, db *sqlx.DB) error {
 	return err
 }
 
-func DeleteUser(userID *uuid.UUID, db *sqlx.DB) error {
-	query := "DELETE FROM users WHERE id = $1"
-	_, err := db.Exec(query, userID.String())
+// DeleteUser soft-deletes a user's account and signs them out of every
+// device. The account is purged once models.DELETION_GRACE_PERIOD elapses,
+// unless the user logs in again before then, and their content is then
+// anonymised or removed according to mode.
+func DeleteUser(userID *uuid.UUID, mode models.AccountDeletionMode, reason *string, db *sqlx.DB) (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	_, err = tx.Exec(`
+		UPDATE users SET deleted_at = $1, deleted_by = $2, delete_reason = $3, deletion_mode = $4
+		WHERE id = $2 AND deleted_at IS NULL
+		`, time.Now().UTC(), userID.String(), reason, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = RevokeSessions(tx, "user_id = $1", userID.String())
 	return err
 }
 
-func InsertRefreshToken(user *models.User, refreshTokenHash string, expirationDate time.Time, devcieID string, db *sqlx.DB) error {
-	_, err := db.Exec(
-		"INSERT INTO refresh_tokens(user_id, token_hash, expiration_date, device_id) VALUES ($1, $2, $3, $4)",
-		user.ID,
-		refreshTokenHash,
-		expirationDate,
-		devcieID)
+// RevokeSessions ends the sessions in refresh_tokens matching the condition
+// where, and denylists the access tokens issued for them, which would
+// otherwise stay valid until they expire. It returns how many were ended.
+func RevokeSessions(db sqlx.Execer, where string, args ...interface{}) (int64, error) {
+	result, err := db.Exec(fmt.Sprintf(`
+		WITH revoked AS (DELETE FROM refresh_tokens WHERE %s RETURNING family_id)
+		INSERT INTO access_token_denylist(session_id) SELECT family_id FROM revoked
+		ON CONFLICT DO NOTHING
+		`, where), args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// IsSessionRevoked reports whether the access tokens of the session are denylisted.
+func IsSessionRevoked(db *sqlx.DB, sessionID uuid.UUID) (bool, error) {
+	return FetchOne[bool](db, "SELECT EXISTS (SELECT 1 FROM access_token_denylist WHERE session_id = $1)", sessionID)
+}
+
+// CountSignInMethods returns how many ways the user has left to sign in
+// with, counting their password, linked providers and passkeys.
+func CountSignInMethods(db sqlx.Queryer, userID uuid.UUID) (int, error) {
+	var count int
+	err := sqlx.Get(db, &count, `
+		SELECT
+			(SELECT COUNT(*) FROM users WHERE id = $1 AND password_hash <> '') +
+			(SELECT COUNT(*) FROM user_identities WHERE user_id = $1) +
+			(SELECT COUNT(*) FROM passkeys WHERE user_id = $1)
+		`, userID)
+	return count, err
+}
+
+func InsertRefreshToken(refreshToken *models.RefreshToken, db sqlx.Ext) error {
+	_, err := sqlx.NamedExec(db, `
+		INSERT INTO refresh_tokens(user_id, device_id, token_hash, token_id, family_id, expiration_date, user_agent, ip_address)
+		VALUES (:user_id, :device_id, :token_hash, :token_id, :family_id, :expiration_date, :user_agent, :ip_address)
+		`, refreshToken)
 	return err
 }
 
-func DeleteThread(threadID int, db *sqlx.DB) error {
-	query := "DELETE FROM threads WHERE id = $1"
-	_, err := db.Exec(query, threadID)
+// InsertSecurityEvent flags a security event on the user's account, which
+// happened on the device of the request described by client.
+func InsertSecurityEvent(userID uuid.UUID, eventType models.SecurityEventType, deviceID string, client models.SessionClient, db sqlx.Execer) error {
+	_, err := db.Exec(
+		"INSERT INTO security_events(user_id, type, device_id, user_agent, ip_address) VALUES ($1, $2, $3, $4, $5)",
+		userID, eventType, deviceID, client.UserAgent, client.IPAddress)
 	return err
 }
 
@@ -88,12 +147,6 @@ func EditComment(comment *models.Comment, db *sqlx.DB) error {
 	return err
 }
 
-func DeleteComment(comment *models.Comment, db *sqlx.DB) error {
-	query := "DELETE FROM comments WHERE id = $1"
-	_, err := db.Exec(query, comment.ID)
-	return err
-}
-
 func HandleTxRollback(tx *sqlx.Tx, err *error, c *gin.Context) {
 	if p := recover(); p != nil {
 		err := tx.Rollback()
@@ -127,7 +180,7 @@ func ToInQueryForm[T any](s []T) string {
 		case int:
 			builder.WriteString(fmt.Sprintf("%d", v))
 		case string:
-			builder.WriteString(fmt.Sprintf("'%s'", v))
+			builder.WriteString(fmt.Sprintf("'%s'", strings.ReplaceAll(v, "'", "''")))
 		default:
 			panic("unsupported tag identifier type")
 		}
@@ -160,6 +213,16 @@ func CheckDuplicateError(err error) bool {
 	return false
 }
 
+func CheckForeignKeyError(err error) bool {
+	if err, ok := err.(*pq.Error); ok {
+		if err.Code == "23503" {
+			return true
+		}
+	}
+
+	return false
+}
+
 func SortCriteriaToDBColumn(s string) (string, error) {
 	switch s {
 	case "relevance":
@@ -212,3 +275,175 @@ func GetCustomTagID(db *sqlx.DB, customTags []string) ([]int, error) {
 
 	return customTagIDs, nil
 }
+
+// KeysetCondition returns the condition selecting the rows after a cursor in a
+// listing ordered by sortColumn then idColumn. The cursor's value and ID are
+// bound to the placeholders $placeholder and $placeholder+1.
+func KeysetCondition(sortColumn string, idColumn string, order string, placeholder int) string {
+	operator := "<"
+	if order == "asc" {
+		operator = ">"
+	}
+
+	return fmt.Sprintf("(%s, %s) %s ($%d, $%d)", sortColumn, idColumn, operator, placeholder, placeholder+1)
+}
+
+// ContainsPattern returns a LIKE pattern matching any string containing s,
+// with the LIKE wildcards in s escaped.
+func ContainsPattern(s string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+	return "%" + escaped + "%"
+}
+
+// SoftDelete marks the row of table with the given id as deleted by
+// deletedBy. Unless deletedBy is a moderator acting on someone else's
+// content, ownerID must own the row. It reports whether a row was deleted.
+func SoftDelete(db sqlx.Execer, table string, id interface{}, ownerID *uuid.UUID, deletedBy uuid.UUID, reason *string) (bool, error) {
+	query := fmt.Sprintf(`
+		UPDATE %s SET deleted_at = $1, deleted_by = $2, delete_reason = $3
+		WHERE id = $4 AND deleted_at IS NULL AND ($5::uuid IS NULL OR user_id = $5)
+		`, table)
+
+	result, err := db.Exec(query, time.Now().UTC(), deletedBy, reason, id, ownerID)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+// Restore restores the soft-deleted row of table with the given id on
+// behalf of userID, who must have deleted their own content within the
+// grace period.
+func Restore(db *sqlx.DB, table string, id interface{}, userID uuid.UUID) error {
+	deletion, err := FetchOne[models.Deletion](db, fmt.Sprintf(
+		"SELECT user_id, deleted_at, deleted_by, delete_reason FROM %s WHERE id = $1 AND deleted_at IS NOT NULL",
+		table), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return api_error.NewFromStr("no deleted content found", http.StatusNotFound)
+		}
+
+		return err
+	}
+
+	if deletion.UserID != userID {
+		return api_error.NewFromStr("no deleted content found", http.StatusNotFound)
+	}
+
+	if deletion.DeletedBy == nil || *deletion.DeletedBy != userID {
+		return api_error.NewFromStr("content removed by a moderator cannot be restored", http.StatusForbidden)
+	}
+
+	if !deletion.IsRestorableBy(userID) {
+		return api_error.NewFromStr("the restore window has expired", http.StatusGone)
+	}
+
+	_, err = db.Exec(fmt.Sprintf(
+		"UPDATE %s SET deleted_at = NULL, deleted_by = NULL, delete_reason = NULL WHERE id = $1", table), id)
+	return err
+}
+
+// PurgeDeleted hard-deletes the users, threads and comments whose grace
+// period has elapsed. Purged threads are deleted along with their comments,
+// which are counted as well. Deleted comments are kept as tombstones, with
+// neither author nor content, for as long as they have replies. The content
+// of purged users who chose to have it anonymised is reassigned to the
+// placeholder account beforehand, as are the channels of every purged user,
+// so that deleting the users leaves the content of others untouched. That of
+// the others is purged like deleted content, their comments with replies
+// becoming tombstones. Revisions of purged content are deleted as well.
+func PurgeDeleted(db *sqlx.DB) (purged int64, err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	purgedUsers := "(SELECT id FROM users WHERE deleted_at < :cutoff AND id <> :anonymous_user_id)"
+	anonymisedUsers := `(
+		SELECT id FROM users
+		WHERE deleted_at < :cutoff AND deletion_mode = 'anonymise' AND id <> :anonymous_user_id
+	)`
+	removedUsers := `(
+		SELECT id FROM users
+		WHERE deleted_at < :cutoff AND deletion_mode IS DISTINCT FROM 'anonymise' AND id <> :anonymous_user_id
+	)`
+	purgedThreads := "(SELECT id FROM threads WHERE deleted_at < :cutoff OR user_id IN " + removedUsers + ")"
+	purgedComments := "(c.deleted_at < :cutoff OR c.user_id IN " + removedUsers + ")"
+	queries := []struct {
+		query   string
+		counted bool
+		repeat  bool // Until no more rows are affected
+	}{
+		{"DELETE FROM comments WHERE thread_id IN " + purgedThreads, true, false},
+		{"DELETE FROM threads WHERE id IN " + purgedThreads, true, false},
+		// Deleting a comment may leave its parent without replies
+		{`DELETE FROM comments c WHERE ` + purgedComments + `
+		AND NOT EXISTS (SELECT 1 FROM comments r WHERE r.parent_id = c.id)`, true, true},
+		{`UPDATE comments c
+		SET comment = '', user_id = :anonymous_user_id, deleted_at = COALESCE(c.deleted_at, NOW())
+		WHERE ` + purgedComments + ` AND (c.comment <> '' OR c.user_id <> :anonymous_user_id)`, false, false},
+		{"UPDATE threads SET user_id = :anonymous_user_id WHERE user_id IN " + anonymisedUsers, false, false},
+		{"UPDATE comments SET user_id = :anonymous_user_id WHERE user_id IN " + anonymisedUsers, false, false},
+		{"UPDATE channels SET creator_id = :anonymous_user_id WHERE creator_id IN " + purgedUsers, false, false},
+		{"DELETE FROM users WHERE deleted_at < :cutoff AND id <> :anonymous_user_id", true, false},
+	}
+
+	// Named parameters, since not every query uses both
+	params := map[string]interface{}{
+		"cutoff":            time.Now().UTC().Add(-models.DELETION_GRACE_PERIOD),
+		"anonymous_user_id": models.ANONYMOUS_USER_ID,
+	}
+	for _, q := range queries {
+		for {
+			result, err := tx.NamedExec(q.query, params)
+			if err != nil {
+				return purged, err
+			}
+
+			rowsAffected, err := result.RowsAffected()
+			if err != nil {
+				return purged, err
+			}
+
+			if q.counted {
+				purged += rowsAffected
+			}
+
+			if !q.repeat || rowsAffected == 0 {
+				break
+			}
+		}
+	}
+
+	// Revisions are not referenced by foreign keys, and would otherwise keep
+	// the content of purged threads and comments, and of tombstones
+	_, err = tx.Exec(`
+		DELETE FROM thread_revisions tr
+		WHERE NOT EXISTS (SELECT 1 FROM threads t WHERE t.id = tr.thread_id)
+		`)
+	if err != nil {
+		return purged, err
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM comment_revisions cr
+		WHERE NOT EXISTS (
+			SELECT 1 FROM comments c WHERE c.id = cr.comment_id AND (c.deleted_at IS NULL OR c.comment <> '')
+		)
+		`)
+	if err != nil {
+		return purged, err
+	}
+
+	return purged, nil
+}
@@ -0,0 +1,96 @@
+package utils_diff
+
+import (
+	"1chanserver/internal/models"
+	"regexp"
+)
+
+// MAX_LCS_CELLS bounds the size of the table used to diff the part of two
+// texts which differs. Beyond it, that part is reported as entirely replaced.
+// Diffs are served to anonymous users, so the table is kept to about 1MB,
+// e.g. differing parts of 500 tokens, words and whitespace, each.
+const MAX_LCS_CELLS = 250_000
+
+// Whitespace is tokenized as well, so that the segments of a diff
+// concatenate back into the texts they were computed from.
+var tokenPattern = regexp.MustCompile(`\s+|\S+`)
+
+// Words returns the word-level diff turning from into to. Concatenating the
+// equal and deleted segments gives from, and the equal and inserted ones to.
+func Words(from string, to string) []models.DiffSegment {
+	a := tokenPattern.FindAllString(from, -1)
+	b := tokenPattern.FindAllString(to, -1)
+
+	// Edits are usually local, so the common prefix and suffix are
+	// skipped before computing the longest common subsequence
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	segments := make([]models.DiffSegment, 0)
+	segments = appendSegment(segments, models.DiffEqual, a[:prefix]...)
+	segments = diffTokens(segments, a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])
+	segments = appendSegment(segments, models.DiffEqual, a[len(a)-suffix:]...)
+
+	return segments
+}
+
+// diffTokens appends the diff between the token lists a and b to segments.
+func diffTokens(segments []models.DiffSegment, a []string, b []string) []models.DiffSegment {
+	if len(a)*len(b) > MAX_LCS_CELLS {
+		segments = appendSegment(segments, models.DiffDelete, a...)
+		return appendSegment(segments, models.DiffInsert, b...)
+	}
+
+	// lcs[i*width+j] is the length of the longest common subsequence of a[i:] and b[j:]
+	width := len(b) + 1
+	lcs := make([]int32, (len(a)+1)*width)
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i*width+j] = lcs[(i+1)*width+j+1] + 1
+			} else {
+				lcs[i*width+j] = max(lcs[(i+1)*width+j], lcs[i*width+j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			segments = appendSegment(segments, models.DiffEqual, a[i])
+			i++
+			j++
+		case lcs[(i+1)*width+j] >= lcs[i*width+j+1]:
+			segments = appendSegment(segments, models.DiffDelete, a[i])
+			i++
+		default:
+			segments = appendSegment(segments, models.DiffInsert, b[j])
+			j++
+		}
+	}
+
+	segments = appendSegment(segments, models.DiffDelete, a[i:]...)
+	return appendSegment(segments, models.DiffInsert, b[j:]...)
+}
+
+// appendSegment appends tokens to segments, merging them into the last
+// segment when it has the same operation.
+func appendSegment(segments []models.DiffSegment, op models.DiffOp, tokens ...string) []models.DiffSegment {
+	for _, token := range tokens {
+		if len(segments) > 0 && segments[len(segments)-1].Op == op {
+			segments[len(segments)-1].Text += token
+		} else {
+			segments = append(segments, models.DiffSegment{Op: op, Text: token})
+		}
+	}
+
+	return segments
+}
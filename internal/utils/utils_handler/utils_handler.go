@@ -1,8 +1,10 @@
 package utils_handler
 
 import (
+	"1chanserver/internal/models"
 	"1chanserver/internal/models/api_error"
 	"1chanserver/internal/utils/utils_db"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
@@ -29,6 +31,21 @@ func GetStringMap(c *gin.Context) (map[string]string, error) {
 	return obj, err
 }
 
+// GetDeleteRequest returns the optional body of a DELETE request.
+func GetDeleteRequest(c *gin.Context) (models.DeleteRequest, error) {
+	var deleteRequest models.DeleteRequest
+	if c.Request.ContentLength == 0 {
+		return deleteRequest, nil
+	}
+
+	err := c.ShouldBindJSON(&deleteRequest)
+	if err != nil {
+		return deleteRequest, api_error.NewFromErr(err, http.StatusBadRequest)
+	}
+
+	return deleteRequest, nil
+}
+
 func GetReqPage(c *gin.Context) (int, error) {
 	pageStr := c.Param("page")
 	if pageStr == "" {
@@ -114,3 +131,83 @@ func GetThreadReqQuery(c *gin.Context, tableAlias string, defaultSortCriteria st
 
 	return reqQuery, nil
 }
+
+// GetOptionalUserID returns the ID of the signed-in user on routes
+// guarded by middleware.OptionalAuth, or nil for anonymous requests.
+func GetOptionalUserID(c *gin.Context) *uuid.UUID {
+	userID, ok := c.Get("UserID")
+	if !ok {
+		return nil
+	}
+
+	id := userID.(uuid.UUID)
+	return &id
+}
+
+// GetSessionClient describes the client making the request, to be recorded
+// against the session it uses.
+func GetSessionClient(c *gin.Context) models.SessionClient {
+	return models.SessionClient{
+		UserAgent: c.Request.UserAgent(),
+		IPAddress: c.ClientIP(),
+	}
+}
+
+// GetReqRole returns the role of the signed-in user, as carried by their
+// access token. Tokens carrying no role are treated as a regular user's.
+func GetReqRole(c *gin.Context) models.UserRole {
+	role, ok := c.Get("Role")
+	if !ok || role.(models.UserRole) == "" {
+		return models.RegularUserRole
+	}
+
+	return role.(models.UserRole)
+}
+
+// GetPageRequest reads the page, page_size and cursor query parameters of a
+// listing sorted by sortBy in the given order. Passing a cursor, even an empty
+// one, switches the listing to cursor mode, in which page is ignored.
+func GetPageRequest(c *gin.Context, sortBy string, order string) (models.PageRequest, error) {
+	pageRequest := models.PageRequest{
+		Page:     1,
+		PageSize: models.DEFAULT_PAGE_SIZE,
+	}
+
+	if pageSize := c.Query("page_size"); pageSize != "" {
+		pageSizeInt, err := strconv.Atoi(pageSize)
+		if err != nil || pageSizeInt <= 0 || pageSizeInt > models.MAX_PAGE_SIZE {
+			return pageRequest, api_error.NewFromStr(
+				fmt.Sprintf("page_size must be between 1 and %d", models.MAX_PAGE_SIZE), http.StatusBadRequest)
+		}
+
+		pageRequest.PageSize = pageSizeInt
+	}
+
+	cursor, cursorMode := c.GetQuery("cursor")
+	if !cursorMode {
+		pageInt, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+		if err != nil || pageInt <= 0 {
+			return pageRequest, api_error.InvalidPageReq
+		}
+
+		pageRequest.Page = pageInt
+		return pageRequest, nil
+	}
+
+	pageRequest.CursorMode = true
+	if cursor == "" {
+		return pageRequest, nil
+	}
+
+	decodedCursor, err := models.DecodeCursor(cursor)
+	if err != nil {
+		return pageRequest, api_error.NewFromStr("invalid cursor", http.StatusBadRequest)
+	}
+
+	if decodedCursor.SortBy != sortBy || decodedCursor.Order != order {
+		return pageRequest, api_error.NewFromStr("cursor does not match the listing's sort order", http.StatusBadRequest)
+	}
+
+	pageRequest.Cursor = decodedCursor
+	return pageRequest, nil
+}
@@ -0,0 +1,222 @@
+package utils_jwks
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MIN_RSA_KEY_BITS is the smallest RSA key accepted for signing tokens.
+const MIN_RSA_KEY_BITS = 2048
+
+// Key is a key which tokens are signed or verified with. Its ID is carried
+// in the kid header of the tokens it signs.
+type Key struct {
+	ID       string
+	Method   jwt.SigningMethod
+	signer   interface{} // Private key, or HMAC secret
+	public   interface{} // Public key, or HMAC secret
+	notAfter time.Time   // No tokens are verified with the key after then, unless zero
+}
+
+// KeySet holds the keys tokens are verified with, one of which, the active
+// key, new tokens are signed with. Keys can be rotated without invalidating
+// issued tokens by adding a new key, making it the active one, and removing
+// the previous key once the tokens it signed have expired.
+type KeySet struct {
+	keys   map[string]*Key
+	active *Key
+}
+
+// JWK is the public part of an RSA or Ed25519 key, as described in RFC 7517
+// and RFC 8037.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// NewHMACKeySet returns a key set which signs tokens with secret using
+// HS256. Such tokens carry no kid, as the secret cannot be published.
+func NewHMACKeySet(secret []byte) *KeySet {
+	key := &Key{ID: "", Method: jwt.SigningMethodHS256, signer: secret, public: secret}
+	return &KeySet{
+		keys:   map[string]*Key{key.ID: key},
+		active: key,
+	}
+}
+
+// LoadKeySet loads the PEM-encoded RSA and Ed25519 private keys in dir,
+// named <kid>.pem, and signs new tokens with the key activeKeyID. It may
+// be empty when dir holds a single key. RSA keys sign with RS256, and
+// Ed25519 keys with EdDSA.
+//
+// When legacySecret is set, tokens without a kid are still verified with
+// it using HS256 until legacyUntil, so that tokens issued before switching
+// to asymmetric keys remain valid until they expire. The secret is rejected
+// afterwards, so that it cannot be used to forge tokens indefinitely.
+func LoadKeySet(dir string, activeKeyID string, legacySecret []byte, legacyUntil time.Time) (*KeySet, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no signing keys found in %s", dir)
+	}
+
+	set := &KeySet{keys: make(map[string]*Key)}
+	for _, path := range paths {
+		key, err := loadKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load signing key %s: %w", path, err)
+		}
+
+		set.keys[key.ID] = key
+	}
+
+	if activeKeyID == "" && len(set.keys) == 1 {
+		for _, key := range set.keys {
+			activeKeyID = key.ID
+		}
+	}
+
+	active, ok := set.keys[activeKeyID]
+	if !ok {
+		return nil, fmt.Errorf("active signing key %q not found in %s", activeKeyID, dir)
+	}
+	set.active = active
+
+	if len(legacySecret) != 0 {
+		set.keys[""] = &Key{
+			ID:       "",
+			Method:   jwt.SigningMethodHS256,
+			signer:   legacySecret,
+			public:   legacySecret,
+			notAfter: legacyUntil,
+		}
+	}
+
+	return set, nil
+}
+
+func loadKey(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var privateKey interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &Key{ID: strings.TrimSuffix(filepath.Base(path), ".pem"), signer: privateKey}
+	switch privateKey := privateKey.(type) {
+	case *rsa.PrivateKey:
+		if privateKey.N.BitLen() < MIN_RSA_KEY_BITS {
+			return nil, fmt.Errorf("RSA keys must have at least %d bits", MIN_RSA_KEY_BITS)
+		}
+		key.Method = jwt.SigningMethodRS256
+		key.public = &privateKey.PublicKey
+	case ed25519.PrivateKey:
+		key.Method = jwt.SigningMethodEdDSA
+		key.public = privateKey.Public()
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, only RSA and Ed25519 keys are supported", privateKey)
+	}
+
+	return key, nil
+}
+
+// Sign signs claims with the active key.
+func (s *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(s.active.Method, claims)
+	if s.active.ID != "" {
+		token.Header["kid"] = s.active.ID
+	}
+
+	return token.SignedString(s.active.signer)
+}
+
+// Keyfunc returns the key to verify token with, as identified by its kid,
+// after checking that token is signed with the algorithm of that key.
+func (s *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	keyID, _ := token.Header["kid"].(string)
+	key, ok := s.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", keyID)
+	}
+
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	if !key.notAfter.IsZero() && time.Now().After(key.notAfter) {
+		return nil, fmt.Errorf("signing key %q has been retired", keyID)
+	}
+
+	return key.public, nil
+}
+
+// JWKS returns the public keys of the set, sorted by kid. HMAC secrets
+// are never included.
+func (s *KeySet) JWKS() JWKS {
+	jwks := JWKS{Keys: make([]JWK, 0, len(s.keys))}
+	for _, key := range s.keys {
+		jwk := JWK{KeyID: key.ID, Use: "sig", Algorithm: key.Method.Alg()}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		default:
+			continue
+		}
+
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+
+	sort.Slice(jwks.Keys, func(i, j int) bool {
+		return jwks.Keys[i].KeyID < jwks.Keys[j].KeyID
+	})
+
+	return jwks
+}
@@ -0,0 +1,389 @@
+package utils_search
+
+import (
+	"1chanserver/internal/models"
+	"1chanserver/internal/models/api_error"
+	"fmt"
+	"github.com/lib/pq"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	MAX_QUERY_LENGTH  = 256
+	MIN_PREFIX_LENGTH = 2
+	DATE_LAYOUT       = "2006-01-02"
+)
+
+// Query is a parsed search query. Free text, quoted phrases, -exclusions and
+// OR are kept as-is in Text, to be handled by websearch_to_tsquery, while the
+// other operators are extracted into structured filters.
+type Query struct {
+	Text     string
+	Prefixes []string // Prefix terms, with a leading "!" when excluded
+	Authors  []string
+	Tags     []string
+	After    *time.Time // Inclusive
+	Before   *time.Time // Exclusive
+
+	// Languages restricts the search to content written in these
+	// languages. Every language is searched when empty.
+	Languages []models.AppLanguage
+}
+
+// Columns names the columns of the searched table which a Query is matched against.
+type Columns struct {
+	SearchVector string
+	UserID       string
+	ThreadID     string
+	CreationDate string
+	Language     string
+}
+
+func invalidQuery(format string, args ...interface{}) error {
+	return api_error.NewFromStr("invalid search query: "+fmt.Sprintf(format, args...), http.StatusBadRequest)
+}
+
+// Parse parses a search query supporting "quoted phrases", -exclusions, OR,
+// prefix*, author:name, tag:name, after:YYYY-MM-DD and before:YYYY-MM-DD.
+// Malformed queries are reported as 400 errors.
+func Parse(raw string) (Query, error) {
+	var query Query
+
+	if len(raw) > MAX_QUERY_LENGTH {
+		return query, invalidQuery("must be at most %d characters long", MAX_QUERY_LENGTH)
+	}
+
+	tokens, err := tokenize(raw)
+	if err != nil {
+		return query, err
+	}
+
+	var textTokens []string
+	for _, token := range tokens {
+		if name, value, ok := strings.Cut(token, ":"); ok && !strings.HasPrefix(token, `"`) {
+			value = strings.Trim(value, `"`)
+
+			switch strings.ToLower(name) {
+			case "author", "tag", "after", "before":
+				if value == "" {
+					return query, invalidQuery("missing value for %s:", name)
+				}
+			}
+
+			switch strings.ToLower(name) {
+			case "author":
+				query.Authors = append(query.Authors, value)
+				continue
+			case "tag":
+				query.Tags = append(query.Tags, strings.ToLower(value))
+				continue
+			case "after", "before":
+				date, err := time.Parse(DATE_LAYOUT, value)
+				if err != nil {
+					return query, invalidQuery("%s: expects a date formatted as YYYY-MM-DD", name)
+				}
+
+				if strings.ToLower(name) == "after" {
+					query.After = &date
+				} else {
+					query.Before = &date
+				}
+				continue
+			}
+		}
+
+		if strings.HasSuffix(token, "*") && !strings.HasPrefix(strings.TrimPrefix(token, "-"), `"`) {
+			prefix, err := parsePrefix(token)
+			if err != nil {
+				return query, err
+			}
+
+			query.Prefixes = append(query.Prefixes, prefix)
+			continue
+		}
+
+		textTokens = append(textTokens, token)
+	}
+
+	for i, token := range textTokens {
+		if token != "OR" {
+			continue
+		}
+
+		if i == 0 || i == len(textTokens)-1 || textTokens[i-1] == "OR" {
+			return query, invalidQuery("OR must be placed between two search terms")
+		}
+	}
+
+	if query.After != nil && query.Before != nil && !query.After.Before(*query.Before) {
+		return query, invalidQuery("after: must be earlier than before:")
+	}
+
+	query.Text = strings.Join(textTokens, " ")
+
+	if query.Text == "" && len(query.Prefixes) == 0 && len(query.Authors) == 0 &&
+		len(query.Tags) == 0 && query.After == nil && query.Before == nil {
+		return query, invalidQuery("missing search terms")
+	}
+
+	return query, nil
+}
+
+// tokenize splits raw on whitespace, except within double quotes.
+func tokenize(raw string) ([]string, error) {
+	var tokens []string
+	var token strings.Builder
+	inQuotes := false
+
+	for _, char := range raw {
+		switch {
+		case char == '"':
+			inQuotes = !inQuotes
+			token.WriteRune(char)
+		case unicode.IsSpace(char) && !inQuotes:
+			if token.Len() > 0 {
+				tokens = append(tokens, token.String())
+				token.Reset()
+			}
+		default:
+			token.WriteRune(char)
+		}
+	}
+
+	if inQuotes {
+		return nil, invalidQuery("unterminated quoted phrase")
+	}
+
+	if token.Len() > 0 {
+		tokens = append(tokens, token.String())
+	}
+
+	return tokens, nil
+}
+
+// parsePrefix validates a prefix* term, which may be excluded with a leading
+// "-". Prefixes are restricted to letters and digits, so that they can be
+// safely embedded in a to_tsquery expression.
+func parsePrefix(token string) (string, error) {
+	excluded := strings.HasPrefix(token, "-")
+	prefix := strings.TrimSuffix(strings.TrimPrefix(token, "-"), "*")
+
+	if len([]rune(prefix)) < MIN_PREFIX_LENGTH {
+		return "", invalidQuery("prefix terms need at least %d characters", MIN_PREFIX_LENGTH)
+	}
+
+	for _, char := range prefix {
+		if !unicode.IsLetter(char) && !unicode.IsDigit(char) {
+			return "", invalidQuery("prefix terms may only contain letters and digits")
+		}
+	}
+
+	if excluded {
+		return "!" + prefix, nil
+	}
+
+	return prefix, nil
+}
+
+// placeholder appends arg to args and returns its placeholder.
+func placeholder(args *[]interface{}, arg interface{}) string {
+	*args = append(*args, arg)
+	return fmt.Sprintf("$%d", len(*args))
+}
+
+// languages returns the languages the query is matched in.
+func (q Query) languages() []models.AppLanguage {
+	if len(q.Languages) == 0 {
+		return models.AppLanguages
+	}
+
+	return q.Languages
+}
+
+// TSQuery returns the tsquery expression matching the query's text and prefix
+// terms against search vectors built for lang, appending its arguments to
+// args, or an empty string when the query consists of filters only.
+func (q Query) TSQuery(lang models.AppLanguage, args *[]interface{}) string {
+	var expressions []string
+
+	if q.Text != "" {
+		expressions = append(expressions,
+			fmt.Sprintf("app_language_tsquery('%s', %s)", lang, placeholder(args, q.Text)))
+	}
+
+	for _, prefix := range q.Prefixes {
+		expressions = append(expressions,
+			fmt.Sprintf("to_tsquery(app_language_ts_config('%s'), %s)", lang, placeholder(args, prefix+":*")))
+	}
+
+	if len(expressions) == 0 {
+		return ""
+	}
+
+	return "(" + strings.Join(expressions, " && ") + ")"
+}
+
+// FullText holds the tsquery expressions of a query in each of its languages,
+// as search vectors are built with the text search configuration of the
+// language their content is written in.
+type FullText struct {
+	columns   Columns
+	languages []models.AppLanguage
+	tsQueries []string
+}
+
+// FullText returns the full-text part of the query matched against the
+// table described by columns, appending its arguments to args.
+func (q Query) FullText(columns Columns, args *[]interface{}) FullText {
+	fullText := FullText{columns: columns}
+
+	if q.Text == "" && len(q.Prefixes) == 0 {
+		return fullText
+	}
+
+	for _, lang := range q.languages() {
+		fullText.languages = append(fullText.languages, lang)
+		fullText.tsQueries = append(fullText.tsQueries, q.TSQuery(lang, args))
+	}
+
+	return fullText
+}
+
+// Empty reports whether the query has no full-text part, i.e. consists of filters only.
+func (f FullText) Empty() bool {
+	return len(f.tsQueries) == 0
+}
+
+// Condition matches rows against the tsquery of their own language.
+func (f FullText) Condition() string {
+	conditions := make([]string, len(f.languages))
+	for i, lang := range f.languages {
+		conditions[i] = fmt.Sprintf("(%s = '%s' AND %s @@ %s)",
+			f.columns.Language, lang, f.columns.SearchVector, f.tsQueries[i])
+	}
+
+	return "(" + strings.Join(conditions, " OR ") + ")"
+}
+
+// Rank ranks rows against the tsquery of their own language.
+func (f FullText) Rank() string {
+	if f.Empty() {
+		return "0::real"
+	}
+
+	var rank strings.Builder
+	fmt.Fprintf(&rank, "CASE %s", f.columns.Language)
+	for i, lang := range f.languages {
+		fmt.Fprintf(&rank, " WHEN '%s' THEN ts_rank(%s, %s)", lang, f.columns.SearchVector, f.tsQueries[i])
+	}
+	rank.WriteString(" ELSE 0 END")
+
+	return rank.String()
+}
+
+// Headline returns a snippet of document highlighting the query's matches,
+// appending the ts_headline options to args. Without a full-text part, the
+// snippet is the beginning of document.
+func (f FullText) Headline(document string, options string, args *[]interface{}) string {
+	if f.Empty() {
+		return fmt.Sprintf("left(%s, 200)", document)
+	}
+
+	optionsPlaceholder := placeholder(args, options)
+
+	var headline strings.Builder
+	fmt.Fprintf(&headline, "CASE %s", f.columns.Language)
+	for i, lang := range f.languages {
+		fmt.Fprintf(&headline, " WHEN '%s' THEN ts_headline(app_language_ts_config('%s'), %s, %s, %s)",
+			lang, lang, document, f.tsQueries[i], optionsPlaceholder)
+	}
+	fmt.Fprintf(&headline, " ELSE left(%s, 200) END", document)
+
+	return headline.String()
+}
+
+// Conditions returns the SQL conditions, to be joined with AND, selecting the
+// rows of the table described by columns which match the query. Their
+// arguments are appended to args.
+func (q Query) Conditions(columns Columns, args *[]interface{}) []string {
+	var conditions []string
+
+	if fullText := q.FullText(columns, args); !fullText.Empty() {
+		conditions = append(conditions, fullText.Condition())
+	}
+
+	return append(conditions, q.Filters(columns, args)...)
+}
+
+// Filters is Conditions without the full-text condition, for callers which
+// also need the FullText itself, e.g. to rank results.
+func (q Query) Filters(columns Columns, args *[]interface{}) []string {
+	var conditions []string
+
+	if len(q.Authors) > 0 {
+		conditions = append(conditions, fmt.Sprintf(
+			"%s IN (SELECT id FROM users WHERE username = ANY(%s))",
+			columns.UserID, placeholder(args, pq.Array(q.Authors))))
+	}
+
+	for _, tag := range q.Tags {
+		conditions = append(conditions, fmt.Sprintf(`EXISTS (
+			SELECT 1 FROM thread_custom_tags tct JOIN custom_tags ct ON ct.id = tct.custom_tag_id
+			WHERE tct.thread_id = %s AND ct.tag = %s)`, columns.ThreadID, placeholder(args, tag)))
+	}
+
+	if q.After != nil {
+		conditions = append(conditions, fmt.Sprintf("%s >= %s", columns.CreationDate, placeholder(args, *q.After)))
+	}
+
+	if q.Before != nil {
+		conditions = append(conditions, fmt.Sprintf("%s < %s", columns.CreationDate, placeholder(args, *q.Before)))
+	}
+
+	if len(q.Languages) > 0 {
+		conditions = append(conditions, fmt.Sprintf("%s = ANY(%s::app_language[])",
+			columns.Language, placeholder(args, pq.Array(q.Languages))))
+	}
+
+	return conditions
+}
+
+// Terms returns the words of the query's text and prefix terms, without any
+// operators, for matching against fields which are not full-text indexed.
+func (q Query) Terms() string {
+	var terms []string
+
+	// Text has already been tokenized successfully by Parse
+	tokens, _ := tokenize(q.Text)
+	for _, token := range tokens {
+		if token == "OR" || strings.HasPrefix(token, "-") {
+			continue
+		}
+		terms = append(terms, strings.Trim(token, `"`))
+	}
+
+	for _, prefix := range q.Prefixes {
+		if !strings.HasPrefix(prefix, "!") {
+			terms = append(terms, prefix)
+		}
+	}
+
+	return strings.TrimSpace(strings.Join(terms, " "))
+}
+
+// ParseLanguage parses the lang parameter restricting a search to content
+// written in a single language. Every language is searched when lang is empty.
+func ParseLanguage(lang string) ([]models.AppLanguage, error) {
+	if lang == "" {
+		return nil, nil
+	}
+
+	if !models.AppLanguage(lang).IsValid() {
+		return nil, api_error.NewFromStr("invalid language", http.StatusBadRequest)
+	}
+
+	return []models.AppLanguage{models.AppLanguage(lang)}, nil
+}
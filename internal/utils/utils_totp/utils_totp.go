@@ -0,0 +1,138 @@
+package utils_totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The parameters are the defaults of RFC 6238, as authenticator apps
+// commonly ignore any others given in the provisioning URI.
+const (
+	TOTP_DIGITS        = 6
+	TOTP_PERIOD        = 30 * time.Second
+	TOTP_SECRET_LENGTH = 20
+
+	// TOTP_SKEW is how many steps before or after the current one a code
+	// is still accepted for, to allow for clock drift.
+	TOTP_SKEW = 1
+
+	RECOVERY_CODE_LENGTH = 10
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a random base32-encoded TOTP secret.
+func GenerateSecret() (string, error) {
+	secret := make([]byte, TOTP_SECRET_LENGTH)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return encoding.EncodeToString(secret), nil
+}
+
+// ProvisioningURI returns the otpauth URI which authenticator apps are
+// enrolled with, usually by scanning it as a QR code.
+func ProvisioningURI(secret string, issuer string, accountName string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprintf("%d", TOTP_DIGITS))
+	query.Set("period", fmt.Sprintf("%d", int(TOTP_PERIOD.Seconds())))
+
+	label := url.PathEscape(issuer + ":" + accountName)
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, query.Encode())
+}
+
+// Step returns the time step t falls in.
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(TOTP_PERIOD.Seconds())
+}
+
+// Code returns the code of secret for the given time step.
+func Code(secret string, step int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation, as described in RFC 4226
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulo := uint32(1)
+	for i := 0; i < TOTP_DIGITS; i++ {
+		modulo *= 10
+	}
+
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, value%modulo), nil
+}
+
+// Validate checks code against secret at time t, and returns the step it
+// was valid for. Codes of steps up to lastUsedStep are rejected, so that
+// each code can only be used once.
+func Validate(secret string, code string, t time.Time, lastUsedStep int64) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != TOTP_DIGITS {
+		return 0, false
+	}
+
+	current := Step(t)
+	for step := current - TOTP_SKEW; step <= current+TOTP_SKEW; step++ {
+		if step <= lastUsedStep {
+			continue
+		}
+
+		expected, err := Code(secret, step)
+		if err != nil {
+			return 0, false
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// GenerateRecoveryCodes returns n random recovery codes, formatted as two
+// groups of lowercase base32 characters, e.g. "abcde-fghij".
+func GenerateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	for i := range codes {
+		raw := make([]byte, RECOVERY_CODE_LENGTH*5/8)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(encoding.EncodeToString(raw))
+		codes[i] = code[:RECOVERY_CODE_LENGTH/2] + "-" + code[RECOVERY_CODE_LENGTH/2:]
+	}
+
+	return codes, nil
+}
+
+// NormaliseRecoveryCode strips the separators and case of a recovery code,
+// as typed by the user, before it is hashed or compared.
+func NormaliseRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
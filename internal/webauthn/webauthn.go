@@ -0,0 +1,380 @@
+package webauthn
+
+import (
+	"1chanserver/internal/utils/utils_cbor"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+)
+
+// CHALLENGE_SIZE is the number of random bytes in a challenge.
+const CHALLENGE_SIZE = 32
+
+// MAX_CREDENTIAL_ID_SIZE is the largest credential ID accepted, as set by
+// the WebAuthn specification.
+const MAX_CREDENTIAL_ID_SIZE = 1023
+
+// COSE algorithm identifiers of the supported credential public keys, in
+// order of preference.
+const (
+	ALG_ES256 int64 = -7
+	ALG_EDDSA int64 = -8
+	ALG_RS256 int64 = -257
+)
+
+var SupportedAlgorithms = []int64{ALG_ES256, ALG_EDDSA, ALG_RS256}
+
+const (
+	CeremonyCreate = "webauthn.create"
+	CeremonyGet    = "webauthn.get"
+)
+
+// Flags of the authenticator data.
+const (
+	FlagUserPresent    byte = 0x01
+	FlagUserVerified   byte = 0x04
+	FlagBackupEligible byte = 0x08
+	FlagBackedUp       byte = 0x10
+	FlagAttestedData   byte = 0x40
+	FlagExtensionData  byte = 0x80
+)
+
+var (
+	ErrInvalidClientData    = errors.New("invalid client data")
+	ErrInvalidAuthenticator = errors.New("invalid authenticator data")
+	ErrInvalidSignature     = errors.New("invalid signature")
+	ErrUnsupportedKey       = errors.New("unsupported credential public key")
+)
+
+// RelyingParty is the site passkeys are registered with. Authenticators
+// scope passkeys to ID, a domain, and browsers only let Origins use them.
+type RelyingParty struct {
+	ID      string
+	Name    string
+	Origins []string
+}
+
+// FromEnv returns the relying party configured by the WEBAUTHN_RP_ID,
+// WEBAUTHN_RP_NAME and comma separated WEBAUTHN_ORIGINS environment
+// variables, which default to the host of clientURL, "1chan" and
+// clientURL respectively.
+func FromEnv(clientURL string) (RelyingParty, error) {
+	rp := RelyingParty{
+		ID:   os.Getenv("WEBAUTHN_RP_ID"),
+		Name: os.Getenv("WEBAUTHN_RP_NAME"),
+	}
+
+	for _, origin := range strings.Split(os.Getenv("WEBAUTHN_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			rp.Origins = append(rp.Origins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+
+	if len(rp.Origins) == 0 {
+		rp.Origins = []string{strings.TrimSuffix(clientURL, "/")}
+	}
+
+	if rp.ID == "" {
+		parsedURL, err := url.Parse(rp.Origins[0])
+		if err != nil || parsedURL.Hostname() == "" {
+			return rp, fmt.Errorf("WEBAUTHN_RP_ID must be set, as it cannot be derived from %q", rp.Origins[0])
+		}
+		rp.ID = parsedURL.Hostname()
+	}
+
+	if rp.Name == "" {
+		rp.Name = "1chan"
+	}
+
+	return rp, nil
+}
+
+// NewChallenge returns a random challenge, encoded as unpadded base64url
+// as it appears in client data.
+func NewChallenge() (string, error) {
+	challenge := make([]byte, CHALLENGE_SIZE)
+	_, err := rand.Read(challenge)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(challenge), nil
+}
+
+// DecodeBase64URL decodes base64url data, with or without padding, as
+// sent by browsers.
+func DecodeBase64URL(data string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(data, "="))
+}
+
+// ClientData is the data the browser passed to the authenticator, which
+// it signs the hash of.
+type ClientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// ParseClientData parses clientDataJSON, checking that it is for the
+// ceremony and comes from one of the origins of the relying party. The
+// challenge it carries is left for the caller to check.
+func (rp RelyingParty) ParseClientData(clientDataJSON []byte, ceremony string) (ClientData, error) {
+	var clientData ClientData
+	err := json.Unmarshal(clientDataJSON, &clientData)
+	if err != nil {
+		return clientData, fmt.Errorf("%w: %s", ErrInvalidClientData, err.Error())
+	}
+
+	if clientData.Type != ceremony {
+		return clientData, fmt.Errorf("%w: unexpected type %q", ErrInvalidClientData, clientData.Type)
+	}
+
+	if !slices.Contains(rp.Origins, clientData.Origin) || clientData.CrossOrigin {
+		return clientData, fmt.Errorf("%w: unexpected origin %q", ErrInvalidClientData, clientData.Origin)
+	}
+
+	if clientData.Challenge == "" {
+		return clientData, fmt.Errorf("%w: missing challenge", ErrInvalidClientData)
+	}
+
+	return clientData, nil
+}
+
+// AuthenticatorData is the data the authenticator signs, along with the
+// hash of the client data.
+type AuthenticatorData struct {
+	RPIDHash  []byte
+	Flags     byte
+	SignCount uint32
+
+	// Set during registration only
+	AAGUID       []byte
+	CredentialID []byte
+	PublicKey    []byte // COSE_Key
+}
+
+func (d *AuthenticatorData) HasFlag(flag byte) bool {
+	return d.Flags&flag != 0
+}
+
+// ParseAuthenticatorData parses the authenticator data in data.
+func ParseAuthenticatorData(data []byte) (AuthenticatorData, error) {
+	var authData AuthenticatorData
+	if len(data) < 37 {
+		return authData, fmt.Errorf("%w: too short", ErrInvalidAuthenticator)
+	}
+
+	authData.RPIDHash = data[:32]
+	authData.Flags = data[32]
+	authData.SignCount = binary.BigEndian.Uint32(data[33:37])
+	rest := data[37:]
+
+	if authData.HasFlag(FlagAttestedData) {
+		if len(rest) < 18 {
+			return authData, fmt.Errorf("%w: truncated attested credential data", ErrInvalidAuthenticator)
+		}
+
+		authData.AAGUID = rest[:16]
+		credentialIDSize := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if credentialIDSize > MAX_CREDENTIAL_ID_SIZE || credentialIDSize > len(rest) {
+			return authData, fmt.Errorf("%w: invalid credential ID size", ErrInvalidAuthenticator)
+		}
+
+		authData.CredentialID = rest[:credentialIDSize]
+		rest = rest[credentialIDSize:]
+
+		// The public key is only delimited by its own encoding
+		_, afterKey, err := utils_cbor.Decode(rest)
+		if err != nil {
+			return authData, fmt.Errorf("%w: %s", ErrInvalidAuthenticator, err.Error())
+		}
+
+		authData.PublicKey = rest[:len(rest)-len(afterKey)]
+		rest = afterKey
+	}
+
+	if authData.HasFlag(FlagExtensionData) {
+		_, afterExtensions, err := utils_cbor.Decode(rest)
+		if err != nil {
+			return authData, fmt.Errorf("%w: %s", ErrInvalidAuthenticator, err.Error())
+		}
+		rest = afterExtensions
+	}
+
+	if len(rest) != 0 {
+		return authData, fmt.Errorf("%w: trailing data", ErrInvalidAuthenticator)
+	}
+
+	return authData, nil
+}
+
+// checkAuthenticatorData checks that authData is scoped to the relying party,
+// and that the user was present and, if required, verified.
+func (rp RelyingParty) checkAuthenticatorData(authData *AuthenticatorData, requireUserVerification bool) error {
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if subtle.ConstantTimeCompare(authData.RPIDHash, rpIDHash[:]) != 1 {
+		return fmt.Errorf("%w: unexpected relying party", ErrInvalidAuthenticator)
+	}
+
+	if !authData.HasFlag(FlagUserPresent) {
+		return fmt.Errorf("%w: user not present", ErrInvalidAuthenticator)
+	}
+
+	if requireUserVerification && !authData.HasFlag(FlagUserVerified) {
+		return fmt.Errorf("%w: user not verified", ErrInvalidAuthenticator)
+	}
+
+	return nil
+}
+
+// VerifyRegistration verifies the attestation object returned when creating
+// a passkey, and returns the authenticator data holding the new credential.
+// Attestation statements are not verified, as passkeys are not restricted
+// to particular authenticators, and "none" attestation is requested.
+func (rp RelyingParty) VerifyRegistration(attestationObject []byte, requireUserVerification bool) (AuthenticatorData, error) {
+	decoded, rest, err := utils_cbor.Decode(attestationObject)
+	if err != nil || len(rest) != 0 {
+		return AuthenticatorData{}, fmt.Errorf("%w: malformed attestation object", ErrInvalidAuthenticator)
+	}
+
+	attestation, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return AuthenticatorData{}, fmt.Errorf("%w: malformed attestation object", ErrInvalidAuthenticator)
+	}
+
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return AuthenticatorData{}, fmt.Errorf("%w: missing authenticator data", ErrInvalidAuthenticator)
+	}
+
+	authData, err := ParseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return authData, err
+	}
+
+	err = rp.checkAuthenticatorData(&authData, requireUserVerification)
+	if err != nil {
+		return authData, err
+	}
+
+	if authData.CredentialID == nil {
+		return authData, fmt.Errorf("%w: missing attested credential data", ErrInvalidAuthenticator)
+	}
+
+	_, _, err = ParsePublicKey(authData.PublicKey)
+	if err != nil {
+		return authData, err
+	}
+
+	return authData, nil
+}
+
+// VerifyAssertion verifies the signature an authenticator made with the
+// credential whose COSE_Key is publicKey, and returns the authenticator
+// data it signed. The sign count is left for the caller to check.
+func (rp RelyingParty) VerifyAssertion(publicKey []byte, rawAuthData []byte, clientDataJSON []byte, signature []byte, requireUserVerification bool) (AuthenticatorData, error) {
+	authData, err := ParseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return authData, err
+	}
+
+	err = rp.checkAuthenticatorData(&authData, requireUserVerification)
+	if err != nil {
+		return authData, err
+	}
+
+	algorithm, key, err := ParsePublicKey(publicKey)
+	if err != nil {
+		return authData, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(bytes.Clone(rawAuthData), clientDataHash[:]...)
+
+	if !verifySignature(algorithm, key, signed, signature) {
+		return authData, ErrInvalidSignature
+	}
+
+	return authData, nil
+}
+
+// ParsePublicKey parses a COSE_Key (RFC 9053) of one of SupportedAlgorithms,
+// and returns its algorithm along with the key.
+func ParsePublicKey(coseKey []byte) (int64, crypto.PublicKey, error) {
+	decoded, rest, err := utils_cbor.Decode(coseKey)
+	if err != nil || len(rest) != 0 {
+		return 0, nil, fmt.Errorf("%w: malformed key", ErrUnsupportedKey)
+	}
+
+	key, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return 0, nil, fmt.Errorf("%w: malformed key", ErrUnsupportedKey)
+	}
+
+	keyType, _ := key[int64(1)].(int64)
+	algorithm, _ := key[int64(3)].(int64)
+	switch {
+	case algorithm == ALG_ES256 && keyType == 2:
+		curve, _ := key[int64(-1)].(int64)
+		x, okX := key[int64(-2)].([]byte)
+		y, okY := key[int64(-3)].([]byte)
+		if curve != 1 || !okX || !okY || len(x) != 32 || len(y) != 32 {
+			return 0, nil, fmt.Errorf("%w: invalid P-256 key", ErrUnsupportedKey)
+		}
+
+		publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			return 0, nil, fmt.Errorf("%w: invalid P-256 key", ErrUnsupportedKey)
+		}
+		return algorithm, publicKey, nil
+	case algorithm == ALG_EDDSA && keyType == 1:
+		curve, _ := key[int64(-1)].(int64)
+		x, ok := key[int64(-2)].([]byte)
+		if curve != 6 || !ok || len(x) != ed25519.PublicKeySize {
+			return 0, nil, fmt.Errorf("%w: invalid Ed25519 key", ErrUnsupportedKey)
+		}
+		return algorithm, ed25519.PublicKey(x), nil
+	case algorithm == ALG_RS256 && keyType == 3:
+		n, okN := key[int64(-1)].([]byte)
+		e, okE := key[int64(-2)].([]byte)
+		if !okN || !okE || len(e) == 0 || len(e) > 4 || len(n)*8 < 2048 {
+			return 0, nil, fmt.Errorf("%w: invalid RSA key", ErrUnsupportedKey)
+		}
+		return algorithm, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	default:
+		return 0, nil, fmt.Errorf("%w: algorithm %d with key type %d", ErrUnsupportedKey, algorithm, keyType)
+	}
+}
+
+func verifySignature(algorithm int64, key crypto.PublicKey, signed []byte, signature []byte) bool {
+	switch algorithm {
+	case ALG_ES256:
+		hash := sha256.Sum256(signed)
+		return ecdsa.VerifyASN1(key.(*ecdsa.PublicKey), hash[:], signature)
+	case ALG_EDDSA:
+		return ed25519.Verify(key.(ed25519.PublicKey), signed, signature)
+	case ALG_RS256:
+		hash := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, hash[:], signature) == nil
+	default:
+		return false
+	}
+}
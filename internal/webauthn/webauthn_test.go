@@ -0,0 +1,350 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var testRP = RelyingParty{ID: "1chan.test", Name: "1chan", Origins: []string{"https://1chan.test"}}
+
+const testClientDataJSON = `{"type":"webauthn.get","challenge":"Y2hhbGxlbmdl","origin":"https://1chan.test","crossOrigin":false}`
+
+// Assertions of testClientDataJSON and the authenticator data of
+// assertionData(FlagUserPresent|FlagUserVerified, 1), made with fixed keys.
+// The Ed25519 key is the one of RFC 8032, section 7.1, test 1.
+var assertionVectors = []struct {
+	name      string
+	algorithm int64
+	publicKey string // COSE_Key
+	signature string
+}{
+	{
+		"ES256", ALG_ES256,
+		"a5010203262001215820f89f26f62fd9ade26c82a95b0db870d185fd822efdd4f6942bc1ba2d90f35b63225820" +
+			"1afa33d78003a23581fa43fb3588cb78134b025dd9f86d8080b6c8d793c86fb8",
+		"30450220532f4a8142988fe2090d7ccbee141634fb3bf7e74f53578cadc118b1e8d6a7530221008428b814b45739089e6e5a013ddd2735" +
+			"e906161f4d42935e58c39ed94f65910d",
+	},
+	{
+		"EdDSA", ALG_EDDSA,
+		"a4010103272006215820d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a",
+		"4ec7d134670d117aed2fb41594ff603b16a2df8e1255b6f3cc31121a629ff800248b93e3368e2db66dfec32580de32545754b962cac0a5" +
+			"7ceb6e92bb7c326c09",
+	},
+	{
+		"RS256", ALG_RS256,
+		"a401030339010020590100c9f270610f1db7e953bd4281e9bd16a1bc9f85c668886eda64e4564ed40ffab3fd10a4289e63ff457287d7" +
+			"9f607344ed7b34d33cc5db51167bd82bfdefe3323f2250cfcba37ccfc3c75bd32bc98744aaf933ea18b021411b6e16ba350e63e7d2" +
+			"43a8ea2aa56777fb6b222bdb57880be4aa7926639f4d04ab4715019db12797a47730cc233f5be8c0c2eddea4c1d8ed385ee50fd29b" +
+			"7cdabe9a9a40e6508d27024f94e9a8c013dd1a574d1d0f36e14129f877a88e1e7beb5f5b38ebb1ea3b60f81410e72fb31d45a7d703" +
+			"815c7adb91415935dec128b2f5e30d2074620e85f9ca6783c527d856176a49bfed8894bb5db36805a5cb06109d53a72663f27b6eab" +
+			"792143010001",
+		"1ebec8cd61a1336e0dd0a040843f8539c4ee3cb9c3a66e916aeafd725150702dae7b83efb4caf807ded3b9bcafcefa1866dd92475357" +
+			"0f6f4a5d3ecff90456e948d507ad96e45e7c5ed0f17fbcf048d4279ba0ecf342d89b7e5fc5208c8cee5fa681e94b64648eba5ec5b4" +
+			"b4f095e82913a71f74e60fbdb3b5d0e139505d060e4c6a6750d0a63d06f3980e04c8d36fec772491316bb47a5bf7fc25233f0e2393" +
+			"2914605a085842793bc6b8b01e222c3c3eda9108121998aedad91ebbfc6b3517afabf891b3150a33b6a353aafaca3be9128e847013" +
+			"a6fe0af3c118e9d8ce6f17b97ba1279af46e5b767430b847338e7ce0568a65b6b2420d9116e5a700bd5173",
+	},
+}
+
+// authenticatorData returns authenticator data scoped to rpID, followed by
+// rest.
+func authenticatorData(rpID string, flags byte, signCount uint32, rest ...byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, signCount)
+	return append(data, rest...)
+}
+
+func assertionData(flags byte, signCount uint32) []byte {
+	return authenticatorData(testRP.ID, flags, signCount)
+}
+
+// attestedCredentialData returns the attested credential data of the
+// credential credentialID whose COSE_Key is publicKey.
+func attestedCredentialData(credentialID []byte, publicKey []byte) []byte {
+	data := make([]byte, 16) // AAGUID
+	data = binary.BigEndian.AppendUint16(data, uint16(len(credentialID)))
+	data = append(data, credentialID...)
+	return append(data, publicKey...)
+}
+
+// attestationObject returns a "none" attestation of authData.
+func attestationObject(authData []byte) []byte {
+	object := mustHex("a3" + "63666d74" + "646e6f6e65" + "6761747453746d74" + "a0" + "6861757468446174615901")
+	object = binary.BigEndian.AppendUint16(object[:len(object)-1], uint16(len(authData)))
+	return append(object, authData...)
+}
+
+func mustHex(s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func TestParseClientData(t *testing.T) {
+	tests := []struct {
+		name     string
+		json     string
+		ceremony string
+		valid    bool
+	}{
+		{"valid", testClientDataJSON, CeremonyGet, true},
+		{"unknown fields", `{"type":"webauthn.create","challenge":"Y2hhbGxlbmdl","origin":"https://1chan.test","other_keys_can_be_added_here":"x"}`, CeremonyCreate, true},
+		{"other ceremony", testClientDataJSON, CeremonyCreate, false},
+		{"other origin", `{"type":"webauthn.get","challenge":"Y2hhbGxlbmdl","origin":"https://evil.test"}`, CeremonyGet, false},
+		{"origin with trailing slash", `{"type":"webauthn.get","challenge":"Y2hhbGxlbmdl","origin":"https://1chan.test/"}`, CeremonyGet, false},
+		{"cross origin", `{"type":"webauthn.get","challenge":"Y2hhbGxlbmdl","origin":"https://1chan.test","crossOrigin":true}`, CeremonyGet, false},
+		{"missing challenge", `{"type":"webauthn.get","origin":"https://1chan.test"}`, CeremonyGet, false},
+		{"malformed", `{"type":`, CeremonyGet, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clientData, err := testRP.ParseClientData([]byte(test.json), test.ceremony)
+			if test.valid {
+				if err != nil {
+					t.Fatalf("ParseClientData() error = %v", err)
+				}
+				if clientData.Challenge != "Y2hhbGxlbmdl" {
+					t.Errorf("challenge = %q", clientData.Challenge)
+				}
+				return
+			}
+
+			if !errors.Is(err, ErrInvalidClientData) {
+				t.Errorf("ParseClientData() error = %v, want %v", err, ErrInvalidClientData)
+			}
+		})
+	}
+}
+
+func TestParseAuthenticatorData(t *testing.T) {
+	credentialID := []byte("credential")
+	publicKey := mustHex(assertionVectors[1].publicKey)
+	attested := attestedCredentialData(credentialID, publicKey)
+	userFlags := FlagUserPresent | FlagUserVerified
+
+	tests := []struct {
+		name  string
+		data  []byte
+		valid bool
+	}{
+		{"assertion", assertionData(userFlags, 7), true},
+		{"attested credential", authenticatorData(testRP.ID, userFlags|FlagAttestedData, 0, attested...), true},
+		{"extensions", authenticatorData(testRP.ID, userFlags|FlagExtensionData, 0, mustHex("a16b6372656450726f7465637402")...), true},
+		{"attested credential and extensions", authenticatorData(testRP.ID, userFlags|FlagAttestedData|FlagExtensionData, 0,
+			append(bytes.Clone(attested), mustHex("a0")...)...), true},
+		{"too short", assertionData(userFlags, 7)[:36], false},
+		{"trailing data", authenticatorData(testRP.ID, userFlags, 7, 0x00), false},
+		{"trailing data after credential", authenticatorData(testRP.ID, userFlags|FlagAttestedData, 0,
+			append(bytes.Clone(attested), 0x00)...), false},
+		{"trailing data after extensions", authenticatorData(testRP.ID, userFlags|FlagExtensionData, 0, 0xa0, 0x00), false},
+		{"missing extensions", authenticatorData(testRP.ID, userFlags|FlagExtensionData, 0), false},
+		{"truncated attested credential", authenticatorData(testRP.ID, userFlags|FlagAttestedData, 0, attested[:17]...), false},
+		{"truncated credential ID", authenticatorData(testRP.ID, userFlags|FlagAttestedData, 0, attested[:20]...), false},
+		{"truncated public key", authenticatorData(testRP.ID, userFlags|FlagAttestedData, 0, attested[:len(attested)-1]...), false},
+		{"credential ID too large", authenticatorData(testRP.ID, userFlags|FlagAttestedData, 0,
+			attestedCredentialData(make([]byte, MAX_CREDENTIAL_ID_SIZE+1), publicKey)...), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			authData, err := ParseAuthenticatorData(test.data)
+			if !test.valid {
+				if !errors.Is(err, ErrInvalidAuthenticator) {
+					t.Errorf("ParseAuthenticatorData() error = %v, want %v", err, ErrInvalidAuthenticator)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("ParseAuthenticatorData() error = %v", err)
+			}
+
+			if authData.Flags != test.data[32] || authData.SignCount != binary.BigEndian.Uint32(test.data[33:37]) {
+				t.Errorf("flags = %x, sign count = %d", authData.Flags, authData.SignCount)
+			}
+
+			if authData.HasFlag(FlagAttestedData) {
+				if !bytes.Equal(authData.CredentialID, credentialID) || !bytes.Equal(authData.PublicKey, publicKey) {
+					t.Errorf("credential ID = %x, public key = %x", authData.CredentialID, authData.PublicKey)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyRegistration(t *testing.T) {
+	credentialID := []byte("credential")
+	publicKey := mustHex(assertionVectors[0].publicKey)
+	attested := attestedCredentialData(credentialID, publicKey)
+	userFlags := FlagUserPresent | FlagUserVerified
+
+	tests := []struct {
+		name                    string
+		attestationObject       []byte
+		requireUserVerification bool
+		wantErr                 error
+	}{
+		{"valid", attestationObject(authenticatorData(testRP.ID, userFlags|FlagAttestedData, 0, attested...)), true, nil},
+		{"user verification not required", attestationObject(authenticatorData(testRP.ID, FlagUserPresent|FlagAttestedData, 0, attested...)), false, nil},
+		{"other relying party", attestationObject(authenticatorData("evil.test", userFlags|FlagAttestedData, 0, attested...)), true, ErrInvalidAuthenticator},
+		{"user not present", attestationObject(authenticatorData(testRP.ID, FlagUserVerified|FlagAttestedData, 0, attested...)), true, ErrInvalidAuthenticator},
+		{"user not verified", attestationObject(authenticatorData(testRP.ID, FlagUserPresent|FlagAttestedData, 0, attested...)), true, ErrInvalidAuthenticator},
+		{"missing attested credential", attestationObject(authenticatorData(testRP.ID, userFlags, 0)), true, ErrInvalidAuthenticator},
+		{"trailing authenticator data", attestationObject(authenticatorData(testRP.ID, userFlags|FlagAttestedData, 0,
+			append(bytes.Clone(attested), 0x00)...)), true, ErrInvalidAuthenticator},
+		{"trailing attestation object", append(attestationObject(authenticatorData(testRP.ID, userFlags|FlagAttestedData, 0, attested...)), 0x00), true, ErrInvalidAuthenticator},
+		{"missing authenticator data", mustHex("a163666d74646e6f6e65"), true, ErrInvalidAuthenticator},
+		{"not a map", mustHex("80"), true, ErrInvalidAuthenticator},
+		{"unsupported key", attestationObject(authenticatorData(testRP.ID, userFlags|FlagAttestedData, 0,
+			attestedCredentialData(credentialID, mustHex("a2010203381c"))...)), true, ErrUnsupportedKey},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			authData, err := testRP.VerifyRegistration(test.attestationObject, test.requireUserVerification)
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Errorf("VerifyRegistration() error = %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("VerifyRegistration() error = %v", err)
+			}
+
+			if !bytes.Equal(authData.CredentialID, credentialID) || !bytes.Equal(authData.PublicKey, publicKey) {
+				t.Errorf("credential ID = %x, public key = %x", authData.CredentialID, authData.PublicKey)
+			}
+		})
+	}
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	userFlags := FlagUserPresent | FlagUserVerified
+	otherKey := mustHex(assertionVectors[1].publicKey)
+
+	for _, vector := range assertionVectors {
+		publicKey := mustHex(vector.publicKey)
+		signature := mustHex(vector.signature)
+
+		tamperedSignature := bytes.Clone(signature)
+		tamperedSignature[len(tamperedSignature)-1] ^= 0x01
+
+		tests := []struct {
+			name                    string
+			publicKey               []byte
+			authData                []byte
+			clientDataJSON          string
+			signature               []byte
+			requireUserVerification bool
+			wantErr                 error
+		}{
+			{"valid", publicKey, assertionData(userFlags, 1), testClientDataJSON, signature, true, nil},
+			{"tampered signature", publicKey, assertionData(userFlags, 1), testClientDataJSON, tamperedSignature, true, ErrInvalidSignature},
+			{"empty signature", publicKey, assertionData(userFlags, 1), testClientDataJSON, nil, true, ErrInvalidSignature},
+			{"other client data", publicKey, assertionData(userFlags, 1), strings.Replace(testClientDataJSON, "Y2hh", "ZGhh", 1), signature, true, ErrInvalidSignature},
+			{"other sign count", publicKey, assertionData(userFlags, 2), testClientDataJSON, signature, true, ErrInvalidSignature},
+			{"other relying party", publicKey, authenticatorData("evil.test", userFlags, 1), testClientDataJSON, signature, true, ErrInvalidAuthenticator},
+			{"user not present", publicKey, assertionData(FlagUserVerified, 1), testClientDataJSON, signature, true, ErrInvalidAuthenticator},
+			{"user not verified", publicKey, assertionData(FlagUserPresent, 1), testClientDataJSON, signature, true, ErrInvalidAuthenticator},
+			{"trailing authenticator data", publicKey, append(assertionData(userFlags, 1), 0x00), testClientDataJSON, signature, true, ErrInvalidAuthenticator},
+			{"truncated authenticator data", publicKey, assertionData(userFlags, 1)[:36], testClientDataJSON, signature, true, ErrInvalidAuthenticator},
+			{"malformed key", publicKey[:len(publicKey)-1], assertionData(userFlags, 1), testClientDataJSON, signature, true, ErrUnsupportedKey},
+		}
+		if vector.algorithm != ALG_EDDSA {
+			tests = append(tests, struct {
+				name                    string
+				publicKey               []byte
+				authData                []byte
+				clientDataJSON          string
+				signature               []byte
+				requireUserVerification bool
+				wantErr                 error
+			}{"other key", otherKey, assertionData(userFlags, 1), testClientDataJSON, signature, true, ErrInvalidSignature})
+		}
+
+		for _, test := range tests {
+			t.Run(vector.name+"/"+test.name, func(t *testing.T) {
+				authData, err := testRP.VerifyAssertion(test.publicKey, test.authData, []byte(test.clientDataJSON), test.signature,
+					test.requireUserVerification)
+				if test.wantErr != nil {
+					if !errors.Is(err, test.wantErr) {
+						t.Errorf("VerifyAssertion() error = %v, want %v", err, test.wantErr)
+					}
+					return
+				}
+
+				if err != nil {
+					t.Fatalf("VerifyAssertion() error = %v", err)
+				}
+
+				if authData.SignCount != 1 {
+					t.Errorf("sign count = %d, want 1", authData.SignCount)
+				}
+			})
+		}
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		key       string
+		algorithm int64 // 0 when the key is rejected
+	}{
+		{"ES256", assertionVectors[0].publicKey, ALG_ES256},
+		{"EdDSA", assertionVectors[1].publicKey, ALG_EDDSA},
+		{"RS256", assertionVectors[2].publicKey, ALG_RS256},
+		{"P-256 point off the curve", strings.Replace(assertionVectors[0].publicKey, "f89f26f6", "f89f26f7", 1), 0},
+		{"P-256 key on another curve", strings.Replace(assertionVectors[0].publicKey, "2001", "2002", 1), 0},
+		{"P-256 key with a short coordinate", "a5010203262001215801002258201afa33d78003a23581fa43fb3588cb78134b025dd9f86d8080b6c8d793c86fb8", 0},
+		{"Ed25519 key on another curve", strings.Replace(assertionVectors[1].publicKey, "2006", "2007", 1), 0},
+		{"Ed25519 key of the wrong size", "a401010327200621581fd75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f70751", 0},
+		{"RSA key below 2048 bits", "a40103033901002058ff" + strings.Repeat("ff", 255) + "2143010001", 0},
+		{"RSA key without exponent", "a30103033901002059010000" + strings.Repeat("ff", 255), 0},
+		{"algorithm of another key type", "a401010326200621582000" + strings.Repeat("00", 31), 0},
+		{"unsupported algorithm", "a20102033822", 0},
+		{"not a map", "80", 0},
+		{"trailing data", assertionVectors[1].publicKey + "00", 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			algorithm, key, err := ParsePublicKey(mustHex(test.key))
+			if test.algorithm == 0 {
+				if !errors.Is(err, ErrUnsupportedKey) {
+					t.Errorf("ParsePublicKey() = %d, %v, want %v", algorithm, err, ErrUnsupportedKey)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("ParsePublicKey() error = %v", err)
+			}
+
+			if algorithm != test.algorithm || key == nil {
+				t.Errorf("ParsePublicKey() = %d, %v, want algorithm %d", algorithm, key, test.algorithm)
+			}
+		})
+	}
+}
+
+func TestDecodeBase64URL(t *testing.T) {
+	for _, encoded := range []string{"AQID_-8", "AQID_-8="} {
+		decoded, err := DecodeBase64URL(encoded)
+		if err != nil || !bytes.Equal(decoded, []byte{1, 2, 3, 0xff, 0xef}) {
+			t.Errorf("DecodeBase64URL(%q) = %x, %v", encoded, decoded, err)
+		}
+	}
+}
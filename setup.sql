@@ -4,16 +4,34 @@ CREATE DATABASE forum;
 
 \c forum 
 
+-- Trigram matching, for search suggestions tolerant of typos
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
 CREATE TYPE app_language AS ENUM ('en', 'id', 'ja');
 CREATE TYPE app_theme AS ENUM ('light', 'dark', 'auto');
-CREATE TYPE notification_type AS ENUM ('admin', 'thread', 'dm');
-CREATE TYPE report_status AS ENUM ('pending', 'resolved');
+CREATE TYPE notification_type AS ENUM ('admin', 'thread', 'comment', 'like', 'dm', 'saved_search');
+CREATE TYPE user_role AS ENUM ('user', 'moderator', 'admin');
+CREATE TYPE report_status AS ENUM ('pending', 'claimed', 'resolved');
+CREATE TYPE moderation_action AS ENUM ('dismiss', 'delete_content', 'warn_user', 'suspend_user');
+CREATE TYPE account_deletion_mode AS ENUM ('anonymise', 'remove');
+CREATE TYPE email_token_purpose AS ENUM ('verify_email', 'change_email', 'reset_password');
+CREATE TYPE security_event_type AS ENUM ('refresh_token_reuse', 'passkey_clone_suspected');
+CREATE TYPE webauthn_ceremony AS ENUM ('registration', 'authentication');
 
 -- Users
+-- The first admin has to be appointed directly in the database:
+-- UPDATE users SET role = 'admin' WHERE username = '...';
 CREATE TABLE users (
     id UUID PRIMARY KEY,
     username VARCHAR(255) UNIQUE NOT NULL,
-    password_hash TEXT NOT NULL
+    password_hash TEXT NOT NULL,
+    role user_role NOT NULL DEFAULT 'user',
+    suspended_until TIMESTAMPTZ,
+    deleted_at TIMESTAMPTZ,
+    deleted_by UUID,
+    delete_reason TEXT,
+    deletion_mode account_deletion_mode, -- What happens to the user's content once the account is purged
+    FOREIGN KEY (deleted_by) REFERENCES users(id) ON DELETE SET NULL
 );
 
 CREATE TABLE user_profiles (
@@ -21,33 +39,217 @@ CREATE TABLE user_profiles (
     profile_picture_path TEXT,
     biodata TEXT NOT NULL DEFAULT 'Hello, I''m using 1chan!',
     email TEXT,
+    email_verified BOOLEAN NOT NULL DEFAULT FALSE,
     post_count INT NOT NULL DEFAULT 0,
     comment_count INT NOT NULL DEFAULT 0,
     preferred_lang app_language NOT NULL DEFAULT 'en',
     preferred_theme app_theme NOT NULL DEFAULT 'auto',
     creation_date TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
     last_login TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    search_vector tsvector NOT NULL DEFAULT ''::tsvector,
+    record_search_history BOOLEAN NOT NULL DEFAULT TRUE,
     FOREIGN KEY (id) REFERENCES users(id) ON DELETE CASCADE
 );
 
+-- Password resets are only sent to verified emails, which therefore
+-- must identify a single account
+CREATE UNIQUE INDEX idx_user_profiles_verified_email ON user_profiles(LOWER(email)) WHERE email_verified;
+
 CREATE TABLE notifications (
     id BIGSERIAL PRIMARY KEY,
     user_id UUID NOT NULL,
+    actor_id UUID,
     related_id BIGINT,
+    thread_id BIGINT,
     type notification_type NOT NULL,
     message TEXT,
     creation_date TIMESTAMPTZ DEFAULT NOW(),
     acknowledged_date TIMESTAMPTZ,
-    FOREIGN KEY (user_id) REFERENCES users(id)
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (actor_id) REFERENCES users(id) ON DELETE SET NULL
 );
 
+CREATE INDEX idx_notifications_unread ON notifications(user_id, creation_date DESC) WHERE acknowledged_date IS NULL;
+
 -- Authorisation
 
+-- Each refresh token is a session of the user on one of their devices. The
+-- token is rotated on every refresh, and all the tokens a session has had
+-- form its family.
 CREATE TABLE refresh_tokens (
     id BIGSERIAL PRIMARY KEY,
     user_id UUID NOT NULL,
     device_id TEXT NOT NULL,
     token_hash TEXT NOT NULL,
+    token_id UUID NOT NULL, -- jti of the current token
+    family_id UUID UNIQUE NOT NULL,
+    expiration_date TIMESTAMPTZ NOT NULL,
+    user_agent TEXT,
+    ip_address TEXT,
+    creation_date TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_date TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_refresh_tokens_user_id ON refresh_tokens(user_id, device_id);
+
+-- Tokens rotated out of a family. Presenting one again means it was stolen,
+-- so the whole family is revoked, unless it is the token rotated out last and
+-- is presented again shortly after, as tabs refreshing at once do. It is then
+-- given its successor, which is kept encrypted with a key derived from it.
+CREATE TABLE rotated_refresh_tokens (
+    token_id UUID PRIMARY KEY,
+    family_id UUID NOT NULL,
+    user_id UUID NOT NULL,
+    successor_token_id UUID NOT NULL,
+    sealed_successor TEXT NOT NULL,
+    rotated_date TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expiration_date TIMESTAMPTZ NOT NULL, -- Expiry of the token itself, after which it is no longer kept
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Sessions whose access tokens are rejected before they expire, because the
+-- session was revoked. Entries are kept for as long as an access token lives.
+CREATE TABLE access_token_denylist (
+    session_id UUID PRIMARY KEY,
+    revoked_date TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Single-use tickets which authenticate a server-sent event stream, since
+-- browsers cannot set an Authorization header on an EventSource.
+CREATE TABLE stream_tickets (
+    token_hash TEXT PRIMARY KEY,
+    user_id UUID NOT NULL,
+    session_id UUID NOT NULL,
+    expiration_date TIMESTAMPTZ NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE security_events (
+    id BIGSERIAL PRIMARY KEY,
+    user_id UUID NOT NULL,
+    type security_event_type NOT NULL,
+    device_id TEXT,
+    user_agent TEXT,
+    ip_address TEXT,
+    creation_date TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_security_events_user_id ON security_events(user_id, creation_date DESC);
+
+-- Single-use tokens sent by email. Only their SHA-256 hashes are stored, and
+-- a user has at most one pending token per purpose.
+CREATE TABLE email_tokens (
+    token_hash TEXT PRIMARY KEY,
+    user_id UUID NOT NULL,
+    purpose email_token_purpose NOT NULL,
+    email TEXT NOT NULL, -- Address the token was sent to
+    creation_date TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expiration_date TIMESTAMPTZ NOT NULL,
+    UNIQUE (user_id, purpose),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- TOTP two-factor authentication. The secret is pending until the user
+-- confirms their enrolment with a first code, which sets enabled_date.
+CREATE TABLE user_totp (
+    user_id UUID PRIMARY KEY,
+    secret TEXT NOT NULL,
+    enabled_date TIMESTAMPTZ,
+    last_used_step BIGINT NOT NULL DEFAULT 0, -- Codes of this time step or earlier cannot be used again
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Failed two-factor attempts, counted per user over a rolling window so that
+-- requesting new login challenges does not give an attacker more guesses
+CREATE TABLE totp_failed_attempts (
+    id BIGSERIAL PRIMARY KEY,
+    user_id UUID NOT NULL,
+    attempt_date TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_totp_failed_attempts_user_id ON totp_failed_attempts(user_id, attempt_date);
+
+CREATE TABLE totp_recovery_codes (
+    id BIGSERIAL PRIMARY KEY,
+    user_id UUID NOT NULL,
+    code_hash TEXT NOT NULL,
+    used_date TIMESTAMPTZ,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_totp_recovery_codes_user_id ON totp_recovery_codes(user_id) WHERE used_date IS NULL;
+
+-- Issued after a correct password to users with two-factor authentication
+-- enabled, and exchanged for their tokens along with a valid code
+CREATE TABLE login_challenges (
+    token_hash TEXT PRIMARY KEY,
+    user_id UUID NOT NULL,
+    device_id TEXT NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    expiration_date TIMESTAMPTZ NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Accounts of users with OpenID Connect providers. Users who signed up with
+-- a provider have an empty password_hash until they set a password.
+CREATE TABLE user_identities (
+    id BIGSERIAL PRIMARY KEY,
+    user_id UUID NOT NULL,
+    provider TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    email TEXT,
+    creation_date TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_login_date TIMESTAMPTZ,
+    UNIQUE (provider, subject),
+    UNIQUE (user_id, provider),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE oidc_states (
+    state_hash TEXT PRIMARY KEY,
+    provider TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    nonce TEXT NOT NULL,
+    code_verifier TEXT NOT NULL,
+    user_id UUID, -- Set when linking the provider to an existing account
+    expiration_date TIMESTAMPTZ NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE oidc_registrations (
+    token_hash TEXT PRIMARY KEY,
+    provider TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    email TEXT,
+    email_verified BOOLEAN NOT NULL DEFAULT FALSE,
+    expiration_date TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE passkeys (
+    id BIGSERIAL PRIMARY KEY,
+    user_id UUID NOT NULL,
+    credential_id TEXT UNIQUE NOT NULL,
+    public_key BYTEA NOT NULL, -- COSE_Key
+    sign_count BIGINT NOT NULL DEFAULT 0,
+    transports TEXT[] NOT NULL DEFAULT '{}',
+    name TEXT NOT NULL,
+    backed_up BOOLEAN NOT NULL DEFAULT FALSE,
+    creation_date TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_date TIMESTAMPTZ,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_passkeys_user_id ON passkeys(user_id);
+
+CREATE TABLE webauthn_challenges (
+    challenge TEXT PRIMARY KEY,
+    ceremony webauthn_ceremony NOT NULL,
+    user_id UUID, -- Set for registrations
+    device_id TEXT NOT NULL,
     expiration_date TIMESTAMPTZ NOT NULL,
     FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 );
@@ -55,9 +257,24 @@ CREATE TABLE refresh_tokens (
 -- Channels
 CREATE TABLE channels (
     id BIGSERIAL PRIMARY KEY,
-    name TEXT NOT NULL,
+    name TEXT UNIQUE NOT NULL,
     description TEXT NOT NULL DEFAULT 'Welcome to this channel!',
-    channel_picture_path TEXT
+    channel_picture_path TEXT,
+    creator_id UUID NOT NULL,
+    creation_date TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_date TIMESTAMPTZ,
+    follower_count INT NOT NULL DEFAULT 0,
+    thread_count INT NOT NULL DEFAULT 0,
+    FOREIGN KEY (creator_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE channel_moderators (
+    channel_id BIGINT NOT NULL,
+    user_id UUID NOT NULL,
+    appointed_date TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (channel_id, user_id),
+    FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 );
 
 -- Threads
@@ -74,9 +291,14 @@ CREATE TABLE threads (
     dislike_count INT NOT NULL DEFAULT 0,
     view_count INT NOT NULL DEFAULT 0,
     comment_count INT NOT NULL DEFAULT 0,
+    lang app_language NOT NULL DEFAULT 'en',
     search_vector tsvector NOT NULL,
-    FOREIGN KEY (user_id) REFERENCES users(id),
-    FOREIGN KEY (channel_id) REFERENCES channels(id)
+    deleted_at TIMESTAMPTZ,
+    deleted_by UUID,
+    delete_reason TEXT,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE SET NULL,
+    FOREIGN KEY (deleted_by) REFERENCES users(id) ON DELETE SET NULL
 );
 
 -- Comments
@@ -84,24 +306,70 @@ CREATE TABLE comments (
     id BIGSERIAL PRIMARY KEY,
     thread_id INT NOT NULL,
     user_id UUID NOT NULL,
+    parent_id BIGINT,
+    depth INT NOT NULL DEFAULT 0,
     comment TEXT NOT NULL,
     creation_date TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
     updated_date TIMESTAMP,
     like_count INT NOT NULL DEFAULT 0,
     dislike_count INT NOT NULL DEFAULT 0,
+    reply_count INT NOT NULL DEFAULT 0,
+    lang app_language NOT NULL DEFAULT 'en',
     search_vector tsvector NOT NULL,
+    deleted_at TIMESTAMPTZ,
+    deleted_by UUID,
+    delete_reason TEXT,
     FOREIGN KEY (thread_id) REFERENCES threads(id) ON DELETE CASCADE,
-    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (parent_id) REFERENCES comments(id) ON DELETE CASCADE,
+    FOREIGN KEY (deleted_by) REFERENCES users(id) ON DELETE SET NULL
 );
 
+CREATE INDEX idx_comments_parent_id ON comments(parent_id);
+CREATE INDEX idx_comments_thread_id ON comments(thread_id);
+
+-- Soft-deleted users, threads and comments are kept for a grace period,
+-- during which their owners can restore them, before being purged.
+
+CREATE INDEX idx_users_deleted_at ON users(deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX idx_threads_deleted_at ON threads(deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX idx_comments_deleted_at ON comments(deleted_at) WHERE deleted_at IS NOT NULL;
+
+-- Trigger function to update comments' reply count
+-- whenever a reply is deleted from / inserted into comments table
+
+CREATE OR REPLACE FUNCTION update_comment_reply_count()
+    RETURNS TRIGGER AS $$
+BEGIN
+    IF (TG_OP) = 'INSERT' AND NEW.parent_id IS NOT NULL THEN
+        UPDATE comments
+        SET reply_count = reply_count + 1
+        WHERE comments.id = NEW.parent_id;
+    ELSEIF (TG_OP) = 'DELETE' AND OLD.parent_id IS NOT NULL THEN
+        UPDATE comments
+        SET reply_count = reply_count - 1
+        WHERE comments.id = OLD.parent_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER comment_reply_count_update
+    AFTER INSERT OR DELETE
+    ON comments
+    FOR EACH ROW
+EXECUTE FUNCTION update_comment_reply_count();
+
 -- Polls
 CREATE TABLE polls (
     id BIGSERIAL PRIMARY KEY,
     thread_id INT NOT NULL,
     question TEXT NOT NULL,
     creation_date TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
-    max_choice INT NOT NULL DEFAULT 1,
-    FOREIGN KEY (thread_id) REFERENCES threads(id)
+    close_date TIMESTAMPTZ,
+    max_choice INT NOT NULL DEFAULT 1 CHECK (max_choice >= 1),
+    hide_results_until_voted BOOLEAN NOT NULL DEFAULT FALSE,
+    FOREIGN KEY (thread_id) REFERENCES threads(id) ON DELETE CASCADE
 );
 
 CREATE TABLE poll_options (
@@ -110,7 +378,7 @@ CREATE TABLE poll_options (
     option_text TEXT NOT NULL,
     vote_count INT NOT NULL DEFAULT 0,
     PRIMARY KEY (poll_id, option_id),
-    FOREIGN KEY (poll_id) REFERENCES polls(id)
+    FOREIGN KEY (poll_id) REFERENCES polls(id) ON DELETE CASCADE
 );
 
 CREATE TABLE user_poll_votes (
@@ -118,21 +386,64 @@ CREATE TABLE user_poll_votes (
     poll_id BIGINT NOT NULL,
     poll_option_id INT NOT NULL,
     PRIMARY KEY (user_id, poll_id, poll_option_id),
-    FOREIGN KEY (user_id) REFERENCES users(id),
-    FOREIGN KEY (poll_id) REFERENCES polls(id),
-    FOREIGN KEY (poll_id, poll_option_id) REFERENCES poll_options(poll_id, option_id)
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (poll_id) REFERENCES polls(id) ON DELETE CASCADE,
+    FOREIGN KEY (poll_id, poll_option_id) REFERENCES poll_options(poll_id, option_id) ON DELETE CASCADE
 );
 
+CREATE UNIQUE INDEX idx_polls_thread_id ON polls(thread_id);
+
+-- Trigger function to update poll options' vote count
+-- whenever user_poll_votes table is deleted from / inserted into
+
+CREATE OR REPLACE FUNCTION update_poll_option_vote_count()
+    RETURNS TRIGGER AS $$
+BEGIN
+    IF (TG_OP) = 'INSERT' THEN
+        UPDATE poll_options
+        SET vote_count = vote_count + 1
+        WHERE poll_id = NEW.poll_id AND option_id = NEW.poll_option_id;
+    ELSEIF (TG_OP) = 'DELETE' THEN
+        UPDATE poll_options
+        SET vote_count = vote_count - 1
+        WHERE poll_id = OLD.poll_id AND option_id = OLD.poll_option_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER poll_option_vote_count_update
+    AFTER INSERT OR DELETE
+    ON user_poll_votes
+    FOR EACH ROW
+EXECUTE FUNCTION update_poll_option_vote_count();
+
 -- Direct Messaging
 CREATE TABLE direct_messages (
     message_id BIGINT NOT NULL,
     user_a_id UUID NOT NULL,
     user_b_id UUID NOT NULL,
+    sender_id UUID NOT NULL,
+    content TEXT NOT NULL,
     creation_date TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    read_date TIMESTAMPTZ,
     PRIMARY KEY (message_id, user_a_id, user_b_id),
     CONSTRAINT consistent_parties CHECK (user_a_id < user_b_id),
-    FOREIGN KEY (user_a_id) REFERENCES users(id),
-    FOREIGN KEY (user_b_id) REFERENCES users(id)
+    CONSTRAINT sender_is_party CHECK (sender_id = user_a_id OR sender_id = user_b_id),
+    FOREIGN KEY (user_a_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_b_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_direct_messages_user_b ON direct_messages(user_b_id);
+
+CREATE TABLE user_blocks (
+    blocker_id UUID NOT NULL,
+    blocked_id UUID NOT NULL,
+    creation_date TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (blocker_id, blocked_id),
+    CONSTRAINT no_self_block CHECK (blocker_id <> blocked_id),
+    FOREIGN KEY (blocker_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (blocked_id) REFERENCES users(id) ON DELETE CASCADE
 );
 
 -- Trigger function to automatically asign increasing message_id for
@@ -168,34 +479,201 @@ EXECUTE FUNCTION assign_message_id();
 -- );
 
 -- Reports
+-- The reported content is snapshotted on report creation, so that
+-- reports remain reviewable after the content itself is deleted.
 CREATE TABLE reports (
     id BIGSERIAL PRIMARY KEY,
     thread_id BIGINT,
     comment_id BIGINT,
-    reporter_id UUID NOT NULL,
+    reporter_id UUID,      -- NULL once the reporter is purged
+    reported_user_id UUID, -- NULL once the reported user is purged
     moderator_id UUID,
+    status report_status NOT NULL DEFAULT 'pending',
     report_reason TEXT NOT NULL,
+    content_snapshot TEXT NOT NULL,
     actions_taken TEXT,
     creation_date TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    claimed_date TIMESTAMPTZ,
     resolved_date TIMESTAMPTZ,
-    FOREIGN KEY (reporter_id) REFERENCES users(id),
-    FOREIGN KEY (moderator_id) REFERENCES users(id),
-    FOREIGN KEY (thread_id) REFERENCES threads(id),
-    FOREIGN KEY (comment_id) REFERENCES comments(id),
-    CHECK (thread_id IS NOT NULL OR comment_id IS NOT NULL)
+    FOREIGN KEY (reporter_id) REFERENCES users(id) ON DELETE SET NULL,
+    FOREIGN KEY (reported_user_id) REFERENCES users(id) ON DELETE SET NULL,
+    FOREIGN KEY (moderator_id) REFERENCES users(id) ON DELETE SET NULL,
+    FOREIGN KEY (thread_id) REFERENCES threads(id) ON DELETE SET NULL,
+    FOREIGN KEY (comment_id) REFERENCES comments(id) ON DELETE SET NULL
 );
 
+CREATE INDEX idx_reports_status ON reports(status, creation_date);
+
+-- Audit trail of every action taken by moderators
+
+CREATE TABLE moderation_log (
+    id BIGSERIAL PRIMARY KEY,
+    moderator_id UUID,
+    report_id BIGINT,
+    action moderation_action NOT NULL,
+    target_user_id UUID,
+    thread_id BIGINT,
+    comment_id BIGINT,
+    note TEXT,
+    creation_date TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (moderator_id) REFERENCES users(id) ON DELETE SET NULL,
+    FOREIGN KEY (report_id) REFERENCES reports(id) ON DELETE SET NULL,
+    FOREIGN KEY (target_user_id) REFERENCES users(id) ON DELETE SET NULL
+);
+
+-- Revisions of threads and comments. Revisions are kept when the thread or
+-- comment is deleted, so that moderators can still review them.
+
+CREATE TABLE thread_revisions (
+    id BIGSERIAL PRIMARY KEY,
+    thread_id BIGINT NOT NULL,
+    user_id UUID,
+    revision INT NOT NULL,
+    title TEXT NOT NULL,
+    original_post TEXT NOT NULL,
+    creation_date TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE UNIQUE INDEX idx_thread_revisions_thread_id ON thread_revisions(thread_id, revision);
+
+CREATE TABLE comment_revisions (
+    id BIGSERIAL PRIMARY KEY,
+    comment_id BIGINT NOT NULL,
+    thread_id BIGINT NOT NULL,
+    user_id UUID,
+    revision INT NOT NULL,
+    comment TEXT NOT NULL,
+    creation_date TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE UNIQUE INDEX idx_comment_revisions_comment_id ON comment_revisions(comment_id, revision);
+
+-- Trigger function to record a revision whenever a thread
+-- is created or its title / original post is edited
+
+CREATE OR REPLACE FUNCTION record_thread_revision()
+    RETURNS TRIGGER AS $$
+BEGIN
+    IF (TG_OP) = 'UPDATE' THEN
+        IF NEW.title = OLD.title AND NEW.original_post = OLD.original_post THEN
+            RETURN NULL;
+        END IF;
+    END IF;
+
+    INSERT INTO thread_revisions(thread_id, user_id, revision, title, original_post, creation_date)
+    SELECT NEW.id, NEW.user_id, COALESCE(MAX(revision), 0) + 1, NEW.title, NEW.original_post, CURRENT_TIMESTAMP
+    FROM thread_revisions
+    WHERE thread_id = NEW.id;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER thread_revision_record
+    AFTER INSERT OR UPDATE
+    ON threads
+    FOR EACH ROW
+EXECUTE FUNCTION record_thread_revision();
+
+-- Trigger function to record a revision whenever a comment
+-- is created or edited
+
+CREATE OR REPLACE FUNCTION record_comment_revision()
+    RETURNS TRIGGER AS $$
+BEGIN
+    IF (TG_OP) = 'UPDATE' THEN
+        IF NEW.comment = OLD.comment THEN
+            RETURN NULL;
+        END IF;
+    END IF;
+
+    INSERT INTO comment_revisions(comment_id, thread_id, user_id, revision, comment, creation_date)
+    SELECT NEW.id, NEW.thread_id, NEW.user_id, COALESCE(MAX(revision), 0) + 1, NEW.comment, CURRENT_TIMESTAMP
+    FROM comment_revisions
+    WHERE comment_id = NEW.id;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER comment_revision_record
+    AFTER INSERT OR UPDATE
+    ON comments
+    FOR EACH ROW
+EXECUTE FUNCTION record_comment_revision();
+
 -- Indexes the search vector for threads and comments
 
 CREATE INDEX comments_search_vector_idx ON comments USING gin(search_vector);
 CREATE INDEX threads_search_vector_idx ON threads USING gin(search_vector);
+CREATE INDEX user_profiles_search_vector_idx ON user_profiles USING gin(search_vector);
+
+-- Trigram indexes for search suggestions
+
+CREATE INDEX threads_title_trgm_idx ON threads USING gin(title gin_trgm_ops);
+CREATE INDEX users_username_trgm_idx ON users USING gin(username gin_trgm_ops);
+
+-- Text search configuration of each app language. Japanese has no
+-- stemmer, so it is indexed with the simple configuration and CJK bigrams.
+
+CREATE OR REPLACE FUNCTION app_language_ts_config(lang app_language)
+    RETURNS regconfig AS $$
+    SELECT CASE lang
+        WHEN 'en' THEN 'english'::regconfig
+        WHEN 'id' THEN 'indonesian'::regconfig
+        ELSE 'simple'::regconfig
+    END;
+$$ LANGUAGE sql IMMUTABLE;
+
+-- Splits every run of CJK characters into overlapping bigrams, as CJK text
+-- is not separated by spaces and would otherwise be indexed as a single word
+
+CREATE OR REPLACE FUNCTION cjk_bigrams(content TEXT)
+    RETURNS TEXT AS $$
+DECLARE
+    run TEXT;
+    bigrams TEXT := '';
+BEGIN
+    FOR run IN
+        SELECT m[1] FROM regexp_matches(content, '([\u3040-\u30ff\u3400-\u4dbf\u4e00-\u9fff\uff66-\uff9f]+)', 'g') AS m
+    LOOP
+        IF length(run) = 1 THEN
+            bigrams := bigrams || ' ' || run;
+        ELSE
+            FOR i IN 1..length(run) - 1 LOOP
+                bigrams := bigrams || ' ' || substr(run, i, 2);
+            END LOOP;
+        END IF;
+    END LOOP;
+    RETURN bigrams;
+END;
+$$ LANGUAGE plpgsql IMMUTABLE;
+
+CREATE OR REPLACE FUNCTION app_language_tsvector(lang app_language, content TEXT)
+    RETURNS tsvector AS $$
+    SELECT CASE lang
+        WHEN 'ja' THEN to_tsvector('simple', content) || to_tsvector('simple', cjk_bigrams(content))
+        ELSE to_tsvector(app_language_ts_config(lang), content)
+    END;
+$$ LANGUAGE sql IMMUTABLE;
+
+-- Builds the tsquery matching a websearch_to_tsquery query against search
+-- vectors built by app_language_tsvector for the same language
+
+CREATE OR REPLACE FUNCTION app_language_tsquery(lang app_language, query TEXT)
+    RETURNS tsquery AS $$
+    SELECT CASE lang
+        WHEN 'ja' THEN websearch_to_tsquery('simple', query) || plainto_tsquery('simple', cjk_bigrams(query))
+        ELSE websearch_to_tsquery(app_language_ts_config(lang), query)
+    END;
+$$ LANGUAGE sql IMMUTABLE;
 
 -- Trigger function to update threads table's search vector
 
 CREATE OR REPLACE FUNCTION update_thread_search_vector()
     RETURNS TRIGGER AS $$
 BEGIN
-    NEW.search_vector := to_tsvector('english', NEW.title || ' ' || NEW.original_post);
+    NEW.search_vector := app_language_tsvector(NEW.lang, NEW.title || ' ' || NEW.original_post);
     RETURN NEW;
 END;
 $$ LANGUAGE plpgsql;
@@ -210,7 +688,7 @@ EXECUTE FUNCTION update_thread_search_vector();
 CREATE OR REPLACE FUNCTION update_comment_search_vector()
     RETURNS TRIGGER AS $$
     BEGIN
-        NEW.search_vector := to_tsvector('english', NEW.comment);
+        NEW.search_vector := app_language_tsvector(NEW.lang, NEW.comment);
         RETURN NEW;
     END;
     $$ LANGUAGE plpgsql;
@@ -220,50 +698,69 @@ CREATE TRIGGER trigger_update_comment_search_vector
     FOR EACH ROW
 EXECUTE FUNCTION update_comment_search_vector();
 
--- Trigger function to update user's comment count
+-- Trigger function to update user profiles' search vector
+
+CREATE OR REPLACE FUNCTION update_user_profile_search_vector()
+    RETURNS TRIGGER AS $$
+BEGIN
+    NEW.search_vector := to_tsvector('english', NEW.biodata);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER trigger_update_user_profile_search_vector
+    BEFORE INSERT OR UPDATE ON user_profiles
+    FOR EACH ROW
+EXECUTE FUNCTION update_user_profile_search_vector();
+
+-- Trigger function to update user's comment count. Soft-deleted
+-- comments are no longer counted, and are counted again once restored.
 
 CREATE OR REPLACE FUNCTION update_user_comment_count()
     RETURNS TRIGGER AS $$
     BEGIN
-        IF (TG_OP) = 'INSERT' THEN
+        IF (TG_OP) = 'INSERT' OR ((TG_OP) = 'UPDATE' AND OLD.deleted_at IS NOT NULL AND NEW.deleted_at IS NULL) THEN
             UPDATE user_profiles
             SET comment_count = comment_count + 1
             WHERE id = NEW.user_id;
-        ELSEIF (TG_OP = 'DELETE') THEN
+        ELSEIF ((TG_OP) = 'DELETE' AND OLD.deleted_at IS NULL) OR
+               ((TG_OP) = 'UPDATE' AND OLD.deleted_at IS NULL AND NEW.deleted_at IS NOT NULL) THEN
             UPDATE user_profiles
             SET comment_count = comment_count - 1
-            WHERE id = NEW.user_id;
+            WHERE id = OLD.user_id;
         END IF;
         RETURN NULL;
     END;
     $$ LANGUAGE plpgsql;
 
 CREATE TRIGGER user_comment_count_update
-    AFTER INSERT OR DELETE
+    AFTER INSERT OR DELETE OR UPDATE OF deleted_at
     ON comments
     FOR EACH ROW
 EXECUTE FUNCTION update_user_comment_count();
 
--- Trigger function to update user's post count
+-- Trigger function to update user's post count. Soft-deleted
+-- threads are no longer counted, and are counted again once restored.
 
 CREATE OR REPLACE FUNCTION update_user_post_count()
     RETURNS TRIGGER AS $$
 BEGIN
-    IF (TG_OP) = 'INSERT' THEN
+    IF (TG_OP) = 'INSERT' OR ((TG_OP) = 'UPDATE' AND OLD.deleted_at IS NOT NULL AND NEW.deleted_at IS NULL) THEN
         UPDATE user_profiles
         SET post_count = post_count + 1
         WHERE id = NEW.user_id;
-    ELSEIF (TG_OP = 'DELETE') THEN
+    ELSEIF ((TG_OP) = 'DELETE' AND OLD.deleted_at IS NULL) OR
+           ((TG_OP) = 'UPDATE' AND OLD.deleted_at IS NULL AND NEW.deleted_at IS NOT NULL) THEN
         UPDATE user_profiles
         SET post_count = post_count - 1
-        WHERE id = NEW.user_id;
+        WHERE id = OLD.user_id;
     END IF;
     RETURN NULL;
 END;
 $$ LANGUAGE plpgsql;
 
 CREATE TRIGGER user_post_count_update
-    AFTER INSERT OR DELETE
+    AFTER INSERT OR DELETE OR UPDATE OF deleted_at
     ON threads
     FOR EACH ROW
 EXECUTE FUNCTION update_user_post_count();
@@ -274,17 +771,79 @@ CREATE TABLE user_search_history(
     id BIGSERIAL PRIMARY KEY,
     user_id UUID NOT NULL,
     query TEXT NOT NULL,
-    FOREIGN KEY (user_id) REFERENCES users(id)
+    creation_date TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_user_search_history_user_id ON user_search_history(user_id, creation_date DESC);
+CREATE INDEX user_search_history_query_trgm_idx ON user_search_history USING gin(query gin_trgm_ops);
+
+-- Threads created after last_checked_date have not been matched against the
+-- saved search yet, for notification purposes
+CREATE TABLE saved_searches(
+    id BIGSERIAL PRIMARY KEY,
+    user_id UUID NOT NULL,
+    name TEXT NOT NULL,
+    query TEXT NOT NULL DEFAULT '',
+    tags TEXT NOT NULL DEFAULT '',        -- Comma separated tag IDs
+    custom_tags TEXT NOT NULL DEFAULT '', -- Comma separated custom tag names
+    sort_by TEXT NOT NULL DEFAULT 'relevance',
+    sort_order TEXT NOT NULL DEFAULT 'desc',
+    lang app_language,
+    notify BOOLEAN NOT NULL DEFAULT FALSE,
+    last_checked_date TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    creation_date TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_saved_searches_user_id ON saved_searches(user_id);
+CREATE INDEX idx_saved_searches_notify ON saved_searches(id) WHERE notify;
+
+-- Threads already notified of for a saved search. Matching overlaps the
+-- previous check, so that threads committed late are not missed, and these
+-- keep them from being notified of twice until they fall out of the overlap.
+CREATE TABLE saved_search_matches(
+    saved_search_id BIGINT,
+    thread_id BIGINT,
+    thread_creation_date TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (saved_search_id, thread_id),
+    FOREIGN KEY (saved_search_id) REFERENCES saved_searches(id) ON DELETE CASCADE,
+    FOREIGN KEY (thread_id) REFERENCES threads(id) ON DELETE CASCADE
 );
 
 CREATE TABLE user_channel_follows(
     user_id UUID,
     channel_id BIGINT,
-    FOREIGN KEY (user_id) REFERENCES users(id),
-    FOREIGN KEY (channel_id) REFERENCES channels(id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE,
     PRIMARY KEY (user_id, channel_id)
 );
 
+-- Trigger function to update channels' follower count
+-- whenever user_channel_follows table is deleted from / inserted into
+
+CREATE OR REPLACE FUNCTION update_channel_follower_count()
+    RETURNS TRIGGER AS $$
+BEGIN
+    IF (TG_OP) = 'INSERT' THEN
+        UPDATE channels
+        SET follower_count = follower_count + 1
+        WHERE channels.id = NEW.channel_id;
+    ELSEIF (TG_OP) = 'DELETE' THEN
+        UPDATE channels
+        SET follower_count = follower_count - 1
+        WHERE channels.id = OLD.channel_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER channel_follower_count_update
+    AFTER INSERT OR DELETE
+    ON user_channel_follows
+    FOR EACH ROW
+EXECUTE FUNCTION update_channel_follower_count();
+
 CREATE TABLE user_comment_likes (
     user_id UUID,
     comment_id BIGINT,
@@ -394,16 +953,18 @@ CREATE TRIGGER set_thread_last_comment_timestamp
 EXECUTE FUNCTION update_thread_last_comment_timestamp();
 
 -- Trigger functions to update threads' comment count
--- whenever comments table is deleted from / inserted into
+-- whenever comments table is deleted from / inserted into,
+-- or a comment is soft-deleted / restored
 
 CREATE OR REPLACE FUNCTION update_thread_comment_count()
 RETURNS TRIGGER AS $$
     BEGIN
-        IF (TG_OP) = 'INSERT' THEN
+        IF (TG_OP) = 'INSERT' OR ((TG_OP) = 'UPDATE' AND OLD.deleted_at IS NOT NULL AND NEW.deleted_at IS NULL) THEN
             UPDATE threads
             SET comment_count = comment_count + 1
             WHERE threads.id = NEW.thread_id;
-        ELSEIF (TG_OP) = 'DELETE' THEN
+        ELSEIF ((TG_OP) = 'DELETE' AND OLD.deleted_at IS NULL) OR
+               ((TG_OP) = 'UPDATE' AND OLD.deleted_at IS NULL AND NEW.deleted_at IS NOT NULL) THEN
             UPDATE threads
             SET comment_count = comment_count - 1
             WHERE threads.id = OLD.thread_id;
@@ -413,7 +974,7 @@ RETURNS TRIGGER AS $$
 $$ LANGUAGE plpgsql;
 
 CREATE TRIGGER user_thread_comment_count_update
-    AFTER INSERT OR DELETE
+    AFTER INSERT OR DELETE OR UPDATE OF deleted_at
     ON comments
     FOR EACH ROW
 EXECUTE FUNCTION update_thread_comment_count();
@@ -440,6 +1001,7 @@ CREATE TABLE thread_custom_tags (
 -- Indexes
 
 CREATE UNIQUE INDEX idx_custom_tags_tag ON custom_tags(tag);
+CREATE INDEX custom_tags_tag_trgm_idx ON custom_tags USING gin(tag gin_trgm_ops);
 CREATE INDEX idx_thread_custom_tags ON thread_custom_tags(custom_tag_id);
 
 -- Thread auxiliary tables
@@ -460,6 +1022,33 @@ CREATE TABLE thread_channels (
      FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE
 );
 
+-- Trigger function to update channels' thread count
+-- whenever thread_channels table is deleted from / inserted into
+
+CREATE OR REPLACE FUNCTION update_channel_thread_count()
+    RETURNS TRIGGER AS $$
+BEGIN
+    IF (TG_OP) = 'INSERT' THEN
+        UPDATE channels
+        SET thread_count = thread_count + 1
+        WHERE channels.id = NEW.channel_id;
+    ELSEIF (TG_OP) = 'DELETE' THEN
+        UPDATE channels
+        SET thread_count = thread_count - 1
+        WHERE channels.id = OLD.channel_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER channel_thread_count_update
+    AFTER INSERT OR DELETE
+    ON thread_channels
+    FOR EACH ROW
+EXECUTE FUNCTION update_channel_thread_count();
+
+CREATE INDEX idx_threads_channel_id ON threads(channel_id);
+
 -- Insert default tags
 
 INSERT INTO tags (id, tag) VALUES
@@ -482,6 +1071,15 @@ INSERT INTO tags (id, tag) VALUES
                                (16, 'Work & Productivity'),
                                (17, 'Travel'),
                                (18, 'Food & Drinks');
+
+-- Placeholder account which the content of users who chose to have it
+-- anonymised is reassigned to when their account is purged. It cannot be
+-- logged into, and is excluded from purges.
+INSERT INTO users (id, username, password_hash, deleted_at) VALUES
+    ('00000000-0000-0000-0000-000000000000', '[deleted]', '', CURRENT_TIMESTAMP);
+INSERT INTO user_profiles (id, biodata) VALUES
+    ('00000000-0000-0000-0000-000000000000', '');
+
 -- SAMPLE DATA
 -- INSERT INTO users(id, username, password_hash) VALUES
 --    ('23cdeffc-1c44-41e6-ab0b-001e6591b01f', 'kyo73', '$argon2id$v=19$m=65536,t=1,p=2$RdTX6X6yI9aNSDqsIEy5Aw$LA1cB0j7vDUzv21NQz8fvAvAtXRsdfHIioGKJ3e38Oo');
@@ -492,4 +1090,4 @@ INSERT INTO tags (id, tag) VALUES
 -- INSERT INTO threads(user_id, title, original_post) VALUES
 --     ('23cdeffc-1c44-41e6-ab0b-001e6591b01f', 'The Rust Programming Language', 'Rust is the best language. Rust is the best language. Rust is the best language. Rust is the best language. Rust is the best language. Rust is the best language. Rust is the best language.');
 --
--- INSERT INTO thread_tags VALUES (1, 0);
\ No newline at end of file
+-- INSERT INTO thread_tags VALUES (1, 0);